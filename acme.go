@@ -0,0 +1,382 @@
+package main
+
+// A small ACME (RFC 8555) client, for obtaining certificates with DNS-01 challenges.
+// The vendored golang.org/x/crypto/acme package only speaks the first draft of
+// the protocol, which does not support wildcard certificates.
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The default ACME directory
+	letsEncryptDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+
+	// How long to wait for an authorization or order to change status
+	acmePollTimeout = 3 * time.Minute
+)
+
+var errACMEBadNonce = errors.New("ACME server rejected the nonce")
+
+// The URLs listed in an ACME directory
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// An ACME identifier, like a domain name
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// An ACME order for a certificate
+type acmeOrder struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+	url            string
+}
+
+// An ACME challenge
+type acmeChallenge struct {
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+	Status string `json:"status"`
+}
+
+// An ACME authorization for one identifier
+type acmeAuthorization struct {
+	Identifier acmeIdentifier  `json:"identifier"`
+	Status     string          `json:"status"`
+	Wildcard   bool            `json:"wildcard"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+// An ACME problem document
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+// An ACME client with an ECDSA P-256 account key
+type acmeClient struct {
+	directoryURL string
+	key          *ecdsa.PrivateKey
+	dir          *acmeDirectory
+	kid          string
+	nonces       []string
+	mut          sync.Mutex
+}
+
+// Create a new ACME client, given a directory URL and an account key
+func newACMEClient(directoryURL string, key *ecdsa.PrivateKey) *acmeClient {
+	if directoryURL == "" {
+		directoryURL = letsEncryptDirectory
+	}
+	return &acmeClient{directoryURL: directoryURL, key: key}
+}
+
+// Encode data as unpadded base64, as used by JOSE
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Return the JWK for the public part of the account key.
+// The fields are in lexicographical order, as required for thumbprints.
+func (c *acmeClient) jwk() string {
+	pub := c.key.PublicKey
+	return fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, b64(pad32(pub.X)), b64(pad32(pub.Y)))
+}
+
+// Return a big number as 32 bytes, padded with zeroes to the left
+func pad32(n *big.Int) []byte {
+	b := n.Bytes()
+	if len(b) >= 32 {
+		return b
+	}
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+// Return the key authorization for the given challenge token
+func (c *acmeClient) keyAuthorization(token string) string {
+	thumbprint := sha256.Sum256([]byte(c.jwk()))
+	return token + "." + b64(thumbprint[:])
+}
+
+// Return the value of the TXT record for the given DNS-01 challenge token
+func (c *acmeClient) dnsRecordValue(token string) string {
+	digest := sha256.Sum256([]byte(c.keyAuthorization(token)))
+	return b64(digest[:])
+}
+
+// Retrieve the directory, if it has not already been retrieved
+func (c *acmeClient) discover(ctx context.Context) error {
+	if c.dir != nil {
+		return nil
+	}
+	req, err := http.NewRequest("GET", c.directoryURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not retrieve the ACME directory from %s: %s", c.directoryURL, resp.Status)
+	}
+	var dir acmeDirectory
+	if err := json.NewDecoder(resp.Body).Decode(&dir); err != nil {
+		return err
+	}
+	c.dir = &dir
+	return nil
+}
+
+// Return a fresh nonce, either one that was returned earlier or a new one
+func (c *acmeClient) nonce(ctx context.Context) (string, error) {
+	c.mut.Lock()
+	if l := len(c.nonces); l > 0 {
+		n := c.nonces[l-1]
+		c.nonces = c.nonces[:l-1]
+		c.mut.Unlock()
+		return n, nil
+	}
+	c.mut.Unlock()
+	req, err := http.NewRequest("HEAD", c.dir.NewNonce, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	n := resp.Header.Get("Replay-Nonce")
+	if n == "" {
+		return "", errors.New("the ACME server did not return a nonce")
+	}
+	return n, nil
+}
+
+// Keep the nonce from a response, for use in the next request
+func (c *acmeClient) keepNonce(resp *http.Response) {
+	if n := resp.Header.Get("Replay-Nonce"); n != "" {
+		c.mut.Lock()
+		c.nonces = append(c.nonces, n)
+		c.mut.Unlock()
+	}
+}
+
+// Sign the payload as a JWS with the account key. A nil payload is used
+// for POST-as-GET requests.
+func (c *acmeClient) sign(url, nonce string, payload interface{}) ([]byte, error) {
+	protected := fmt.Sprintf(`{"alg":"ES256","nonce":%q,"url":%q,`, nonce, url)
+	if c.kid == "" {
+		protected += `"jwk":` + c.jwk() + "}"
+	} else {
+		protected += fmt.Sprintf(`"kid":%q}`, c.kid)
+	}
+	encodedPayload := ""
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		encodedPayload = b64(data)
+	}
+	encodedProtected := b64([]byte(protected))
+	digest := sha256.Sum256([]byte(encodedProtected + "." + encodedPayload))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := append(pad32(r), pad32(s)...)
+	return json.Marshal(map[string]string{
+		"protected": encodedProtected,
+		"payload":   encodedPayload,
+		"signature": b64(signature),
+	})
+}
+
+// Send a signed POST request and return the response body and headers.
+// The request is retried once if the nonce is rejected.
+func (c *acmeClient) post(ctx context.Context, url string, payload interface{}) ([]byte, http.Header, error) {
+	body, header, err := c.postOnce(ctx, url, payload)
+	if err == errACMEBadNonce {
+		return c.postOnce(ctx, url, payload)
+	}
+	return body, header, err
+}
+
+func (c *acmeClient) postOnce(ctx context.Context, url string, payload interface{}) ([]byte, http.Header, error) {
+	nonce, err := c.nonce(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	jws, err := c.sign(url, nonce, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(jws))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	c.keepNonce(resp)
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode >= 400 {
+		var problem acmeProblem
+		json.Unmarshal(data, &problem)
+		if strings.HasSuffix(problem.Type, ":badNonce") {
+			return nil, nil, errACMEBadNonce
+		}
+		return nil, nil, fmt.Errorf("ACME request to %s failed: %s %s", url, resp.Status, problem.Detail)
+	}
+	return data, resp.Header, nil
+}
+
+// Register an account, or find the existing account for the key
+func (c *acmeClient) register(ctx context.Context, email string) error {
+	if err := c.discover(ctx); err != nil {
+		return err
+	}
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if email != "" {
+		account["contact"] = []string{"mailto:" + email}
+	}
+	_, header, err := c.post(ctx, c.dir.NewAccount, account)
+	if err != nil {
+		return err
+	}
+	c.kid = header.Get("Location")
+	if c.kid == "" {
+		return errors.New("the ACME server did not return an account URL")
+	}
+	return nil
+}
+
+// Place a new order for the given domains
+func (c *acmeClient) newOrder(ctx context.Context, domains []string) (*acmeOrder, error) {
+	var identifiers []acmeIdentifier
+	for _, domain := range domains {
+		identifiers = append(identifiers, acmeIdentifier{Type: "dns", Value: domain})
+	}
+	data, header, err := c.post(ctx, c.dir.NewOrder, map[string]interface{}{"identifiers": identifiers})
+	if err != nil {
+		return nil, err
+	}
+	var order acmeOrder
+	if err := json.Unmarshal(data, &order); err != nil {
+		return nil, err
+	}
+	order.url = header.Get("Location")
+	return &order, nil
+}
+
+// Retrieve an authorization
+func (c *acmeClient) authorization(ctx context.Context, url string) (*acmeAuthorization, error) {
+	data, _, err := c.post(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	var authz acmeAuthorization
+	if err := json.Unmarshal(data, &authz); err != nil {
+		return nil, err
+	}
+	return &authz, nil
+}
+
+// Tell the server that the challenge is ready to be validated
+func (c *acmeClient) accept(ctx context.Context, chal acmeChallenge) error {
+	_, _, err := c.post(ctx, chal.URL, struct{}{})
+	return err
+}
+
+// Wait for an authorization to become valid
+func (c *acmeClient) waitAuthorization(ctx context.Context, url string) error {
+	deadline := time.Now().Add(acmePollTimeout)
+	for time.Now().Before(deadline) {
+		authz, err := c.authorization(ctx, url)
+		if err != nil {
+			return err
+		}
+		switch authz.Status {
+		case "valid":
+			return nil
+		case "invalid", "deactivated", "expired", "revoked":
+			return fmt.Errorf("authorization for %s is %s", authz.Identifier.Value, authz.Status)
+		}
+		time.Sleep(2 * time.Second)
+	}
+	return fmt.Errorf("timeout while waiting for the authorization at %s", url)
+}
+
+// Finalize the order with the given CSR and download the certificate chain, as PEM
+func (c *acmeClient) finalize(ctx context.Context, order *acmeOrder, csr []byte) ([]byte, error) {
+	data, _, err := c.post(ctx, order.Finalize, map[string]string{"csr": b64(csr)})
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, order); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(acmePollTimeout)
+	for order.Status != "valid" {
+		if order.Status == "invalid" {
+			return nil, errors.New("the ACME order is invalid")
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("timeout while waiting for the certificate to be issued")
+		}
+		time.Sleep(2 * time.Second)
+		data, _, err := c.post(ctx, order.url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, order); err != nil {
+			return nil, err
+		}
+	}
+	certPEM, _, err := c.post(ctx, order.Certificate, nil)
+	return certPEM, err
+}
+
+// Create a DER encoded certificate signing request for the given domains
+func createCSR(key crypto.Signer, domains []string) ([]byte, error) {
+	template := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}
+	return x509.CreateCertificateRequest(rand.Reader, template, key)
+}
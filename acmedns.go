@@ -0,0 +1,398 @@
+package main
+
+// Obtaining and renewing certificates with ACME DNS-01 challenges.
+// Useful for wildcard certificates and for servers that can not be reached on port 80.
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tylerb/graceful"
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	// Renew certificates that expire within this duration
+	acmeRenewBefore = 30 * 24 * time.Hour
+
+	// How often to check if the certificate should be renewed
+	acmeRenewInterval = 12 * time.Hour
+
+	// How long to wait before trying again, if a certificate could not be obtained
+	acmeRetryInterval = 10 * time.Minute
+
+	// How long to wait for TXT records to become visible
+	acmePropagationTimeout = 2 * time.Minute
+)
+
+// Obtains, caches and renews a certificate for a list of domains
+type acmeDNSManager struct {
+	provider  dnsProvider
+	domains   []string
+	email     string
+	directory string
+	cacheDir  string
+	cert      *tls.Certificate
+	notAfter  time.Time
+	fallback  *tls.Certificate // used until a certificate has been obtained
+	mut       sync.RWMutex
+}
+
+// Look up an ACME or DNS provider setting, first from server.lua, then from the environment
+func (ac *algernonConfig) acmeSetting(name string) string {
+	if value, ok := ac.acmeSettings[name]; ok {
+		return value
+	}
+	return os.Getenv(name)
+}
+
+// The directory where the account key and certificates are stored
+func (ac *algernonConfig) acmeCacheDir() string {
+	if dir := ac.acmeSetting("ACME_CACHE_DIR"); dir != "" {
+		return dir
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		return filepath.Join(home, ".cache", "algernon", "acme")
+	}
+	return filepath.Join(os.TempDir(), "algernon-acme")
+}
+
+// Split a comma separated list of domains
+func splitDomains(s string) []string {
+	var domains []string
+	for _, domain := range strings.Split(s, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// The base filename for cached files for the given domains
+func (m *acmeDNSManager) baseFilename() string {
+	return filepath.Join(m.cacheDir, strings.Replace(m.domains[0], "*", "_wildcard", 1))
+}
+
+// Check if the certificate is missing or expires soon
+func (m *acmeDNSManager) needsRenewal() bool {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	return m.cert == nil || time.Now().Add(acmeRenewBefore).After(m.notAfter)
+}
+
+// Return the current certificate, for use in tls.Config. The fallback
+// certificate is used until a certificate has been obtained.
+func (m *acmeDNSManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	if m.cert != nil {
+		return m.cert, nil
+	}
+	if m.fallback != nil {
+		return m.fallback, nil
+	}
+	return nil, errors.New("no certificate has been obtained yet")
+}
+
+// Set the certificate that is used until a certificate has been obtained
+func (m *acmeDNSManager) setFallback(cert *tls.Certificate) {
+	m.mut.Lock()
+	m.fallback = cert
+	m.mut.Unlock()
+}
+
+// Use the given PEM encoded certificate and key
+func (m *acmeDNSManager) setCertificate(certPEM, keyPEM []byte) error {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	m.mut.Lock()
+	m.cert = &cert
+	m.notAfter = leaf.NotAfter
+	m.mut.Unlock()
+	return nil
+}
+
+// Load a cached certificate, if there is one
+func (m *acmeDNSManager) loadCached() error {
+	certPEM, err := ioutil.ReadFile(m.baseFilename() + ".crt")
+	if err != nil {
+		return err
+	}
+	keyPEM, err := ioutil.ReadFile(m.baseFilename() + ".key")
+	if err != nil {
+		return err
+	}
+	return m.setCertificate(certPEM, keyPEM)
+}
+
+// Load the ECDSA key with the given filename, or generate and save a new one
+func loadOrCreateECKey(filename string) (*ecdsa.PrivateKey, error) {
+	if data, err := ioutil.ReadFile(filename); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("could not decode " + filename)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := encodeECKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, ioutil.WriteFile(filename, keyPEM, 0600)
+}
+
+// Encode an ECDSA key as PEM
+func encodeECKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// Wait until the TXT record can be looked up, or until the timeout is reached
+func waitForTXTRecord(fqdn, value string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if records, err := net.LookupTXT(fqdn); err == nil {
+			for _, record := range records {
+				if record == value {
+					return
+				}
+			}
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// Obtain a new certificate, by solving DNS-01 challenges for all the domains
+func (m *acmeDNSManager) obtain() error {
+	ctx := context.Background()
+	if err := os.MkdirAll(m.cacheDir, 0700); err != nil {
+		return err
+	}
+	accountKey, err := loadOrCreateECKey(filepath.Join(m.cacheDir, "account.key"))
+	if err != nil {
+		return err
+	}
+	client := newACMEClient(m.directory, accountKey)
+	if err := client.register(ctx, m.email); err != nil {
+		return err
+	}
+	order, err := client.newOrder(ctx, m.domains)
+	if err != nil {
+		return err
+	}
+
+	// Create the TXT records for all pending authorizations
+	type pending struct {
+		authzURL string
+		chal     acmeChallenge
+		fqdn     string
+		value    string
+	}
+	var challenges []pending
+	defer func() {
+		for _, p := range challenges {
+			if err := m.provider.CleanUp(p.fqdn, p.value); err != nil {
+				log.Warn("Could not remove TXT record for " + p.fqdn + ": " + err.Error())
+			}
+		}
+	}()
+	for _, authzURL := range order.Authorizations {
+		authz, err := client.authorization(ctx, authzURL)
+		if err != nil {
+			return err
+		}
+		if authz.Status == "valid" {
+			continue
+		}
+		found := false
+		for _, chal := range authz.Challenges {
+			if chal.Type != "dns-01" {
+				continue
+			}
+			p := pending{
+				authzURL: authzURL,
+				chal:     chal,
+				fqdn:     "_acme-challenge." + authz.Identifier.Value,
+				value:    client.dnsRecordValue(chal.Token),
+			}
+			if err := m.provider.Present(p.fqdn, p.value); err != nil {
+				return err
+			}
+			challenges = append(challenges, p)
+			found = true
+			break
+		}
+		if !found {
+			return errors.New("no DNS-01 challenge was offered for " + authz.Identifier.Value)
+		}
+	}
+
+	// Wait for the records to propagate, then let the ACME server check them
+	for _, p := range challenges {
+		waitForTXTRecord(p.fqdn, p.value, acmePropagationTimeout)
+	}
+	for _, p := range challenges {
+		if err := client.accept(ctx, p.chal); err != nil {
+			return err
+		}
+	}
+	for _, p := range challenges {
+		if err := client.waitAuthorization(ctx, p.authzURL); err != nil {
+			return err
+		}
+	}
+
+	// Create a new key and request the certificate
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := createCSR(certKey, m.domains)
+	if err != nil {
+		return err
+	}
+	certPEM, err := client.finalize(ctx, order, csr)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := encodeECKey(certKey)
+	if err != nil {
+		return err
+	}
+	if err := m.setCertificate(certPEM, keyPEM); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(m.baseFilename()+".key", keyPEM, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(m.baseFilename()+".crt", certPEM, 0600)
+}
+
+// Obtain a new certificate if needed, and log the outcome.
+// Returns false if a certificate was needed but could not be obtained.
+func (m *acmeDNSManager) renew() bool {
+	if !m.needsRenewal() {
+		return true
+	}
+	log.Info("Obtaining a certificate for " + strings.Join(m.domains, ", ") + " with DNS-01 challenges")
+	if err := m.obtain(); err != nil {
+		log.Error("Could not obtain a certificate: ", err)
+		return false
+	}
+	log.Info("Obtained a certificate for " + strings.Join(m.domains, ", "))
+	return true
+}
+
+// Obtain a certificate, and renew it before it expires. Tries again after
+// acmeRetryInterval if a certificate could not be obtained. Runs until the
+// process exits.
+func (m *acmeDNSManager) run() {
+	timer := time.NewTimer(0)
+	for range timer.C {
+		if m.renew() {
+			timer.Reset(acmeRenewInterval)
+		} else {
+			timer.Reset(acmeRetryInterval)
+		}
+	}
+}
+
+// Set up certificates from ACME DNS-01 challenges, if a DNS provider is configured.
+// A cached certificate is used if it is still valid. The certificate is
+// obtained and renewed in the background, so that serving is not delayed.
+func (ac *algernonConfig) setupACMEDNS() {
+	if len(ac.acmeDomains) == 0 {
+		log.Error("ACME DNS-01: no domains are given")
+		return
+	}
+	provider, err := newDNSProvider(ac.acmeDNSProvider, ac.acmeSetting)
+	if err != nil {
+		log.Error("ACME DNS-01: ", err)
+		return
+	}
+	m := &acmeDNSManager{
+		provider:  provider,
+		domains:   ac.acmeDomains,
+		email:     ac.acmeSetting("ACME_EMAIL"),
+		directory: ac.acmeSetting("ACME_DIRECTORY"),
+		cacheDir:  ac.acmeCacheDir(),
+	}
+	if err := m.loadCached(); err != nil && !os.IsNotExist(err) {
+		log.Warn("ACME DNS-01: could not use the cached certificate: ", err)
+	}
+	ac.acmeDNS = m
+	go m.run()
+}
+
+// Serve HTTPS with the given server. With ACME DNS-01, the certificate is
+// looked up for each connection, so that new certificates are used as soon as
+// they are obtained. The certificate files are used until then, if they exist.
+func (ac *algernonConfig) listenAndServeTLS(srv *graceful.Server) error {
+	if ac.acmeDNS != nil {
+		if cert, err := tls.LoadX509KeyPair(ac.serverCert, ac.serverKey); err == nil {
+			ac.acmeDNS.setFallback(&cert)
+		}
+		if srv.TLSConfig == nil {
+			srv.TLSConfig = &tls.Config{}
+		}
+		srv.TLSConfig.GetCertificate = ac.acmeDNS.getCertificate
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServeTLS(ac.serverCert, ac.serverKey)
+}
+
+// Export the server configuration function for ACME DNS-01 challenges
+func (ac *algernonConfig) exportACMEDNSFunction(L *lua.LState) {
+
+	// Obtain certificates with DNS-01 challenges. Takes a DNS provider name,
+	// a comma separated string or a table of domains and an optional table of
+	// settings (that otherwise are read from the environment).
+	L.SetGlobal("ACMEDNS", L.NewFunction(func(L *lua.LState) int {
+		ac.acmeDNSProvider = L.ToString(1)
+		ac.acmeDomains = nil
+		switch v := L.Get(2).(type) {
+		case *lua.LTable:
+			v.ForEach(func(_, value lua.LValue) {
+				ac.acmeDomains = append(ac.acmeDomains, value.String())
+			})
+		default:
+			ac.acmeDomains = splitDomains(L.ToString(2))
+		}
+		if settings, ok := L.Get(3).(*lua.LTable); ok {
+			if ac.acmeSettings == nil {
+				ac.acmeSettings = make(map[string]string)
+			}
+			settings.ForEach(func(key, value lua.LValue) {
+				ac.acmeSettings[key.String()] = value.String()
+			})
+		}
+		return 0 // number of results
+	}))
+}
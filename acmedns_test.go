@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestACMEDNSGetCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := encodeECKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	m := &acmeDNSManager{}
+	if _, err := m.getCertificate(nil); err == nil {
+		t.Error("expected an error before a certificate has been obtained")
+	}
+	fallback := &tls.Certificate{}
+	m.setFallback(fallback)
+	if cert, _ := m.getCertificate(nil); cert != fallback {
+		t.Error("expected the fallback certificate until a certificate has been obtained")
+	}
+	// A new certificate is used right away
+	if err := m.setCertificate(certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	if cert, err := m.getCertificate(nil); err != nil || cert == fallback {
+		t.Error("expected the obtained certificate to be used")
+	}
+	if m.needsRenewal() {
+		t.Error("expected a certificate that expires in 90 days not to need renewal")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+// Versioning of the Lua API. Scripts can declare the version of the API they
+// are written for with apiversion(2). Scripts that do not declare a version
+// get version 1, where the old names of functions are still available, but
+// a deprecation warning is logged the first time each of them is used.
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	// The newest version of the Lua API
+	currentAPIVersion = 2
+
+	// The version of scripts that do not declare a version
+	defaultAPIVersion = 1
+
+	// The registry key for the API version that the running script declared
+	apiVersionRegistryKey = "algernon.apiversion"
+)
+
+// A function that has been replaced, and the API version where it was removed
+type deprecation struct {
+	name        string
+	replacement string
+	removedIn   int
+}
+
+var (
+	// The deprecated functions, which are kept for scripts that declare an
+	// older API version, or no version at all
+	deprecations = []deprecation{
+		{"toJSON", "JSON", 2},
+		{"ToJSON", "JSON", 2},
+		{"CacheStats", "CacheInfo", 2},
+	}
+
+	// The deprecation warnings that have been logged, by function and place
+	warnedDeprecations    = make(map[string]bool)
+	warnedDeprecationsMut sync.Mutex
+)
+
+// Return the API version that the running script declared
+func scriptAPIVersion(L *lua.LState) int {
+	if version, ok := L.G.Registry.RawGetString(apiVersionRegistryKey).(lua.LNumber); ok {
+		return int(version)
+	}
+	return defaultAPIVersion
+}
+
+// Forget the API version of the previous script, before a Lua state is reused
+func resetAPIVersion(L *lua.LState) {
+	L.G.Registry.RawSetString(apiVersionRegistryKey, lua.LNil)
+}
+
+// Check if a deprecation warning has not been logged before, and remember it
+func firstWarning(key string) bool {
+	warnedDeprecationsMut.Lock()
+	defer warnedDeprecationsMut.Unlock()
+	if warnedDeprecations[key] {
+		return false
+	}
+	warnedDeprecations[key] = true
+	return true
+}
+
+// Replace a deprecated function with a function that logs a warning and then
+// calls it, or raises an error if the script declared an API version where the
+// function has been removed
+func wrapDeprecated(L *lua.LState, d deprecation) {
+	original, ok := L.GetGlobal(d.name).(*lua.LFunction)
+	if !ok || !original.IsG {
+		return
+	}
+	L.SetGlobal(d.name, L.NewFunction(func(L *lua.LState) int {
+		if version := scriptAPIVersion(L); version >= d.removedIn {
+			L.RaiseError("%s was removed in API version %d, use %s instead", d.name, d.removedIn, d.replacement)
+			return 0 // number of results
+		}
+		where := L.Where(1)
+		if firstWarning(d.name + " " + where) {
+			log.Warnf("%s %s is deprecated and will not be available with apiversion(%d), use %s instead", where, d.name, d.removedIn, d.replacement)
+		}
+		return original.GFunction(L)
+	}))
+}
+
+// Export the apiversion function, and wrap the deprecated functions
+func exportAPIVersionFunctions(L *lua.LState) {
+
+	// Declare the version of the Lua API that the script is written for.
+	// Without an argument, the declared version is returned.
+	L.SetGlobal("apiversion", L.NewFunction(func(L *lua.LState) int {
+		if L.GetTop() == 0 {
+			L.Push(lua.LNumber(scriptAPIVersion(L)))
+			return 1 // number of results
+		}
+		version := L.CheckInt(1)
+		if version < defaultAPIVersion || version > currentAPIVersion {
+			L.RaiseError("API version %d is not supported, this version of Algernon supports API version %d to %d", version, defaultAPIVersion, currentAPIVersion)
+			return 0 // number of results
+		}
+		L.G.Registry.RawSetString(apiVersionRegistryKey, lua.LNumber(version))
+		return 0 // number of results
+	}))
+
+	for _, d := range deprecations {
+		wrapDeprecated(L, d)
+	}
+}
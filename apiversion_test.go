@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+func TestAPIVersion(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	L.SetGlobal("CacheStats", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString("stats"))
+		return 1
+	}))
+	exportAPIVersionFunctions(L)
+	if err := L.DoString(`assert(apiversion() == 1 and CacheStats() == "stats")`); err != nil {
+		t.Error(err)
+	}
+	if err := L.DoString(`apiversion(2); CacheStats()`); err == nil {
+		t.Error("expected an error when calling a removed function")
+	}
+	if err := L.DoString(`apiversion(99)`); err == nil {
+		t.Error("expected an error for an unsupported API version")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+// Authentication providers, for letting users in with something else than the
+// username and password of the permission system, like SAML, Kerberos/SPNEGO
+// or a single sign-on proxy. Before the permissions are checked, the providers
+// are asked in turn who a request is from. When a provider returns a username,
+// the user is created if needed, and logged in as usual, with the user cookie.
+// Providers can be written in Go, or added with AuthProvider in serverconf.lua,
+// which can also be done from the Lua code of a plugin.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/yuin/gopher-lua"
+)
+
+// An authentication provider finds out who a request is from
+type authProvider interface {
+	// The name of the provider, for the logs
+	Name() string
+	// Return the username for a request, or an empty string if the request
+	// does not have credentials that the provider knows about. Headers, like
+	// WWW-Authenticate, may be set, but nothing should be written.
+	Authenticate(w http.ResponseWriter, req *http.Request) (string, error)
+}
+
+// An authentication provider that is a function
+type authProviderFunc struct {
+	name         string
+	authenticate func(w http.ResponseWriter, req *http.Request) (string, error)
+}
+
+func (p *authProviderFunc) Name() string {
+	return p.name
+}
+
+func (p *authProviderFunc) Authenticate(w http.ResponseWriter, req *http.Request) (string, error) {
+	return p.authenticate(w, req)
+}
+
+// Add an authentication provider. Providers are asked in the order they are added.
+func (ac *algernonConfig) addAuthProvider(p authProvider) {
+	ac.authProvidersMut.Lock()
+	ac.authProviders = append(ac.authProviders, p)
+	ac.authProvidersMut.Unlock()
+}
+
+// Ask the authentication providers who a request is from, unless the user
+// is already logged in. If a provider knows, the user is logged in, both for
+// this request and with a cookie for the following requests.
+func (ac *algernonConfig) authenticate(w http.ResponseWriter, req *http.Request) {
+	ac.authProvidersMut.RLock()
+	providers := ac.authProviders
+	ac.authProvidersMut.RUnlock()
+	if len(providers) == 0 || ac.perm == nil {
+		return
+	}
+	userstate := ac.perm.UserState()
+	if userstate.UserRights(req) {
+		return
+	}
+	for _, p := range providers {
+		username, err := p.Authenticate(w, req)
+		if err != nil {
+			log.Warn("Authentication provider "+p.Name()+" failed: ", err)
+			continue
+		}
+		if username = strings.TrimSpace(username); username == "" {
+			continue
+		}
+		if err := ac.loginAs(w, req, username); err != nil {
+			log.Error("Could not log in "+username+" for authentication provider "+p.Name()+": ", err)
+			return
+		}
+		tracef(req, "Authenticated as %s by %s", username, p.Name())
+		return
+	}
+}
+
+// Log in the given user, and create the user if it does not exist. The new
+// user cookie is also added to the request, so that the permission system and
+// the handlers see the user as logged in right away.
+func (ac *algernonConfig) loginAs(w http.ResponseWriter, req *http.Request, username string) error {
+	userstate := ac.perm.UserState()
+	if !userstate.HasUser(username) {
+		// The user logs in with the provider, so the password is never used
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		userstate.AddUser(username, hex.EncodeToString(b), "")
+		userstate.MarkConfirmed(username)
+	}
+	if err := userstate.Login(w, username); err != nil {
+		return err
+	}
+	// Find the cookie that was just set
+	response := &http.Response{Header: http.Header{"Set-Cookie": w.Header()["Set-Cookie"]}}
+	var userCookie *http.Cookie
+	for _, c := range response.Cookies() {
+		if c.Name == "user" {
+			userCookie = c
+		}
+	}
+	if userCookie == nil {
+		return errors.New("the user cookie was not set")
+	}
+	// Replace the user cookie in the request
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != "user" {
+			req.AddCookie(c)
+		}
+	}
+	req.AddCookie(&http.Cookie{Name: userCookie.Name, Value: userCookie.Value})
+	return nil
+}
+
+// Make it possible to add authentication providers from Lua
+func (ac *algernonConfig) exportAuthProviderFunction(L *lua.LState, filename string) {
+	// Add an authentication provider, given a name and a Lua function.
+	// The function can use the request functions, like headers(), and
+	// should return the username, or nothing if the request is not from
+	// a user that the provider knows about.
+	L.SetGlobal("AuthProvider", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		luaAuthFunc := L.CheckFunction(2)
+		ac.addAuthProvider(&authProviderFunc{name, func(w http.ResponseWriter, req *http.Request) (string, error) {
+			// The Lua state is shared with the handlers and filters
+			ac.luahandlermutex.Lock()
+			defer ac.luahandlermutex.Unlock()
+			ac.exportCommonFunctions(w, req, filename, L, nil, nil)
+			L.Push(luaAuthFunc)
+			if err := L.PCall(0, 1, nil); err != nil {
+				return "", err
+			}
+			result := L.Get(-1)
+			L.Pop(1)
+			if result.Type() != lua.LTString {
+				return "", nil
+			}
+			return result.String(), nil
+		}})
+		return 0 // number of results
+	}))
+}
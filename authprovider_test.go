@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthProvider(t *testing.T) {
+	ac := newAlgernonConfig()
+	ac.perm = newMemoryPermissions(newMemoryStore())
+	ac.perm.AddUserPath("/private")
+	ac.addAuthProvider(&authProviderFunc{"header", func(w http.ResponseWriter, req *http.Request) (string, error) {
+		return req.Header.Get("X-Remote-User"), nil
+	}})
+	req := httptest.NewRequest("GET", "/private/page", nil)
+	w := httptest.NewRecorder()
+	ac.authenticate(w, req)
+	if !ac.perm.Rejected(w, req) {
+		t.Error("expected the request without a user to be rejected")
+	}
+	req.Header.Set("X-Remote-User", "bob")
+	ac.authenticate(w, req)
+	if ac.perm.Rejected(w, req) {
+		t.Error("expected the request from bob to be let through")
+	}
+	if username := ac.perm.UserState().Username(req); username != "bob" {
+		t.Errorf("expected bob to be logged in, got %q", username)
+	}
+	if w.Header().Get("Set-Cookie") == "" {
+		t.Error("expected the user cookie to be set")
+	}
+}
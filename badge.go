@@ -0,0 +1,104 @@
+package main
+
+// A status badge, at /status.svg, for dashboards and README files. The badge
+// shows if the server and the database are up, the version and the number of
+// requests per minute.
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The URL path of the status badge
+	statusBadgePath = "/status.svg"
+
+	// The approximate width of a character in the badge, in pixels
+	badgeCharWidth = 7
+
+	// The padding on each side of the text in the badge, in pixels
+	badgePadding = 6
+)
+
+// Counts requests, for the last minute, in one second intervals
+type requestRate struct {
+	mut     sync.Mutex
+	buckets [60]int
+	seconds [60]int64 // the Unix time of each bucket
+}
+
+// Count a request
+func (rr *requestRate) add() {
+	now := time.Now().Unix()
+	i := now % int64(len(rr.buckets))
+	rr.mut.Lock()
+	if rr.seconds[i] != now {
+		rr.seconds[i] = now
+		rr.buckets[i] = 0
+	}
+	rr.buckets[i]++
+	rr.mut.Unlock()
+}
+
+// Return the number of requests during the last minute
+func (rr *requestRate) perMinute() int {
+	cutoff := time.Now().Unix() - int64(len(rr.buckets))
+	total := 0
+	rr.mut.Lock()
+	for i, count := range rr.buckets {
+		if rr.seconds[i] > cutoff {
+			total += count
+		}
+	}
+	rr.mut.Unlock()
+	return total
+}
+
+// Count all requests
+func (rr *requestRate) handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rr.add()
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// Render a badge with a label on the left and a message on the right, in the given color
+func badgeSVG(label, message, color string) string {
+	labelWidth := len(label)*badgeCharWidth + 2*badgePadding
+	messageWidth := len(message)*badgeCharWidth + 2*badgePadding
+	width := labelWidth + messageWidth
+	label, message = html.EscapeString(label), html.EscapeString(message)
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[4]s: %[5]s">`+
+		`<title>%[4]s: %[5]s</title>`+
+		`<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>`+
+		`<clipPath id="r"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath>`+
+		`<g clip-path="url(#r)"><rect width="%[2]d" height="20" fill="#555"/><rect x="%[2]d" width="%[3]d" height="20" fill="%[6]s"/><rect width="%[1]d" height="20" fill="url(#s)"/></g>`+
+		`<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">`+
+		`<text x="%[7]d" y="15" fill="#010101" fill-opacity=".3">%[4]s</text><text x="%[7]d" y="14">%[4]s</text>`+
+		`<text x="%[8]d" y="15" fill="#010101" fill-opacity=".3">%[5]s</text><text x="%[8]d" y="14">%[5]s</text>`+
+		`</g></svg>`,
+		width, labelWidth, messageWidth, label, message, color, labelWidth/2, labelWidth+messageWidth/2)
+}
+
+// Serve the status badge. The label can be changed with ?label=
+func (ac *algernonConfig) statusBadgeHandler(w http.ResponseWriter, req *http.Request) {
+	label := req.URL.Query().Get("label")
+	if label == "" {
+		label = "algernon"
+	}
+	status, color := "up", "#4c1"
+	if ac.perm != nil {
+		if err := ac.perm.UserState().Host().Ping(); err != nil {
+			status, color = "database down", "#e05d44"
+		}
+	}
+	version := strings.TrimPrefix(versionString, "Algernon ")
+	message := fmt.Sprintf("%s | %s | %d req/min", status, version, ac.requestRate.perMinute())
+	w.Header().Set("Content-Type", "image/svg+xml; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache, max-age=0")
+	fmt.Fprint(w, badgeSVG(label, message, color))
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStatusBadge(t *testing.T) {
+	rr := &requestRate{}
+	for i := 0; i < 3; i++ {
+		rr.add()
+	}
+	if n := rr.perMinute(); n != 3 {
+		t.Errorf("expected 3 requests per minute, got %d", n)
+	}
+	svg := badgeSVG("a<b", "up", "#4c1")
+	if !strings.HasPrefix(svg, "<svg ") || !strings.Contains(svg, "a&lt;b") || strings.Contains(svg, "a<b") {
+		t.Errorf("unexpected badge: %s", svg)
+	}
+}
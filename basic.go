@@ -368,7 +368,7 @@ func (ac *algernonConfig) exportBasicWeb(w http.ResponseWriter, req *http.Reques
 			log.Error("Could not find:", luaFilename)
 			return 0 // number of results
 		}
-		if err := L.DoFile(luaFilename); err != nil {
+		if err := ac.doLuaFile(L, luaFilename); err != nil {
 			log.Errorf("Error running %s: %s\n", luaFilename, err.Error())
 			return 0 // number of results
 		}
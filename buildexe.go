@@ -0,0 +1,164 @@
+package main
+
+// Building a self-contained executable, by appending an application directory
+// as a ZIP archive to a copy of the Algernon executable. When the executable
+// is started without a directory or file, the application is extracted to a
+// temporary directory and served, just like an .alg file.
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The start of the comment of the appended ZIP archive, followed by the size
+// of the executable, so that the archive can be found and replaced
+const embeddedAppComment = "algernon-app:"
+
+// Return the size of the executable without the appended application, and
+// true if there is one
+func embeddedApp(exe string) (int64, bool) {
+	f, err := os.Open(exe)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, false
+	}
+	r, err := zip.NewReader(f, info.Size())
+	if err != nil || !strings.HasPrefix(r.Comment, embeddedAppComment) {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(strings.TrimPrefix(r.Comment, embeddedAppComment), 10, 64)
+	if err != nil || size <= 0 || size > info.Size() {
+		return 0, false
+	}
+	return size, true
+}
+
+// Set the comment of a ZIP archive that has just been written to f, without
+// a comment. The comment is at the end of the archive, after its length in
+// the last two bytes of the end of central directory record.
+func setZIPComment(f *os.File, comment string) error {
+	if len(comment) > 0xffff {
+		return errors.New("the ZIP comment is too long")
+	}
+	if _, err := f.Seek(-2, io.SeekEnd); err != nil {
+		return err
+	}
+	length := []byte{byte(len(comment)), byte(len(comment) >> 8)}
+	_, err := f.Write(append(length, comment...))
+	return err
+}
+
+// Write a copy of the given executable, with the files in the given directory
+// appended as a ZIP archive. The .git directory is skipped. Returns the number
+// of files that were added.
+func buildExe(exe, dir, output string) (int, error) {
+	if info, err := os.Stat(dir); err != nil {
+		return 0, err
+	} else if !info.IsDir() {
+		return 0, errors.New(dir + " is not a directory")
+	}
+	exeData, err := ioutil.ReadFile(exe)
+	if err != nil {
+		return 0, err
+	}
+	// Leave out the application that is already embedded, if there is one
+	if size, found := embeddedApp(exe); found {
+		exeData = exeData[:size]
+	}
+	absOutput, err := filepath.Abs(output)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Write(exeData); err != nil {
+		return 0, err
+	}
+
+	// The offsets in the archive are from the start of the executable, so
+	// that the archive can be read directly from the executable
+	zw := zip.NewWriter(f)
+	zw.SetOffset(int64(len(exeData)))
+	count := 0
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		// Do not add the executable to itself, if it is written to the directory
+		if abs, err := filepath.Abs(p); err == nil && abs == absOutput {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		header.Method = zip.Deflate
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		if _, err := io.Copy(w, src); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	if err := setZIPComment(f, embeddedAppComment+strconv.Itoa(len(exeData))); err != nil {
+		return 0, err
+	}
+	return count, f.Close()
+}
+
+// Build a self-contained executable for an application directory
+func buildExeCommand(ac *algernonConfig, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: algernon --build-exe DIR OUTPUT")
+	}
+	exe, err := executable()
+	if err != nil {
+		return err
+	}
+	count, err := buildExe(exe, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s, with %d files from %s\n", args[1], count, args[0])
+	return nil
+}
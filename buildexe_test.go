@@ -0,0 +1,52 @@
+package main
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildExe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "algernon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	exe := filepath.Join(dir, "algernon")
+	ioutil.WriteFile(exe, []byte("not really an executable"), 0755)
+	appDir := filepath.Join(dir, "app")
+	os.MkdirAll(filepath.Join(appDir, "static"), 0755)
+	ioutil.WriteFile(filepath.Join(appDir, "index.lua"), []byte(`print("hi")`), 0644)
+	ioutil.WriteFile(filepath.Join(appDir, "static", "style.css"), []byte("body {}"), 0644)
+
+	if _, found := embeddedApp(exe); found {
+		t.Error("expected no embedded application")
+	}
+	output := filepath.Join(dir, "app.exe")
+	if count, err := buildExe(exe, appDir, output); err != nil || count != 2 {
+		t.Fatalf("expected 2 files, got %d and %v", count, err)
+	}
+	size, found := embeddedApp(output)
+	if !found || size != int64(len("not really an executable")) {
+		t.Fatalf("expected an embedded application after %d bytes, got %d", len("not really an executable"), size)
+	}
+	// The archive can be read from the executable
+	r, err := zip.OpenReader(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if len(r.File) != 2 || r.File[1].Name != "static/style.css" {
+		t.Error("unexpected files in the archive")
+	}
+	// Building from an executable with an application replaces the application
+	again := filepath.Join(dir, "again.exe")
+	if _, err := buildExe(output, appDir, again); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := embeddedApp(again); size != int64(len("not really an executable")) {
+		t.Error("expected the embedded application to be replaced")
+	}
+}
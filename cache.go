@@ -9,7 +9,8 @@ import (
 
 // Helper function for sending file data (that might be cached) to a HTTP client
 func dataToClient(w http.ResponseWriter, req *http.Request, filename string, data []byte) {
-	datablock.NewDataBlock(data, true).ToClient(w, req, filename, clientCanGzip(req), gzipThreshold)
+	threshold, fast := gzipSettings(req)
+	datablock.NewDataBlock(data, fast).ToClient(w, req, filename, clientCanGzip(req), threshold)
 }
 
 // Export functions related to the cache. cache can be nil.
@@ -40,6 +41,7 @@ func (ac *algernonConfig) exportCacheFunctions(L *lua.LState) {
 			return 1 // number of results
 		}
 		ac.cache.Clear()
+		ac.broadcaster.cleared()
 		L.Push(lua.LString(clearedMessage))
 		return 1 // number of results
 	}))
@@ -0,0 +1,208 @@
+package main
+
+// Cache invalidation across several instances of Algernon that use the same
+// Redis server. When a file changes, or the server is reloaded after a deploy,
+// a message is published on a Redis channel, and all the other instances
+// remove the file from their cache, or clear their cache, right away.
+// File names are sent relative to the server directory, so that the
+// instances may serve from different directories.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/simpleredis"
+)
+
+const (
+	// The Redis channel for the cache invalidation messages
+	cacheBroadcastChannel = "algernon:cache"
+
+	// How often the subscription is pinged, to keep it within the read timeout
+	cacheBroadcastPing = 3 * time.Second
+
+	// How long to wait before subscribing again, if the connection is lost
+	cacheBroadcastRetry = 2 * time.Second
+)
+
+// A cache invalidation message
+type cacheMessage struct {
+	From  string `json:"from"`
+	File  string `json:"file,omitempty"`
+	Clear bool   `json:"clear,omitempty"`
+}
+
+// Sends and receives cache invalidation messages
+type cacheBroadcaster struct {
+	pool      *simpleredis.ConnectionPool
+	id        string // for skipping messages from this instance
+	serverDir string
+	cache     *fileCache
+	verbose   bool
+
+	mut    sync.Mutex
+	conn   redis.Conn // the current subscription
+	closed bool
+}
+
+// Create a broadcaster that uses the Redis server at the given address
+func newCacheBroadcaster(redisAddr, serverDir string, cache *fileCache, verbose bool) (*cacheBroadcaster, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	pool := simpleredis.NewConnectionPoolHost(redisAddr)
+	if err := pool.Ping(); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return &cacheBroadcaster{
+		pool:      pool,
+		id:        hex.EncodeToString(b),
+		serverDir: serverDir,
+		cache:     cache,
+		verbose:   verbose,
+	}, nil
+}
+
+// Publish a message to the other instances
+func (cb *cacheBroadcaster) publish(msg cacheMessage) {
+	msg.From = cb.id
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	conn := cb.pool.Get(0)
+	defer conn.Close()
+	if _, err := conn.Do("PUBLISH", cacheBroadcastChannel, data); err != nil {
+		log.Warn("Could not broadcast a cache invalidation: ", err)
+	}
+}
+
+// Tell the other instances that a file in the server directory has changed.
+// Does nothing if cb is nil.
+func (cb *cacheBroadcaster) fileChanged(filename string) {
+	if cb == nil {
+		return
+	}
+	rel, err := filepath.Rel(cb.serverDir, filename)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return
+	}
+	cb.publish(cacheMessage{File: filepath.ToSlash(rel)})
+}
+
+// Tell the other instances to clear their cache. Does nothing if cb is nil.
+func (cb *cacheBroadcaster) cleared() {
+	if cb == nil {
+		return
+	}
+	cb.publish(cacheMessage{Clear: true})
+}
+
+// Apply a message from another instance
+func (cb *cacheBroadcaster) handle(data []byte) {
+	var msg cacheMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Warn("Invalid cache invalidation message: ", err)
+		return
+	}
+	if msg.From == cb.id {
+		return
+	}
+	switch {
+	case msg.Clear:
+		cb.cache.Clear()
+		if cb.verbose {
+			log.Info("Cleared the cache, as requested by another instance")
+		}
+	case msg.File != "":
+		rel := filepath.Clean(filepath.FromSlash(msg.File))
+		if filepath.IsAbs(rel) || strings.HasPrefix(rel, "..") {
+			return
+		}
+		// The file may not be in the cache, which is fine
+		cb.cache.Remove(filepath.Join(cb.serverDir, rel))
+		if cb.verbose {
+			log.Info("Removed ", rel, " from the cache, as requested by another instance")
+		}
+	}
+}
+
+// Subscribe to the messages from the other instances, and subscribe again if
+// the connection is lost. Returns when the broadcaster is closed.
+func (cb *cacheBroadcaster) listen() {
+	for {
+		cb.mut.Lock()
+		if cb.closed {
+			cb.mut.Unlock()
+			return
+		}
+		cb.conn = cb.pool.Get(0)
+		psc := redis.PubSubConn{Conn: cb.conn}
+		cb.mut.Unlock()
+
+		err := cb.receive(psc)
+		psc.Close()
+
+		cb.mut.Lock()
+		closed := cb.closed
+		cb.mut.Unlock()
+		if closed {
+			return
+		}
+		log.Warn("Lost the subscription to cache invalidations, subscribing again: ", err)
+		time.Sleep(cacheBroadcastRetry)
+	}
+}
+
+// Receive messages until the connection fails
+func (cb *cacheBroadcaster) receive(psc redis.PubSubConn) error {
+	if err := psc.Subscribe(cacheBroadcastChannel); err != nil {
+		return err
+	}
+	// Ping regularly, so that receiving does not time out when there are no messages
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(cacheBroadcastPing)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if psc.Ping("") != nil {
+					return
+				}
+			}
+		}
+	}()
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			cb.handle(v.Data)
+		case error:
+			return v
+		}
+	}
+}
+
+// Stop listening and close the connections to Redis
+func (cb *cacheBroadcaster) close() {
+	cb.mut.Lock()
+	cb.closed = true
+	if cb.conn != nil {
+		cb.conn.Close()
+	}
+	cb.mut.Unlock()
+	cb.pool.Close()
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheBroadcast(t *testing.T) {
+	dir, err := ioutil.TempDir("", "algernon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "index.html")
+	if err := ioutil.WriteFile(filename, []byte("hi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cache := newFileCache(1024, false, 1024, false)
+	cb := &cacheBroadcaster{id: "self", serverDir: dir, cache: cache}
+	if _, err := cache.Read(filename, true); err != nil {
+		t.Fatal(err)
+	}
+	// Messages from this instance are skipped
+	cb.handle([]byte(`{"from":"self","file":"index.html"}`))
+	if cache.Remove(filename) != nil {
+		t.Error("expected the file to still be cached")
+	}
+	cache.Read(filename, true)
+	cb.handle([]byte(`{"from":"other","file":"index.html"}`))
+	if cache.Remove(filename) == nil {
+		t.Error("expected the file to be removed from the cache")
+	}
+	cache.Read(filename, true)
+	cb.handle([]byte(`{"from":"other","clear":true}`))
+	if !cache.IsEmpty() {
+		t.Error("expected the cache to be cleared")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+// A page for admins that lists the files in the cache, with their sizes, hits,
+// compression ratios and ages, where files can be removed from the cache.
+// Useful for finding a good --cachesize and cache mode for a site.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The URL path of the cache debug page
+const cacheDebugPath = "/_cache"
+
+// A file in the cache, as JSON
+type cacheDebugEntry struct {
+	ID           string    `json:"id"`
+	Size         uint64    `json:"size"`
+	OriginalSize uint64    `json:"original_size"`
+	Ratio        float64   `json:"ratio"`
+	Hits         uint64    `json:"hits"`
+	Stored       time.Time `json:"stored"`
+	AgeSeconds   int64     `json:"age_seconds"`
+}
+
+// The cache, as JSON
+type cacheDebugInfo struct {
+	Size          uint64            `json:"size"`
+	Used          uint64            `json:"used"`
+	MaxEntitySize uint64            `json:"max_entity_size"`
+	Hits          uint64            `json:"hits"`
+	Misses        uint64            `json:"misses"`
+	Evicted       uint64            `json:"evicted"`
+	Rejected      uint64            `json:"rejected"`
+	Entries       []cacheDebugEntry `json:"entries"`
+}
+
+// For sorting cache entries by "size" (the default), "hits", "age" or "name"
+type cacheEntriesBy struct {
+	entries []cacheEntry
+	by      string
+}
+
+func (s cacheEntriesBy) Len() int {
+	return len(s.entries)
+}
+
+func (s cacheEntriesBy) Less(i, j int) bool {
+	a, b := s.entries[i], s.entries[j]
+	switch s.by {
+	case "hits":
+		return a.Hits > b.Hits
+	case "age":
+		return a.Stored.Before(b.Stored)
+	case "name":
+		return a.ID < b.ID
+	}
+	return a.Size > b.Size
+}
+
+func (s cacheEntriesBy) Swap(i, j int) {
+	s.entries[i], s.entries[j] = s.entries[j], s.entries[i]
+}
+
+// Sort the cache entries by "size" (the default), "hits", "age" or "name"
+func sortCacheEntries(entries []cacheEntry, by string) {
+	sort.Stable(cacheEntriesBy{entries, by})
+}
+
+// List the files in the cache, as HTML or as JSON with ?format=json, or
+// remove a file from the cache when an ID is posted. Only for admins.
+func (ac *algernonConfig) cacheDebugHandler(w http.ResponseWriter, req *http.Request) {
+	if !ac.perm.UserState().AdminRights(req) {
+		http.Error(w, "Only admins can see the cache", http.StatusForbidden)
+		return
+	}
+	if ac.cache == nil {
+		http.Error(w, "Caching is disabled", http.StatusNotFound)
+		return
+	}
+
+	sortQuery := "?sort=" + url.QueryEscape(req.URL.Query().Get("sort"))
+
+	if req.Method == "POST" {
+		if !ac.validCSRF(req) {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		id := req.FormValue("id")
+		if err := ac.cache.Remove(id); err != nil {
+			http.Error(w, "The file is not in the cache", http.StatusNotFound)
+			return
+		}
+		log.Info("Removed ", id, " from the cache, for ", ac.perm.UserState().Username(req))
+		http.Redirect(w, req, cacheDebugPath+sortQuery, http.StatusSeeOther)
+		return
+	}
+
+	entries := ac.cache.Entries()
+	sortCacheEntries(entries, req.URL.Query().Get("sort"))
+	total, used, maxEntitySize := ac.cache.Usage()
+	metrics := ac.cache.Metrics()
+	now := time.Now()
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if req.URL.Query().Get("format") == "json" {
+		info := cacheDebugInfo{
+			Size:          total,
+			Used:          used,
+			MaxEntitySize: maxEntitySize,
+			Hits:          metrics.Hits,
+			Misses:        metrics.Misses,
+			Evicted:       metrics.Evicted,
+			Rejected:      metrics.Rejected,
+			Entries:       make([]cacheDebugEntry, len(entries)),
+		}
+		for i, e := range entries {
+			info.Entries[i] = cacheDebugEntry{e.ID, e.Size, e.OriginalSize, e.Ratio(), e.Hits, e.Stored, int64(now.Sub(e.Stored).Seconds())}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+		return
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<p>Using %d of %d bytes, in %d files. ", used, total, len(entries))
+	if maxEntitySize > 0 {
+		fmt.Fprintf(&buf, "Files larger than %d bytes are not cached. ", maxEntitySize)
+	}
+	fmt.Fprintf(&buf, "Hit rate: %.1f%% (%d hits, %d misses). Evicted: %d. Not admitted: %d.</p>",
+		metrics.HitRate()*100, metrics.Hits, metrics.Misses, metrics.Evicted, metrics.Rejected)
+	buf.WriteString(`<p>Sort by <a href="?sort=size">size</a>, <a href="?sort=hits">hits</a>, <a href="?sort=age">age</a> or <a href="?sort=name">name</a>. <a href="?format=json">JSON</a></p>`)
+	buf.WriteString("<table><tr><th>File</th><th>Size</th><th>File size</th><th>Ratio</th><th>Hits</th><th>Age</th><th></th></tr>")
+	action := html.EscapeString(cacheDebugPath + sortQuery)
+	// With --csrf, the CSRF field is added to all POST forms
+	csrf := ""
+	if !ac.csrfProtection {
+		ensureCSRFCookie(w, req)
+		csrf = csrfField(ac.csrfToken(req))
+	}
+	for _, e := range entries {
+		fmt.Fprintf(&buf, `<tr><td>%s</td><td>%d</td><td>%d</td><td>%.2f</td><td>%d</td><td>%s</td>`,
+			html.EscapeString(e.ID), e.Size, e.OriginalSize, e.Ratio(), e.Hits, now.Sub(e.Stored)/time.Second*time.Second)
+		fmt.Fprintf(&buf, `<td><form method="post" action="%s">%s<input type="hidden" name="id" value="%s"><input type="submit" value="Remove"></form></td></tr>`,
+			action, csrf, html.EscapeString(e.ID))
+	}
+	buf.WriteString("</table>")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, messagePage("Cache", buf.String(), ac.defaultTheme))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSortCacheEntries(t *testing.T) {
+	now := time.Now()
+	entries := []cacheEntry{
+		{ID: "a", Size: 10, Hits: 5, Stored: now},
+		{ID: "b", Size: 30, Hits: 1, Stored: now.Add(-time.Minute)},
+		{ID: "c", Size: 20, Hits: 9, Stored: now.Add(-time.Second)},
+	}
+	for by, first := range map[string]string{"": "b", "hits": "c", "age": "b", "name": "a"} {
+		sortCacheEntries(entries, by)
+		if entries[0].ID != first {
+			t.Errorf("expected %s first when sorting by %q, got %s", first, by, entries[0].ID)
+		}
+	}
+}
+
+func TestCacheDebugCSRF(t *testing.T) {
+	ac := newAlgernonConfig()
+	var err error
+	if ac.perm, err = ac.memoryBackend(); err != nil {
+		t.Fatal(err)
+	}
+	userstate := ac.perm.UserState()
+	userstate.AddUser("admin", "secret", "")
+	userstate.SetAdminStatus("admin")
+	userstate.SetLoggedIn("admin")
+	login := httptest.NewRecorder()
+	if err := userstate.Login(login, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	ac.cache = newFileCache(1024, false, 0, false)
+
+	req := httptest.NewRequest("POST", cacheDebugPath, strings.NewReader("id=/tmp/a.md"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range login.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	ac.cacheDebugHandler(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected the eviction without a CSRF token to be rejected, got %d", w.Code)
+	}
+
+	// With the token, the file is looked up, but it is not in the cache
+	req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "token"})
+	req.Header.Set(csrfHeaderName, ac.csrfToken(req))
+	w = httptest.NewRecorder()
+	ac.cacheDebugHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected the eviction with a CSRF token to be accepted, got %d", w.Code)
+	}
+}
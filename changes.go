@@ -0,0 +1,145 @@
+package main
+
+// Removing changed files from the cache, when the files in the server
+// directory change. Changes are coalesced per file and applied one at a time,
+// so that a deploy that touches hundreds of files does not cause hundreds of
+// cache removals and recompiles at once. Files are only read and rendered
+// again when they are requested.
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/recwatch"
+)
+
+const (
+	// Wait for a file to stop changing for this long before removing it from the cache
+	changeQuietPeriod = 250 * time.Millisecond
+
+	// But do not wait for longer than this, for files that keep changing
+	changeMaxDelay = 2 * time.Second
+)
+
+// When a file first and last changed, since it was removed from the cache
+type pendingChange struct {
+	first time.Time
+	last  time.Time
+}
+
+// A queue of changed files, that are waiting to be removed from the cache
+type changeQueue struct {
+	mut      sync.Mutex
+	pending  map[string]pendingChange
+	applyMut sync.Mutex // only apply one batch of changes at a time
+	apply    func(filename string)
+}
+
+func newChangeQueue(apply func(filename string)) *changeQueue {
+	return &changeQueue{pending: make(map[string]pendingChange), apply: apply}
+}
+
+// Add a change to the queue. Several changes to the same file are coalesced.
+func (q *changeQueue) add(filename string) {
+	now := time.Now()
+	q.mut.Lock()
+	change, found := q.pending[filename]
+	if !found {
+		change.first = now
+	}
+	change.last = now
+	q.pending[filename] = change
+	q.mut.Unlock()
+}
+
+// Take the changes that match the given function out of the queue, and apply them
+func (q *changeQueue) applyWhere(match func(filename string, change pendingChange) bool) int {
+	q.mut.Lock()
+	var filenames []string
+	for filename, change := range q.pending {
+		if match(filename, change) {
+			filenames = append(filenames, filename)
+			delete(q.pending, filename)
+		}
+	}
+	q.mut.Unlock()
+	if len(filenames) == 0 {
+		return 0
+	}
+	q.applyMut.Lock()
+	defer q.applyMut.Unlock()
+	for _, filename := range filenames {
+		q.apply(filename)
+	}
+	return len(filenames)
+}
+
+// Apply the changes to the files that have stopped changing, or that have
+// been waiting for too long
+func (q *changeQueue) applyDue(now time.Time) int {
+	return q.applyWhere(func(_ string, change pendingChange) bool {
+		return now.Sub(change.last) >= changeQuietPeriod || now.Sub(change.first) >= changeMaxDelay
+	})
+}
+
+// Apply the pending changes in a directory right away. Called before a
+// request is served, so that a changed page, template or data file is never
+// served from the cache.
+func (q *changeQueue) settle(dir string) {
+	q.mut.Lock()
+	empty := len(q.pending) == 0
+	q.mut.Unlock()
+	if empty {
+		return
+	}
+	q.applyWhere(func(filename string, _ pendingChange) bool {
+		return filepath.Dir(filename) == dir
+	})
+}
+
+// Watch a directory recursively, and remove changed files from the cache
+func (ac *algernonConfig) watchChanges(dir string) error {
+	rw, err := recwatch.NewRecursiveWatcher(dir)
+	if err != nil {
+		return err
+	}
+	ac.changes = newChangeQueue(func(filename string) {
+		// The file may not be in the cache, which is fine
+		ac.cache.Remove(filename)
+		ac.broadcaster.fileChanged(filename)
+	})
+	go func() {
+		ticker := time.NewTicker(changeQuietPeriod / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case ev := <-rw.Events:
+				// Skip hidden files, like the swap files of editors
+				if strings.HasPrefix(filepath.Base(ev.Name), ".") {
+					continue
+				}
+				// Also watch new directories
+				if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+					for _, folder := range recwatch.Subfolders(ev.Name) {
+						if err := rw.Add(folder); err != nil {
+							log.Warn("Could not watch " + folder + ": " + err.Error())
+						}
+					}
+					continue
+				}
+				ac.changes.add(ev.Name)
+			case err := <-rw.Errors:
+				log.Error(err)
+			case now := <-ticker.C:
+				if n := ac.changes.applyDue(now); n > 0 && ac.verboseMode {
+					log.Infof("Removed %d changed files from the cache", n)
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChangeQueue(t *testing.T) {
+	var applied []string
+	q := newChangeQueue(func(filename string) {
+		applied = append(applied, filename)
+	})
+	q.add("site/index.md")
+	q.add("site/index.md")
+	q.add("site/style/main.css")
+	if n := q.applyDue(time.Now()); n != 0 {
+		t.Errorf("expected the changes to wait for the quiet period, but %d were applied", n)
+	}
+	q.settle("site")
+	if len(applied) != 1 || applied[0] != "site/index.md" {
+		t.Errorf("expected only the changes in the directory to be applied, got %v", applied)
+	}
+	if n := q.applyDue(time.Now().Add(changeQuietPeriod)); n != 1 {
+		t.Errorf("expected 1 change to be applied after the quiet period, got %d", n)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+// Client Hints (Save-Data, DPR, Viewport-Width and Width), for choosing
+// image variants and compression, and for adaptive Lua pages
+
+import (
+	"math"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	// Sent to the client when client hints are enabled
+	acceptClientHints = "DPR, Viewport-Width, Width, Save-Data, Sec-CH-DPR, Sec-CH-Viewport-Width, Sec-CH-Width"
+
+	// Responses that depend on client hints must vary on them
+	varyClientHints = "DPR, Viewport-Width, Width, Save-Data"
+)
+
+// The client hints for a request. Zero values means that the hint was not given.
+type clientHints struct {
+	saveData      bool
+	dpr           float64
+	viewportWidth int
+	width         int
+}
+
+// Return the value of a client hint header, with or without the Sec-CH- prefix
+func hintHeader(req *http.Request, name string) string {
+	if value := req.Header.Get("Sec-CH-" + name); value != "" {
+		return value
+	}
+	return req.Header.Get(name)
+}
+
+// Parse the client hints from the request headers
+func parseClientHints(req *http.Request) clientHints {
+	var hints clientHints
+	hints.saveData = strings.EqualFold(strings.TrimSpace(req.Header.Get("Save-Data")), "on")
+	if dpr, err := strconv.ParseFloat(hintHeader(req, "DPR"), 64); err == nil && dpr > 0 {
+		hints.dpr = dpr
+	}
+	if vw, err := strconv.Atoi(hintHeader(req, "Viewport-Width")); err == nil && vw > 0 {
+		hints.viewportWidth = vw
+	}
+	if width, err := strconv.Atoi(hintHeader(req, "Width")); err == nil && width > 0 {
+		hints.width = width
+	}
+	return hints
+}
+
+// Return the gzip threshold and if fast compression should be used.
+// Clients that asks to save data gets everything compressed as much as possible.
+func gzipSettings(req *http.Request) (int, bool) {
+	if parseClientHints(req).saveData {
+		return 0, false
+	}
+	return gzipThreshold, true
+}
+
+// Check if the filename extension is for an image that can have variants
+func isImageExtension(ext string) bool {
+	switch ext {
+	case ".png", ".jpg", ".jpeg", ".gif", ".webp", ".avif":
+		return true
+	}
+	return false
+}
+
+// Find the width variants of an image, like "photo-640w.jpg" for "photo.jpg".
+// Returns a map from width to filename.
+func widthVariants(filename string) map[int]string {
+	base := strings.TrimSuffix(filename, filepath.Ext(filename))
+	matches, err := filepath.Glob(base + "-*w" + filepath.Ext(filename))
+	if err != nil {
+		return nil
+	}
+	variants := make(map[int]string)
+	for _, match := range matches {
+		widthString := strings.TrimSuffix(strings.TrimPrefix(match, base+"-"), "w"+filepath.Ext(filename))
+		if width, err := strconv.Atoi(widthString); err == nil {
+			variants[width] = match
+		}
+	}
+	return variants
+}
+
+// Select an image variant that suits the client hints. The variants are
+// files next to the image, like "photo@2x.jpg" for high density displays
+// or "photo-640w.jpg" for a given width. The original image is returned
+// if there is no suitable variant, or if the client wishes to save data.
+func imageVariant(req *http.Request, filename string) string {
+	hints := parseClientHints(req)
+	if hints.saveData {
+		return filename
+	}
+	dpr := hints.dpr
+	if dpr == 0 {
+		dpr = 1
+	}
+
+	// If the needed width is known, select the smallest variant that is wide enough
+	width := hints.width
+	if width == 0 && hints.viewportWidth > 0 {
+		width = int(math.Ceil(float64(hints.viewportWidth) * dpr))
+	}
+	if width > 0 {
+		if variants := widthVariants(filename); len(variants) > 0 {
+			var widths []int
+			for w := range variants {
+				widths = append(widths, w)
+			}
+			sort.Ints(widths)
+			for _, w := range widths {
+				if w >= width {
+					return variants[w]
+				}
+			}
+			// Use the largest variant if none are wide enough
+			return variants[widths[len(widths)-1]]
+		}
+	}
+
+	// Select a pixel density variant, like "photo@2x.png"
+	base := strings.TrimSuffix(filename, filepath.Ext(filename))
+	for density := int(math.Ceil(dpr)); density > 1; density-- {
+		variant := base + "@" + strconv.Itoa(density) + "x" + filepath.Ext(filename)
+		if fs.Exists(variant) {
+			return variant
+		}
+	}
+	return filename
+}
+
+// Make the client hints for the current request available to Lua
+func exportClientHints(L *lua.LState, req *http.Request) {
+
+	// Return a table with the client hints: savedata (bool), dpr, viewportwidth
+	// and width. The numbers are 0 if not given by the client.
+	L.SetGlobal("clienthints", L.NewFunction(func(L *lua.LState) int {
+		hints := parseClientHints(req)
+		table := L.NewTable()
+		table.RawSetString("savedata", lua.LBool(hints.saveData))
+		table.RawSetString("dpr", lua.LNumber(hints.dpr))
+		table.RawSetString("viewportwidth", lua.LNumber(hints.viewportWidth))
+		table.RawSetString("width", lua.LNumber(hints.width))
+		L.Push(table)
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,53 @@
+package main
+
+// Commands that can be given as the first argument, like "algernon sign app.alg"
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// A command takes the configuration and the arguments after the command name
+type command func(ac *algernonConfig, args []string) error
+
+// Return the available commands
+func availableCommands() map[string]command {
+	return map[string]command{
+		"build-exe": buildExeCommand,
+		"deploy":    deployCommand,
+		"keygen":    keygenCommand,
+		"manifest":  manifestCommand,
+		"sign":      signCommand,
+		"verify":    verifyCommand,
+	}
+}
+
+// Check if the given argument is a command. If there is a file or directory
+// with the same name, that is served instead, for backward compatibility.
+func isCommand(arg string) bool {
+	if _, found := availableCommands()[arg]; !found {
+		return false
+	}
+	_, err := os.Stat(arg)
+	return os.IsNotExist(err)
+}
+
+// Return the sorted names of the available commands
+func commandNames() []string {
+	var names []string
+	for name := range availableCommands() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run the command that was given as the first argument and exit
+func (ac *algernonConfig) runCommandAndExit() {
+	if err := availableCommands()[ac.command](ac, ac.commandArgs); err != nil {
+		fmt.Fprintln(os.Stderr, "error: "+err.Error())
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,284 @@
+package main
+
+// Comments for Markdown pages, stored in the database. Logged in users can
+// post comments, admins can approve and delete them, and users can delete
+// their own comments.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// The URL path that comments are posted to
+	commentsPath = "/_comments"
+
+	// The ID of the KeyValue where the comments are stored, per page
+	commentsKeyValueID = "comments"
+
+	// The maximum length of a comment, in bytes
+	maxCommentLength = 4000
+)
+
+// A comment on a page
+type comment struct {
+	ID       string    `json:"id"`
+	Author   string    `json:"author"`
+	Text     string    `json:"text"`
+	Time     time.Time `json:"time"`
+	Approved bool      `json:"approved"`
+}
+
+// Check if comments should be shown for a Markdown page, given the value of
+// the "comments" keyword. Comments can be turned off for a page with "off".
+func (ac *algernonConfig) commentsEnabledFor(keyword string) bool {
+	if !ac.comments {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(keyword)) {
+	case "off", "no", "false":
+		return false
+	}
+	return true
+}
+
+// Load the comments for the given page
+func (ac *algernonConfig) loadComments(page string) ([]comment, error) {
+	kv, err := ac.perm.UserState().Creator().NewKeyValue(commentsKeyValueID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := kv.Get(page)
+	if err != nil || data == "" {
+		// No comments yet
+		return nil, nil
+	}
+	var comments []comment
+	err = json.Unmarshal([]byte(data), &comments)
+	return comments, err
+}
+
+// Save the comments for the given page
+func (ac *algernonConfig) saveComments(page string, comments []comment) error {
+	kv, err := ac.perm.UserState().Creator().NewKeyValue(commentsKeyValueID)
+	if err != nil {
+		return err
+	}
+	if len(comments) == 0 {
+		return kv.Del(page)
+	}
+	data, err := json.Marshal(comments)
+	if err != nil {
+		return err
+	}
+	return kv.Set(page, string(data))
+}
+
+// Render a form with a single button, for approving or deleting a comment
+func commentButton(page, id, action, label, csrf string) string {
+	return fmt.Sprintf(`<form method="POST" action="%s" class="comment-action"><input type="hidden" name="page" value="%s"><input type="hidden" name="id" value="%s"><input type="hidden" name="action" value="%s">%s<button type="submit">%s</button></form>`,
+		commentsPath, html.EscapeString(page), html.EscapeString(id), action, csrf, label)
+}
+
+// Return the Markdown file that the comments for a page belong to, or an
+// empty string if the page is not a Markdown file in the server directory.
+// The page is also where the visitor is sent after posting, so only clean
+// local paths are accepted.
+func (ac *algernonConfig) commentsPageFile(page string) string {
+	if !strings.HasPrefix(page, "/") || strings.HasPrefix(page, "//") || strings.Contains(page, "\\") {
+		return ""
+	}
+	if cleaned := path.Clean(page); cleaned != page && cleaned+"/" != page {
+		return ""
+	}
+	filename := url2filename(ac.serverDirOrFilename, page)
+	if fs.Exists(filename) && fs.IsDir(filename) {
+		dirname := filename
+		filename = ""
+		for _, indexFilename := range ac.indexFilesFor(dirname) {
+			if indexFile := filepath.Join(dirname, indexFilename); fs.Exists(indexFile) {
+				filename = indexFile
+				break
+			}
+		}
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".md", ".markdown":
+		if fs.Exists(filename) && !fs.IsDir(filename) {
+			return filename
+		}
+	}
+	return ""
+}
+
+// Render the comments for a page, and a form for posting a new comment
+func (ac *algernonConfig) commentsHTML(w http.ResponseWriter, req *http.Request) string {
+	page := req.URL.Path
+	userstate := ac.perm.UserState()
+	username := userstate.Username(req)
+	loggedIn := username != "" && userstate.IsLoggedIn(username)
+	isAdmin := loggedIn && userstate.IsAdmin(username)
+
+	comments, err := ac.loadComments(page)
+	if err != nil {
+		log.Error("Could not load the comments for ", page, ": ", err)
+	}
+
+	// With --csrf, the CSRF field is added to all POST forms
+	csrf := ""
+	if !ac.csrfProtection {
+		ensureCSRFCookie(w, req)
+		csrf = csrfField(ac.csrfToken(req))
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`<section id="comments"><style>#comments .comment{margin:1em 0;padding:0.5em 1em;border-left:3px solid #8888}#comments .pending{opacity:0.6}#comments .comment-meta{font-size:0.85em;opacity:0.8}#comments .comment-action{display:inline;margin-right:0.5em}#comments textarea{width:100%;min-height:6em;box-sizing:border-box}</style>`)
+	buf.WriteString("<h2>Comments</h2>")
+	shown := 0
+	for _, c := range comments {
+		own := loggedIn && c.Author == username
+		if !c.Approved && !isAdmin && !own {
+			continue
+		}
+		shown++
+		class := "comment"
+		status := ""
+		if !c.Approved {
+			class += " pending"
+			status = " (awaiting moderation)"
+		}
+		fmt.Fprintf(&buf, `<div class="%s" id="comment-%s"><div class="comment-meta"><strong>%s</strong> · %s%s</div><p>%s</p>`,
+			class, html.EscapeString(c.ID), html.EscapeString(c.Author), c.Time.Format("2006-01-02 15:04"), status,
+			strings.Replace(html.EscapeString(c.Text), "\n", "<br>", -1))
+		if isAdmin && !c.Approved {
+			buf.WriteString(commentButton(page, c.ID, "approve", "Approve", csrf))
+		}
+		if isAdmin || own {
+			buf.WriteString(commentButton(page, c.ID, "delete", "Delete", csrf))
+		}
+		buf.WriteString("</div>")
+	}
+	if shown == 0 {
+		buf.WriteString("<p>No comments yet.</p>")
+	}
+	if loggedIn {
+		fmt.Fprintf(&buf, `<form method="POST" action="%s"><input type="hidden" name="page" value="%s"><input type="hidden" name="action" value="post">%s<textarea name="text" maxlength="%d" required></textarea><p><button type="submit">Post comment</button></p></form>`,
+			commentsPath, html.EscapeString(page), csrf, maxCommentLength)
+	} else {
+		buf.WriteString("<p><em>Log in to comment.</em></p>")
+	}
+	buf.WriteString("</section>")
+	return buf.String()
+}
+
+// Generate an ID for a comment
+func newCommentID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Handle posting, approving and deleting comments
+func (ac *algernonConfig) commentsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !ac.validCSRF(req) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+	page := req.FormValue("page")
+	if ac.commentsPageFile(page) == "" {
+		http.Error(w, "Invalid page", http.StatusBadRequest)
+		return
+	}
+	userstate := ac.perm.UserState()
+	username := userstate.Username(req)
+	if username == "" || !userstate.IsLoggedIn(username) {
+		http.Error(w, "Log in to comment", http.StatusForbidden)
+		return
+	}
+	isAdmin := userstate.IsAdmin(username)
+
+	// Only one change to the comments at a time
+	ac.commentsMut.Lock()
+	defer ac.commentsMut.Unlock()
+
+	comments, err := ac.loadComments(page)
+	if err != nil {
+		log.Error("Could not load the comments for ", page, ": ", err)
+		http.Error(w, "Could not load the comments", http.StatusInternalServerError)
+		return
+	}
+
+	id := req.FormValue("id")
+	switch req.FormValue("action") {
+	case "post":
+		text := strings.TrimSpace(req.FormValue("text"))
+		if text == "" || len(text) > maxCommentLength {
+			http.Error(w, fmt.Sprintf("A comment must be between 1 and %d bytes long", maxCommentLength), http.StatusBadRequest)
+			return
+		}
+		id = newCommentID()
+		comments = append(comments, comment{
+			ID:       id,
+			Author:   username,
+			Text:     text,
+			Time:     time.Now(),
+			Approved: isAdmin || !ac.moderateComments,
+		})
+	case "approve":
+		if !isAdmin {
+			http.Error(w, "Only admins can approve comments", http.StatusForbidden)
+			return
+		}
+		for i := range comments {
+			if comments[i].ID == id {
+				comments[i].Approved = true
+			}
+		}
+	case "delete":
+		kept := comments[:0]
+		for _, c := range comments {
+			if c.ID == id {
+				if !isAdmin && c.Author != username {
+					http.Error(w, "Only admins and the author can delete a comment", http.StatusForbidden)
+					return
+				}
+				continue
+			}
+			kept = append(kept, c)
+		}
+		comments = kept
+		id = ""
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+
+	if err := ac.saveComments(page, comments); err != nil {
+		log.Error("Could not save the comments for ", page, ": ", err)
+		http.Error(w, "Could not save the comments", http.StatusInternalServerError)
+		return
+	}
+
+	// Go back to the page
+	anchor := "#comments"
+	if id != "" {
+		anchor = "#comment-" + id
+	}
+	http.Redirect(w, req, page+anchor, http.StatusSeeOther)
+}
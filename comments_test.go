@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xyproto/datablock"
+)
+
+func TestCommentsPageFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "comments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "blog"), 0755)
+	os.Mkdir(filepath.Join(dir, "app"), 0755)
+	for _, name := range []string{"about.md", "blog/index.md", "app/index.lua", "style.css"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte("x"), 0644)
+	}
+	if fs == nil {
+		fs = datablock.NewFileStat(false, 0)
+	}
+	ac := newAlgernonConfig()
+	ac.serverDirOrFilename = dir
+
+	for _, page := range []string{"/about.md", "/blog/", "/blog"} {
+		if ac.commentsPageFile(page) == "" {
+			t.Errorf("expected comments to be allowed for %s", page)
+		}
+	}
+	for _, page := range []string{"", "about.md", "//evil.com/about.md", "/\\evil.com", "/\\about.md", "/missing.md", "/style.css", "/app/", "/blog/../about.md", "/./about.md"} {
+		if ac.commentsPageFile(page) != "" {
+			t.Errorf("expected comments to be rejected for %q", page)
+		}
+	}
+}
+
+func TestCommentsCSRF(t *testing.T) {
+	ac := newAlgernonConfig()
+	req := httptest.NewRequest("POST", commentsPath, strings.NewReader("page=/about.md&action=post&text=hi"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	ac.commentsHandler(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected a comment without a CSRF token to be rejected, got %d", w.Code)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+// Typed access to configuration values from Lua, with config.get("key", default).
+// Values are looked up in the flags that are given on the command line, then
+// in the environment and then in the settings file given with --settings.
+// The value is converted to the same type as the default value.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/yuin/gopher-lua"
+)
+
+// A function that is called when a setting changes
+type settingWatcher struct {
+	key      string
+	onChange func(newValue, oldValue string)
+}
+
+// The settings from the settings file, and the functions that are called
+// when they change
+type settingsFile struct {
+	mut      sync.RWMutex
+	filename string
+	values   map[string]string
+	watchers []settingWatcher
+}
+
+// Flatten a JSON value to strings, by key. Keys of nested objects are joined
+// with ".", and arrays are joined with ",".
+func flattenSettings(prefix string, value interface{}, values map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, nested := range v {
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			flattenSettings(key, nested, values)
+		}
+	case []interface{}:
+		var elements []string
+		for _, element := range v {
+			elements = append(elements, fmt.Sprint(element))
+		}
+		values[prefix] = strings.Join(elements, ",")
+	case nil:
+		values[prefix] = ""
+	default:
+		values[prefix] = fmt.Sprint(v)
+	}
+}
+
+// Read the settings from a JSON file
+func readSettings(filename string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var settings map[string]interface{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	flattenSettings("", settings, values)
+	return values, nil
+}
+
+// Read the settings file again, and call the watchers of the settings that changed
+func (sf *settingsFile) reload() {
+	values, err := readSettings(sf.filename)
+	if err != nil {
+		log.Error("Could not read the settings: ", err)
+		return
+	}
+	sf.mut.Lock()
+	old := sf.values
+	sf.values = values
+	watchers := sf.watchers
+	sf.mut.Unlock()
+
+	var changed []string
+	for key, value := range values {
+		if oldValue, ok := old[key]; !ok || oldValue != value {
+			changed = append(changed, key)
+		}
+	}
+	for key := range old {
+		if _, ok := values[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	sort.Strings(changed)
+	log.Info("Changed settings: ", strings.Join(changed, ", "))
+	for _, key := range changed {
+		for _, watcher := range watchers {
+			if watcher.key == key {
+				watcher.onChange(values[key], old[key])
+			}
+		}
+	}
+}
+
+// Load the settings file, and read it again when the server is reloaded
+func (ac *algernonConfig) loadSettings() error {
+	values, err := readSettings(ac.settingsFilename)
+	if err != nil {
+		return err
+	}
+	ac.settings = &settingsFile{filename: ac.settingsFilename, values: values}
+	atReload(ac.settings.reload)
+	return nil
+}
+
+// Return the name of the environment variable for a setting, like DB_HOST for "db.host"
+func settingEnvName(key string) string {
+	return strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+// Check if the flag with the given name was given
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+// Look up a setting in the given flags, the environment and the settings file
+func (ac *algernonConfig) lookupSetting(key string) (string, bool) {
+	var (
+		value string
+		found bool
+	)
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == key {
+			value, found = f.Value.String(), true
+		}
+	})
+	if found {
+		return value, true
+	}
+	if value, ok := os.LookupEnv(settingEnvName(key)); ok {
+		return value, true
+	}
+	if ac.settings != nil {
+		ac.settings.mut.RLock()
+		defer ac.settings.mut.RUnlock()
+		value, ok := ac.settings.values[key]
+		return value, ok
+	}
+	return "", false
+}
+
+// Convert a setting to the type of the default value. If the setting can not
+// be converted, the default value is returned.
+func coerceSetting(L *lua.LState, key, value string, defaultValue lua.LValue) lua.LValue {
+	switch defaultValue.Type() {
+	case lua.LTNumber:
+		number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			log.Warnf("The setting %s is not a number: %q", key, value)
+			return defaultValue
+		}
+		return lua.LNumber(number)
+	case lua.LTBool:
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case "true", "yes", "on", "1":
+			return lua.LTrue
+		case "false", "no", "off", "0", "":
+			return lua.LFalse
+		}
+		log.Warnf("The setting %s is not a boolean: %q", key, value)
+		return defaultValue
+	case lua.LTTable:
+		table := L.NewTable()
+		for _, element := range strings.Split(value, ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				table.Append(lua.LString(element))
+			}
+		}
+		return table
+	}
+	return lua.LString(value)
+}
+
+// Make the config table available to Lua, with the config.get function
+func (ac *algernonConfig) exportConfigFunctions(L *lua.LState) {
+	config := L.NewTable()
+
+	// Get a setting, converted to the type of the default value.
+	// Returns the default value, or nil, if the setting is not found.
+	L.SetField(config, "get", L.NewFunction(func(L *lua.LState) int {
+		key := L.CheckString(1)
+		defaultValue := L.Get(2)
+		value, found := ac.lookupSetting(key)
+		if !found {
+			L.Push(defaultValue)
+			return 1 // number of results
+		}
+		L.Push(coerceSetting(L, key, value, defaultValue))
+		return 1 // number of results
+	}))
+
+	L.SetGlobal("config", config)
+}
+
+// Make config.onchange available to server configuration scripts
+func (ac *algernonConfig) exportConfigChangeFunction(L *lua.LState) {
+	config, ok := L.GetGlobal("config").(*lua.LTable)
+	if !ok {
+		return
+	}
+
+	// Call a function with the new and the old value when a setting in the
+	// settings file changes, when the server is reloaded
+	var mut sync.Mutex
+	L.SetField(config, "onchange", L.NewFunction(func(L *lua.LState) int {
+		key := L.CheckString(1)
+		fn := L.CheckFunction(2)
+		if ac.settings == nil {
+			log.Warn("config.onchange requires a settings file, given with --settings")
+			return 0 // number of results
+		}
+		ac.settings.mut.Lock()
+		ac.settings.watchers = append(ac.settings.watchers, settingWatcher{key, func(newValue, oldValue string) {
+			mut.Lock()
+			defer mut.Unlock()
+			if err := L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true}, lua.LString(newValue), lua.LString(oldValue)); err != nil {
+				log.Error("config.onchange for "+key+" failed: ", err)
+			}
+		}})
+		ac.settings.mut.Unlock()
+		return 0 // number of results
+	}))
+}
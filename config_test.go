@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+func TestCoerceSetting(t *testing.T) {
+	values := make(map[string]string)
+	flattenSettings("", map[string]interface{}{
+		"db":   map[string]interface{}{"port": 5432.0},
+		"tags": []interface{}{"a", "b"},
+	}, values)
+	if values["db.port"] != "5432" || values["tags"] != "a,b" {
+		t.Errorf("unexpected flattened settings: %v", values)
+	}
+	L := lua.NewState()
+	defer L.Close()
+	if v := coerceSetting(L, "db.port", values["db.port"], lua.LNumber(0)); v != lua.LNumber(5432) {
+		t.Errorf("expected the number 5432, got %v", v)
+	}
+	if v := coerceSetting(L, "debug", "off", lua.LTrue); v != lua.LFalse {
+		t.Errorf("expected false, got %v", v)
+	}
+	if v := coerceSetting(L, "port", "abc", lua.LNumber(80)); v != lua.LNumber(80) {
+		t.Errorf("expected the default value, got %v", v)
+	}
+	if v, ok := coerceSetting(L, "tags", values["tags"], L.NewTable()).(*lua.LTable); !ok || v.Len() != 2 {
+		t.Errorf("expected a table with 2 elements, got %v", v)
+	}
+}
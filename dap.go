@@ -0,0 +1,313 @@
+package main
+
+// A Debug Adapter Protocol (DAP) endpoint for the Lua debugger, so that
+// editors like VS Code can set breakpoints, step and inspect variables.
+// The Lua code always runs in the server, so "launch" and "attach" just
+// connects to it. All paused Lua code is presented as a single thread.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The thread ID that is used for the paused Lua code
+const dapThreadID = 1
+
+// A DAP request from the client
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// A DAP connection
+type dapSession struct {
+	dbg      *luaDebugger
+	conn     net.Conn
+	writeMut sync.Mutex
+	seq      int
+}
+
+// Write a DAP message, with a Content-Length header
+func (s *dapSession) send(message map[string]interface{}) error {
+	s.writeMut.Lock()
+	defer s.writeMut.Unlock()
+	return s.write(message)
+}
+
+// Write a DAP message. The caller must hold the write mutex.
+func (s *dapSession) write(message map[string]interface{}) error {
+	s.seq++
+	message["seq"] = s.seq
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.conn, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	return err
+}
+
+// Send an event to the client
+func (s *dapSession) event(name string, body interface{}) error {
+	return s.send(map[string]interface{}{"type": "event", "event": name, "body": body})
+}
+
+// Write a response to a request. If err is not nil, the request failed.
+// The caller must hold the write mutex.
+func (s *dapSession) respond(req *dapRequest, body interface{}, err error) error {
+	response := map[string]interface{}{
+		"type":        "response",
+		"request_seq": req.Seq,
+		"command":     req.Command,
+		"success":     err == nil,
+	}
+	if err != nil {
+		response["message"] = err.Error()
+	} else if body != nil {
+		response["body"] = body
+	}
+	return s.write(response)
+}
+
+// Read a DAP request, which has a Content-Length header
+func readDAPRequest(r *bufio.Reader) (*dapRequest, error) {
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, errors.New("missing Content-Length")
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	var req dapRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// Handle a single DAP request and return the response body
+func (s *dapSession) handle(req *dapRequest) (interface{}, error) {
+	switch req.Command {
+	case "initialize":
+		return map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsEvaluateForHovers":        true,
+		}, nil
+	case "launch", "attach", "configurationDone", "setExceptionBreakpoints":
+		return nil, nil
+	case "setBreakpoints":
+		var args struct {
+			Source struct {
+				Path string `json:"path"`
+			} `json:"source"`
+			Breakpoints []struct {
+				Line int `json:"line"`
+			} `json:"breakpoints"`
+		}
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		var lines []int
+		var breakpoints []map[string]interface{}
+		for _, bp := range args.Breakpoints {
+			lines = append(lines, bp.Line)
+			breakpoints = append(breakpoints, map[string]interface{}{"verified": true, "line": bp.Line})
+		}
+		s.dbg.setBreakpoints(args.Source.Path, lines)
+		return map[string]interface{}{"breakpoints": breakpoints}, nil
+	case "threads":
+		return map[string]interface{}{
+			"threads": []map[string]interface{}{{"id": dapThreadID, "name": "Lua"}},
+		}, nil
+	case "stackTrace":
+		frames, err := s.dbg.stack()
+		if err != nil {
+			return nil, err
+		}
+		var stackFrames []map[string]interface{}
+		for _, frame := range frames {
+			stackFrames = append(stackFrames, map[string]interface{}{
+				// The frame ID is the stack level, plus one since 0 is not a valid ID
+				"id":     frame.level + 1,
+				"name":   frame.name,
+				"source": map[string]interface{}{"name": filepath.Base(frame.source), "path": debugFilename(frame.source)},
+				"line":   frame.line,
+				"column": 1,
+			})
+		}
+		return map[string]interface{}{"stackFrames": stackFrames, "totalFrames": len(stackFrames)}, nil
+	case "scopes":
+		var args struct {
+			FrameID int `json:"frameId"`
+		}
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		// The variables reference is the same as the frame ID
+		return map[string]interface{}{
+			"scopes": []map[string]interface{}{{"name": "Locals", "variablesReference": args.FrameID, "expensive": false}},
+		}, nil
+	case "variables":
+		var args struct {
+			VariablesReference int `json:"variablesReference"`
+		}
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		variables, err := s.dbg.variables(args.VariablesReference - 1)
+		if err != nil {
+			return nil, err
+		}
+		var result []map[string]interface{}
+		for _, variable := range variables {
+			result = append(result, map[string]interface{}{"name": variable.name, "value": variable.value, "variablesReference": 0})
+		}
+		return map[string]interface{}{"variables": result}, nil
+	case "evaluate":
+		var args struct {
+			Expression string `json:"expression"`
+			FrameID    int    `json:"frameId"`
+		}
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		level := args.FrameID - 1
+		if args.FrameID == 0 {
+			frames, err := s.dbg.stack()
+			if err != nil {
+				return nil, err
+			}
+			if len(frames) > 0 {
+				level = frames[0].level
+			}
+		}
+		result, err := s.dbg.eval(level, args.Expression)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"result": result, "variablesReference": 0}, nil
+	case "continue":
+		return map[string]interface{}{"allThreadsContinued": true}, s.dbg.resume(stepNone)
+	case "next":
+		return nil, s.dbg.resume(stepOver)
+	case "stepIn":
+		return nil, s.dbg.resume(stepIn)
+	case "stepOut":
+		return nil, s.dbg.resume(stepOut)
+	case "pause":
+		s.dbg.requestPause()
+		return nil, nil
+	case "disconnect":
+		return nil, nil
+	}
+	return nil, errors.New("unsupported request: " + req.Command)
+}
+
+// Serve a DAP client until it disconnects
+func (s *dapSession) serve() {
+	defer s.conn.Close()
+
+	// Tell the client when the Lua code is paused
+	listenerID := s.dbg.addListener(func(p *debugPause) {
+		s.event("stopped", map[string]interface{}{
+			"reason":            p.reason,
+			"threadId":          dapThreadID,
+			"allThreadsStopped": true,
+		})
+	})
+	defer s.dbg.removeListener(listenerID)
+
+	r := bufio.NewReader(s.conn)
+	for {
+		req, err := readDAPRequest(r)
+		if err != nil {
+			if err != io.EOF {
+				log.Error("DAP: ", err)
+			}
+			break
+		}
+		// Hold the write mutex until the response is written, so that a
+		// "stopped" event after stepping is not sent before the response
+		s.writeMut.Lock()
+		body, err := s.handle(req)
+		err = s.respond(req, body, err)
+		s.writeMut.Unlock()
+		if err != nil {
+			break
+		}
+		if req.Command == "initialize" {
+			s.event("initialized", nil)
+		}
+		if req.Command == "disconnect" {
+			break
+		}
+	}
+
+	// Don't leave any Lua code paused when the client is gone
+	s.dbg.clearBreakpoints()
+	s.dbg.resume(stepNone)
+}
+
+// Return the address to listen for DAP clients on. DAP clients are not
+// authenticated and can evaluate any Lua code, so only loopback addresses are
+// allowed. With just a port, like ":4711", localhost is used.
+func dapListenAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	if !isLoopback(host) {
+		return "", errors.New(addr + " is not a loopback address, and anyone that can connect to it could run Lua code on the server")
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// Listen for DAP clients on the given address, in the background
+func (ac *algernonConfig) serveDAP() {
+	addr, err := dapListenAddr(ac.dapAddr)
+	if err != nil {
+		log.Error("Not serving the Lua debugger over DAP: ", err)
+		return
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Error("Could not serve the Lua debugger over DAP: ", err)
+		return
+	}
+	log.Info("Serving the Lua debugger over DAP on " + addr)
+	atShutdown(func() {
+		listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !strings.Contains(err.Error(), "use of closed network connection") {
+					log.Error("DAP: ", err)
+				}
+				return
+			}
+			session := &dapSession{dbg: ac.debugger, conn: conn}
+			go session.serve()
+		}
+	}()
+}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestDAPListenAddr(t *testing.T) {
+	for given, expected := range map[string]string{
+		"localhost:4711": "localhost:4711",
+		"127.0.0.1:4711": "127.0.0.1:4711",
+		"[::1]:4711":     "[::1]:4711",
+		":4711":          "localhost:4711",
+	} {
+		if addr, err := dapListenAddr(given); err != nil || addr != expected {
+			t.Errorf("expected %s for %s, got %s (%v)", expected, given, addr, err)
+		}
+	}
+	for _, given := range []string{"0.0.0.0:4711", "192.168.0.1:4711", "example.com:4711", "4711"} {
+		if _, err := dapListenAddr(given); err == nil {
+			t.Errorf("expected %s to be refused", given)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+// Keeping track of if the database backend can be reached, for Redis,
+// MariaDB/MySQL and PostgreSQL. The connection pools connect again by
+// themselves, so the database is pinged regularly, and more and more seldom
+// while it is down, until it answers again. While the database is down,
+// dbHealthy() returns false in Lua, and with --dbfallback the server can
+// reject requests that may change something ("readonly"), and use the
+// permission decisions from when the database was up ("cache").
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	// How often the database is pinged while it is up
+	dbCheckInterval = 5 * time.Second
+
+	// The longest time between pings while the database is down
+	dbMaxBackoff = time.Minute
+
+	// How long a permission decision can be used while the database is down
+	dbDecisionTTL = 10 * time.Minute
+
+	// The maximum number of permission decisions that are kept
+	maxDBDecisions = 10000
+)
+
+// A permission decision for a user and an URL path, from when the database was up
+type permissionDecision struct {
+	rejected bool
+	time     time.Time
+}
+
+// Keeps track of the database, and what to do while it is down
+type dbHealth struct {
+	healthy        int32 // 1 if the database is up
+	ping           func() error
+	readOnly       bool
+	cacheDecisions bool
+	onChange       func(healthy bool, err error)
+
+	mut       sync.Mutex
+	decisions map[string]permissionDecision
+}
+
+// Parse a comma separated list of fallbacks, "readonly" and "cache".
+// "none" and a blank string is for no fallbacks.
+func parseDBFallback(s string) (readOnly, cacheDecisions bool, err error) {
+	for _, fallback := range strings.Split(s, ",") {
+		switch strings.ToLower(strings.TrimSpace(fallback)) {
+		case "readonly":
+			readOnly = true
+		case "cache":
+			cacheDecisions = true
+		case "", "none":
+		default:
+			return false, false, fmt.Errorf("unknown database fallback: %q (use readonly, cache or both)", fallback)
+		}
+	}
+	return readOnly, cacheDecisions, nil
+}
+
+// Create a health check for the database, given a function for pinging it
+func newDBHealth(ping func() error, readOnly, cacheDecisions bool) *dbHealth {
+	return &dbHealth{
+		healthy:        1,
+		ping:           ping,
+		readOnly:       readOnly,
+		cacheDecisions: cacheDecisions,
+		decisions:      make(map[string]permissionDecision),
+	}
+}
+
+// Check if the database was up the last time it was pinged. A nil dbHealth
+// is for databases that are always up, like Bolt and the in-memory database.
+func (h *dbHealth) Healthy() bool {
+	return h == nil || atomic.LoadInt32(&h.healthy) == 1
+}
+
+// Ping the database, and log if it went down or came back up
+func (h *dbHealth) check() error {
+	err := h.ping()
+	healthy := int32(0)
+	if err == nil {
+		healthy = 1
+	}
+	if atomic.SwapInt32(&h.healthy, healthy) != healthy {
+		if err != nil {
+			log.Error("The database is down: ", err)
+		} else {
+			log.Info("The database is up again")
+		}
+		if h.onChange != nil {
+			h.onChange(err == nil, err)
+		}
+	}
+	return err
+}
+
+// Return how long to wait before the next ping, after the given number of
+// failed pings in a row
+func dbBackoff(failures int) time.Duration {
+	if failures == 0 {
+		return dbCheckInterval
+	}
+	wait := time.Second
+	for i := 1; i < failures && wait < dbMaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > dbMaxBackoff {
+		wait = dbMaxBackoff
+	}
+	return wait
+}
+
+// Ping the database until the server shuts down
+func (h *dbHealth) monitor() {
+	failures := 0
+	for {
+		time.Sleep(dbBackoff(failures))
+		if err := h.check(); err != nil {
+			failures++
+		} else {
+			failures = 0
+		}
+	}
+}
+
+// Check if a request should be rejected by the permission system. While the
+// database is down, and with the "cache" fallback, the decision from when the
+// database was up is used, if there is one.
+func (h *dbHealth) rejected(w http.ResponseWriter, req *http.Request, rejected func(http.ResponseWriter, *http.Request) bool) bool {
+	if !h.cacheDecisions {
+		return rejected(w, req)
+	}
+	key := req.URL.Path
+	if c, err := req.Cookie("user"); err == nil {
+		key = c.Value + "\x00" + key
+	}
+	if !h.Healthy() {
+		h.mut.Lock()
+		decision, found := h.decisions[key]
+		h.mut.Unlock()
+		if found && time.Since(decision.time) < dbDecisionTTL {
+			return decision.rejected
+		}
+		return rejected(w, req)
+	}
+	result := rejected(w, req)
+	h.mut.Lock()
+	if len(h.decisions) >= maxDBDecisions {
+		h.decisions = make(map[string]permissionDecision)
+	}
+	h.decisions[key] = permissionDecision{result, time.Now()}
+	h.mut.Unlock()
+	return result
+}
+
+// Check if a request should be rejected by the permission system
+func (ac *algernonConfig) permissionRejected(w http.ResponseWriter, req *http.Request) bool {
+	if ac.dbHealth == nil {
+		return ac.perm.Rejected(w, req)
+	}
+	return ac.dbHealth.rejected(w, req, ac.perm.Rejected)
+}
+
+// Reject requests that may change something while the database is down,
+// with the "readonly" fallback
+func (ac *algernonConfig) readOnlyHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ac.dbHealth.Healthy() || safeMethod(req.Method) {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(dbCheckInterval.Seconds())))
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, messagePage("Service Unavailable", "The database is down, so nothing can be changed right now. Try again in a little while.", ac.defaultTheme))
+	})
+}
+
+// Start keeping track of the database, for the databases that may go down
+func (ac *algernonConfig) setupDBHealth(readOnly, cacheDecisions bool) {
+	switch ac.dbName {
+	case "Redis", "MariaDB/MySQL", "PostgreSQL":
+	default:
+		return
+	}
+	host := ac.perm.UserState().Host()
+	ac.dbHealth = newDBHealth(host.Ping, readOnly, cacheDecisions)
+	ac.dbHealth.onChange = func(healthy bool, err error) {
+		if healthy {
+			ac.emitEvent(eventDatabaseUp, map[string]interface{}{"database": ac.dbName})
+			return
+		}
+		ac.emitEvent(eventDatabaseDown, map[string]interface{}{"database": ac.dbName, "error": err.Error()})
+	}
+	go ac.dbHealth.monitor()
+}
+
+// Make it possible to check if the database is up, from Lua
+func (ac *algernonConfig) exportDBHealthFunction(L *lua.LState) {
+	L.SetGlobal("dbHealthy", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(ac.dbHealth.Healthy()))
+		return 1 // number of results
+	}))
+}
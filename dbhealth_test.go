@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDBHealth(t *testing.T) {
+	if _, _, err := parseDBFallback("readonly,sometimes"); err == nil {
+		t.Error("expected an unknown fallback to be rejected")
+	}
+	if readOnly, cacheDecisions, err := parseDBFallback("readonly, cache"); err != nil || !readOnly || !cacheDecisions {
+		t.Error("expected both fallbacks")
+	}
+	if dbBackoff(0) != dbCheckInterval || dbBackoff(2) != 2*time.Second || dbBackoff(100) != dbMaxBackoff {
+		t.Error("unexpected backoff")
+	}
+	var down error
+	h := newDBHealth(func() error { return down }, true, true)
+	req := httptest.NewRequest("GET", "/private", nil)
+	allow := func(http.ResponseWriter, *http.Request) bool { return false }
+	deny := func(http.ResponseWriter, *http.Request) bool { return true }
+	if h.rejected(nil, req, allow) {
+		t.Error("expected the request to be allowed")
+	}
+	down = errors.New("connection refused")
+	h.check()
+	if h.Healthy() {
+		t.Error("expected the database to be down")
+	}
+	// The decision from when the database was up is used
+	if h.rejected(nil, req, deny) {
+		t.Error("expected the cached decision to be used")
+	}
+	down = nil
+	h.check()
+	if !h.Healthy() || !h.rejected(nil, req, deny) {
+		t.Error("expected the permission system to be asked when the database is up")
+	}
+}
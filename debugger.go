@@ -0,0 +1,705 @@
+package main
+
+// A debugger for Lua handlers, with breakpoints, stepping and inspection of
+// local variables. gopher-lua has no line hooks, so in debug mode, Lua files
+// are instrumented when they are loaded, by inserting a call to a hook
+// before every statement.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/xyproto/term"
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// The name of the Lua function that is called before every statement
+const debugLineHook = "__debugline"
+
+var errNotPaused = errors.New("not paused")
+
+// How to continue after being paused
+type stepMode int
+
+const (
+	stepNone stepMode = iota // run until a breakpoint
+	stepIn                   // pause at the next line
+	stepOver                 // pause at the next line in the same function or a caller
+	stepOut                  // pause at the next line in a caller
+)
+
+// A stack frame of a paused Lua state
+type debugFrame struct {
+	level  int
+	name   string
+	source string
+	line   int
+}
+
+// A local variable or upvalue of a paused Lua state, formatted for display
+type debugVariable struct {
+	name  string
+	value string
+}
+
+// For sorting variables by name
+type debugVariablesByName []debugVariable
+
+func (v debugVariablesByName) Len() int {
+	return len(v)
+}
+
+func (v debugVariablesByName) Less(i, j int) bool {
+	return v[i].name < v[j].name
+}
+
+func (v debugVariablesByName) Swap(i, j int) {
+	v[i], v[j] = v[j], v[i]
+}
+
+// A Lua state that is paused, waiting for requests from the REPL or DAP
+type debugPause struct {
+	filename string
+	line     int
+	reason   string // "breakpoint", "step" or "pause"
+
+	// Requests are run by the paused Lua state. Returning true resumes it.
+	requests chan func(L *lua.LState) bool
+	resumed  chan struct{}
+}
+
+// The Lua debugger. Breakpoints are per absolute filename and line.
+type luaDebugger struct {
+	mut            sync.Mutex
+	breakpoints    map[string]map[int]bool
+	mode           stepMode
+	stepL          *lua.LState
+	stepDepth      int
+	pauseRequested bool
+	paused         *debugPause
+	listeners      map[int]func(p *debugPause)
+	nextListenerID int
+
+	// Only one Lua state can be paused at a time
+	pauseMut sync.Mutex
+}
+
+func newLuaDebugger() *luaDebugger {
+	return &luaDebugger{
+		breakpoints: make(map[string]map[int]bool),
+		listeners:   make(map[int]func(p *debugPause)),
+	}
+}
+
+// Return the absolute path of a Lua file, which is used for the breakpoints
+func debugFilename(filename string) string {
+	if absFilename, err := filepath.Abs(filename); err == nil {
+		return absFilename
+	}
+	return filepath.Clean(filename)
+}
+
+// Insert a call to the line hook before every statement, including the
+// statements in nested blocks and function bodies
+func instrumentStmts(stmts []ast.Stmt, filename string) []ast.Stmt {
+	instrumented := make([]ast.Stmt, 0, len(stmts)*2)
+	for _, stmt := range stmts {
+		instrumentStmt(stmt, filename)
+		line := stmt.Line()
+		hook := &ast.FuncCallExpr{
+			Func: &ast.IdentExpr{Value: debugLineHook},
+			Args: []ast.Expr{&ast.StringExpr{Value: filename}, &ast.NumberExpr{Value: strconv.Itoa(line)}},
+		}
+		hook.SetLine(line)
+		hook.SetLastLine(line)
+		hookStmt := &ast.FuncCallStmt{Expr: hook}
+		hookStmt.SetLine(line)
+		hookStmt.SetLastLine(line)
+		instrumented = append(instrumented, hookStmt, stmt)
+	}
+	return instrumented
+}
+
+// Instrument the blocks within a statement
+func instrumentStmt(stmt ast.Stmt, filename string) {
+	switch s := stmt.(type) {
+	case *ast.AssignStmt:
+		instrumentExprs(s.Lhs, filename)
+		instrumentExprs(s.Rhs, filename)
+	case *ast.LocalAssignStmt:
+		instrumentExprs(s.Exprs, filename)
+	case *ast.FuncCallStmt:
+		instrumentExpr(s.Expr, filename)
+	case *ast.DoBlockStmt:
+		s.Stmts = instrumentStmts(s.Stmts, filename)
+	case *ast.WhileStmt:
+		instrumentExpr(s.Condition, filename)
+		s.Stmts = instrumentStmts(s.Stmts, filename)
+	case *ast.RepeatStmt:
+		instrumentExpr(s.Condition, filename)
+		s.Stmts = instrumentStmts(s.Stmts, filename)
+	case *ast.IfStmt:
+		instrumentExpr(s.Condition, filename)
+		s.Then = instrumentStmts(s.Then, filename)
+		s.Else = instrumentStmts(s.Else, filename)
+	case *ast.NumberForStmt:
+		instrumentExprs([]ast.Expr{s.Init, s.Limit, s.Step}, filename)
+		s.Stmts = instrumentStmts(s.Stmts, filename)
+	case *ast.GenericForStmt:
+		instrumentExprs(s.Exprs, filename)
+		s.Stmts = instrumentStmts(s.Stmts, filename)
+	case *ast.FuncDefStmt:
+		instrumentExpr(s.Func, filename)
+	case *ast.ReturnStmt:
+		instrumentExprs(s.Exprs, filename)
+	}
+}
+
+func instrumentExprs(exprs []ast.Expr, filename string) {
+	for _, expr := range exprs {
+		instrumentExpr(expr, filename)
+	}
+}
+
+// Instrument the function bodies within an expression
+func instrumentExpr(expr ast.Expr, filename string) {
+	switch e := expr.(type) {
+	case *ast.FunctionExpr:
+		e.Stmts = instrumentStmts(e.Stmts, filename)
+	case *ast.FuncCallExpr:
+		instrumentExprs([]ast.Expr{e.Func, e.Receiver}, filename)
+		instrumentExprs(e.Args, filename)
+	case *ast.AttrGetExpr:
+		instrumentExprs([]ast.Expr{e.Object, e.Key}, filename)
+	case *ast.TableExpr:
+		for _, field := range e.Fields {
+			instrumentExprs([]ast.Expr{field.Key, field.Value}, filename)
+		}
+	case *ast.LogicalOpExpr:
+		instrumentExprs([]ast.Expr{e.Lhs, e.Rhs}, filename)
+	case *ast.RelationalOpExpr:
+		instrumentExprs([]ast.Expr{e.Lhs, e.Rhs}, filename)
+	case *ast.StringConcatOpExpr:
+		instrumentExprs([]ast.Expr{e.Lhs, e.Rhs}, filename)
+	case *ast.ArithmeticOpExpr:
+		instrumentExprs([]ast.Expr{e.Lhs, e.Rhs}, filename)
+	case *ast.UnaryMinusOpExpr:
+		instrumentExpr(e.Expr, filename)
+	case *ast.UnaryNotOpExpr:
+		instrumentExpr(e.Expr, filename)
+	case *ast.UnaryLenOpExpr:
+		instrumentExpr(e.Expr, filename)
+	}
+}
+
+// Run a Lua file that has been instrumented for the debugger
+func (dbg *luaDebugger) doFile(L *lua.LState, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	chunk, err := parse.Parse(f, filename)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	proto, err := lua.Compile(instrumentStmts(chunk, debugFilename(filename)), filename)
+	if err != nil {
+		return err
+	}
+	L.SetGlobal(debugLineHook, L.NewFunction(dbg.lineHook))
+	L.Push(&lua.LFunction{Env: L.Env, Proto: proto, Upvalues: []*lua.Upvalue{}})
+	return L.PCall(0, lua.MultRet, nil)
+}
+
+// Run a Lua file. In debug mode, the file is instrumented for the debugger first.
+func (ac *algernonConfig) doLuaFile(L *lua.LState, filename string) error {
+	if ac.debugger == nil {
+		return L.DoFile(filename)
+	}
+	return ac.debugger.doFile(L, filename)
+}
+
+// Return the number of stack frames
+func callDepth(L *lua.LState) int {
+	depth := 0
+	for {
+		if _, ok := L.GetStack(depth); !ok {
+			return depth
+		}
+		depth++
+	}
+}
+
+// Called before every statement in instrumented Lua code.
+// Takes the filename and the line number.
+func (dbg *luaDebugger) lineHook(L *lua.LState) int {
+	filename := L.ToString(1)
+	line := L.ToInt(2)
+	if reason := dbg.shouldPause(L, filename, line); reason != "" {
+		dbg.pause(L, filename, line, reason)
+	}
+	return 0 // number of results
+}
+
+// Check if the Lua state should pause at the given line, and return the reason
+func (dbg *luaDebugger) shouldPause(L *lua.LState, filename string, line int) string {
+	dbg.mut.Lock()
+	defer dbg.mut.Unlock()
+	if dbg.breakpoints[filename][line] {
+		return "breakpoint"
+	}
+	if dbg.pauseRequested {
+		return "pause"
+	}
+	if dbg.mode == stepNone || dbg.stepL != L {
+		return ""
+	}
+	switch dbg.mode {
+	case stepIn:
+		return "step"
+	case stepOver:
+		if callDepth(L) <= dbg.stepDepth {
+			return "step"
+		}
+	case stepOut:
+		if callDepth(L) < dbg.stepDepth {
+			return "step"
+		}
+	}
+	return ""
+}
+
+// Pause the Lua state and serve requests until one of them resumes it.
+// If there is no REPL nor DAP client to resume it, nothing happens.
+func (dbg *luaDebugger) pause(L *lua.LState, filename string, line int, reason string) {
+	dbg.pauseMut.Lock()
+	defer dbg.pauseMut.Unlock()
+
+	p := &debugPause{
+		filename: filename,
+		line:     line,
+		reason:   reason,
+		requests: make(chan func(L *lua.LState) bool),
+		resumed:  make(chan struct{}),
+	}
+
+	dbg.mut.Lock()
+	if len(dbg.listeners) == 0 {
+		dbg.pauseRequested = false
+		dbg.mut.Unlock()
+		return
+	}
+	dbg.paused = p
+	dbg.mode = stepNone
+	dbg.pauseRequested = false
+	var listeners []func(p *debugPause)
+	for _, listener := range dbg.listeners {
+		listeners = append(listeners, listener)
+	}
+	dbg.mut.Unlock()
+
+	for _, listener := range listeners {
+		listener(p)
+	}
+	for request := range p.requests {
+		if request(L) {
+			break
+		}
+	}
+
+	dbg.mut.Lock()
+	dbg.paused = nil
+	dbg.mut.Unlock()
+	close(p.resumed)
+}
+
+// Add a function that is called when a Lua state is paused. Returns an ID
+// that can be used for removing the listener.
+func (dbg *luaDebugger) addListener(listener func(p *debugPause)) int {
+	dbg.mut.Lock()
+	defer dbg.mut.Unlock()
+	dbg.nextListenerID++
+	dbg.listeners[dbg.nextListenerID] = listener
+	return dbg.nextListenerID
+}
+
+func (dbg *luaDebugger) removeListener(id int) {
+	dbg.mut.Lock()
+	delete(dbg.listeners, id)
+	dbg.mut.Unlock()
+}
+
+// Return the paused Lua state, or nil
+func (dbg *luaDebugger) pausedAt() *debugPause {
+	dbg.mut.Lock()
+	defer dbg.mut.Unlock()
+	return dbg.paused
+}
+
+// Run a request on the paused Lua state, and wait for it to finish
+func (dbg *luaDebugger) request(f func(L *lua.LState) bool) error {
+	p := dbg.pausedAt()
+	if p == nil {
+		return errNotPaused
+	}
+	done := make(chan struct{})
+	select {
+	case p.requests <- func(L *lua.LState) bool {
+		defer close(done)
+		return f(L)
+	}:
+	case <-p.resumed:
+		return errNotPaused
+	}
+	<-done
+	return nil
+}
+
+// Resume the paused Lua state
+func (dbg *luaDebugger) resume(mode stepMode) error {
+	return dbg.request(func(L *lua.LState) bool {
+		dbg.mut.Lock()
+		dbg.mode = mode
+		dbg.stepL = L
+		dbg.stepDepth = callDepth(L)
+		dbg.mut.Unlock()
+		return true
+	})
+}
+
+// Pause at the next line that is run by any Lua state
+func (dbg *luaDebugger) requestPause() {
+	dbg.mut.Lock()
+	dbg.pauseRequested = true
+	dbg.mut.Unlock()
+}
+
+// Set or clear a breakpoint
+func (dbg *luaDebugger) setBreakpoint(filename string, line int, enabled bool) {
+	dbg.mut.Lock()
+	defer dbg.mut.Unlock()
+	filename = debugFilename(filename)
+	if enabled {
+		if dbg.breakpoints[filename] == nil {
+			dbg.breakpoints[filename] = make(map[int]bool)
+		}
+		dbg.breakpoints[filename][line] = true
+		return
+	}
+	delete(dbg.breakpoints[filename], line)
+	if len(dbg.breakpoints[filename]) == 0 {
+		delete(dbg.breakpoints, filename)
+	}
+}
+
+// Replace all breakpoints for the given file
+func (dbg *luaDebugger) setBreakpoints(filename string, lines []int) {
+	dbg.mut.Lock()
+	defer dbg.mut.Unlock()
+	filename = debugFilename(filename)
+	delete(dbg.breakpoints, filename)
+	if len(lines) == 0 {
+		return
+	}
+	dbg.breakpoints[filename] = make(map[int]bool)
+	for _, line := range lines {
+		dbg.breakpoints[filename][line] = true
+	}
+}
+
+// Remove all breakpoints
+func (dbg *luaDebugger) clearBreakpoints() {
+	dbg.mut.Lock()
+	dbg.breakpoints = make(map[string]map[int]bool)
+	dbg.mut.Unlock()
+}
+
+// Return all breakpoints, as sorted "filename:line" strings
+func (dbg *luaDebugger) listBreakpoints() []string {
+	dbg.mut.Lock()
+	defer dbg.mut.Unlock()
+	var breakpoints []string
+	for filename, lines := range dbg.breakpoints {
+		for line := range lines {
+			breakpoints = append(breakpoints, filename+":"+strconv.Itoa(line))
+		}
+	}
+	sort.Strings(breakpoints)
+	return breakpoints
+}
+
+// Format a Lua value for display
+func debugValueString(value lua.LValue) string {
+	var buf bytes.Buffer
+	pprintToWriter(&buf, value)
+	return buf.String()
+}
+
+// Return the Lua stack frames of the paused Lua state, innermost first
+func (dbg *luaDebugger) stack() ([]debugFrame, error) {
+	var frames []debugFrame
+	err := dbg.request(func(L *lua.LState) bool {
+		for level := 0; ; level++ {
+			d, ok := L.GetStack(level)
+			if !ok {
+				break
+			}
+			if _, err := L.GetInfo("Snl", d, nil); err != nil || d.What == "G" {
+				continue
+			}
+			name := d.Name
+			if name == "" {
+				name = "main chunk"
+				if d.What != "main" {
+					name = "function"
+				}
+			}
+			frames = append(frames, debugFrame{level, name, d.Source, d.CurrentLine})
+		}
+		return false
+	})
+	return frames, err
+}
+
+// Return the local variables and upvalues at the given stack level
+func frameVariables(L *lua.LState, level int) map[string]lua.LValue {
+	variables := make(map[string]lua.LValue)
+	d, ok := L.GetStack(level)
+	if !ok {
+		return variables
+	}
+	if fn, err := L.GetInfo("f", d, nil); err == nil {
+		if f, ok := fn.(*lua.LFunction); ok {
+			for i := 1; ; i++ {
+				name, value := L.GetUpvalue(f, i)
+				if name == "" {
+					break
+				}
+				variables[name] = value
+			}
+		}
+	}
+	// Local variables shadow upvalues, and later locals shadow earlier ones
+	for i := 1; ; i++ {
+		name, value := L.GetLocal(d, i)
+		if name == "" {
+			break
+		}
+		// Skip internal variables, like "(for index)"
+		if !strings.HasPrefix(name, "(") {
+			variables[name] = value
+		}
+	}
+	return variables
+}
+
+// Return the local variables and upvalues at the given stack level, sorted by name
+func (dbg *luaDebugger) variables(level int) ([]debugVariable, error) {
+	var variables []debugVariable
+	err := dbg.request(func(L *lua.LState) bool {
+		for name, value := range frameVariables(L, level) {
+			variables = append(variables, debugVariable{name, debugValueString(value)})
+		}
+		return false
+	})
+	sort.Sort(debugVariablesByName(variables))
+	return variables, err
+}
+
+// Evaluate a Lua expression or statement at the given stack level. The local
+// variables and upvalues are available, but assigning to them has no effect.
+func (dbg *luaDebugger) eval(level int, code string) (string, error) {
+	var (
+		result  string
+		evalErr error
+	)
+	err := dbg.request(func(L *lua.LState) bool {
+		env := L.NewTable()
+		for name, value := range frameVariables(L, level) {
+			env.RawSetString(name, value)
+		}
+		meta := L.NewTable()
+		meta.RawSetString("__index", L.Get(lua.GlobalsIndex))
+		L.SetMetatable(env, meta)
+
+		fn, err := L.LoadString("return " + code)
+		if err != nil {
+			if fn, err = L.LoadString(code); err != nil {
+				evalErr = err
+				return false
+			}
+		}
+		L.SetFEnv(fn, env)
+		L.Push(fn)
+		if evalErr = L.PCall(0, 1, nil); evalErr == nil {
+			result = debugValueString(L.Get(-1))
+			L.Pop(1)
+		}
+		return false
+	})
+	if err != nil {
+		return "", err
+	}
+	return result, evalErr
+}
+
+// Export the breakpoint function, for pausing at a given place in the code.
+// It does nothing when not in debug mode.
+func (ac *algernonConfig) exportDebugFunctions(L *lua.LState) {
+	L.SetGlobal("breakpoint", L.NewFunction(func(L *lua.LState) int {
+		if ac.debugger == nil {
+			return 0 // number of results
+		}
+		d, ok := L.GetStack(1)
+		if !ok {
+			return 0 // number of results
+		}
+		if _, err := L.GetInfo("Sl", d, nil); err != nil {
+			return 0 // number of results
+		}
+		ac.debugger.pause(L, debugFilename(d.Source), d.CurrentLine, "breakpoint")
+		return 0 // number of results
+	}))
+}
+
+// Help text for the debugger commands in the REPL
+const debugHelpText = `dbg break FILE:LINE   Set a breakpoint. Relative filenames are relative to the server directory.
+dbg clear [FILE:LINE] Clear a breakpoint, or all breakpoints.
+dbg list              List the breakpoints.
+dbg pause             Pause at the next line that is run.
+dbg continue          Continue running (also "dbg c").
+dbg step              Step to the next line, into function calls (also "dbg s").
+dbg next              Step to the next line, over function calls (also "dbg n").
+dbg out               Step out of the current function (also "dbg o").
+dbg where             Show the stack frames of the paused Lua code (also "dbg bt").
+dbg locals [FRAME]    Show the local variables and upvalues.
+dbg print EXPR        Evaluate an expression in the innermost frame (also "dbg p").`
+
+// Split "filename:line" into a filename and a line number.
+// Relative filenames are relative to the server directory.
+func (ac *algernonConfig) parseBreakpoint(s string) (string, int, error) {
+	pos := strings.LastIndex(s, ":")
+	if pos == -1 {
+		return "", 0, errors.New("the breakpoint must be on the form FILE:LINE")
+	}
+	line, err := strconv.Atoi(s[pos+1:])
+	if err != nil {
+		return "", 0, errors.New("invalid line number: " + s[pos+1:])
+	}
+	filename := s[:pos]
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(ac.serverDirOrFilename, filename)
+	}
+	return filename, line, nil
+}
+
+// Run a debugger command from the REPL, like "break index.lua:3"
+func (ac *algernonConfig) debugCommand(o *term.TextOutput, line string) {
+	dbg := ac.debugger
+	line = strings.TrimSpace(line)
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		if p := dbg.pausedAt(); p != nil {
+			o.Println(o.LightYellow(fmt.Sprintf("Paused at %s:%d (%s)", p.filename, p.line, p.reason)))
+		} else {
+			o.Println(o.LightYellow("Running"))
+		}
+		o.Println(debugHelpText)
+		return
+	}
+	arg := strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+
+	var err error
+	switch fields[0] {
+	case "break", "b":
+		var (
+			filename   string
+			lineNumber int
+		)
+		if filename, lineNumber, err = ac.parseBreakpoint(arg); err == nil {
+			dbg.setBreakpoint(filename, lineNumber, true)
+		}
+	case "clear":
+		if arg == "" {
+			dbg.clearBreakpoints()
+			break
+		}
+		var (
+			filename   string
+			lineNumber int
+		)
+		if filename, lineNumber, err = ac.parseBreakpoint(arg); err == nil {
+			dbg.setBreakpoint(filename, lineNumber, false)
+		}
+	case "list", "l":
+		for _, breakpoint := range dbg.listBreakpoints() {
+			o.Println(breakpoint)
+		}
+	case "pause":
+		dbg.requestPause()
+	case "continue", "c":
+		err = dbg.resume(stepNone)
+	case "step", "s":
+		err = dbg.resume(stepIn)
+	case "next", "n":
+		err = dbg.resume(stepOver)
+	case "out", "o":
+		err = dbg.resume(stepOut)
+	case "where", "bt":
+		var frames []debugFrame
+		if frames, err = dbg.stack(); err == nil {
+			for i, frame := range frames {
+				o.Println(fmt.Sprintf("#%d %s at %s:%d", i, frame.name, frame.source, frame.line))
+			}
+		}
+	case "locals":
+		frameNumber := 0
+		if arg != "" {
+			if frameNumber, err = strconv.Atoi(arg); err != nil {
+				break
+			}
+		}
+		var frames []debugFrame
+		if frames, err = dbg.stack(); err != nil {
+			break
+		}
+		if frameNumber < 0 || frameNumber >= len(frames) {
+			err = errors.New("no such frame")
+			break
+		}
+		var variables []debugVariable
+		if variables, err = dbg.variables(frames[frameNumber].level); err == nil {
+			for _, variable := range variables {
+				o.Println(variable.name + " = " + variable.value)
+			}
+		}
+	case "print", "p":
+		var frames []debugFrame
+		if frames, err = dbg.stack(); err != nil {
+			break
+		}
+		level := 0
+		if len(frames) > 0 {
+			level = frames[0].level
+		}
+		var result string
+		if result, err = dbg.eval(level, arg); err == nil {
+			o.Println(result)
+		}
+	default:
+		err = errors.New("unknown debugger command: " + fields[0])
+	}
+	if err != nil {
+		o.Err(err.Error())
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+// Deploying a server directory to a remote host over SSH, by only uploading
+// the files that differ, then triggering a reload of the remote instance.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// The default command for reloading Algernon on the remote host
+const defaultReloadCommand = "pkill -HUP -x algernon"
+
+// Quote a string for use in a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Split a target like user@host:/srv/site into user, host and directory
+func parseDeployTarget(target string) (user, host, dir string, err error) {
+	pos := strings.Index(target, ":")
+	if pos == -1 {
+		return "", "", "", errors.New("the target must be on the form [user@]host:/directory")
+	}
+	host, dir = target[:pos], target[pos+1:]
+	if at := strings.LastIndex(host, "@"); at != -1 {
+		user, host = host[:at], host[at+1:]
+	}
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	if host == "" || dir == "" {
+		return "", "", "", errors.New("the target must be on the form [user@]host:/directory")
+	}
+	return user, host, dir, nil
+}
+
+// Return the authentication methods from the SSH agent and the default key files
+func sshAuthMethods() []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	var signers []ssh.Signer
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		data, err := ioutil.ReadFile(filepath.Join(os.Getenv("HOME"), ".ssh", name))
+		if err != nil {
+			continue
+		}
+		// Keys with a passphrase must be added to the SSH agent
+		if signer, err := ssh.ParsePrivateKey(data); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	return methods
+}
+
+// Connect to the given host, verifying the host key with ~/.ssh/known_hosts
+func sshConnect(user, host, port string) (*ssh.Client, error) {
+	hostKeyCallback, err := knownhosts.New(filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            sshAuthMethods(),
+		HostKeyCallback: hostKeyCallback,
+	}
+	return ssh.Dial("tcp", net.JoinHostPort(host, port), config)
+}
+
+// Run a command on the remote host, with the given stdin, and return stdout
+func sshRun(client *ssh.Client, cmd string, stdin io.Reader) ([]byte, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	var stdout, stderr bytes.Buffer
+	session.Stdin = stdin
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err := session.Run(cmd); err != nil {
+		return nil, fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// Return the SHA-256 checksums of all files in the local directory, by relative path.
+// Hidden files and directories, like .git, are skipped.
+func localChecksums(dir string) (map[string]string, error) {
+	checksums := make(map[string]string)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") && p != dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		checksums[filepath.ToSlash(rel)] = hex.EncodeToString(sum[:])
+		return nil
+	})
+	return checksums, err
+}
+
+// Return the SHA-256 checksums of all files in the remote directory, by relative path
+func remoteChecksums(client *ssh.Client, dir string) (map[string]string, error) {
+	output, err := sshRun(client, "cd "+shellQuote(dir)+" 2>/dev/null && find . -type f -exec sha256sum {} + || true", nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseChecksums(output)
+}
+
+// Parse the output of sha256sum, by relative path. Hidden files and the files
+// in hidden directories are skipped, like for the local files, so that they
+// are never deleted on the remote host.
+func parseChecksums(output []byte) (map[string]string, error) {
+	checksums := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		// The format is "checksum  ./path"
+		fields := strings.SplitN(scanner.Text(), "  ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		name := strings.TrimPrefix(fields[1], "./")
+		if hiddenPath(name) {
+			continue
+		}
+		checksums[name] = fields[0]
+	}
+	return checksums, scanner.Err()
+}
+
+// Check if a relative path is a hidden file, or is in a hidden directory
+func hiddenPath(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Deploy the server directory to a remote host over SSH
+func deployCommand(ac *algernonConfig, args []string) error {
+	flags := flag.NewFlagSet("deploy", flag.ContinueOnError)
+	localDir := flags.String("dir", ac.serverDirOrFilename, "Local server directory")
+	port := flags.String("port", "22", "SSH port")
+	reloadCommand := flags.String("reload", defaultReloadCommand, "Command for reloading the remote server, or empty")
+	deleteFiles := flags.Bool("delete", false, "Delete remote files that do not exist locally")
+	dryRun := flags.Bool("dry", false, "Only list the changes")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: algernon deploy [-dir DIR] [-port PORT] [-reload CMD] [-delete] [-dry] [user@]host:/directory")
+	}
+	user, host, remoteDir, err := parseDeployTarget(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	local, err := localChecksums(*localDir)
+	if err != nil {
+		return err
+	}
+	client, err := sshConnect(user, host, *port)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	remote, err := remoteChecksums(client, remoteDir)
+	if err != nil {
+		return err
+	}
+
+	// Find the files that are new or changed, and the files that are gone
+	var changed, removed []string
+	for name, sum := range local {
+		if remote[name] != sum {
+			changed = append(changed, name)
+		}
+	}
+	for name := range remote {
+		if _, found := local[name]; !found {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(changed)
+	sort.Strings(removed)
+
+	for _, name := range changed {
+		fmt.Println("upload " + name)
+		if *dryRun {
+			continue
+		}
+		f, err := os.Open(filepath.Join(*localDir, filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+		remoteFilename := path.Join(remoteDir, name)
+		cmd := "mkdir -p " + shellQuote(path.Dir(remoteFilename)) + " && cat > " + shellQuote(remoteFilename)
+		_, err = sshRun(client, cmd, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("could not upload %s: %s", name, err)
+		}
+	}
+	if *deleteFiles {
+		for _, name := range removed {
+			fmt.Println("delete " + name)
+			if *dryRun {
+				continue
+			}
+			if _, err := sshRun(client, "rm -f "+shellQuote(path.Join(remoteDir, name)), nil); err != nil {
+				return fmt.Errorf("could not delete %s: %s", name, err)
+			}
+		}
+	} else if len(removed) > 0 {
+		fmt.Printf("%d remote file(s) do not exist locally (use -delete to remove them)\n", len(removed))
+	}
+
+	if len(changed) == 0 && (!*deleteFiles || len(removed) == 0) {
+		fmt.Println("Already up to date")
+		return nil
+	}
+	if *dryRun || *reloadCommand == "" {
+		return nil
+	}
+	if _, err := sshRun(client, *reloadCommand, nil); err != nil {
+		return fmt.Errorf("could not reload the remote server: %s", err)
+	}
+	fmt.Println("Reloaded the remote server")
+	return nil
+}
@@ -0,0 +1,14 @@
+package main
+
+import "testing"
+
+func TestParseChecksums(t *testing.T) {
+	output := "aaa  ./index.md\nbbb  ./.env\nccc  ./.git/HEAD\nddd  ./img/.hidden.png\neee  ./img/logo.png\n"
+	checksums, err := parseChecksums([]byte(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checksums) != 2 || checksums["index.md"] != "aaa" || checksums["img/logo.png"] != "eee" {
+		t.Errorf("expected only the files that are not hidden, got %v", checksums)
+	}
+}
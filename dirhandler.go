@@ -4,6 +4,7 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"net/http"
 	"path/filepath"
 	"strings"
@@ -31,7 +32,7 @@ func directoryListing(w http.ResponseWriter, req *http.Request, rootdir, dirname
 		urlpath := fullFilename[len(rootdir)+1:]
 
 		// Output different entries for files and directories
-		buf.WriteString(htmlLink(filename, urlpath, fs.IsDir(fullFilename)))
+		buf.WriteString(htmlIconLink(filename, urlpath, fullFilename, fs.IsDir(fullFilename), ac.listingThumbnails, ac.mediaPlayer))
 	}
 	title := dirname
 	// Strip the leading "./"
@@ -49,11 +50,14 @@ func directoryListing(w http.ResponseWriter, req *http.Request, rootdir, dirname
 	//	title = versionString
 	//}
 
+	// Use a folder icon as the favicon
+	head := `<link rel="icon" href="` + iconURI(dirname, true) + `">`
+
 	var htmldata []byte
 	if buf.Len() > 0 {
-		htmldata = []byte(messagePage(title, buf.String(), theme))
+		htmldata = []byte(messagePageWithHead(title, head, buf.String(), theme))
 	} else {
-		htmldata = []byte(messagePage(title, "Empty directory", theme))
+		htmldata = []byte(messagePageWithHead(title, head, "Empty directory", theme))
 	}
 
 	// If the auto-refresh feature has been enabled
@@ -86,13 +90,27 @@ func (ac *algernonConfig) dirPage(w http.ResponseWriter, req *http.Request, root
 		return
 	}
 	// Handle the serving of index files, if needed
-	for _, indexfile := range indexFilenames {
+	for _, indexfile := range ac.indexFilesFor(dirname) {
 		filename := filepath.Join(dirname, indexfile)
+		if ac.languageVariants {
+			// Look for language variants, like "index.de.md"
+			if variant, found := selectLanguage(w, req, filename); found {
+				ac.filePage(w, req, variant, ac.defaultLuaDataFilename)
+				return
+			}
+			continue
+		}
 		if fs.Exists(filename) {
 			ac.filePage(w, req, filename, ac.defaultLuaDataFilename)
 			return
 		}
 	}
+	// Directory listings may be turned off in .algernon.toml
+	if o := ac.overlayFor(dirname); o != nil && o.listing != nil && !*o.listing {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, noPage(req.URL.Path, theme))
+		return
+	}
 	// Serve a directory listing of no index file is found
 	directoryListing(w, req, rootdir, dirname, theme, ac)
 }
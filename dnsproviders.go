@@ -0,0 +1,429 @@
+package main
+
+// DNS providers for creating the TXT records needed by ACME DNS-01 challenges
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The TTL for the TXT records, in seconds
+const challengeRecordTTL = 120
+
+// A DNS provider can create and remove TXT records
+type dnsProvider interface {
+	// Create a TXT record with the given fully qualified name and value
+	Present(fqdn, value string) error
+	// Remove the TXT record with the given fully qualified name and value
+	CleanUp(fqdn, value string) error
+}
+
+// Create a DNS provider, given a name and a function for looking up settings
+func newDNSProvider(name string, setting func(string) string) (dnsProvider, error) {
+	switch strings.ToLower(name) {
+	case "cloudflare":
+		return newCloudflareProvider(setting)
+	case "route53":
+		return newRoute53Provider(setting)
+	case "rfc2136", "nsupdate":
+		return newRFC2136Provider(setting)
+	}
+	return nil, fmt.Errorf("unknown DNS provider: %s (use cloudflare, route53 or rfc2136)", name)
+}
+
+// Return the parent domains of the given name, from the longest to the shortest.
+// For example: a.b.example.com, b.example.com, example.com
+func parentDomains(name string) []string {
+	name = strings.TrimSuffix(name, ".")
+	labels := strings.Split(name, ".")
+	var domains []string
+	for i := 0; i < len(labels)-1; i++ {
+		domains = append(domains, strings.Join(labels[i:], "."))
+	}
+	return domains
+}
+
+// --- Cloudflare ---
+
+// A DNS provider that uses the Cloudflare API.
+// Needs CLOUDFLARE_API_TOKEN, or both CLOUDFLARE_EMAIL and CLOUDFLARE_API_KEY.
+type cloudflareProvider struct {
+	token, email, apiKey string
+	records              map[string]string // from fqdn+value to zone ID/record ID
+	mut                  sync.Mutex
+}
+
+func newCloudflareProvider(setting func(string) string) (*cloudflareProvider, error) {
+	p := &cloudflareProvider{
+		token:   setting("CLOUDFLARE_API_TOKEN"),
+		email:   setting("CLOUDFLARE_EMAIL"),
+		apiKey:  setting("CLOUDFLARE_API_KEY"),
+		records: make(map[string]string),
+	}
+	if p.token == "" && (p.email == "" || p.apiKey == "") {
+		return nil, errors.New("cloudflare: CLOUDFLARE_API_TOKEN, or CLOUDFLARE_EMAIL and CLOUDFLARE_API_KEY, must be set")
+	}
+	return p, nil
+}
+
+// Send a request to the Cloudflare API and decode the result into the given value
+func (p *cloudflareProvider) request(method, path string, body interface{}, result interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, "https://api.cloudflare.com/client/v4"+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	} else {
+		req.Header.Set("X-Auth-Email", p.email)
+		req.Header.Set("X-Auth-Key", p.apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var envelope struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("cloudflare: %s: %s", resp.Status, err)
+	}
+	if !envelope.Success {
+		var messages []string
+		for _, e := range envelope.Errors {
+			messages = append(messages, e.Message)
+		}
+		return fmt.Errorf("cloudflare: %s: %s", resp.Status, strings.Join(messages, ", "))
+	}
+	if result != nil {
+		return json.Unmarshal(envelope.Result, result)
+	}
+	return nil
+}
+
+// Find the ID of the zone that contains the given name
+func (p *cloudflareProvider) zoneID(fqdn string) (string, error) {
+	for _, domain := range parentDomains(fqdn) {
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		if err := p.request("GET", "/zones?name="+domain, nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			return zones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("cloudflare: found no zone for %s", fqdn)
+}
+
+// Present creates the TXT record
+func (p *cloudflareProvider) Present(fqdn, value string) error {
+	zoneID, err := p.zoneID(fqdn)
+	if err != nil {
+		return err
+	}
+	record := map[string]interface{}{
+		"type":    "TXT",
+		"name":    strings.TrimSuffix(fqdn, "."),
+		"content": value,
+		"ttl":     challengeRecordTTL,
+	}
+	var result struct {
+		ID string `json:"id"`
+	}
+	if err := p.request("POST", "/zones/"+zoneID+"/dns_records", record, &result); err != nil {
+		return err
+	}
+	p.mut.Lock()
+	p.records[fqdn+value] = zoneID + "/dns_records/" + result.ID
+	p.mut.Unlock()
+	return nil
+}
+
+// CleanUp removes the TXT record
+func (p *cloudflareProvider) CleanUp(fqdn, value string) error {
+	p.mut.Lock()
+	recordPath, ok := p.records[fqdn+value]
+	delete(p.records, fqdn+value)
+	p.mut.Unlock()
+	if !ok {
+		return nil
+	}
+	return p.request("DELETE", "/zones/"+recordPath, nil, nil)
+}
+
+// --- Route53 ---
+
+// A DNS provider that uses the AWS Route53 API.
+// Needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY. AWS_SESSION_TOKEN and
+// AWS_HOSTED_ZONE_ID are optional.
+type route53Provider struct {
+	accessKey, secretKey, sessionToken, zoneID string
+	values                                     map[string][]string // TXT values per name
+	mut                                        sync.Mutex
+}
+
+func newRoute53Provider(setting func(string) string) (*route53Provider, error) {
+	p := &route53Provider{
+		accessKey:    setting("AWS_ACCESS_KEY_ID"),
+		secretKey:    setting("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: setting("AWS_SESSION_TOKEN"),
+		zoneID:       setting("AWS_HOSTED_ZONE_ID"),
+		values:       make(map[string][]string),
+	}
+	if p.accessKey == "" || p.secretKey == "" {
+		return nil, errors.New("route53: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return p, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+// Send a request to the Route53 API, signed with AWS Signature Version 4
+func (p *route53Provider) request(method, path, query string, body []byte) ([]byte, error) {
+	const (
+		host    = "route53.amazonaws.com"
+		region  = "us-east-1"
+		service = "route53"
+	)
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	headers := map[string]string{
+		"host":                 host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if p.sessionToken != "" {
+		headers["x-amz-security-token"] = p.sessionToken
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{method, path, query, canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+	signingKey := hmacSHA256(hmacSHA256(hmacSHA256(hmacSHA256([]byte("AWS4"+p.secretKey), date), region), service), "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	url := "https://" + host + path
+	if query != "" {
+		url += "?" + query
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		if name != "host" {
+			req.Header.Set(name, value)
+		}
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", p.accessKey, scope, signedHeaders, signature))
+	if body != nil {
+		req.Header.Set("Content-Type", "text/xml")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		var awsErr struct {
+			Message string `xml:"Error>Message"`
+		}
+		xml.Unmarshal(data, &awsErr)
+		return nil, fmt.Errorf("route53: %s: %s", resp.Status, awsErr.Message)
+	}
+	return data, nil
+}
+
+// Find the ID of the hosted zone that contains the given name
+func (p *route53Provider) hostedZoneID(fqdn string) (string, error) {
+	if p.zoneID != "" {
+		return p.zoneID, nil
+	}
+	for _, domain := range parentDomains(fqdn) {
+		data, err := p.request("GET", "/2013-04-01/hostedzonesbyname", "dnsname="+domain+"&maxitems=1", nil)
+		if err != nil {
+			return "", err
+		}
+		var result struct {
+			HostedZones []struct {
+				ID   string `xml:"Id"`
+				Name string `xml:"Name"`
+			} `xml:"HostedZones>HostedZone"`
+		}
+		if err := xml.Unmarshal(data, &result); err != nil {
+			return "", err
+		}
+		if len(result.HostedZones) > 0 && strings.TrimSuffix(result.HostedZones[0].Name, ".") == domain {
+			return strings.TrimPrefix(result.HostedZones[0].ID, "/hostedzone/"), nil
+		}
+	}
+	return "", fmt.Errorf("route53: found no hosted zone for %s", fqdn)
+}
+
+// Create, update or delete a TXT record set. A record set holds all the
+// values for a name, for example for both example.com and *.example.com.
+func (p *route53Provider) change(action, fqdn string, values []string) error {
+	zoneID, err := p.hostedZoneID(fqdn)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+	body.WriteString(`<ChangeResourceRecordSetsRequest xmlns="https://route53.amazonaws.com/doc/2013-04-01/"><ChangeBatch><Changes><Change>`)
+	fmt.Fprintf(&body, "<Action>%s</Action><ResourceRecordSet><Name>%s</Name><Type>TXT</Type><TTL>%d</TTL>", action, strings.TrimSuffix(fqdn, ".")+".", challengeRecordTTL)
+	body.WriteString("<ResourceRecords>")
+	for _, value := range values {
+		body.WriteString(`<ResourceRecord><Value>"`)
+		xml.EscapeText(&body, []byte(value))
+		body.WriteString(`"</Value></ResourceRecord>`)
+	}
+	body.WriteString(`</ResourceRecords></ResourceRecordSet></Change></Changes></ChangeBatch></ChangeResourceRecordSetsRequest>`)
+	_, err = p.request("POST", "/2013-04-01/hostedzone/"+zoneID+"/rrset", "", body.Bytes())
+	return err
+}
+
+// Present creates the TXT record
+func (p *route53Provider) Present(fqdn, value string) error {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	values := append(p.values[fqdn], value)
+	if err := p.change("UPSERT", fqdn, values); err != nil {
+		return err
+	}
+	p.values[fqdn] = values
+	return nil
+}
+
+// CleanUp removes the TXT record
+func (p *route53Provider) CleanUp(fqdn, value string) error {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	values := p.values[fqdn]
+	var remaining []string
+	for _, v := range values {
+		if v != value {
+			remaining = append(remaining, v)
+		}
+	}
+	p.values[fqdn] = remaining
+	if len(remaining) > 0 {
+		return p.change("UPSERT", fqdn, remaining)
+	}
+	delete(p.values, fqdn)
+	if len(values) == 0 {
+		return nil
+	}
+	return p.change("DELETE", fqdn, values)
+}
+
+// --- RFC2136 ---
+
+// A DNS provider that sends dynamic updates (RFC2136) with the nsupdate utility.
+// Needs RFC2136_NAMESERVER. RFC2136_TSIG_KEY, RFC2136_TSIG_SECRET and
+// RFC2136_TSIG_ALGORITHM are optional.
+type rfc2136Provider struct {
+	nameserver, tsigKey, tsigSecret, tsigAlgorithm string
+}
+
+func newRFC2136Provider(setting func(string) string) (*rfc2136Provider, error) {
+	p := &rfc2136Provider{
+		nameserver:    setting("RFC2136_NAMESERVER"),
+		tsigKey:       setting("RFC2136_TSIG_KEY"),
+		tsigSecret:    setting("RFC2136_TSIG_SECRET"),
+		tsigAlgorithm: setting("RFC2136_TSIG_ALGORITHM"),
+	}
+	if p.nameserver == "" {
+		return nil, errors.New("rfc2136: RFC2136_NAMESERVER must be set")
+	}
+	if p.tsigAlgorithm == "" {
+		p.tsigAlgorithm = "hmac-sha256"
+	}
+	if _, err := exec.LookPath("nsupdate"); err != nil {
+		return nil, errors.New("rfc2136: nsupdate must be installed")
+	}
+	return p, nil
+}
+
+// Send an update with nsupdate
+func (p *rfc2136Provider) update(action, fqdn, value string) error {
+	server := p.nameserver
+	port := "53"
+	if i := strings.LastIndex(server, ":"); i > 0 && !strings.HasSuffix(server, "]") {
+		server, port = server[:i], server[i+1:]
+	}
+	var script bytes.Buffer
+	fmt.Fprintf(&script, "server %s %s\n", server, port)
+	if p.tsigKey != "" && p.tsigSecret != "" {
+		fmt.Fprintf(&script, "key %s:%s %s\n", p.tsigAlgorithm, p.tsigKey, p.tsigSecret)
+	}
+	fmt.Fprintf(&script, "update %s %s. %d TXT \"%s\"\nsend\n", action, strings.TrimSuffix(fqdn, "."), challengeRecordTTL, value)
+	cmd := exec.Command("nsupdate")
+	cmd.Stdin = &script
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("rfc2136: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Present creates the TXT record
+func (p *rfc2136Provider) Present(fqdn, value string) error {
+	return p.update("add", fqdn, value)
+}
+
+// CleanUp removes the TXT record
+func (p *rfc2136Provider) CleanUp(fqdn, value string) error {
+	return p.update("delete", fqdn, value)
+}
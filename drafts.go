@@ -0,0 +1,101 @@
+package main
+
+// Expiring preview URLs for Markdown pages marked with "draft: true"
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	// How long a preview URL is valid, if no duration is given
+	defaultPreviewDuration = 24 * time.Hour
+
+	// The URL parameter that holds the preview token
+	previewParameter = "preview"
+)
+
+var previewSecretMut sync.Mutex
+
+// Check if the value of a "draft" keyword means that the page is a draft
+func isDraft(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "true", "yes", "1", "on":
+		return true
+	}
+	return false
+}
+
+// Return the secret used for signing preview tokens.
+// A random secret is generated if none has been given.
+func (ac *algernonConfig) getPreviewSecret() []byte {
+	previewSecretMut.Lock()
+	defer previewSecretMut.Unlock()
+	if len(ac.previewSecret) == 0 {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			ac.fatalExit(err)
+		}
+		ac.previewSecret = secret
+	}
+	return ac.previewSecret
+}
+
+// Create the signature for the given URL path and expiry time
+func (ac *algernonConfig) previewSignature(urlpath string, expires int64) string {
+	mac := hmac.New(sha256.New, ac.getPreviewSecret())
+	mac.Write([]byte(urlpath + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Create a preview token for the given URL path that expires after the given duration
+func (ac *algernonConfig) previewToken(urlpath string, d time.Duration) string {
+	expires := time.Now().Add(d).Unix()
+	return strconv.FormatInt(expires, 10) + "-" + ac.previewSignature(urlpath, expires)
+}
+
+// Check if the given token is a valid and unexpired preview token for the URL path
+func (ac *algernonConfig) validPreviewToken(urlpath, token string) bool {
+	fields := strings.SplitN(token, "-", 2)
+	if len(fields) != 2 {
+		return false
+	}
+	expires, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(fields[1]), []byte(ac.previewSignature(urlpath, expires)))
+}
+
+// Create a preview URL for the given URL path, that expires after the given duration
+func (ac *algernonConfig) previewURL(urlpath string, d time.Duration) string {
+	if !strings.HasPrefix(urlpath, "/") {
+		urlpath = "/" + urlpath
+	}
+	return urlpath + "?" + previewParameter + "=" + url.QueryEscape(ac.previewToken(urlpath, d))
+}
+
+// Export functions related to draft previews
+func (ac *algernonConfig) exportDraftFunctions(L *lua.LState) {
+
+	// Return an URL path for previewing a draft, given an URL path and
+	// an optional number of seconds before the URL expires.
+	L.SetGlobal("PreviewURL", L.NewFunction(func(L *lua.LState) int {
+		urlpath := L.ToString(1)
+		d := defaultPreviewDuration
+		if L.GetTop() > 1 {
+			d = time.Duration(L.ToInt64(2)) * time.Second
+		}
+		L.Push(lua.LString(ac.previewURL(urlpath, d)))
+		return 1 // number of results
+	}))
+}
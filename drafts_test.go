@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPreviewToken(t *testing.T) {
+	ac := newAlgernonConfig()
+	token := ac.previewToken("/draft.md", time.Minute)
+	if !ac.validPreviewToken("/draft.md", token) {
+		t.Error("valid preview token was rejected")
+	}
+	if ac.validPreviewToken("/other.md", token) {
+		t.Error("preview token was accepted for another path")
+	}
+	if ac.validPreviewToken("/draft.md", ac.previewToken("/draft.md", -time.Minute)) {
+		t.Error("expired preview token was accepted")
+	}
+}
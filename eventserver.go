@@ -36,8 +36,8 @@ func (t timeKeys) Swap(i, j int) {
 }
 
 // Event can write SSE events to the given ResponseWriter
-// id can be nil.
-func Event(w http.ResponseWriter, id *uint64, message string, flush bool) {
+// id can be nil. Returns an error if the event could not be written.
+func Event(w http.ResponseWriter, id *uint64, message string, flush bool) error {
 	var buf bytes.Buffer
 	if id != nil {
 		buf.WriteString(fmt.Sprintf("id: %v\n", *id))
@@ -46,10 +46,13 @@ func Event(w http.ResponseWriter, id *uint64, message string, flush bool) {
 		buf.WriteString(fmt.Sprintf("data: %s\n", msg))
 	}
 	buf.WriteString("\n")
-	io.Copy(w, &buf)
+	if _, err := io.Copy(w, &buf); err != nil {
+		return err
+	}
 	if flush {
 		Flush(w)
 	}
+	return nil
 }
 
 // Flush can flush the given ResponseWriter.
@@ -105,9 +108,12 @@ func genFileChangeEvents(events TimeEventMap, mut *sync.Mutex, maxAge time.Durat
 		w.Header().Set("Connection", "keep-alive")
 		w.Header().Set("Access-Control-Allow-Origin", allowed)
 
-		var id uint64
+		var (
+			id     uint64
+			failed bool
+		)
 
-		for {
+		for !failed {
 			func() { // Use an anonymous function, just for using "defer"
 				mut.Lock()
 				defer mut.Unlock()
@@ -128,16 +134,24 @@ func genFileChangeEvents(events TimeEventMap, mut *sync.Mutex, maxAge time.Durat
 						}
 						// Avoid sending several events for the same filename
 						if ev.Name != prevname {
-							// Send an event to the client
-							Event(w, &id, ev.Name, true)
+							// Send an event to the client, and stop if the client is gone
+							if err := Event(w, &id, ev.Name, true); err != nil {
+								failed = true
+								return
+							}
 							id++
 							prevname = ev.Name
 						}
 					}
 				}
 			}()
-			// Wait for old events to be gone, and new to appear
-			time.Sleep(maxAge)
+			// Wait for old events to be gone, and new to appear,
+			// unless the client has disconnected
+			select {
+			case <-req.Context().Done():
+				return
+			case <-time.After(maxAge):
+			}
 		}
 	}
 }
@@ -170,7 +184,12 @@ func (ac *algernonConfig) EventServer(path, allowed string) {
 	go func() {
 		eventMux := http.NewServeMux()
 		// Fire off events whenever a file in the server directory changes
-		eventMux.HandleFunc(ac.defaultEventPath, genFileChangeEvents(events, &mut, ac.refreshDuration, allowed, ac))
+		var handler http.Handler = genFileChangeEvents(events, &mut, ac.refreshDuration, allowed, ac)
+		if ac.streams != nil {
+			// Limit the number of connections, and disconnect slow clients
+			handler = ac.streams.limit(handler)
+		}
+		eventMux.Handle(ac.defaultEventPath, handler)
 		eventServer := &http.Server{
 			Addr:    ac.eventAddr,
 			Handler: eventMux,
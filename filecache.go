@@ -0,0 +1,431 @@
+package main
+
+// A file cache with a size limit, that keeps the popular files. Like the
+// FileCache from the datablock package, but files can be removed one at a
+// time, the files in the cache can be listed and there are counters for the
+// hits, misses and evictions. With the admission policy enabled, a full cache
+// only makes room for files that have recently been requested more often than
+// the files that would have to be removed (TinyLFU).
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/datablock"
+)
+
+const (
+	sketchDepth = 4    // Number of rows in the frequency sketch
+	sketchWidth = 4096 // Number of counters per row, must be a power of two
+	sketchReset = 10 * sketchWidth
+)
+
+var (
+	// Used if a file that is not in the cache is removed
+	errNotCached = errors.New("the file is not in the cache")
+
+	// Used if a file is not popular enough to replace the files that would
+	// have to be removed from the cache to make room for it
+	errNotAdmitted = errors.New("the file is not popular enough to be stored in the cache")
+)
+
+// A file in the cache
+type cachedFile struct {
+	block        *datablock.DataBlock // may be compressed, must not be modified
+	size         uint64               // the size in the cache
+	originalSize uint64               // the size of the file
+	hits         uint64
+	stored       time.Time
+}
+
+// Counters for how well the cache is working
+type cacheMetrics struct {
+	Hits     uint64 // Reads that were served from the cache
+	Misses   uint64 // Reads that had to go to the disk
+	Rejected uint64 // Files that were not stored because of the admission policy
+	Evicted  uint64 // Files that were removed to make room for other files
+}
+
+// Return the share of the reads that were served from the cache, from 0 to 1
+func (m cacheMetrics) HitRate() float64 {
+	if m.Hits+m.Misses == 0 {
+		return 0
+	}
+	return float64(m.Hits) / float64(m.Hits+m.Misses)
+}
+
+// Information about a file in the cache
+type cacheEntry struct {
+	ID           string    // The normalized filename
+	Size         uint64    // The size in the cache, which may be compressed
+	OriginalSize uint64    // The size of the file
+	Hits         uint64    // Reads that were served from the cache
+	Stored       time.Time // When the file was stored in the cache
+}
+
+// Return the size in the cache divided by the size of the file
+func (e cacheEntry) Ratio() float64 {
+	if e.OriginalSize == 0 {
+		return 1
+	}
+	return float64(e.Size) / float64(e.OriginalSize)
+}
+
+// For sorting cache entries by ID
+type cacheEntriesByID []cacheEntry
+
+func (s cacheEntriesByID) Len() int           { return len(s) }
+func (s cacheEntriesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s cacheEntriesByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+// The file cache
+type fileCache struct {
+	mut               sync.Mutex
+	size              uint64 // the total size of the cache
+	used              uint64
+	compress          bool
+	maxEntitySize     uint64 // 0 for no limit
+	compressionSpeed  bool   // prefer fast over compact compression
+	files             map[string]*cachedFile
+	sketch            *frequencySketch // only for the admission policy
+	metrics           cacheMetrics
+	cacheWarningGiven bool
+}
+
+// Create a new file cache. The arguments are the same as for
+// datablock.NewFileCache.
+func newFileCache(cacheSize uint64, compress bool, maxEntitySize uint64, compressionSpeed bool) *fileCache {
+	return &fileCache{
+		size:             cacheSize,
+		compress:         compress,
+		maxEntitySize:    maxEntitySize,
+		compressionSpeed: compressionSpeed,
+		files:            make(map[string]*cachedFile),
+	}
+}
+
+// Normalize the filename, in the same way as the datablock package
+func cacheID(filename string) string {
+	if len(filename) > 2 && strings.HasPrefix(filename, "./") {
+		return filename[2:]
+	}
+	return filename
+}
+
+// Return a copy of a cached data block, so that the one in the cache is not
+// changed when it is compressed, decompressed or modified by the caller.
+// Compressed data is only ever replaced, not modified in place.
+func copyBlock(block *datablock.DataBlock, compressionSpeed bool) *datablock.DataBlock {
+	if !block.IsCompressed() {
+		return datablock.NewDataBlock(append([]byte(nil), block.MustData()...), compressionSpeed)
+	}
+	c := *block
+	return &c
+}
+
+// SetAdmission enables or disables the admission policy. When enabled, a full
+// cache only stores a file if it has been requested more often recently than
+// each of the files that would have to be removed to make room for it. This
+// keeps a burst of requests for large or rarely used files from pushing the
+// popular files out of the cache.
+func (cache *fileCache) SetAdmission(enabled bool) {
+	cache.mut.Lock()
+	defer cache.mut.Unlock()
+	if enabled {
+		cache.sketch = &frequencySketch{}
+	} else {
+		cache.sketch = nil
+	}
+}
+
+// Read a file, from the cache if cached is true and the file is there.
+// If cached is true and the file is not in the cache, it is stored in the
+// cache. Cache errors are only logged, since the data can still be returned.
+func (cache *fileCache) Read(filename string, cached bool) (*datablock.DataBlock, error) {
+	id := cacheID(filename)
+	if !cached {
+		data, err := ioutil.ReadFile(id)
+		if err != nil {
+			return nil, err
+		}
+		return datablock.NewDataBlock(data, cache.compressionSpeed), nil
+	}
+
+	cache.mut.Lock()
+	defer cache.mut.Unlock()
+
+	// Keep track of how often the file is requested, for the admission policy
+	if cache.sketch != nil {
+		cache.sketch.increment(id)
+	}
+
+	if f, found := cache.files[id]; found {
+		f.hits++
+		cache.metrics.Hits++
+		return copyBlock(f.block, cache.compressionSpeed), nil
+	}
+	cache.metrics.Misses++
+
+	data, err := ioutil.ReadFile(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := cache.store(id, data); err != nil && err != errNotAdmitted {
+		// Could be that the file is too large
+		log.Debug("Could not cache ", id, ": ", err)
+	}
+	return datablock.NewDataBlock(data, cache.compressionSpeed), nil
+}
+
+// Store data in the cache, making room if needed. The cache must be locked.
+func (cache *fileCache) store(id string, data []byte) error {
+	// The caller gets the same data, so store a copy
+	block := datablock.NewDataBlock(append([]byte(nil), data...), cache.compressionSpeed)
+	if cache.compress {
+		if err := block.Compress(); err != nil {
+			return fmt.Errorf("compression error: %s", err)
+		}
+	}
+	size := uint64(block.Length())
+	if size > cache.size {
+		return datablock.ErrLargerThanCache
+	}
+	if cache.maxEntitySize != 0 && size > cache.maxEntitySize {
+		return datablock.ErrEntityTooLarge
+	}
+
+	if size > cache.free() {
+		// Warn once that the cache is now full
+		if !cache.cacheWarningGiven {
+			log.Warn("Cache is full. You may want to increase the cache size.")
+			cache.cacheWarningGiven = true
+		}
+		victims := cache.victims(size)
+		// With the admission policy, only make room for files that are
+		// more popular than the files that would be removed
+		if cache.sketch != nil && !cache.admit(id, victims) {
+			cache.metrics.Rejected++
+			return errNotAdmitted
+		}
+		for _, victim := range victims {
+			cache.remove(victim)
+			cache.metrics.Evicted++
+		}
+	}
+
+	cache.files[id] = &cachedFile{
+		block:        block,
+		size:         size,
+		originalSize: uint64(len(data)),
+		stored:       time.Now(),
+	}
+	cache.used += size
+	return nil
+}
+
+// Return the free space in the cache. The cache must be locked.
+func (cache *fileCache) free() uint64 {
+	return cache.size - cache.used
+}
+
+// Remove a file from the cache. The cache must be locked.
+func (cache *fileCache) remove(id string) bool {
+	f, found := cache.files[id]
+	if !found {
+		return false
+	}
+	cache.used -= f.size
+	delete(cache.files, id)
+	return true
+}
+
+// For sorting cached files by hits, the least popular first
+type idsByHits struct {
+	ids   []string
+	files map[string]*cachedFile
+}
+
+func (s idsByHits) Len() int      { return len(s.ids) }
+func (s idsByHits) Swap(i, j int) { s.ids[i], s.ids[j] = s.ids[j], s.ids[i] }
+func (s idsByHits) Less(i, j int) bool {
+	a, b := s.files[s.ids[i]], s.files[s.ids[j]]
+	if a.hits != b.hits {
+		return a.hits < b.hits
+	}
+	return s.ids[i] < s.ids[j]
+}
+
+// Find the files that would have to be removed to make room for the given
+// number of bytes, the least popular first. The cache must be locked.
+func (cache *fileCache) victims(size uint64) []string {
+	ids := make([]string, 0, len(cache.files))
+	for id := range cache.files {
+		ids = append(ids, id)
+	}
+	sort.Sort(idsByHits{ids, cache.files})
+	free := cache.free()
+	for i, id := range ids {
+		if free >= size {
+			return ids[:i]
+		}
+		free += cache.files[id].size
+	}
+	return ids
+}
+
+// Check if a file should be stored, if the given files have to be removed to
+// make room for it. The cache must be locked.
+func (cache *fileCache) admit(id string, victims []string) bool {
+	frequency := cache.sketch.estimate(id)
+	for _, victim := range victims {
+		if cache.sketch.estimate(victim) >= frequency {
+			return false
+		}
+	}
+	return true
+}
+
+// Remove a file from the cache, so that it is read from disk the next time.
+// Returns an error if the file is not in the cache.
+func (cache *fileCache) Remove(filename string) error {
+	cache.mut.Lock()
+	defer cache.mut.Unlock()
+	if !cache.remove(cacheID(filename)) {
+		return errNotCached
+	}
+	return nil
+}
+
+// Clear the entire cache
+func (cache *fileCache) Clear() {
+	cache.mut.Lock()
+	defer cache.mut.Unlock()
+	cache.files = make(map[string]*cachedFile)
+	cache.used = 0
+	// Allow one warning if the cache should fill up
+	cache.cacheWarningGiven = false
+}
+
+// Check if the cache is empty
+func (cache *fileCache) IsEmpty() bool {
+	cache.mut.Lock()
+	defer cache.mut.Unlock()
+	return len(cache.files) == 0
+}
+
+// Return the counters for the cache use
+func (cache *fileCache) Metrics() cacheMetrics {
+	cache.mut.Lock()
+	defer cache.mut.Unlock()
+	return cache.metrics
+}
+
+// Return information about the files in the cache, sorted by ID
+func (cache *fileCache) Entries() []cacheEntry {
+	cache.mut.Lock()
+	defer cache.mut.Unlock()
+	entries := make([]cacheEntry, 0, len(cache.files))
+	for id, f := range cache.files {
+		entries = append(entries, cacheEntry{id, f.size, f.originalSize, f.hits, f.stored})
+	}
+	sort.Sort(cacheEntriesByID(entries))
+	return entries
+}
+
+// Return the total size of the cache, the number of bytes in use and the
+// maximum size per file (0 if there is no maximum)
+func (cache *fileCache) Usage() (total, used, maxEntitySize uint64) {
+	cache.mut.Lock()
+	defer cache.mut.Unlock()
+	return cache.size, cache.used, cache.maxEntitySize
+}
+
+// Return formatted cache statistics
+func (cache *fileCache) Stats() string {
+	entries := cache.Entries()
+	total, used, _ := cache.Usage()
+	metrics := cache.Metrics()
+
+	cache.mut.Lock()
+	admission := cache.sketch != nil
+	cache.mut.Unlock()
+
+	var buf bytes.Buffer
+	buf.WriteString("Cache information:\n")
+	fmt.Fprintf(&buf, "\tCompression:\t%s\n", map[bool]string{true: "enabled", false: "disabled"}[cache.compress])
+	fmt.Fprintf(&buf, "\tTotal cache:\t%d bytes\n", total)
+	fmt.Fprintf(&buf, "\tFree cache:\t%d bytes\n", total-used)
+	if len(entries) > 0 {
+		buf.WriteString("\tData in cache:\n")
+		for _, e := range entries {
+			fmt.Fprintf(&buf, "\t\tid=%v\tsize=%d\thits=%d\n", e.ID, e.Size, e.Hits)
+		}
+	}
+	fmt.Fprintf(&buf, "\tAdmission policy:\t%s\n", map[bool]string{true: "TinyLFU", false: "disabled"}[admission])
+	fmt.Fprintf(&buf, "\tHit rate:\t%.1f%% (%d hits, %d misses)\n", metrics.HitRate()*100, metrics.Hits, metrics.Misses)
+	fmt.Fprintf(&buf, "\tEvicted:\t%d\n", metrics.Evicted)
+	fmt.Fprintf(&buf, "\tNot admitted:\t%d\n", metrics.Rejected)
+	return buf.String()
+}
+
+// A count-min sketch that estimates how often a file has been requested
+// recently, as used by TinyLFU. The counters are halved after a number of
+// requests, so that old popularity fades.
+type frequencySketch struct {
+	counters  [sketchDepth][sketchWidth]uint8
+	additions int
+}
+
+// Return the counter positions for an ID, one per row
+func (sketch *frequencySketch) positions(id string) (pos [sketchDepth]uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)
+	for i := range pos {
+		pos[i] = (h1 + uint32(i)*h2) & (sketchWidth - 1)
+	}
+	return pos
+}
+
+// Register a request for an ID
+func (sketch *frequencySketch) increment(id string) {
+	for row, i := range sketch.positions(id) {
+		if sketch.counters[row][i] < 255 {
+			sketch.counters[row][i]++
+		}
+	}
+	sketch.additions++
+	if sketch.additions >= sketchReset {
+		sketch.halve()
+	}
+}
+
+// Estimate the number of recent requests for an ID
+func (sketch *frequencySketch) estimate(id string) uint8 {
+	min := uint8(255)
+	for row, i := range sketch.positions(id) {
+		if sketch.counters[row][i] < min {
+			min = sketch.counters[row][i]
+		}
+	}
+	return min
+}
+
+// Halve all counters
+func (sketch *frequencySketch) halve() {
+	for row := range sketch.counters {
+		for i := range sketch.counters[row] {
+			sketch.counters[row][i] /= 2
+		}
+	}
+	sketch.additions /= 2
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileCacheAdmission(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admission")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	small := filepath.Join(dir, "small.html")
+	large := filepath.Join(dir, "large.bin")
+	ioutil.WriteFile(small, []byte(strings.Repeat("s", 600)), 0644)
+	ioutil.WriteFile(large, []byte(strings.Repeat("l", 800)), 0644)
+
+	cache := newFileCache(1000, false, 0, true)
+	cache.SetAdmission(true)
+	// The small file is popular
+	for i := 0; i < 5; i++ {
+		if _, err := cache.Read(small, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A single request for the large file should not push out the small file
+	block, err := cache.Read(large, true)
+	if err != nil || block.Length() != 800 {
+		t.Fatal("expected the large file to be read from disk")
+	}
+	entries := cache.Entries()
+	if len(entries) != 1 || entries[0].ID != small {
+		t.Errorf("expected only the small file to be cached, got %v", entries)
+	}
+	if m := cache.Metrics(); m.Rejected != 1 || m.Hits != 4 || m.Misses != 2 || m.Evicted != 0 {
+		t.Errorf("unexpected metrics: %+v", m)
+	}
+
+	// Without the admission policy, the large file replaces the small file
+	cache.SetAdmission(false)
+	cache.Read(large, true)
+	if entries := cache.Entries(); len(entries) != 1 || entries[0].ID != large {
+		t.Errorf("expected only the large file to be cached, got %v", entries)
+	}
+	if m := cache.Metrics(); m.Evicted != 1 {
+		t.Errorf("expected one eviction, got %+v", m)
+	}
+}
+
+func TestFileCacheCopies(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		cache := newFileCache(100000, compress, 0, true)
+		cache.Read("README.md", true)
+		block, err := cache.Read("README.md", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Changing the returned block must not change the cached file
+		block.Decompress()
+		data := block.MustData()
+		original := data[0]
+		data[0] = '!'
+		again, _ := cache.Read("README.md", true)
+		if again.MustData()[0] != original {
+			t.Errorf("the cached file was modified through a returned block (compress: %v)", compress)
+		}
+		if again.IsCompressed() != compress {
+			t.Errorf("expected IsCompressed to be %v", compress)
+		}
+	}
+}
+
+func TestFileCacheRemove(t *testing.T) {
+	cache := newFileCache(100000, false, 0, true)
+	if _, err := cache.Read("./README.md", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Remove("README.md"); err != nil {
+		t.Error("expected the file to be removed:", err)
+	}
+	if !cache.IsEmpty() {
+		t.Error("expected the cache to be empty")
+	}
+	if _, used, _ := cache.Usage(); used != 0 {
+		t.Errorf("expected no bytes to be in use, got %d", used)
+	}
+	if cache.Remove("README.md") != errNotCached {
+		t.Error("expected an error when removing a file that is not cached")
+	}
+}
+
+func TestFileCacheEntries(t *testing.T) {
+	cache := newFileCache(100000, true, 0, true)
+	if _, err := cache.Read("README.md", true); err != nil {
+		t.Fatal(err)
+	}
+	cache.Read("README.md", true)
+	entries := cache.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("expected one entry, got %d", len(entries))
+	}
+	e := entries[0]
+	if e.ID != "README.md" || e.Hits != 1 || e.Size >= e.OriginalSize || e.Stored.IsZero() {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+	if total, used, _ := cache.Usage(); total != 100000 || used != e.Size {
+		t.Errorf("unexpected usage: %d of %d bytes", used, total)
+	}
+}
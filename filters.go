@@ -0,0 +1,100 @@
+package main
+
+// Filters that are applied to rendered HTML before it is sent to the client
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/yuin/gopher-lua"
+)
+
+// A filter takes HTML and returns modified HTML
+type htmlFilterFunc func(req *http.Request, htmldata []byte) ([]byte, error)
+
+// A filter that applies to URL paths starting with the given prefix
+type htmlFilter struct {
+	prefix string
+	filter htmlFilterFunc
+}
+
+// Add a filter for rendered HTML, for URL paths that starts with the given prefix
+func (ac *algernonConfig) addHTMLFilter(prefix string, filter htmlFilterFunc) {
+	ac.htmlFiltersMut.Lock()
+	ac.htmlFilters = append(ac.htmlFilters, htmlFilter{prefix, filter})
+	ac.htmlFiltersMut.Unlock()
+}
+
+// Check if there are filters that applies to the given URL path
+func (ac *algernonConfig) hasHTMLFilters(urlpath string) bool {
+	ac.htmlFiltersMut.RLock()
+	defer ac.htmlFiltersMut.RUnlock()
+	for _, f := range ac.htmlFilters {
+		if strings.HasPrefix(urlpath, f.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply the filters that match the requested URL path, in the order they were added.
+// If a filter fails, the error is logged and the HTML from the previous filter is used.
+func (ac *algernonConfig) filterHTML(req *http.Request, htmldata []byte) []byte {
+	ac.htmlFiltersMut.RLock()
+	defer ac.htmlFiltersMut.RUnlock()
+	for _, f := range ac.htmlFilters {
+		if !strings.HasPrefix(req.URL.Path, f.prefix) {
+			continue
+		}
+		filtered, err := f.filter(req, htmldata)
+		if err != nil {
+			log.Error("HTML filter for "+f.prefix+" failed: ", err)
+			continue
+		}
+		htmldata = filtered
+	}
+	return htmldata
+}
+
+// Apply the filters to the body of a recorded response, if it is HTML
+func (ac *algernonConfig) filterRecorder(req *http.Request, recorder *httptest.ResponseRecorder) {
+	contentType := recorder.Header().Get("Content-Type")
+	if contentType != "" && !strings.Contains(contentType, "html") {
+		return
+	}
+	filtered := ac.filterHTML(req, recorder.Body.Bytes())
+	recorder.Body = bytes.NewBuffer(filtered)
+}
+
+// Export functions for adding HTML filters from Lua
+func (ac *algernonConfig) exportFilterFunctions(L *lua.LState) {
+	// Add a filter for rendered HTML from Markdown, Amber, Pongo2 and Lua.
+	// Takes an URL path prefix and a Lua function that is given the HTML and
+	// the URL path, and that returns the modified HTML.
+	L.SetGlobal("AddFilter", L.NewFunction(func(L *lua.LState) int {
+		prefix := L.ToString(1)
+		luaFilterFunc := L.ToFunction(2)
+		ac.addHTMLFilter(prefix, func(req *http.Request, htmldata []byte) ([]byte, error) {
+			// The Lua state is shared with the handlers and authentication providers
+			ac.luahandlermutex.Lock()
+			defer ac.luahandlermutex.Unlock()
+			L.Push(luaFilterFunc)
+			L.Push(lua.LString(string(htmldata)))
+			L.Push(lua.LString(req.URL.Path))
+			if err := L.PCall(2, 1, nil); err != nil {
+				return nil, err
+			}
+			result := L.Get(-1)
+			L.Pop(1)
+			if result.Type() != lua.LTString {
+				return nil, errors.New("the filter function must return a string")
+			}
+			return []byte(result.String()), nil
+		})
+		return 0 // number of results
+	}))
+}
@@ -0,0 +1,546 @@
+package main
+
+// Forms that are declared in the server configuration or at the top of a
+// Markdown page, like contact and feedback forms. Submissions are validated,
+// rate limited, stored in the database and optionally sent by email.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	// The URL path prefix that forms from the server configuration can be
+	// posted to, for pages that are not Markdown pages
+	formsPath = "/_forms/"
+
+	// The prefix of the ID of the List where the submissions of a form are stored
+	formsListPrefix = "form:"
+
+	// The hidden field with the name of the form that is submitted
+	formNameField = "_form"
+
+	// A hidden field that should be left empty. Bots tend to fill it in.
+	formHoneypotField = "_website"
+
+	// The default number of submissions per hour, per form and client
+	defaultFormLimit = 5
+
+	// How often the clients that have not submitted a form for an hour are
+	// forgotten
+	formSweepInterval = 10 * time.Minute
+
+	// The maximum length of a field, in bytes
+	maxFormFieldLength     = 200
+	maxFormTextAreaLength  = 8000
+	formSubmissionsPerPage = 100
+)
+
+// The types of form fields, and if they are rendered as a textarea
+var formFieldTypes = map[string]bool{
+	"text":     false,
+	"email":    false,
+	"url":      false,
+	"number":   false,
+	"tel":      false,
+	"textarea": true,
+}
+
+var formNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// A field in a form
+type formField struct {
+	name     string
+	kind     string
+	required bool
+}
+
+// A form, and what should happen with the submissions
+type form struct {
+	name     string
+	fields   []formField
+	email    string // send the submissions to this address, if set
+	subject  string
+	redirect string // redirect to this URL path after a submission, if set
+	submit   string // the label of the submit button
+	limit    int    // submissions per hour, per client
+}
+
+// A submitted form, as stored in the database
+type formSubmission struct {
+	Time   time.Time         `json:"time"`
+	Client string            `json:"client"`
+	User   string            `json:"user,omitempty"`
+	Fields map[string]string `json:"fields"`
+}
+
+// Parse a comma separated list of fields, on the form "name*:type", where
+// "*" marks a required field and the type is optional. For example:
+// "name*, email*:email, message*:textarea"
+func parseFormFields(spec string) ([]formField, error) {
+	var fields []formField
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		field := formField{kind: "text"}
+		if pos := strings.Index(part, ":"); pos != -1 {
+			field.kind = strings.ToLower(strings.TrimSpace(part[pos+1:]))
+			part = strings.TrimSpace(part[:pos])
+		}
+		if strings.HasSuffix(part, "*") {
+			field.required = true
+			part = strings.TrimSpace(part[:len(part)-1])
+		}
+		field.name = part
+		if !formNameRegexp.MatchString(field.name) || strings.HasPrefix(field.name, "_") {
+			return nil, fmt.Errorf("invalid form field name: %q", field.name)
+		}
+		if _, ok := formFieldTypes[field.kind]; !ok {
+			return nil, fmt.Errorf("unknown form field type: %q", field.kind)
+		}
+		fields = append(fields, field)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("a form must have at least one field")
+	}
+	return fields, nil
+}
+
+// Create a new form, with fields as described by parseFormFields
+func newForm(name, fieldSpec string) (*form, error) {
+	if !formNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid form name: %q", name)
+	}
+	fields, err := parseFormFields(fieldSpec)
+	if err != nil {
+		return nil, err
+	}
+	return &form{name: name, fields: fields, submit: "Send", limit: defaultFormLimit}, nil
+}
+
+// Make a label out of a field name, like "Full name" for "full_name"
+func fieldLabel(name string) string {
+	label := strings.Replace(strings.Replace(name, "_", " ", everyInstance), "-", " ", everyInstance)
+	return strings.ToUpper(label[:1]) + label[1:]
+}
+
+// Add a form that is declared in the server configuration
+func (ac *algernonConfig) addForm(f *form) {
+	ac.formsMut.Lock()
+	ac.forms[f.name] = f
+	ac.formsMut.Unlock()
+}
+
+// Find a form that is declared in the server configuration
+func (ac *algernonConfig) findForm(name string) *form {
+	ac.formsMut.Lock()
+	defer ac.formsMut.Unlock()
+	return ac.forms[name]
+}
+
+// Find the form for a Markdown page. Fields can be declared with "form_fields",
+// or the name of a form from the server configuration can be given with "form".
+// Returns nil if the page has no form.
+func (ac *algernonConfig) markdownForm(given map[string]string) (*form, error) {
+	name := strings.TrimSpace(given["form"])
+	if given["form_fields"] == "" {
+		if name == "" {
+			return nil, nil
+		}
+		if f := ac.findForm(name); f != nil {
+			return f, nil
+		}
+		return nil, fmt.Errorf("no such form: %s", name)
+	}
+	if name == "" {
+		name = "form"
+	}
+	f, err := newForm(name, given["form_fields"])
+	if err != nil {
+		return nil, err
+	}
+	f.email = strings.TrimSpace(given["form_email"])
+	f.redirect = strings.TrimSpace(given["form_redirect"])
+	if submit := strings.TrimSpace(given["form_submit"]); submit != "" {
+		f.submit = submit
+	}
+	return f, nil
+}
+
+// Render a form, with the given hidden field with the CSRF token, which may be
+// empty. The given values and errors are from a submission that did not
+// validate, and may be nil.
+func (f *form) html(action, csrf string, values, errs map[string]string, sent bool) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<section id="form-%s"><style>#form-%s label{display:block;margin-top:0.8em}#form-%s input,#form-%s textarea{width:100%%;box-sizing:border-box}#form-%s textarea{min-height:8em}#form-%s .form-error{color:#c33}#form-%s .form-sent{color:#393}</style>`,
+		f.name, f.name, f.name, f.name, f.name, f.name, f.name)
+	if sent {
+		buf.WriteString(`<p class="form-sent">Thank you, the form has been sent.</p>`)
+	}
+	if msg := errs[""]; msg != "" {
+		fmt.Fprintf(&buf, `<p class="form-error">%s</p>`, html.EscapeString(msg))
+	}
+	fmt.Fprintf(&buf, `<form method="POST" action="%s#form-%s">%s<input type="hidden" name="%s" value="%s">`,
+		html.EscapeString(action), f.name, csrf, formNameField, f.name)
+	fmt.Fprintf(&buf, `<div style="display:none"><input type="text" name="%s" tabindex="-1" autocomplete="off"></div>`, formHoneypotField)
+	for _, field := range f.fields {
+		required := ""
+		marker := ""
+		if field.required {
+			required = " required"
+			marker = " *"
+		}
+		fmt.Fprintf(&buf, `<label for="%s-%s">%s%s</label>`, f.name, field.name, fieldLabel(field.name), marker)
+		value := html.EscapeString(values[field.name])
+		if formFieldTypes[field.kind] {
+			fmt.Fprintf(&buf, `<textarea id="%s-%s" name="%s" maxlength="%d"%s>%s</textarea>`,
+				f.name, field.name, field.name, maxFormTextAreaLength, required, value)
+		} else {
+			fmt.Fprintf(&buf, `<input type="%s" id="%s-%s" name="%s" value="%s" maxlength="%d"%s>`,
+				field.kind, f.name, field.name, field.name, value, maxFormFieldLength, required)
+		}
+		if msg := errs[field.name]; msg != "" {
+			fmt.Fprintf(&buf, `<div class="form-error">%s</div>`, html.EscapeString(msg))
+		}
+	}
+	fmt.Fprintf(&buf, `<p><button type="submit">%s</button></p></form></section>`, html.EscapeString(f.submit))
+	return buf.String()
+}
+
+// Validate the submitted values. Returns the values and a map from field
+// names to error messages, which is empty if the submission is valid.
+func (f *form) validate(req *http.Request) (map[string]string, map[string]string) {
+	values := make(map[string]string)
+	errs := make(map[string]string)
+	for _, field := range f.fields {
+		value := strings.TrimSpace(req.PostFormValue(field.name))
+		values[field.name] = value
+		maxLength := maxFormFieldLength
+		if formFieldTypes[field.kind] {
+			maxLength = maxFormTextAreaLength
+		}
+		switch {
+		case value == "":
+			if field.required {
+				errs[field.name] = "This field is required."
+			}
+		case len(value) > maxLength:
+			errs[field.name] = fmt.Sprintf("This field can be at most %d characters long.", maxLength)
+		case field.kind == "email":
+			if addr, err := mail.ParseAddress(value); err != nil || addr.Address != value {
+				errs[field.name] = "This is not a valid email address."
+			}
+		case field.kind == "url":
+			if u, err := url.Parse(value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs[field.name] = "This is not a valid URL."
+			}
+		case field.kind == "number":
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				errs[field.name] = "This is not a number."
+			}
+		}
+	}
+	return values, errs
+}
+
+// Return the IP address of the client
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// Check if a client may submit a form, and count the submission if so
+func (ac *algernonConfig) allowFormSubmission(f *form, client string) bool {
+	if f.limit <= 0 {
+		return true
+	}
+	key := f.name + " " + client
+	now := time.Now()
+	ac.formsMut.Lock()
+	defer ac.formsMut.Unlock()
+	if now.Sub(ac.formsSwept) > formSweepInterval {
+		sweepFormSubmissions(ac.formSubmissions, now)
+		ac.formsSwept = now
+	}
+	var recent []time.Time
+	for _, t := range ac.formSubmissions[key] {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= f.limit {
+		ac.formSubmissions[key] = recent
+		return false
+	}
+	ac.formSubmissions[key] = append(recent, now)
+	return true
+}
+
+// Forget the clients that have not submitted a form during the last hour
+func sweepFormSubmissions(submissions map[string][]time.Time, now time.Time) {
+	for key, times := range submissions {
+		if len(times) == 0 || now.Sub(times[len(times)-1]) >= time.Hour {
+			delete(submissions, key)
+		}
+	}
+}
+
+// Store a submission in the database
+func (ac *algernonConfig) storeFormSubmission(f *form, submission formSubmission) error {
+	list, err := ac.perm.UserState().Creator().NewList(formsListPrefix + f.name)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(submission)
+	if err != nil {
+		return err
+	}
+	return list.Add(string(data))
+}
+
+// Send a submission by email, with the SMTP server given by --smtp
+func (ac *algernonConfig) mailFormSubmission(f *form, submission formSubmission) error {
+	if ac.smtpURL == "" {
+		return fmt.Errorf("no SMTP server has been configured, use --smtp")
+	}
+	u, err := url.Parse(ac.smtpURL)
+	if err != nil {
+		return err
+	}
+	from := ac.mailFrom
+	if from == "" {
+		from = "algernon@localhost"
+	}
+	subject := f.subject
+	if subject == "" {
+		subject = "Form submission: " + f.name
+	}
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n", from, f.email, subject)
+	for _, field := range f.fields {
+		fmt.Fprintf(&body, "%s: %s\r\n", fieldLabel(field.name), submission.Fields[field.name])
+	}
+	fmt.Fprintf(&body, "\r\nSent from %s at %s\r\n", submission.Client, submission.Time.Format(time.RFC1123))
+	var auth smtp.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		host, _, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			host = u.Host
+		}
+		auth = smtp.PlainAuth("", u.User.Username(), password, host)
+	}
+	return smtp.SendMail(u.Host, auth, from, []string{f.email}, body.Bytes())
+}
+
+// Handle a submitted form. Returns true if the submission was accepted and the
+// client has been redirected, or the values and errors to show in the form.
+func (ac *algernonConfig) submitForm(w http.ResponseWriter, req *http.Request, f *form, page string) (bool, map[string]string, map[string]string) {
+	// The CSRF token is required, also without --csrf
+	if !ac.validCSRF(req) {
+		values, _ := f.validate(req)
+		return false, values, map[string]string{"": "The form has expired, or was sent from another site. Please try again."}
+	}
+	// Bots that fill in the hidden field are told that all went well
+	if req.PostFormValue(formHoneypotField) != "" {
+		http.Redirect(w, req, ac.formRedirect(f, page), http.StatusSeeOther)
+		return true, nil, nil
+	}
+	values, errs := f.validate(req)
+	if len(errs) > 0 {
+		return false, values, errs
+	}
+	client := clientIP(req)
+	if !ac.allowFormSubmission(f, client) {
+		return false, values, map[string]string{"": "Too many submissions, please try again later."}
+	}
+	submission := formSubmission{
+		Time:   time.Now(),
+		Client: client,
+		User:   ac.perm.UserState().Username(req),
+		Fields: values,
+	}
+	if err := ac.storeFormSubmission(f, submission); err != nil {
+		log.Error("Could not store the submission of the ", f.name, " form: ", err)
+		return false, values, map[string]string{"": "The form could not be sent, please try again later."}
+	}
+	if f.email != "" {
+		go func() {
+			if err := ac.mailFormSubmission(f, submission); err != nil {
+				log.Error("Could not send the submission of the ", f.name, " form by email: ", err)
+			}
+		}()
+	}
+	http.Redirect(w, req, ac.formRedirect(f, page), http.StatusSeeOther)
+	return true, nil, nil
+}
+
+// Find the local page that a form was posted from, or "/" if there is none.
+// Paths like "//example.com" or "/\example.com" are not used, since browsers
+// would go to another host when redirected to them.
+func refererPage(req *http.Request) string {
+	referer, err := url.Parse(req.Referer())
+	if err != nil || (referer.Host != "" && referer.Host != req.Host) {
+		return "/"
+	}
+	page := referer.Path
+	if !strings.HasPrefix(page, "/") || strings.HasPrefix(page, "//") || strings.Contains(page, "\\") {
+		return "/"
+	}
+	return page
+}
+
+// Where to go after a form has been submitted
+func (ac *algernonConfig) formRedirect(f *form, page string) string {
+	if f.redirect != "" {
+		return f.redirect
+	}
+	return page + "?sent=" + f.name + "#form-" + f.name
+}
+
+// Render the form of a Markdown page, and handle it if it is submitted.
+// Returns true if the request has been handled.
+func (ac *algernonConfig) markdownFormHTML(w http.ResponseWriter, req *http.Request, f *form) (string, bool) {
+	var values, errs map[string]string
+	if req.Method == "POST" && req.PostFormValue(formNameField) == f.name {
+		var done bool
+		if done, values, errs = ac.submitForm(w, req, f, req.URL.Path); done {
+			return "", true
+		}
+	}
+	// With --csrf, the CSRF field is added to all POST forms
+	csrf := ""
+	if !ac.csrfProtection {
+		ensureCSRFCookie(w, req)
+		csrf = csrfField(ac.csrfToken(req))
+	}
+	return f.html(req.URL.Path, csrf, values, errs, req.URL.Query().Get("sent") == f.name), false
+}
+
+// Handle forms from the server configuration that are posted to /_forms/NAME,
+// and list the submissions as JSON for admins that GET the same URL
+func (ac *algernonConfig) formsHandler(w http.ResponseWriter, req *http.Request) {
+	f := ac.findForm(strings.TrimPrefix(req.URL.Path, formsPath))
+	if f == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, noPage(req.URL.Path, ac.defaultTheme))
+		return
+	}
+	switch req.Method {
+	case "GET":
+		ac.listFormSubmissions(w, req, f)
+	case "POST":
+		// Go back to the page with the form, if possible
+		page := refererPage(req)
+		done, _, errs := ac.submitForm(w, req, f, page)
+		if done {
+			return
+		}
+		var msgs []string
+		for name, msg := range errs {
+			if name != "" {
+				msg = fieldLabel(name) + ": " + msg
+			}
+			msgs = append(msgs, html.EscapeString(msg))
+		}
+		sort.Strings(msgs)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, messagePage("Invalid form", "<p>"+strings.Join(msgs, "<br>")+"</p>", ac.defaultTheme))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// List the latest submissions of a form as JSON, for admins
+func (ac *algernonConfig) listFormSubmissions(w http.ResponseWriter, req *http.Request, f *form) {
+	userstate := ac.perm.UserState()
+	username := userstate.Username(req)
+	if username == "" || !userstate.IsLoggedIn(username) || !userstate.IsAdmin(username) {
+		http.Error(w, "Only admins can list the submissions", http.StatusForbidden)
+		return
+	}
+	list, err := userstate.Creator().NewList(formsListPrefix + f.name)
+	if err != nil {
+		http.Error(w, "Could not read the submissions", http.StatusInternalServerError)
+		return
+	}
+	// GetLastN fails if there are fewer elements than asked for
+	all, err := list.GetAll()
+	if err != nil {
+		all = []string{}
+	}
+	if len(all) > formSubmissionsPerPage {
+		all = all[len(all)-formSubmissionsPerPage:]
+	}
+	submissions := make([]json.RawMessage, len(all))
+	for i, data := range all {
+		submissions[i] = json.RawMessage(data)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(submissions)
+}
+
+// Export the server configuration function for declaring forms
+func (ac *algernonConfig) exportFormFunction(L *lua.LState) {
+
+	// Declare a form. Takes a name, the fields as a comma separated string or
+	// a table of strings (see parseFormFields) and an optional table with
+	// "email", "subject", "redirect", "submit" and "limit".
+	// Returns true if the form could be declared.
+	L.SetGlobal("Form", L.NewFunction(func(L *lua.LState) int {
+		name := L.ToString(1)
+		var spec string
+		switch v := L.Get(2).(type) {
+		case *lua.LTable:
+			var specs []string
+			v.ForEach(func(_, value lua.LValue) {
+				specs = append(specs, value.String())
+			})
+			spec = strings.Join(specs, ",")
+		default:
+			spec = L.ToString(2)
+		}
+		f, err := newForm(name, spec)
+		if err != nil {
+			log.Error(err)
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		if options, ok := L.Get(3).(*lua.LTable); ok {
+			f.email = lua.LVAsString(options.RawGetString("email"))
+			f.subject = lua.LVAsString(options.RawGetString("subject"))
+			f.redirect = lua.LVAsString(options.RawGetString("redirect"))
+			if submit := lua.LVAsString(options.RawGetString("submit")); submit != "" {
+				f.submit = submit
+			}
+			if limit, ok := options.RawGetString("limit").(lua.LNumber); ok {
+				f.limit = int(limit)
+			}
+		}
+		ac.addForm(f)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSweepFormSubmissions(t *testing.T) {
+	now := time.Now()
+	submissions := map[string][]time.Time{
+		"contact 10.0.0.1": {now.Add(-2 * time.Hour), now.Add(-90 * time.Minute)},
+		"contact 10.0.0.2": {now.Add(-2 * time.Hour), now.Add(-time.Minute)},
+		"contact 10.0.0.3": {},
+	}
+	sweepFormSubmissions(submissions, now)
+	if len(submissions) != 1 || submissions["contact 10.0.0.2"] == nil {
+		t.Errorf("expected only the recent client to be kept, got %v", submissions)
+	}
+}
+
+func TestFormCSRF(t *testing.T) {
+	ac := newAlgernonConfig()
+	f, err := newForm("contact", "name*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/contact.md", strings.NewReader(formNameField+"=contact&name=Bob"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	done, values, errs := ac.submitForm(httptest.NewRecorder(), req, f, "/contact.md")
+	if done || errs[""] == "" || values["name"] != "Bob" {
+		t.Errorf("expected the submission without a CSRF token to be rejected, got %v", errs)
+	}
+
+	// The rendered form has the CSRF field
+	req = httptest.NewRequest("GET", "/contact.md", nil)
+	if formHTML, _ := ac.markdownFormHTML(httptest.NewRecorder(), req, f); !strings.Contains(formHTML, csrfFieldName) {
+		t.Errorf("expected a CSRF field in the form, got %s", formHTML)
+	}
+}
+
+func TestRefererPage(t *testing.T) {
+	for referer, expected := range map[string]string{
+		"":                              "/",
+		"http://example.com/contact":    "/contact",
+		"/contact":                      "/contact",
+		"http://evil.com/contact":       "/",
+		"http://example.com//evil.com":  "/",
+		"http://example.com/\\evil.com": "/",
+		"//evil.com/contact":            "/",
+		"contact":                       "/",
+	} {
+		req := httptest.NewRequest("POST", "http://example.com/_forms/contact", nil)
+		req.Header.Set("Referer", referer)
+		if page := refererPage(req); page != expected {
+			t.Errorf("expected %q for the referer %q, got %q", expected, referer, page)
+		}
+	}
+}
@@ -120,6 +120,10 @@ func (ac *algernonConfig) readAndLogErrors(w http.ResponseWriter, filename, ext
 
 // When serving a file. The file must exist. Must be given a full filename.
 func (ac *algernonConfig) filePage(w http.ResponseWriter, req *http.Request, filename, dataFilename string) {
+	// Remove the files in this directory that have changed from the cache, first
+	if ac.changes != nil {
+		ac.changes.settle(filepath.Dir(filename))
+	}
 
 	if ac.quitAfterFirstRequest {
 		go ac.quitSoon("Quit after first request", defaultSoonDuration)
@@ -140,17 +144,28 @@ func (ac *algernonConfig) filePage(w http.ResponseWriter, req *http.Request, fil
 			return
 		}
 
-		// If the auto-refresh feature has been enabled
-		if ac.autoRefreshMode {
+		// If the auto-refresh feature, the service worker or CSRF tokens have been enabled
+		if ac.autoRefreshMode || ac.pwa || ac.csrfProtection {
 			// Get the bytes from the datablock
 			htmldata := htmlblock.MustData()
-			// Insert JavaScript for refreshing the page, into the HTML
-			htmldata = ac.insertAutoRefresh(req, htmldata)
+			if ac.pwa {
+				// Insert the tags for registering the service worker
+				htmldata = insertPWATags(htmldata)
+			}
+			if ac.autoRefreshMode {
+				// Insert JavaScript for refreshing the page, into the HTML
+				htmldata = ac.insertAutoRefresh(req, htmldata)
+			}
+			if ac.csrfProtection {
+				// Insert the CSRF token in the POST forms
+				htmldata, _ = ac.csrfFilter(req, htmldata)
+			}
 			// Write the data to the client
 			dataToClient(w, req, filename, htmldata)
 		} else {
 			// Serve the file
-			htmlblock.ToClient(w, req, filename, clientCanGzip(req), gzipThreshold)
+			threshold, _ := gzipSettings(req)
+			htmlblock.ToClient(w, req, filename, clientCanGzip(req), threshold)
 		}
 
 		return
@@ -261,6 +276,7 @@ func (ac *algernonConfig) filePage(w http.ResponseWriter, req *http.Request, fil
 			// Run the lua script, without the possibility to flush
 			if err := ac.runLua(recorder, req, filename, flushFunc, httpStatus); err != nil {
 				errortext := err.Error()
+				traceError(req, "%s: %s", filename, errortext)
 				fileblock, err := ac.cache.Read(filename, ac.shouldCache(ext))
 				if err != nil {
 					// If the file could not be read, use the error message as the data
@@ -276,9 +292,31 @@ func (ac *algernonConfig) filePage(w http.ResponseWriter, req *http.Request, fil
 				if httpStatus.code != 0 {
 					w.WriteHeader(httpStatus.code)
 				}
+				// Apply the HTML filters for this URL path, if any
+				ac.filterRecorder(req, recorder)
 				// Then write to the ResponseWriter
 				writeRecorder(w, recorder)
 			}
+		} else if ac.hasHTMLFilters(req.URL.Path) {
+			// Record the output, so that the HTML filters can be applied
+			recorder := httptest.NewRecorder()
+			httpStatus := &FutureStatus{}
+			// Flushing is not possible when the output is filtered
+			flushFunc := func() {}
+			if err := ac.runLua(recorder, req, filename, flushFunc, httpStatus); err != nil {
+				// Output the non-fatal error message to the log
+				log.Error("Error in ", filename+":", err)
+				traceError(req, "%s: %s", filename, err)
+			}
+			ac.filterRecorder(req, recorder)
+			// Write the headers, the status code and then the filtered body
+			for key, values := range recorder.Header() {
+				w.Header()[key] = values
+			}
+			if httpStatus.code != 0 {
+				w.WriteHeader(httpStatus.code)
+			}
+			recorder.Body.WriteTo(w)
 		} else {
 			// The flush function just flushes the ResponseWriter
 			flushFunc := func() {
@@ -288,6 +326,7 @@ func (ac *algernonConfig) filePage(w http.ResponseWriter, req *http.Request, fil
 			if err := ac.runLua(w, req, filename, flushFunc, nil); err != nil {
 				// Output the non-fatal error message to the log
 				log.Error("Error in ", filename+":", err)
+				traceError(req, "%s: %s", filename, err)
 			}
 		}
 
@@ -304,17 +343,37 @@ func (ac *algernonConfig) filePage(w http.ResponseWriter, req *http.Request, fil
 	// movies, music, source code etc. Wrap videos in the right html tags for playback, etc.
 	// This should be placed in a separate Go module.
 
+	// Stream audio and video files from disk, with support for range requests
+	if mediaKind(filename) != "" {
+		ac.serveMedia(w, req, filename)
+		return
+	}
+
+	// Serve a JPEG preview of HEIC and RAW images, if asked for
+	if _, ok := req.URL.Query()[imagePreviewParameter]; ok && hasPreview(filename) {
+		ac.servePreview(w, req, filename)
+		return
+	}
+
 	// Set the correct Content-Type
-	if mimereader != nil {
-		mimereader.SetHeader(w, ext)
-	} else {
-		log.Error("Uninitialized mimereader!")
+	setContentType(w, ext)
+
+	// Select an image variant that suits the client hints, if enabled
+	if ac.clientHints && isImageExtension(ext) {
+		w.Header().Add("Vary", varyClientHints)
+		filename = imageVariant(req, filename)
+	}
+
+	// Serve the compressed file that is next to the file, if there is one and --precompressed is given
+	if ac.servePrecompressed(w, req, filename) {
+		return
 	}
 
 	// Read the file (possibly in compressed format, straight from the cache)
 	if dataBlock, err := ac.readAndLogErrors(w, filename, ext); err == nil {
 		// Serve the file
-		dataBlock.ToClient(w, req, filename, clientCanGzip(req), gzipThreshold)
+		threshold, _ := gzipSettings(req)
+		dataBlock.ToClient(w, req, filename, clientCanGzip(req), threshold)
 	}
 
 }
@@ -333,6 +392,9 @@ func (ac *algernonConfig) serverHeaders(w http.ResponseWriter) {
 		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
 		w.Header().Set("Content-Security-Policy", "connect-src 'self'; object-src 'self'; form-action 'self'")
 	}
+	if ac.clientHints {
+		w.Header().Set("Accept-CH", acceptClientHints)
+	}
 }
 
 // When a file is not found
@@ -355,6 +417,18 @@ func getDomain(req *http.Request) string {
 	return req.Host
 }
 
+// Register a handler function for the given path, with rate limiting unless it has been disabled
+func (ac *algernonConfig) limitedHandle(mux *http.ServeMux, handlePath string, handleFunc http.HandlerFunc) {
+	if ac.disableRateLimiting {
+		mux.HandleFunc(handlePath, handleFunc)
+		return
+	}
+	limiter := tollbooth.NewLimiter(ac.limitRequests, time.Second)
+	limiter.MessageContentType = "text/html; charset=utf-8"
+	limiter.Message = messagePage("Rate-limit exceeded", "<div style='color:red'>You have reached the maximum request limit.</div>", ac.defaultTheme)
+	mux.Handle(handlePath, tollbooth.LimitFuncHandler(limiter, handleFunc))
+}
+
 // Serve all files in the current directory, or only a few select filetypes (html, css, js, png and txt)
 func (ac *algernonConfig) registerHandlers(mux *http.ServeMux, handlePath, servedir string, addDomain bool) {
 
@@ -363,7 +437,10 @@ func (ac *algernonConfig) registerHandlers(mux *http.ServeMux, handlePath, serve
 		// Rejecting requests is handled by the permission system, which
 		// in turn requires a database backend.
 		if ac.perm != nil {
-			if ac.perm.Rejected(w, req) {
+			// Let the authentication providers log in the user first
+			ac.authenticate(w, req)
+			if ac.permissionRejected(w, req) {
+				tracef(req, "Rejected by the permission system")
 				// Get and call the Permission Denied function
 				ac.perm.DenyFunction()(w, req)
 				// Reject the request by returning
@@ -395,27 +472,52 @@ func (ac *algernonConfig) registerHandlers(mux *http.ServeMux, handlePath, serve
 			ac.serverHeaders(w)
 		}
 
+		// The directory configuration files are never served
+		if filepath.Base(noslash) == overlayFilename {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, noPage(filename, ac.defaultTheme))
+			return
+		}
+
+		// Apply the settings from the .algernon.toml files for this directory
+		overlayDir := filepath.Dir(noslash)
+		if hasdir {
+			overlayDir = dirname
+		}
+		theme := ac.defaultTheme
+		if o := ac.overlayFor(overlayDir); o != nil {
+			if !ac.applyOverlay(w, req, o) {
+				return
+			}
+			if o.theme != "" {
+				theme = o.theme
+			}
+		}
+
+		// Select a language variant of the requested file, like "page.de.md" for "page.md"
+		if ac.languageVariants && !hasdir {
+			if variant, found := selectLanguage(w, req, noslash); found {
+				noslash = variant
+				hasfile = true
+			}
+		}
+
 		// Share the directory or file
 		if hasdir {
-			ac.dirPage(w, req, servedir, dirname, ac.defaultTheme)
+			tracef(req, "Serving the directory %s", dirname)
+			ac.dirPage(w, req, servedir, dirname, theme)
 			return
 		} else if !hasdir && hasfile {
 			// Share a single file instead of a directory
+			tracef(req, "Serving the file %s", noslash)
 			ac.filePage(w, req, noslash, ac.defaultLuaDataFilename)
 			return
 		}
 		// Not found
+		tracef(req, "Not found: %s", filename)
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprint(w, noPage(filename, ac.defaultTheme))
 	}
 
-	// Handle requests differently depending on if rate limiting is enabled or not
-	if ac.disableRateLimiting {
-		mux.HandleFunc(handlePath, allRequests)
-	} else {
-		limiter := tollbooth.NewLimiter(ac.limitRequests, time.Second)
-		limiter.MessageContentType = "text/html; charset=utf-8"
-		limiter.Message = messagePage("Rate-limit exceeded", "<div style='color:red'>You have reached the maximum request limit.</div>", ac.defaultTheme)
-		mux.Handle(handlePath, tollbooth.LimitFuncHandler(limiter, allRequests))
-	}
+	ac.limitedHandle(mux, handlePath, allRequests)
 }
@@ -0,0 +1,236 @@
+package main
+
+// Icons and thumbnails for directory listings, as data URIs
+
+import (
+	"bytes"
+	"encoding/base64"
+	img "image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	// Image decoders for the thumbnails
+	_ "image/gif"
+	_ "image/jpeg"
+)
+
+const (
+	// The width and height of thumbnails, in pixels
+	thumbnailSize = 64
+
+	// Images larger than this are not thumbnailed
+	maxThumbnailSourceSize = 16 * MiB
+
+	// Images with more pixels than this are not thumbnailed
+	maxThumbnailSourcePixels = 50 * 1000 * 1000
+
+	// The maximum number of thumbnails to keep in memory
+	maxThumbnails = 1024
+)
+
+// A file icon, with a glyph for the file type drawn on top
+const fileIconSVG = `<svg xmlns="http://www.w3.org/2000/svg" width="16" height="16" viewBox="0 0 16 16"><path d="M3 1h7l3 3v11H3z" fill="#fff" stroke="#888"/><path d="M10 1v3h3" fill="none" stroke="#888"/>%s</svg>`
+
+var (
+	// Glyphs for the file icons, by type
+	iconGlyphs = map[string]string{
+		"file":    ``,
+		"text":    `<path d="M5 7h6M5 9h6M5 11h4" stroke="#888"/>`,
+		"code":    `<path d="M7 7l-2 2 2 2M9 7l2 2-2 2" fill="none" stroke="#3a7bd5"/>`,
+		"image":   `<path d="M4 13l3-4 2 2 1.5-1.5L12 13z" fill="#4caf50"/><circle cx="10" cy="7" r="1" fill="#f5a623"/>`,
+		"audio":   `<path d="M9 6v5.5a1.5 1.5 0 1 1-1-1.4V6l3-1v1.5z" fill="#9c27b0"/>`,
+		"video":   `<path d="M6 7v5l4-2.5z" fill="#e53935"/>`,
+		"archive": `<path d="M7 2h1v1H7zM8 3h1v1H8zM7 4h1v1H7zM8 5h1v1H8zM7 6h2v3H7z" fill="#795548"/>`,
+	}
+
+	// Folder icon
+	folderIconSVG = `<svg xmlns="http://www.w3.org/2000/svg" width="16" height="16" viewBox="0 0 16 16"><path d="M1 3h5l1 2h8v9H1z" fill="#e8b04a" stroke="#b8862a"/></svg>`
+
+	// File types, by extension
+	iconTypes = map[string]string{
+		".txt": "text", ".md": "text", ".markdown": "text", ".csv": "text", ".log": "text",
+		".html": "code", ".htm": "code", ".css": "code", ".js": "code", ".json": "code", ".lua": "code",
+		".go": "code", ".py": "code", ".c": "code", ".h": "code", ".sh": "code", ".xml": "code",
+		".amber": "code", ".gcss": "code", ".scss": "code", ".jsx": "code", ".po2": "code", ".pongo2": "code", ".tmpl": "code",
+		".heic": "image", ".heif": "image", ".dng": "image", ".cr2": "image", ".nef": "image", ".arw": "image",
+		".png": "image", ".jpg": "image", ".jpeg": "image", ".gif": "image", ".svg": "image", ".webp": "image", ".ico": "image", ".avif": "image",
+		".mp3": "audio", ".ogg": "audio", ".opus": "audio", ".wav": "audio", ".flac": "audio", ".m4a": "audio",
+		".mp4": "video", ".webm": "video", ".mkv": "video", ".mov": "video", ".avi": "video",
+		".zip": "archive", ".alg": "archive", ".gz": "archive", ".tgz": "archive", ".bz2": "archive", ".xz": "archive", ".7z": "archive", ".rar": "archive", ".tar": "archive",
+	}
+
+	// Data URIs for the icons, by type
+	iconURIs = make(map[string]string)
+
+	// Cached thumbnails, by filename
+	thumbnails   = make(map[string]thumbnail)
+	thumbnailMut sync.Mutex
+)
+
+// A thumbnail as a data URI, and the modification time of the image
+type thumbnail struct {
+	uri     string
+	modTime time.Time
+}
+
+func init() {
+	for name, glyph := range iconGlyphs {
+		iconURIs[name] = svgDataURI(strings.Replace(fileIconSVG, "%s", glyph, 1))
+	}
+	iconURIs["folder"] = svgDataURI(folderIconSVG)
+}
+
+// Encode an SVG image as a data URI
+func svgDataURI(svg string) string {
+	return "data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString([]byte(svg))
+}
+
+// Return the icon for a file or directory, as a data URI
+func iconURI(filename string, isDir bool) string {
+	if isDir {
+		return iconURIs["folder"]
+	}
+	if iconType, ok := iconTypes[strings.ToLower(filepath.Ext(filename))]; ok {
+		return iconURIs[iconType]
+	}
+	return iconURIs["file"]
+}
+
+// Scale an image down so that it fits within size x size pixels.
+// Each pixel in the thumbnail is the average of the pixels it covers.
+func scaleDown(src img.Image, size int) img.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return src
+	}
+	tw, th := size, size
+	if w > h {
+		th = h * size / w
+	} else {
+		tw = w * size / h
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+	if tw >= w && th >= h {
+		return src
+	}
+	dst := img.NewRGBA(img.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := b.Min.Y+y*h/th, b.Min.Y+(y+1)*h/th
+		for x := 0; x < tw; x++ {
+			x0, x1 := b.Min.X+x*w/tw, b.Min.X+(x+1)*w/tw
+			var r, g, bl, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+cr, g+cg, bl+cb, a+ca
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(bl / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
+
+// Return a thumbnail of the given image as a data URI, or an empty string
+// if no thumbnail could be made. Thumbnails are cached until the image changes.
+func thumbnailURI(filename string) string {
+	isPreviewed := hasPreview(filename)
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".png", ".jpg", ".jpeg", ".gif":
+	default:
+		if !isPreviewed {
+			return ""
+		}
+	}
+	fi, err := os.Stat(filename)
+	if err != nil || (fi.Size() > maxThumbnailSourceSize && !isPreviewed) {
+		return ""
+	}
+	thumbnailMut.Lock()
+	cached, ok := thumbnails[filename]
+	thumbnailMut.Unlock()
+	if ok && cached.modTime.Equal(fi.ModTime()) {
+		return cached.uri
+	}
+	var f io.ReadSeeker
+	if isPreviewed {
+		// Make the thumbnail from the JPEG preview of HEIC and RAW images
+		data, err := previewJPEG(filename)
+		if err != nil {
+			return ""
+		}
+		f = bytes.NewReader(data)
+	} else {
+		file, err := os.Open(filename)
+		if err != nil {
+			return ""
+		}
+		defer file.Close()
+		f = file
+	}
+	// Check the dimensions before decoding the entire image
+	config, _, err := img.DecodeConfig(f)
+	if err != nil || config.Width*config.Height > maxThumbnailSourcePixels {
+		return ""
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return ""
+	}
+	src, _, err := img.Decode(f)
+	if err != nil {
+		return ""
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, scaleDown(src, thumbnailSize)); err != nil {
+		return ""
+	}
+	uri := "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+	thumbnailMut.Lock()
+	if len(thumbnails) >= maxThumbnails {
+		// Start over instead of keeping track of which thumbnails are used the least
+		thumbnails = make(map[string]thumbnail)
+	}
+	thumbnails[filename] = thumbnail{uri, fi.ModTime()}
+	thumbnailMut.Unlock()
+	return uri
+}
+
+// Return a link to a file or directory, with an icon or a thumbnail.
+// Audio and video files are linked to a player page if withPlayer is true.
+func htmlIconLink(text, url, filename string, isDirectory, withThumbnail, withPlayer bool) string {
+	icon := `<img src="` + iconURI(filename, isDirectory) + `" width="16" height="16" alt="" style="vertical-align:middle"> `
+	if withThumbnail && !isDirectory {
+		if uri := thumbnailURI(filename); uri != "" {
+			icon = `<img src="` + uri + `" alt="" style="vertical-align:middle"> `
+		}
+	}
+	if isDirectory {
+		text += "/"
+		url += "/"
+	} else if hasPreview(filename) {
+		// Link to a JPEG preview, since browsers can not show HEIC and RAW images
+		url += "?" + imagePreviewParameter
+	} else if withPlayer && mediaKind(filename) != "" {
+		url += "?" + playParameter
+	}
+	return "<div>" + icon + "<a href=\"/" + url + "\">" + text + "</a></div>"
+}
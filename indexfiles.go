@@ -0,0 +1,82 @@
+package main
+
+// Configurable index files, for choosing which file is served for a directory
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// Return the index filenames for the given directory, in order of priority.
+// The index files from .algernon.toml files are used first, then the
+// configuration for the closest parent directory is used, if there is no
+// configuration for the directory itself.
+func (ac *algernonConfig) indexFilesFor(dirname string) []string {
+	if o := ac.overlayFor(dirname); o != nil && o.index != nil {
+		return o.index
+	}
+	if len(ac.dirIndexFilenames) > 0 {
+		if rel, err := filepath.Rel(ac.serverDirOrFilename, dirname); err == nil && !strings.HasPrefix(rel, "..") {
+			for dir := filepath.ToSlash(rel); ; dir = filepath.ToSlash(filepath.Dir(dir)) {
+				if filenames, ok := ac.dirIndexFilenames[dir]; ok {
+					return filenames
+				}
+				if dir == "." || dir == "/" {
+					break
+				}
+			}
+		}
+	}
+	if ac.indexFilenames != nil {
+		return ac.indexFilenames
+	}
+	return indexFilenames
+}
+
+// Set the index filenames for a directory, relative to the server directory.
+// If the directory is blank, the index filenames are used for all directories.
+func (ac *algernonConfig) setIndexFiles(dir string, filenames []string) {
+	if dir == "" {
+		ac.indexFilenames = filenames
+		return
+	}
+	if ac.dirIndexFilenames == nil {
+		ac.dirIndexFilenames = make(map[string][]string)
+	}
+	ac.dirIndexFilenames[filepath.ToSlash(filepath.Clean(strings.TrimPrefix(dir, "/")))] = filenames
+}
+
+// Export the server configuration function for setting the index files
+func (ac *algernonConfig) exportIndexFilesFunction(L *lua.LState) {
+
+	// Set the index filenames, in order of priority. Takes an optional
+	// directory, relative to the server directory, and a table or comma
+	// separated string of filenames. For example:
+	// IndexFiles({"index.html", "index.lua"}) or IndexFiles("docs", "README.md")
+	L.SetGlobal("IndexFiles", L.NewFunction(func(L *lua.LState) int {
+		var dir string
+		arg := L.Get(1)
+		if L.GetTop() > 1 {
+			dir = L.ToString(1)
+			arg = L.Get(2)
+		}
+		// An empty list means that directory listings are always shown
+		filenames := []string{}
+		switch v := arg.(type) {
+		case *lua.LTable:
+			v.ForEach(func(_, value lua.LValue) {
+				filenames = append(filenames, value.String())
+			})
+		default:
+			for _, filename := range strings.Split(lua.LVAsString(arg), ",") {
+				if filename = strings.TrimSpace(filename); filename != "" {
+					filenames = append(filenames, filename)
+				}
+			}
+		}
+		ac.setIndexFiles(dir, filenames)
+		return 0 // number of results
+	}))
+}
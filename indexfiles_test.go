@@ -0,0 +1,19 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIndexFilesFor(t *testing.T) {
+	ac := newAlgernonConfig()
+	ac.serverDirOrFilename = "/srv/site"
+	ac.setIndexFiles("", []string{"index.html", "index.lua"})
+	ac.setIndexFiles("/docs", []string{"README.md"})
+	if files := ac.indexFilesFor("/srv/site/blog"); strings.Join(files, ",") != "index.html,index.lua" {
+		t.Errorf("unexpected index files for /blog: %v", files)
+	}
+	if files := ac.indexFilesFor("/srv/site/docs/api/"); strings.Join(files, ",") != "README.md" {
+		t.Errorf("unexpected index files for /docs/api: %v", files)
+	}
+}
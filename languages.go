@@ -0,0 +1,220 @@
+package main
+
+// Language variants of files, like "index.de.md" for "index.md", selected
+// by the Accept-Language header or by a cookie
+
+import (
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// The cookie and URL parameter that overrides the Accept-Language header
+const languageCookieName = "lang"
+
+var (
+	// Language tags, like "en" or "pt-BR"
+	languageTagPattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+	// The subtags that may follow the language in the filename of a language
+	// variant: a script, like "-hant", and a region, like "-br" or "-419"
+	variantSubtagsPattern = regexp.MustCompile(`^(-[a-z]{4})?(-([a-z]{2}|[0-9]{3}))?$`)
+
+	// The two letter ISO 639-1 language codes
+	languageCodes = make(map[string]bool)
+)
+
+func init() {
+	for _, code := range strings.Fields(`aa ab ae af ak am an ar as av ay az ba be bg bh bi bm bn bo br bs ca
+ce ch co cr cs cu cv cy da de dv dz ee el en eo es et eu fa ff fi fj fo fr fy ga gd gl gn gu gv ha he
+hi ho hr ht hu hy hz ia id ie ig ii ik io is it iu ja jv ka kg ki kj kk kl km kn ko kr ks ku kv kw ky
+la lb lg li ln lo lt lu lv mg mh mi mk ml mn mr ms mt my na nb nd ne ng nl nn no nr nv ny oc oj om or
+os pa pi pl ps pt qu rm rn ro ru rw sa sc sd se sg si sk sl sm sn so sq sr ss st su sv sw ta te tg th
+ti tk tl tn to tr ts tt tw ty ug uk ur uz ve vi vo wa wo xh yi yo za zh zu`) {
+		languageCodes[code] = true
+	}
+}
+
+// Check if the part of a filename between the name and the extension is a
+// language tag, like "de" in "index.de.md". Only ISO 639-1 languages are
+// recognized, so that names like "jquery.min.js" are not taken as variants.
+func variantLanguage(tag string) bool {
+	tag = strings.ToLower(tag)
+	if len(tag) < 2 || !languageCodes[tag[:2]] {
+		return false
+	}
+	return variantSubtagsPattern.MatchString(tag[2:])
+}
+
+// A language from the Accept-Language header, with its quality value
+type weightedLanguage struct {
+	tag     string
+	quality float64
+}
+
+// For sorting languages by quality, the preferred language first
+type weightedLanguages []weightedLanguage
+
+func (w weightedLanguages) Len() int {
+	return len(w)
+}
+
+func (w weightedLanguages) Less(i, j int) bool {
+	return w[i].quality > w[j].quality
+}
+
+func (w weightedLanguages) Swap(i, j int) {
+	w[i], w[j] = w[j], w[i]
+}
+
+// Parse an Accept-Language header, like "de-CH, de;q=0.9, en;q=0.8",
+// and return the languages in lowercase, sorted by preference.
+// A language with a region is followed by the language without it.
+func parseAcceptLanguage(header string) []string {
+	var weighted weightedLanguages
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if !languageTagPattern.MatchString(tag) {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			weighted = append(weighted, weightedLanguage{tag, quality})
+		}
+	}
+	sort.Stable(weighted)
+	var languages []string
+	found := make(map[string]bool)
+	add := func(tag string) {
+		if !found[tag] {
+			found[tag] = true
+			languages = append(languages, tag)
+		}
+	}
+	for _, w := range weighted {
+		add(w.tag)
+		if pos := strings.Index(w.tag, "-"); pos != -1 {
+			add(w.tag[:pos])
+		}
+	}
+	return languages
+}
+
+// Return the preferred languages for a request. The "lang" URL parameter or
+// cookie comes first, then the languages from the Accept-Language header.
+func preferredLanguages(req *http.Request) []string {
+	var languages []string
+	override := req.URL.Query().Get(languageCookieName)
+	if override == "" {
+		if cookie, err := req.Cookie(languageCookieName); err == nil {
+			override = cookie.Value
+		}
+	}
+	if languageTagPattern.MatchString(override) {
+		languages = append(languages, strings.ToLower(override))
+	}
+	for _, language := range parseAcceptLanguage(req.Header.Get("Accept-Language")) {
+		if len(languages) == 0 || language != languages[0] {
+			languages = append(languages, language)
+		}
+	}
+	return languages
+}
+
+// Return the language variants of a file, like "index.de.md" for "index.md",
+// by lowercase language tag
+func languageVariants(filename string) map[string]string {
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	variants := make(map[string]string)
+	matches, err := filepath.Glob(base + ".*" + ext)
+	if err != nil {
+		return variants
+	}
+	for _, match := range matches {
+		language := strings.TrimSuffix(strings.TrimPrefix(match, base+"."), ext)
+		if variantLanguage(language) {
+			variants[strings.ToLower(language)] = match
+		}
+	}
+	return variants
+}
+
+// Find the language variant of a file that suits the request best. If there
+// is no variant for the preferred languages, the file itself is used if it
+// exists, or else the first variant in alphabetical order. Returns the
+// filename, the language, or an empty language if the file itself is used,
+// and true if the file has language variants.
+func languageVariant(req *http.Request, filename string) (string, string, bool) {
+	variants := languageVariants(filename)
+	if len(variants) == 0 {
+		return filename, "", false
+	}
+	for _, language := range preferredLanguages(req) {
+		if variant, found := variants[language]; found {
+			return variant, language, true
+		}
+	}
+	if fs.Exists(filename) {
+		return filename, "", true
+	}
+	languages := make([]string, 0, len(variants))
+	for language := range variants {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	return variants[languages[0]], languages[0], true
+}
+
+// Select the language variant of a file, set the headers for the response
+// and remember the language if it was given as an URL parameter.
+// Returns the filename that should be served and true, or false if neither
+// the file nor any of its language variants exists.
+func selectLanguage(w http.ResponseWriter, req *http.Request, filename string) (string, bool) {
+	variant, language, hasVariants := languageVariant(req, filename)
+	if !fs.Exists(variant) {
+		return filename, false
+	}
+	if !hasVariants {
+		return variant, true
+	}
+
+	// The response depends on the language preferences of the client
+	w.Header().Add("Vary", "Accept-Language, Cookie")
+	if language != "" {
+		w.Header().Set("Content-Language", language)
+	}
+	if override := req.URL.Query().Get(languageCookieName); languageTagPattern.MatchString(override) {
+		http.SetCookie(w, &http.Cookie{Name: languageCookieName, Value: override, Path: "/", MaxAge: 365 * 24 * 60 * 60})
+	}
+	return variant, true
+}
+
+// Make the preferred languages for the current request available to Lua
+func exportLanguages(L *lua.LState, req *http.Request) {
+
+	// Return the preferred languages of the client, as a table of lowercase
+	// language tags, like {"de-ch", "de", "en"}
+	L.SetGlobal("languages", L.NewFunction(func(L *lua.LState) int {
+		table := L.NewTable()
+		for _, language := range preferredLanguages(req) {
+			table.Append(lua.LString(language))
+		}
+		L.Push(table)
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xyproto/datablock"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	languages := parseAcceptLanguage("en;q=0.8, de-CH, fr;q=0, *;q=0.5, de;q=0.9")
+	expected := []string{"de-ch", "de", "en"}
+	if strings.Join(languages, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, languages)
+	}
+}
+
+func TestLanguageVariants(t *testing.T) {
+	if fs == nil {
+		fs = datablock.NewFileStat(false, 0)
+	}
+	dir, err := ioutil.TempDir("", "languages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"index.md", "index.de.md", "index.pt-BR.md", "jquery.min.js", "style.css"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Language", "pt-BR, de;q=0.5")
+	w := httptest.NewRecorder()
+	if variant, found := selectLanguage(w, req, filepath.Join(dir, "index.md")); !found || filepath.Base(variant) != "index.pt-BR.md" {
+		t.Errorf("expected index.pt-BR.md, got %s", variant)
+	}
+	if w.Header().Get("Vary") == "" || w.Header().Get("Content-Language") != "pt-br" {
+		t.Errorf("unexpected headers: %v", w.Header())
+	}
+
+	// "min" is not a language
+	w = httptest.NewRecorder()
+	if variant, found := selectLanguage(w, req, filepath.Join(dir, "jquery.js")); found {
+		t.Errorf("expected no variant of jquery.js, got %s", variant)
+	}
+
+	// No Vary header for files without variants
+	w = httptest.NewRecorder()
+	if _, found := selectLanguage(w, req, filepath.Join(dir, "style.css")); !found || w.Header().Get("Vary") != "" {
+		t.Errorf("expected style.css without a Vary header, got %v", w.Header())
+	}
+}
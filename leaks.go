@@ -0,0 +1,311 @@
+package main
+
+// Finding goroutines and memory that Lua handlers leave behind, in debug mode.
+// Requests are only measured when no other requests are being handled, so
+// that what is left behind can be blamed on the right handler. The goroutines
+// that are started during a request and still run a little while after it is
+// done, like reads from unclosed websockets or timers and tickers from Go
+// plugins, are logged together with where they were started. The results are
+// shown to admins at /_leaks.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// The URL path of the leak detector page
+	leaksPath = "/_leaks"
+
+	// How long to wait after a request, before looking for goroutines that
+	// were left behind
+	leakCheckDelay = 500 * time.Millisecond
+
+	// Report a handler as leaking memory if the heap grows by more than this
+	// for each of leakHeapRequests measured requests in a row
+	leakHeapGrowth   = 64 * 1024
+	leakHeapRequests = 5
+)
+
+// What one handler has left behind
+type handlerLeaks struct {
+	Name       string    `json:"name"`
+	Requests   int       `json:"requests"`
+	Measured   int       `json:"measured"`
+	Goroutines int       `json:"goroutines"`
+	HeapGrowth int64     `json:"heap_growth"`
+	Creators   []string  `json:"creators"`
+	LastLeak   time.Time `json:"last_leak"`
+
+	heapGrowthInARow int
+}
+
+// Keeps track of the requests that are being handled, and what each Lua
+// handler has left behind
+type leakDetector struct {
+	mut      sync.Mutex
+	inFlight int
+	seq      uint64 // counts the requests, for noticing requests in between
+	handlers map[string]*handlerLeaks
+
+	// Runs the check after a request, after the given delay
+	afterFunc func(time.Duration, func())
+}
+
+func newLeakDetector() *leakDetector {
+	return &leakDetector{
+		handlers: make(map[string]*handlerLeaks),
+		afterFunc: func(d time.Duration, f func()) {
+			time.AfterFunc(d, f)
+		},
+	}
+}
+
+// Return the goroutines, by ID, with the function that started them
+func goroutineCreators() map[string]string {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	return parseGoroutines(string(buf))
+}
+
+// Parse the output of runtime.Stack into the goroutine IDs and the functions
+// that started them
+func parseGoroutines(stacks string) map[string]string {
+	creators := make(map[string]string)
+	for _, stack := range strings.Split(stacks, "\n\n") {
+		lines := strings.Split(strings.TrimSpace(stack), "\n")
+		fields := strings.Fields(lines[0])
+		if len(fields) < 2 || fields[0] != "goroutine" {
+			continue
+		}
+		creator := ""
+		for _, line := range lines {
+			if strings.HasPrefix(line, "created by ") {
+				creator = strings.TrimPrefix(line, "created by ")
+				if i := strings.Index(creator, " in goroutine "); i >= 0 {
+					creator = creator[:i]
+				}
+			}
+		}
+		creators[fields[1]] = creator
+	}
+	return creators
+}
+
+// Check if a goroutine is started by the HTTP server, for connections and
+// reading request bodies
+func serverGoroutine(creator string) bool {
+	return strings.HasPrefix(creator, "net/http.") || strings.Contains(creator, "/http2.")
+}
+
+// Return the heap size after a garbage collection
+func heapSize() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// Keep track of the requests that are being handled. Streams are not counted,
+// since they are supposed to be long-lived.
+func (ld *leakDetector) handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if isStreamRequest(req) {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		ld.mut.Lock()
+		ld.inFlight++
+		ld.seq++
+		ld.mut.Unlock()
+		defer func() {
+			ld.mut.Lock()
+			ld.inFlight--
+			ld.mut.Unlock()
+		}()
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// Return the stats for a handler. The mutex must be locked.
+func (ld *leakDetector) stats(name string) *handlerLeaks {
+	hl, found := ld.handlers[name]
+	if !found {
+		hl = &handlerLeaks{Name: name}
+		ld.handlers[name] = hl
+	}
+	return hl
+}
+
+// Start measuring a request for the given handler. Call the returned
+// function when the handler is done. A nil leakDetector measures nothing.
+func (ld *leakDetector) track(name string) func() {
+	if ld == nil {
+		return func() {}
+	}
+	ld.mut.Lock()
+	ld.stats(name).Requests++
+	solo, seq := ld.inFlight == 1, ld.seq
+	ld.mut.Unlock()
+	if !solo {
+		return func() {}
+	}
+	heap := heapSize()
+	before := goroutineCreators()
+	return func() {
+		ld.afterFunc(leakCheckDelay, func() {
+			ld.check(name, seq, before, heap)
+		})
+	}
+}
+
+// Look for what the handler left behind, if no other requests were handled
+// in the meantime
+func (ld *leakDetector) check(name string, seq uint64, before map[string]string, heapBefore uint64) {
+	ld.mut.Lock()
+	quiet := ld.seq == seq && ld.inFlight == 0
+	ld.mut.Unlock()
+	if !quiet {
+		return
+	}
+	after := goroutineCreators()
+	heapAfter := heapSize()
+
+	// The goroutine that is running this check is not counted
+	var self string
+	for id := range parseGoroutines(string(currentStack())) {
+		self = id
+	}
+	var creators []string
+	for id, creator := range after {
+		if _, found := before[id]; found || id == self || serverGoroutine(creator) {
+			continue
+		}
+		if creator == "" {
+			creator = "unknown"
+		}
+		creators = append(creators, creator)
+	}
+	sort.Strings(creators)
+	growth := int64(heapAfter) - int64(heapBefore)
+
+	ld.mut.Lock()
+	defer ld.mut.Unlock()
+	hl := ld.stats(name)
+	hl.Measured++
+	if len(creators) > 0 {
+		hl.Goroutines += len(creators)
+		hl.LastLeak = time.Now()
+		for _, creator := range creators {
+			if !hasString(hl.Creators, creator) {
+				hl.Creators = append(hl.Creators, creator)
+			}
+		}
+		log.Warnf("%s left %d goroutine(s) running after the request, started by: %s", name, len(creators), strings.Join(creators, ", "))
+	}
+	if growth > leakHeapGrowth {
+		hl.HeapGrowth += growth
+		hl.heapGrowthInARow++
+		if hl.heapGrowthInARow == leakHeapRequests {
+			hl.LastLeak = time.Now()
+			log.Warnf("%s may be leaking memory, the heap has grown after each of the last %d requests (%d bytes in total)", name, leakHeapRequests, hl.HeapGrowth)
+		}
+	} else {
+		hl.heapGrowthInARow = 0
+	}
+}
+
+// Return the stack trace of the current goroutine
+func currentStack() []byte {
+	buf := make([]byte, 4096)
+	return buf[:runtime.Stack(buf, false)]
+}
+
+// Check if a string is in a slice of strings
+func hasString(xs []string, s string) bool {
+	for _, x := range xs {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// For sorting handlers by the number of goroutines they left behind, then by
+// heap growth and then by name
+type leaksByGoroutines []handlerLeaks
+
+func (l leaksByGoroutines) Len() int {
+	return len(l)
+}
+
+func (l leaksByGoroutines) Less(i, j int) bool {
+	if l[i].Goroutines != l[j].Goroutines {
+		return l[i].Goroutines > l[j].Goroutines
+	}
+	if l[i].HeapGrowth != l[j].HeapGrowth {
+		return l[i].HeapGrowth > l[j].HeapGrowth
+	}
+	return l[i].Name < l[j].Name
+}
+
+func (l leaksByGoroutines) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// Return the stats for all handlers, the handlers with the most goroutines first
+func (ld *leakDetector) report() []handlerLeaks {
+	ld.mut.Lock()
+	defer ld.mut.Unlock()
+	result := make([]handlerLeaks, 0, len(ld.handlers))
+	for _, hl := range ld.handlers {
+		c := *hl
+		c.Creators = append([]string(nil), hl.Creators...)
+		result = append(result, c)
+	}
+	sort.Sort(leaksByGoroutines(result))
+	return result
+}
+
+// Show what the Lua handlers have left behind, as HTML or as JSON with
+// ?format=json. Only for admins.
+func (ac *algernonConfig) leaksHandler(w http.ResponseWriter, req *http.Request) {
+	if !ac.perm.UserState().AdminRights(req) {
+		http.Error(w, "Only admins can see the leak detector", http.StatusForbidden)
+		return
+	}
+	report := ac.leaks.report()
+	w.Header().Set("Cache-Control", "no-store")
+	if req.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<p>Currently %d goroutines. Requests are only measured when no other requests are handled at the same time. <a href=\"?format=json\">JSON</a></p>", runtime.NumGoroutine())
+	buf.WriteString("<table><tr><th>Handler</th><th>Requests</th><th>Measured</th><th>Goroutines left</th><th>Heap growth</th><th>Started by</th></tr>")
+	for _, hl := range report {
+		fmt.Fprintf(&buf, "<tr><td>%s</td><td>%d</td><td>%d</td><td>%d</td><td>%d</td><td>%s</td></tr>",
+			html.EscapeString(hl.Name), hl.Requests, hl.Measured, hl.Goroutines, hl.HeapGrowth, html.EscapeString(strings.Join(hl.Creators, ", ")))
+	}
+	buf.WriteString("</table>")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, messagePage("Leaks", buf.String(), ac.defaultTheme))
+}
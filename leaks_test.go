@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeakDetector(t *testing.T) {
+	stacks := "goroutine 1 [running]:\nmain.main()\n\t/src/main.go:10 +0x1d\n\n" +
+		"goroutine 7 [chan receive]:\nmain.worker()\n\t/src/worker.go:3 +0x2a\ncreated by main.start in goroutine 1\n\t/src/worker.go:9 +0x3b\n"
+	creators := parseGoroutines(stacks)
+	if len(creators) != 2 || creators["1"] != "" || creators["7"] != "main.start" {
+		t.Errorf("unexpected goroutines: %v", creators)
+	}
+
+	ld := newLeakDetector()
+	// Run the check when the test is ready, instead of after a delay
+	checks := make(chan func(), 1)
+	ld.afterFunc = func(d time.Duration, f func()) {
+		checks <- f
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	handler := ld.handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer ld.track("leaky.lua")()
+		go func() { <-stop }()
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	(<-checks)()
+	report := ld.report()
+	if len(report) != 1 || report[0].Measured != 1 || report[0].Goroutines != 1 {
+		t.Fatalf("expected one goroutine to be left behind, got %+v", report)
+	}
+	if !strings.Contains(report[0].Creators[0], "TestLeakDetector") {
+		t.Errorf("expected the goroutine to be started by the test, got %q", report[0].Creators[0])
+	}
+	// A nil leak detector measures nothing
+	var none *leakDetector
+	none.track("index.lua")()
+}
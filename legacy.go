@@ -0,0 +1,83 @@
+package main
+
+// Compatibility with HTTP/1.0 and other old clients, for instance embedded
+// devices that can not handle chunked responses
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+)
+
+// A response writer that keeps the response in memory until the handler is
+// done, so that the Content-Length can be set instead of sending it chunked.
+// If the handler sets the Content-Length itself, the response is sent as usual.
+type legacyResponseWriter struct {
+	w           http.ResponseWriter
+	status      int
+	buf         bytes.Buffer
+	wroteHeader bool
+	direct      bool
+}
+
+func (lw *legacyResponseWriter) Header() http.Header {
+	return lw.w.Header()
+}
+
+func (lw *legacyResponseWriter) WriteHeader(status int) {
+	if lw.wroteHeader {
+		return
+	}
+	lw.wroteHeader = true
+	lw.status = status
+	if lw.w.Header().Get("Content-Length") != "" {
+		lw.direct = true
+		lw.w.WriteHeader(status)
+	}
+}
+
+func (lw *legacyResponseWriter) Write(data []byte) (int, error) {
+	if !lw.wroteHeader {
+		lw.WriteHeader(http.StatusOK)
+	}
+	if lw.direct {
+		return lw.w.Write(data)
+	}
+	return lw.buf.Write(data)
+}
+
+// Flushing would make the response chunked, so it is ignored
+func (lw *legacyResponseWriter) Flush() {}
+
+// Send the buffered response, with a Content-Length header
+func (lw *legacyResponseWriter) finish() {
+	if !lw.wroteHeader {
+		lw.WriteHeader(http.StatusOK)
+	}
+	if lw.direct {
+		return
+	}
+	lw.w.Header().Del("Transfer-Encoding")
+	// Responses to HEAD requests have the length of the body that would have been sent
+	if lw.status >= 200 && lw.status != http.StatusNoContent && lw.status != http.StatusNotModified {
+		lw.w.Header().Set("Content-Length", strconv.Itoa(lw.buf.Len()))
+	}
+	lw.w.WriteHeader(lw.status)
+	lw.w.Write(lw.buf.Bytes())
+}
+
+// Wrap a handler so that it can be used by old HTTP clients
+func (ac *algernonConfig) legacyHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// HTTP/1.0 clients are not required to send a Host header
+		if req.Host == "" && ac.serverHost != "" {
+			req.Host = ac.serverHost
+		}
+		// Some old clients claim to accept compressed responses, but can not handle them
+		req.Header.Del("Accept-Encoding")
+
+		lw := &legacyResponseWriter{w: w}
+		handler.ServeHTTP(lw, req)
+		lw.finish()
+	})
+}
@@ -322,9 +322,21 @@ func (ac *algernonConfig) exportCommonFunctions(w http.ResponseWriter, req *http
 	// Make other basic functions available
 	exportBasicSystemFunctions(L)
 
+	// Typed access to flags, environment variables and settings
+	ac.exportConfigFunctions(L)
+
+	// CSRF tokens and flash messages
+	ac.exportSessionFunctions(w, req, L)
+
 	// Functions for rendering markdown or amber
 	ac.exportRenderFunctions(w, req, L)
 
+	// Client hints, for adaptive pages
+	exportClientHints(L, req)
+
+	// Preferred languages
+	exportLanguages(L, req)
+
 	// If there is a database backend
 	if ac.perm != nil {
 
@@ -335,13 +347,14 @@ func (ac *algernonConfig) exportCommonFunctions(w http.ResponseWriter, req *http
 		ac.exportServeFile(w, req, L, filename)
 
 		// Make the functions related to userstate available to the Lua script
-		exportUserstate(w, req, L, userstate)
+		ac.exportUserstate(w, req, L, userstate)
 
 		// Simpleredis data structures
 		exportList(L, userstate)
 		exportSet(L, userstate)
 		exportHash(L, userstate)
 		exportKeyValue(L, userstate)
+		exportModel(L, userstate)
 
 		// For saving and loading Lua functions
 		exportCodeLibrary(L, userstate)
@@ -363,9 +376,23 @@ func (ac *algernonConfig) exportCommonFunctions(w http.ResponseWriter, req *http
 
 	// Cache
 	ac.exportCacheFunctions(L)
+	ac.exportStreamFunctions(L)
+	ac.exportDBHealthFunction(L)
+
+	// Draft previews
+	ac.exportDraftFunctions(L)
+
+	// Breakpoints for the Lua debugger
+	ac.exportDebugFunctions(L)
 
 	// File uploads
-	exportUploadedFile(L, w, req, filepath.Dir(filename))
+	exportUploadedFile(L, w, req, filepath.Dir(filename), ac.scanUpload)
+
+	// API versions and deprecated functions
+	exportAPIVersionFunctions(L)
+
+	// Remove the functions that are not allowed by the sandbox profile
+	applySandbox(L)
 }
 
 // Run a Lua file as a HTTP handler. Also has access to the userstate and permissions.
@@ -420,7 +447,11 @@ func (ac *algernonConfig) runLua(w http.ResponseWriter, req *http.Request, filen
 
 	// Run the script and return the error value.
 	// Logging and/or HTTP response is handled elsewhere.
-	return L.DoFile(filename)
+	tracef(req, "Running the Lua script %s", filename)
+	defer ac.leaks.track(filename)()
+	err := ac.doLuaFile(L, filename)
+	tracef(req, "Done running the Lua script %s", filename)
+	return err
 }
 
 // Run a Lua file as a configuration script. Also has access to the userstate and permissions.
@@ -433,12 +464,15 @@ func (ac *algernonConfig) runLua(w http.ResponseWriter, req *http.Request, filen
 // luaHandler is a flag that lets Lua functions like "handle" and "servedir" be available or not.
 func (ac *algernonConfig) runConfiguration(filename string, mux *http.ServeMux, withHandlerFunctions bool) error {
 
-	// Retrieve a Lua state
-	L := ac.luapool.Get()
+	// Retrieve a Lua state, for configuration scripts
+	L := ac.confluapool.Get()
 
 	// Basic system functions, like log()
 	exportBasicSystemFunctions(L)
 
+	// Typed access to flags, environment variables and settings
+	ac.exportConfigFunctions(L)
+
 	// If there is a database backend
 	if ac.perm != nil {
 
@@ -453,6 +487,7 @@ func (ac *algernonConfig) runConfiguration(filename string, mux *http.ServeMux,
 		exportSet(L, userstate)
 		exportHash(L, userstate)
 		exportKeyValue(L, userstate)
+		exportModel(L, userstate)
 
 		// For saving and loading Lua functions
 		exportCodeLibrary(L, userstate)
@@ -471,14 +506,31 @@ func (ac *algernonConfig) runConfiguration(filename string, mux *http.ServeMux,
 
 	// Cache
 	ac.exportCacheFunctions(L)
+	ac.exportStreamFunctions(L)
+	ac.exportDBHealthFunction(L)
+
+	// Draft previews
+	ac.exportDraftFunctions(L)
+
+	// Breakpoints for the Lua debugger
+	ac.exportDebugFunctions(L)
 
 	if withHandlerFunctions {
 		// Lua HTTP handlers
 		ac.exportLuaHandlerFunctions(L, filename, mux, false, nil, ac.defaultTheme)
+
+		// Filters for rendered HTML
+		ac.exportFilterFunctions(L)
 	}
 
+	// API versions and deprecated functions
+	exportAPIVersionFunctions(L)
+
+	// Remove the functions that are not allowed by the sandbox profile
+	applySandbox(L)
+
 	// Run the script
-	if err := L.DoFile(filename); err != nil {
+	if err := ac.doLuaFile(L, filename); err != nil {
 		// Close the Lua state
 		L.Close()
 
@@ -487,7 +539,7 @@ func (ac *algernonConfig) runConfiguration(filename string, mux *http.ServeMux,
 	}
 
 	// Only put the Lua state back if there were no errors
-	ac.luapool.Put(L)
+	ac.confluapool.Put(L)
 
 	return nil
 }
@@ -506,7 +558,17 @@ func (ac *algernonConfig) luaFunctionMap(w http.ResponseWriter, req *http.Reques
 
 	// Retrieve a Lua state
 	L := ac.luapool.Get()
-	defer ac.luapool.Put(L)
+	// The returned functions use the globals of L after this function has
+	// returned, so L can only be reused if the globals are left as they are.
+	// Otherwise L is closed, which leaves the globals in place.
+	failed := false
+	defer func() {
+		if ac.luapool.hygiene == hygieneOff && !failed {
+			ac.luapool.Put(L)
+		} else {
+			L.Close()
+		}
+	}()
 
 	// Prepare an empty map of functions (and variables)
 	funcs := make(template.FuncMap)
@@ -516,8 +578,8 @@ func (ac *algernonConfig) luaFunctionMap(w http.ResponseWriter, req *http.Reques
 
 	// Run the script
 	if err := L.DoString(string(luadata)); err != nil {
-		// Close the Lua state
-		L.Close()
+		// Close the Lua state instead of reusing it
+		failed = true
 
 		// Logging and/or HTTP response is handled elsewhere
 		return funcs, err
@@ -3,7 +3,6 @@ package main
 import (
 	"net/http"
 	"path/filepath"
-	"sync"
 	"time"
 
 	"github.com/didip/tollbooth"
@@ -15,8 +14,6 @@ import (
 // Make functions related to handling HTTP requests available to Lua scripts
 func (ac *algernonConfig) exportLuaHandlerFunctions(L *lua.LState, filename string, mux *http.ServeMux, addDomain bool, httpStatus *FutureStatus, theme string) {
 
-	luahandlermutex := &sync.RWMutex{}
-
 	L.SetGlobal("handle", L.NewFunction(func(L *lua.LState) int {
 
 		handlePath := L.ToString(1)
@@ -28,11 +25,12 @@ func (ac *algernonConfig) exportLuaHandlerFunctions(L *lua.LState, filename stri
 		wrappedHandleFunc := func(w http.ResponseWriter, req *http.Request) {
 
 			// Set up a new Lua state with the current http.ResponseWriter and *http.Request
-			luahandlermutex.Lock()
+			ac.luahandlermutex.Lock()
 			ac.exportCommonFunctions(w, req, filename, L, nil, httpStatus)
-			luahandlermutex.Unlock()
+			ac.luahandlermutex.Unlock()
 
 			// Then run the given Lua function
+			defer ac.leaks.track("Handler for " + handlePath)()
 			L.Push(handleFunc)
 			if err := L.PCall(0, lua.MultRet, nil); err != nil {
 				// Non-fatal error
@@ -9,8 +9,10 @@ import (
 // https://github.com/yuin/gopher-lua#the-lstate-pool-pattern
 
 type lStatePool struct {
-	m     sync.Mutex
-	saved []*lua.LState
+	m       sync.Mutex
+	saved   []*lua.LState
+	profile sandboxProfile // which libraries and functions are available
+	hygiene stateHygiene   // how Lua states are cleaned up before being reused
 }
 
 func (pl *lStatePool) Get() *lua.LState {
@@ -26,13 +28,29 @@ func (pl *lStatePool) Get() *lua.LState {
 }
 
 func (pl *lStatePool) New() *lua.LState {
-	L := lua.NewState()
+	// Only open the Lua libraries that are allowed by the sandbox profile
+	L := newSandboxedState(pl.profile)
+	// Remember the globals, so that they can be restored before L is reused
+	if pl.hygiene == hygieneReset {
+		recordBaseline(L)
+	}
 	// setting the L up here.
 	// load scripts, set global variables, share channels, etc...
 	return L
 }
 
 func (pl *lStatePool) Put(L *lua.LState) {
+	// The API version is declared per script
+	resetAPIVersion(L)
+	switch pl.hygiene {
+	case hygieneFresh:
+		// Never reuse Lua states
+		L.Close()
+		return
+	case hygieneReset:
+		// Don't let globals from one request leak into the next
+		restoreBaseline(L)
+	}
 	pl.m.Lock()
 	defer pl.m.Unlock()
 	pl.saved = append(pl.saved, L)
@@ -44,6 +44,13 @@ func main() {
 	// Read mime data from the system, if available
 	initializeMime()
 
+	// Read mime types that overrides the system mime types, if given
+	if ac.mimeTypesFilename != "" {
+		if err := readMimeTypes(ac.mimeTypesFilename); err != nil {
+			ac.fatalExit(err)
+		}
+	}
+
 	// Log to a file as JSON, if a log file has been specified
 	if ac.serverLogFile != "" {
 		f, errJSONLog := os.OpenFile(ac.serverLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, ac.defaultPermissions)
@@ -68,11 +75,25 @@ func main() {
 	// Clear the cache every N minutes.
 	fs = datablock.NewFileStat(ac.cacheFileStat, ac.defaultStatCacheRefresh)
 
+	// Check the templates for compile errors, then exit
+	if ac.checkMode || ac.checkJSON {
+		ac.checkTemplatesAndExit(ac.serverDirOrFilename)
+	}
+
 	// Output what we are attempting to access and serve
 	if ac.verboseMode {
 		log.Info("Accessing " + ac.serverDirOrFilename)
 	}
 
+	// Only signed archives can be served, if signatures are required
+	if ac.trustedKeysFilename != "" {
+		switch strings.ToLower(filepath.Ext(ac.serverDirOrFilename)) {
+		case ".zip", ".alg":
+		default:
+			ac.fatalExit(errors.New("Only signed .alg or .zip archives can be served when --require-signed is given"))
+		}
+	}
+
 	// Check if the given directory really is a directory
 	if !fs.IsDir(ac.serverDirOrFilename) {
 		// It is not a directory
@@ -84,14 +105,20 @@ func main() {
 				ac.serveStaticFile(serverFile, ac.defaultWebColonPort)
 				return
 			}
+			ext := strings.ToLower(filepath.Ext(serverFile))
+			if ac.embeddedApp {
+				// The executable ends with a ZIP archive
+				ext = ".alg"
+			}
 			// Switch based on the lowercase filename extension
-			switch strings.ToLower(filepath.Ext(serverFile)) {
+			switch ext {
 			case ".md", ".markdown":
 				// Serve the given Markdown file as a static HTTP server
 				ac.serveStaticFile(serverFile, ac.defaultWebColonPort)
 				return
 			case ".zip", ".alg":
 				// Assume this to be a compressed Algernon application
+				ac.checkSignature(serverFile)
 				if extractErr := unzip.Extract(serverFile, ac.serverTempDir); extractErr != nil {
 					log.Fatalln(extractErr)
 				}
@@ -138,13 +165,13 @@ func main() {
 	}
 
 	// Console output
-	if !ac.quietMode && !ac.singleFileMode && !ac.simpleMode && !ac.noBanner {
+	if !ac.quietMode && !ac.singleFileMode && !ac.simpleMode && !ac.noBanner && !ac.scriptMode() && !ac.infoJSON {
 		// Output a colorful ansi logo if a proper terminal is available
 		fmt.Println(banner())
 	}
 
 	// Dividing line between the banner and output from any of the configuration scripts
-	if len(ac.serverConfigurationFilenames) > 0 && !ac.quietMode {
+	if len(ac.serverConfigurationFilenames) > 0 && !ac.quietMode && !ac.scriptMode() && !ac.infoJSON {
 		fmt.Println("--------------------------------------- - - · ·")
 	}
 
@@ -159,15 +186,77 @@ func main() {
 		if err != nil {
 			log.Fatalln("Could not find a usable database backend.")
 		}
+	} else {
+		// Keep the data in memory, so that Lua scripts still work
+		ac.perm, err = ac.memoryBackend()
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	// A Bolt database can only be opened by one process at a time
+	if ac.workerCount > 0 && strings.HasPrefix(ac.dbName, "Bolt") {
+		log.Fatalln("Worker processes require a database that can be shared, like Redis, MariaDB/MySQL or PostgreSQL.")
+	} else if ac.workerCount > 0 && ac.useNoDatabase {
+		log.Warn("Each worker process has its own in-memory data")
+	}
+
+	// Keep track of if the database is up, and what to do while it is down
+	readOnly, cacheDecisions, err := parseDBFallback(ac.dbFallback)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	ac.setupDBHealth(readOnly, cacheDecisions)
+
+	// Settings for config.get in Lua
+	if ac.settingsFilename != "" {
+		if err := ac.loadSettings(); err != nil {
+			log.Fatalln("Could not read the settings: " + err.Error())
+		}
+	}
+
+	// Sandbox profiles for page scripts and for configuration scripts
+	pageProfile, err := parseSandboxProfile(ac.sandboxName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	confProfile, err := parseSandboxProfile(ac.confSandboxName)
+	if err != nil {
+		log.Fatalln(err)
 	}
 
-	// Lua LState pool
-	ac.luapool = &lStatePool{saved: make([]*lua.LState, 0, 4)}
+	// How pooled Lua states for page scripts are cleaned up between requests
+	hygiene, err := parseStateHygiene(ac.stateHygieneName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// Lua LState pools. The states for configuration scripts are not cleaned
+	// up, since the handlers that are defined there may use their globals.
+	ac.luapool = &lStatePool{saved: make([]*lua.LState, 0, 4), profile: pageProfile, hygiene: hygiene}
+	ac.confluapool = &lStatePool{saved: make([]*lua.LState, 0, 4), profile: confProfile}
 	atShutdown(func() {
 		// TODO: Why not defer?
 		ac.luapool.Shutdown()
+		ac.confluapool.Shutdown()
 	})
 
+	// Run the Lua code given with --eval or the script given with --run, then exit
+	if ac.scriptMode() {
+		ac.runScriptAndExit()
+	}
+
+	// The Lua debugger, for the REPL and for DAP clients
+	if ac.debugMode {
+		ac.debugger = newLuaDebugger()
+		ac.leaks = newLeakDetector()
+		if ac.dapAddr != "" {
+			ac.serveDAP()
+		}
+	} else if ac.dapAddr != "" {
+		log.Warn("The Lua debugger can only be served over DAP in debug mode")
+	}
+
 	// TODO: save repl history + close luapool + close logs ++ at shutdown
 
 	if ac.singleFileMode && filepath.Ext(ac.serverDirOrFilename) == ".lua" {
@@ -180,6 +269,16 @@ func main() {
 		ac.singleFileMode = false
 	}
 
+	// Scan uploaded files before they are saved. The server
+	// configuration may use other scanners for some directories.
+	if ac.uploadScanners != "" {
+		policy, err := newUploadScanPolicy(strings.Split(ac.uploadScanners, ","), ac.uploadQuarantine)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		ac.setUploadScanPolicy("", policy)
+	}
+
 	// Read server configuration script, if present.
 	// The scripts may change global variables.
 	var ranConfigurationFilenames []string
@@ -190,14 +289,13 @@ func main() {
 			}
 			withHandlerFunctions := true
 			if errConf := ac.runConfiguration(filename, mux, withHandlerFunctions); errConf != nil {
-				if ac.perm != nil {
+				if !ac.useNoDatabase {
 					log.Error("Could not use configuration script: " + filename)
 					ac.fatalExit(errConf)
 				} else {
-					if ac.verboseMode {
-						log.Info("Skipping " + filename + " because the database backend is not in use.")
-					}
-
+					// Without a database, configuration scripts were skipped,
+					// so errors in them are not fatal
+					log.Warn("Could not use configuration script "+filename+": ", errConf)
 				}
 			}
 			ranConfigurationFilenames = append(ranConfigurationFilenames, filename)
@@ -226,10 +324,69 @@ func main() {
 		ac.registerHandlers(mux, "/", ac.serverDirOrFilename, ac.serverAddDomain)
 	}
 
+	// Serve the rendering API, if enabled
+	if ac.renderAPIPath != "" {
+		ac.registerRenderAPI(mux)
+	}
+
+	// Comments for Markdown pages, stored in the database or in memory
+	if ac.comments {
+		ac.limitedHandle(mux, commentsPath, ac.commentsHandler)
+	}
+
+	// Forms from the server configuration, for pages that are not Markdown
+	if len(ac.forms) > 0 {
+		ac.limitedHandle(mux, formsPath, ac.formsHandler)
+	}
+
+	// A service worker and web app manifest, for using the site offline
+	if ac.pwa {
+		ac.setupPWA(mux)
+	}
+
+	// A status badge for dashboards and README files
+	if ac.statusBadge {
+		ac.requestRate = &requestRate{}
+		ac.limitedHandle(mux, statusBadgePath, ac.statusBadgeHandler)
+	}
+
+	// A history of the requests for the last hour
+	if ac.metrics {
+		ac.metricsHistory = &metricsHistory{}
+		ac.limitedHandle(mux, metricsPath, ac.metricsHandler)
+	}
+
+	// A page for admins with what the Lua handlers leave behind, in debug mode
+	if ac.leaks != nil {
+		ac.limitedHandle(mux, leaksPath, ac.leaksHandler)
+	}
+
+	// A page for admins with the files in the cache
+	if ac.cacheDebug {
+		ac.limitedHandle(mux, cacheDebugPath, ac.cacheDebugHandler)
+	}
+
+	// Only the server information is written with --info-json, not the
+	// output from the OnReady function
+	if ac.infoJSON {
+		ac.serverReadyFunctionLua = nil
+	}
+
 	// Set the values that has not been set by flags nor scripts
 	// (and can be set by both)
 	ranServerReadyFunction := ac.finalConfiguration(ac.serverHost)
 
+	// Write the server information as JSON, then exit
+	if ac.infoJSON {
+		data, err := ac.InfoJSON()
+		if err != nil {
+			ac.fatalExit(err)
+		}
+		fmt.Println(string(data))
+		ac.generateShutdownFunction(nil)()
+		os.Exit(0)
+	}
+
 	// If no configuration files were being ran successfully,
 	// output basic server information.
 	if len(ac.serverConfigurationFilenames) == 0 {
@@ -245,6 +402,11 @@ func main() {
 		fmt.Println("--------------------------------------- - - · ·")
 	}
 
+	// Obtain certificates with ACME DNS-01 challenges, if a DNS provider is configured
+	if ac.acmeDNSProvider != "" && !ac.serveJustHTTP && !ac.serveJustHTTP2 {
+		ac.setupACMEDNS()
+	}
+
 	// Direct internal logging elsewhere
 	internalLogFile, err := os.Open(ac.internalLogFilename)
 	if err != nil {
@@ -263,6 +425,9 @@ func main() {
 	defer internalLogFile.Close()
 	internallog.SetOutput(internalLogFile)
 
+	// Limits for Server-Sent Event streams and websockets
+	ac.streams = newStreamLimiter(ac.maxStreams, ac.maxStreamsPerIP, ac.streamWriteTimeout)
+
 	// Serve filesystem events in the background.
 	// Used for reloading pages when the sources change.
 	// Can also be used when serving a single file.
@@ -282,6 +447,37 @@ func main() {
 		}
 	}
 
+	// Broadcast cache invalidations to other instances that use the same Redis server
+	if ac.cacheBroadcast && ac.cache != nil {
+		if ac.dbName != "Redis" {
+			log.Warn("--cachebroadcast needs the Redis database backend")
+		} else if ac.broadcaster, err = newCacheBroadcaster(ac.redisAddr, ac.serverDirOrFilename, ac.cache, ac.verboseMode); err != nil {
+			log.Warn("Could not broadcast cache invalidations: " + err.Error())
+		} else {
+			go ac.broadcaster.listen()
+			atShutdown(ac.broadcaster.close)
+		}
+	}
+
+	// Remove files that change on disk from the cache
+	if ac.watchFiles && ac.cache != nil && fs.IsDir(ac.serverDirOrFilename) {
+		if err := ac.watchChanges(ac.serverDirOrFilename); err != nil {
+			log.Warn("Could not watch " + ac.serverDirOrFilename + " for changes: " + err.Error())
+		}
+	}
+
+	// Mirror requests to another server or a log file
+	if ac.mirrorTarget != "" {
+		if ac.mirror, err = newRequestMirror(ac.mirrorTarget, ac.mirrorPercent); err != nil {
+			log.Fatalln("Could not mirror requests to " + ac.mirrorTarget + ": " + err.Error())
+		}
+	}
+
+	// Add CSRF tokens to the POST forms in rendered pages
+	if ac.csrfProtection {
+		ac.addHTMLFilter("/", ac.csrfFilter)
+	}
+
 	// For communicating to and from the REPL
 	ready := make(chan bool) // for when the server is up and running
 	done := make(chan bool)  // for when the user wish to quit the server
@@ -295,9 +491,30 @@ func main() {
 		ignoreTerminalResizeSignal()
 	}
 
+	// Reload when receiving SIGHUP, for instance after "algernon deploy"
+	ac.handleReloadSignal()
+
 	// Run the shutdown functions if graceful does not
 	defer ac.generateShutdownFunction(nil)()
 
+	// Serve requests from the main process, in a worker process
+	if ac.workerSocket != "" {
+		if err := ac.serveWorker(mux); err != nil {
+			ac.fatalExit(err)
+		}
+		return
+	}
+
+	// Pass all requests on to the worker processes
+	if ac.workerCount > 0 {
+		pool, err := ac.startWorkers()
+		if err != nil {
+			ac.fatalExit(err)
+		}
+		mux = http.NewServeMux()
+		ac.limitedHandle(mux, "/", ac.workerProxy(pool).ServeHTTP)
+	}
+
 	// Serve HTTP, HTTP/2 and/or HTTPS
 	if err := ac.serve(mux, done, ready); err != nil {
 		ac.fatalExit(err)
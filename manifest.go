@@ -0,0 +1,166 @@
+package main
+
+// Writing a manifest.json for the static assets in a server directory, with
+// fingerprinted URLs and Subresource Integrity hashes, so that templates and
+// service workers outside of Algernon can refer to the assets deterministically
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/wellington/sass/compiler"
+)
+
+// The default filename of the asset manifest
+const manifestFilename = "manifest.json"
+
+// The file extensions of the assets that are served as they are
+var staticAssetExtensions = map[string]bool{
+	".css": true, ".js": true, ".mjs": true, ".map": true, ".wasm": true,
+	".svg": true, ".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true, ".ico": true,
+	".woff": true, ".woff2": true, ".ttf": true, ".otf": true, ".eot": true,
+}
+
+// An asset in the manifest
+type manifestEntry struct {
+	URL       string `json:"url"`
+	Integrity string `json:"integrity"`
+	Size      int    `json:"size"`
+}
+
+// Return the asset as it is served by Algernon, for assets that are either
+// served as they are or built from GCSS, SCSS or JSX. Returns nil if the file
+// is not an asset.
+func builtAsset(filename string) ([]byte, error) {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if !staticAssetExtensions[ext] && ext != ".gcss" && ext != ".scss" && ext != ".jsx" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	switch ext {
+	case ".gcss":
+		return compileGCSS(filename, data)
+	case ".jsx":
+		return compileJSX(filename, data)
+	case ".scss":
+		// Sass might want to import other files, so compile the file by name.
+		// The compiler output is silenced, since the manifest may go to stdout.
+		o := Output{}
+		o.disable()
+		css, err := compiler.Run(filename)
+		o.enable()
+		return []byte(css), err
+	}
+	return data, nil
+}
+
+// Return the fingerprint of the contents of an asset
+func fingerprint(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// Create a manifest entry for an asset with the given URL path and contents
+func newManifestEntry(urlpath string, data []byte) manifestEntry {
+	integrity := sha512.Sum384(data)
+	return manifestEntry{
+		URL:       urlpath + "?v=" + fingerprint(data),
+		Integrity: "sha384-" + base64.StdEncoding.EncodeToString(integrity[:]),
+		Size:      len(data),
+	}
+}
+
+// Build the manifest for the assets in a server directory, by URL path.
+// Hidden files and directories, like .git, are skipped, and so are the
+// fingerprinted copies that are written with "algernon manifest -hashed".
+func assetManifest(dir string) (map[string]manifestEntry, error) {
+	manifest := make(map[string]manifestEntry)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") && p != dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || info.Name() == manifestFilename || isHashedCopy(p) {
+			return nil
+		}
+		data, err := builtAsset(p)
+		if err != nil {
+			return fmt.Errorf("%s: %s", p, err)
+		}
+		if data == nil {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		urlpath := path.Join("/", filepath.ToSlash(rel))
+		manifest[urlpath] = newManifestEntry(urlpath, data)
+		return nil
+	})
+	return manifest, err
+}
+
+// Write a manifest.json for the assets in a server directory
+func manifestCommand(ac *algernonConfig, args []string) error {
+	flags := flag.NewFlagSet("manifest", flag.ContinueOnError)
+	output := flags.String("o", "", "Where to write the manifest (the default is DIR/"+manifestFilename+", - for stdout)")
+	precompress := flags.Bool("gzip", false, "Also write a compressed FILE.gz next to each asset that is served as it is")
+	hashed := flags.Bool("hashed", false, "Also write a copy of each asset that is served as it is, with the fingerprint in the filename")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return errors.New("usage: algernon manifest [-o FILE] [-gzip] [-hashed] [DIR]")
+	}
+	dir := ac.serverDirOrFilename
+	if flags.NArg() == 1 {
+		dir = flags.Arg(0)
+	}
+	manifest, err := assetManifest(dir)
+	if err != nil {
+		return err
+	}
+	if *hashed || *precompress {
+		if err := writeAssetCopies(dir, manifest, *hashed, *precompress); err != nil {
+			return err
+		}
+	}
+	// The keys are sorted, so the same assets always give the same manifest
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	switch *output {
+	case "-":
+		_, err = os.Stdout.Write(data)
+		return err
+	case "":
+		*output = filepath.Join(dir, manifestFilename)
+	}
+	if err := ioutil.WriteFile(*output, data, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d assets to %s\n", len(manifest), *output)
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+// Streaming of audio and video files, with support for range requests, poster
+// images for videos and a simple player page
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// The query parameter for a JPEG poster image of a video
+	posterParameter = "poster"
+
+	// The query parameter for a page with a player for an audio or video file
+	playParameter = "play"
+
+	// Where in a video the poster image is taken from, in seconds
+	posterOffset = "1"
+)
+
+// Return "audio" or "video" if the given file is an audio or video file,
+// or an empty string if it is not
+func mediaKind(filename string) string {
+	switch kind := iconTypes[strings.ToLower(filepath.Ext(filename))]; kind {
+	case "audio", "video":
+		return kind
+	}
+	return ""
+}
+
+// Make a poster image for a video, with ffmpeg
+func makePoster(filename string) ([]byte, error) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return nil, errors.New("ffmpeg is needed for making poster images")
+	}
+	tmpdir, err := ioutil.TempDir("", "algernon-poster")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpdir)
+	output := filepath.Join(tmpdir, "poster.jpg")
+	// Videos that are shorter than the offset get a poster from the first frame
+	for _, offset := range []string{posterOffset, "0"} {
+		cmd := exec.Command("ffmpeg", "-nostdin", "-loglevel", "error", "-y", "-ss", offset, "-i", filename, "-frames:v", "1", "-q:v", "3", output)
+		if err := runConverter(cmd); err != nil {
+			return nil, err
+		}
+		if data, err := ioutil.ReadFile(output); err == nil && len(data) > 0 {
+			return data, nil
+		}
+	}
+	return nil, errors.New("could not find a frame for the poster")
+}
+
+// Return a page with a player for an audio or video file
+func (ac *algernonConfig) playerPage(filename, urlpath string) string {
+	name := filepath.Base(filename)
+	src := html.EscapeString((&url.URL{Path: urlpath}).String())
+	var player string
+	if mediaKind(filename) == "audio" {
+		player = fmt.Sprintf(`<audio controls preload="metadata" src="%s" style="width:100%%"></audio>`, src)
+	} else {
+		// Add subtitles, if there is a .vtt file with the same name
+		track := ""
+		vttFilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".vtt"
+		if fs.Exists(vttFilename) {
+			vtt := html.EscapeString((&url.URL{Path: strings.TrimSuffix(urlpath, filepath.Ext(urlpath)) + ".vtt"}).String())
+			track = fmt.Sprintf(`<track kind="subtitles" src="%s" default>`, vtt)
+		}
+		player = fmt.Sprintf(`<video controls preload="metadata" poster="%s?%s" src="%s" style="max-width:100%%">%s</video>`, src, posterParameter, src, track)
+	}
+	body := player + fmt.Sprintf(`<p><a href="%s" download>Download %s</a></p>`, src, html.EscapeString(name))
+	return messagePage(html.EscapeString(name), body, ac.defaultTheme)
+}
+
+// Serve an audio or video file. The file is streamed from disk instead of
+// being cached and compressed, so that seeking with range requests works.
+// A poster image or a player page is served instead, if asked for.
+func (ac *algernonConfig) serveMedia(w http.ResponseWriter, req *http.Request, filename string) {
+	query := req.URL.Query()
+	if _, ok := query[playParameter]; ok {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, ac.playerPage(filename, req.URL.Path))
+		return
+	}
+	if _, ok := query[posterParameter]; ok && mediaKind(filename) == "video" {
+		data, err := cachedPreview(filename, makePoster)
+		if err != nil {
+			log.Warn("Could not make a poster for ", filename, ": ", err)
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		dataToClient(w, req, filename+".jpg", data)
+		return
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, noPage(filename, ac.defaultTheme))
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Could not read "+filepath.Base(filename), http.StatusInternalServerError)
+		return
+	}
+	setContentType(w, filepath.Ext(filename))
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.ServeContent(w, req, filename, fi.ModTime(), f)
+}
@@ -0,0 +1,453 @@
+package main
+
+// Users and permissions for the in-memory data structures. This follows the
+// user states of the permissionbolt and permissions2 packages, so that Lua
+// scripts and handlers behave the same as with a database backend.
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/xyproto/cookie"
+	"github.com/xyproto/pinterface"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The length of the confirmation codes for new users, at least
+var minMemoryConfirmationCodeLength = 20
+
+// Users, stored in memory
+type memoryUserState struct {
+	store             *memoryStore
+	users             *memoryHashMap // users, with fields like "loggedin", "confirmed" and "email"
+	usernames         *memorySet     // all usernames, for easy enumeration
+	unconfirmed       *memorySet     // unconfirmed usernames
+	cookieTime        int64          // how long a login cookie lasts, in seconds
+	passwordAlgorithm string         // "bcrypt+", "bcrypt" or "sha256"
+}
+
+func newMemoryUserState(store *memoryStore) *memoryUserState {
+	state := &memoryUserState{
+		store:             store,
+		users:             &memoryHashMap{store, "users"},
+		usernames:         &memorySet{store, "usernames"},
+		unconfirmed:       &memorySet{store, "unconfirmed"},
+		cookieTime:        3600 * 24,
+		passwordAlgorithm: "bcrypt+",
+	}
+	// The cookie secret is kept in the snapshot, so that users stay logged in
+	// when the server is restarted
+	if state.CookieSecret() == "" {
+		state.SetCookieSecret(cookie.RandomCookieFriendlyString(30))
+	}
+	return state
+}
+
+func (state *memoryUserState) Host() pinterface.IHost {
+	return state.store
+}
+
+func (state *memoryUserState) Creator() pinterface.ICreator {
+	return &memoryCreator{state.store}
+}
+
+func (state *memoryUserState) Users() pinterface.IHashMap {
+	return state.users
+}
+
+func (state *memoryUserState) UserRights(req *http.Request) bool {
+	username, err := state.UsernameCookie(req)
+	if err != nil {
+		return false
+	}
+	return state.IsLoggedIn(username)
+}
+
+func (state *memoryUserState) HasUser(username string) bool {
+	has, _ := state.usernames.Has(username)
+	return has
+}
+
+func (state *memoryUserState) BooleanField(username, fieldname string) bool {
+	if !state.HasUser(username) {
+		return false
+	}
+	value, err := state.users.Get(username, fieldname)
+	return err == nil && value == "true"
+}
+
+func (state *memoryUserState) SetBooleanField(username, fieldname string, val bool) {
+	strval := "false"
+	if val {
+		strval = "true"
+	}
+	state.users.Set(username, fieldname, strval)
+}
+
+func (state *memoryUserState) IsConfirmed(username string) bool {
+	return state.BooleanField(username, "confirmed")
+}
+
+func (state *memoryUserState) IsLoggedIn(username string) bool {
+	return state.BooleanField(username, "loggedin")
+}
+
+func (state *memoryUserState) AdminRights(req *http.Request) bool {
+	username, err := state.UsernameCookie(req)
+	if err != nil {
+		return false
+	}
+	return state.IsLoggedIn(username) && state.IsAdmin(username)
+}
+
+func (state *memoryUserState) IsAdmin(username string) bool {
+	return state.BooleanField(username, "admin")
+}
+
+func (state *memoryUserState) UsernameCookie(req *http.Request) (string, error) {
+	username, ok := cookie.SecureCookie(req, "user", state.CookieSecret())
+	if ok && username != "" {
+		return username, nil
+	}
+	return "", errors.New("Could not retrieve the username from browser cookie")
+}
+
+func (state *memoryUserState) SetUsernameCookie(w http.ResponseWriter, username string) error {
+	if username == "" {
+		return errors.New("Can't set cookie for empty username")
+	}
+	if !state.HasUser(username) {
+		return errors.New("Can't store cookie for non-existing user")
+	}
+	cookie.SetSecureCookiePathWithFlags(w, "user", username, state.cookieTime, "/", state.CookieSecret(), false, true)
+	return nil
+}
+
+func (state *memoryUserState) AllUsernames() ([]string, error) {
+	return state.usernames.GetAll()
+}
+
+func (state *memoryUserState) Email(username string) (string, error) {
+	return state.users.Get(username, "email")
+}
+
+func (state *memoryUserState) PasswordHash(username string) (string, error) {
+	return state.users.Get(username, "password")
+}
+
+func (state *memoryUserState) AllUnconfirmedUsernames() ([]string, error) {
+	return state.unconfirmed.GetAll()
+}
+
+func (state *memoryUserState) ConfirmationCode(username string) (string, error) {
+	return state.users.Get(username, "confirmationCode")
+}
+
+func (state *memoryUserState) AddUnconfirmed(username, confirmationCode string) {
+	state.unconfirmed.Add(username)
+	state.users.Set(username, "confirmationCode", confirmationCode)
+}
+
+func (state *memoryUserState) RemoveUnconfirmed(username string) {
+	state.unconfirmed.Del(username)
+	state.users.DelKey(username, "confirmationCode")
+}
+
+func (state *memoryUserState) MarkConfirmed(username string) {
+	state.users.Set(username, "confirmed", "true")
+}
+
+func (state *memoryUserState) RemoveUser(username string) {
+	state.usernames.Del(username)
+	state.users.Del(username)
+}
+
+func (state *memoryUserState) SetAdminStatus(username string) {
+	state.users.Set(username, "admin", "true")
+}
+
+func (state *memoryUserState) RemoveAdminStatus(username string) {
+	state.users.Set(username, "admin", "false")
+}
+
+func (state *memoryUserState) AddUser(username, password, email string) {
+	passwordHash := state.HashPassword(username, password)
+	state.usernames.Add(username)
+	state.users.Set(username, "password", passwordHash)
+	state.users.Set(username, "email", email)
+	for _, fieldname := range []string{"loggedin", "confirmed", "admin"} {
+		state.users.Set(username, fieldname, "false")
+	}
+}
+
+func (state *memoryUserState) SetLoggedIn(username string) {
+	state.users.Set(username, "loggedin", "true")
+}
+
+func (state *memoryUserState) SetLoggedOut(username string) {
+	state.users.Set(username, "loggedin", "false")
+}
+
+func (state *memoryUserState) Login(w http.ResponseWriter, username string) error {
+	state.SetLoggedIn(username)
+	return state.SetUsernameCookie(w, username)
+}
+
+func (state *memoryUserState) ClearCookie(w http.ResponseWriter) {
+	cookie.ClearCookie(w, "user", "/")
+}
+
+func (state *memoryUserState) Logout(username string) {
+	state.SetLoggedOut(username)
+}
+
+func (state *memoryUserState) Username(req *http.Request) string {
+	username, err := state.UsernameCookie(req)
+	if err != nil {
+		return ""
+	}
+	return username
+}
+
+func (state *memoryUserState) CookieTimeout(username string) int64 {
+	return state.cookieTime
+}
+
+func (state *memoryUserState) SetCookieTimeout(cookieTime int64) {
+	state.cookieTime = cookieTime
+}
+
+func (state *memoryUserState) CookieSecret() string {
+	state.store.mut.RLock()
+	defer state.store.mut.RUnlock()
+	return state.store.CookieSecret
+}
+
+func (state *memoryUserState) SetCookieSecret(cookieSecret string) {
+	state.store.update(func() {
+		state.store.CookieSecret = cookieSecret
+	})
+}
+
+func (state *memoryUserState) PasswordAlgo() string {
+	return state.passwordAlgorithm
+}
+
+func (state *memoryUserState) SetPasswordAlgo(algorithm string) error {
+	switch algorithm {
+	case "sha256", "bcrypt", "bcrypt+":
+		state.passwordAlgorithm = algorithm
+	default:
+		return errors.New("Permissions: " + algorithm + " is an unsupported encryption algorithm")
+	}
+	return nil
+}
+
+// Hash the password with sha256, with the cookie secret and username as salt
+func (state *memoryUserState) hashSha256(username, password string) []byte {
+	hasher := sha256.New()
+	io.WriteString(hasher, password+state.CookieSecret()+username)
+	return hasher.Sum(nil)
+}
+
+func (state *memoryUserState) HashPassword(username, password string) string {
+	switch state.passwordAlgorithm {
+	case "sha256":
+		return string(state.hashSha256(username, password))
+	case "bcrypt", "bcrypt+":
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			panic("Permissions: bcrypt password hashing unsuccessful")
+		}
+		return string(hash)
+	}
+	return ""
+}
+
+func (state *memoryUserState) SetPassword(username, password string) {
+	state.users.Set(username, "password", state.HashPassword(username, password))
+}
+
+func (state *memoryUserState) CorrectPassword(username, password string) bool {
+	if !state.HasUser(username) {
+		return false
+	}
+	hashString, err := state.PasswordHash(username)
+	if err != nil || hashString == "" {
+		return false
+	}
+	hash := []byte(hashString)
+	correctSha256 := func() bool {
+		comparisonHash := state.hashSha256(username, password)
+		return len(hash) == len(comparisonHash) && subtle.ConstantTimeCompare(hash, comparisonHash) == 1
+	}
+	switch state.passwordAlgorithm {
+	case "sha256":
+		return correctSha256()
+	case "bcrypt":
+		return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+	case "bcrypt+": // for backwards compatibility with sha256
+		if len(hash) == sha256.Size && correctSha256() {
+			return true
+		}
+		return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+	}
+	return false
+}
+
+func (state *memoryUserState) AlreadyHasConfirmationCode(confirmationCode string) bool {
+	_, err := state.FindUserByConfirmationCode(confirmationCode)
+	return err == nil
+}
+
+func (state *memoryUserState) FindUserByConfirmationCode(confirmationCode string) (string, error) {
+	unconfirmedUsernames, err := state.AllUnconfirmedUsernames()
+	if err != nil {
+		return "", errors.New("All existing users are already confirmed.")
+	}
+	for _, username := range unconfirmedUsernames {
+		if code, err := state.ConfirmationCode(username); err == nil && code == confirmationCode {
+			if !state.HasUser(username) {
+				return username, errors.New("The user that is to be confirmed no longer exists.")
+			}
+			return username, nil
+		}
+	}
+	return "", errors.New("The confirmation code is no longer valid.")
+}
+
+func (state *memoryUserState) Confirm(username string) {
+	state.RemoveUnconfirmed(username)
+	state.MarkConfirmed(username)
+}
+
+func (state *memoryUserState) ConfirmUserByConfirmationCode(confirmationCode string) error {
+	username, err := state.FindUserByConfirmationCode(confirmationCode)
+	if err != nil {
+		return err
+	}
+	state.Confirm(username)
+	return nil
+}
+
+func (state *memoryUserState) SetMinimumConfirmationCodeLength(length int) {
+	minMemoryConfirmationCodeLength = length
+}
+
+func (state *memoryUserState) GenerateUniqueConfirmationCode() (string, error) {
+	const maxConfirmationCodeLength = 100
+	length := minMemoryConfirmationCodeLength
+	confirmationCode := cookie.RandomHumanFriendlyString(length)
+	for state.AlreadyHasConfirmationCode(confirmationCode) {
+		// Make the code longer for every collision
+		length++
+		confirmationCode = cookie.RandomHumanFriendlyString(length)
+		if length > maxConfirmationCodeLength {
+			return confirmationCode, errors.New("Too many generated confirmation codes are not unique!")
+		}
+	}
+	return confirmationCode, nil
+}
+
+// The permission middleware, for the in-memory users
+type memoryPermissions struct {
+	state              *memoryUserState
+	adminPathPrefixes  []string
+	userPathPrefixes   []string
+	publicPathPrefixes []string
+	denied             http.HandlerFunc
+}
+
+// Create permissions with the same default path prefixes as the database backends
+// Without a database, no paths were protected, and that is kept as the
+// default. Paths can be protected with AddAdminPrefix and AddUserPrefix.
+func newMemoryPermissions(store *memoryStore) *memoryPermissions {
+	return &memoryPermissions{
+		state:             newMemoryUserState(store),
+		adminPathPrefixes: []string{},
+		userPathPrefixes:  []string{},
+		publicPathPrefixes: []string{"/", "/login", "/register", "/favicon.ico", "/style", "/img", "/js",
+			"/robots.txt", "/sitemap_index.xml"},
+		denied: func(w http.ResponseWriter, req *http.Request) {
+			http.Error(w, "Permission denied.", http.StatusForbidden)
+		},
+	}
+}
+
+func (perm *memoryPermissions) SetDenyFunction(f http.HandlerFunc) {
+	perm.denied = f
+}
+
+func (perm *memoryPermissions) DenyFunction() http.HandlerFunc {
+	return perm.denied
+}
+
+func (perm *memoryPermissions) UserState() pinterface.IUserState {
+	return perm.state
+}
+
+// Clear makes every path public
+func (perm *memoryPermissions) Clear() {
+	perm.adminPathPrefixes = []string{}
+	perm.userPathPrefixes = []string{}
+}
+
+func (perm *memoryPermissions) AddAdminPath(prefix string) {
+	perm.adminPathPrefixes = append(perm.adminPathPrefixes, prefix)
+}
+
+func (perm *memoryPermissions) AddUserPath(prefix string) {
+	perm.userPathPrefixes = append(perm.userPathPrefixes, prefix)
+}
+
+func (perm *memoryPermissions) AddPublicPath(prefix string) {
+	perm.publicPathPrefixes = append(perm.publicPathPrefixes, prefix)
+}
+
+func (perm *memoryPermissions) SetAdminPath(pathPrefixes []string) {
+	perm.adminPathPrefixes = pathPrefixes
+}
+
+func (perm *memoryPermissions) SetUserPath(pathPrefixes []string) {
+	perm.userPathPrefixes = pathPrefixes
+}
+
+func (perm *memoryPermissions) SetPublicPath(pathPrefixes []string) {
+	perm.publicPathPrefixes = pathPrefixes
+}
+
+// Rejected checks if a request should be rejected. "/" is always public.
+func (perm *memoryPermissions) Rejected(w http.ResponseWriter, req *http.Request) bool {
+	path := req.URL.Path
+	if path == "/" {
+		return false
+	}
+	for _, prefix := range perm.adminPathPrefixes {
+		if strings.HasPrefix(path, prefix) && !perm.state.AdminRights(req) {
+			return true
+		}
+	}
+	for _, prefix := range perm.userPathPrefixes {
+		if strings.HasPrefix(path, prefix) && !perm.state.UserRights(req) {
+			return true
+		}
+	}
+	for _, prefix := range perm.publicPathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func (perm *memoryPermissions) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	if perm.Rejected(w, req) {
+		perm.DenyFunction()(w, req)
+		return
+	}
+	next(w, req)
+}
@@ -0,0 +1,415 @@
+package main
+
+// In-memory data structures, for when no database backend is used
+// (--boltdb=/dev/null or --simple). Lua scripts can then still use Set, List,
+// HashMap, KeyValue and the user functions. The data can optionally be saved
+// to a JSON snapshot, which is loaded again when Algernon starts.
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/pinterface"
+)
+
+// How often the in-memory data is saved to the snapshot file, if it has changed
+const snapshotInterval = 30 * time.Second
+
+var (
+	errMemKeyNotFound = errors.New("Key not found")
+	errMemTooFew      = errors.New("Too few items in list")
+)
+
+// All the in-memory data structures, by name
+type memoryStore struct {
+	mut          sync.RWMutex
+	Lists        map[string][]string                     `json:"lists"`
+	Sets         map[string][]string                     `json:"sets"`
+	HashMaps     map[string]map[string]map[string]string `json:"hashmaps"`
+	KeyValues    map[string]map[string]string            `json:"keyvalues"`
+	CookieSecret string                                  `json:"cookiesecret,omitempty"`
+	changed      bool
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		Lists:     make(map[string][]string),
+		Sets:      make(map[string][]string),
+		HashMaps:  make(map[string]map[string]map[string]string),
+		KeyValues: make(map[string]map[string]string),
+	}
+}
+
+// Ping is here to fulfill the pinterface.IHost interface
+func (s *memoryStore) Ping() error {
+	return nil
+}
+
+// Close is here to fulfill the pinterface.IHost interface
+func (s *memoryStore) Close() {}
+
+// Run a function that modifies the store
+func (s *memoryStore) update(f func()) error {
+	s.mut.Lock()
+	f()
+	s.changed = true
+	s.mut.Unlock()
+	return nil
+}
+
+// Load a JSON snapshot. A missing file is not an error.
+func (s *memoryStore) load(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	loaded := newMemoryStore()
+	if err := json.Unmarshal(data, loaded); err != nil {
+		return err
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	// Fields that are missing from the snapshot are left empty, not nil
+	if loaded.Lists != nil {
+		s.Lists = loaded.Lists
+	}
+	if loaded.Sets != nil {
+		s.Sets = loaded.Sets
+	}
+	if loaded.HashMaps != nil {
+		s.HashMaps = loaded.HashMaps
+	}
+	if loaded.KeyValues != nil {
+		s.KeyValues = loaded.KeyValues
+	}
+	s.CookieSecret = loaded.CookieSecret
+	return nil
+}
+
+// Save a JSON snapshot, if anything has changed since the last one.
+// The file is written to a temporary file first, then renamed.
+func (s *memoryStore) save(filename string) error {
+	s.mut.Lock()
+	if !s.changed {
+		s.mut.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(s)
+	s.changed = false
+	s.mut.Unlock()
+	if err != nil {
+		return err
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(filename), ".algernon-snapshot")
+	if err != nil {
+		return err
+	}
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	return os.Rename(tempFile.Name(), filename)
+}
+
+// For creating in-memory data structures
+type memoryCreator struct {
+	store *memoryStore
+}
+
+func (c *memoryCreator) NewList(id string) (pinterface.IList, error) {
+	return &memoryList{c.store, id}, nil
+}
+
+func (c *memoryCreator) NewSet(id string) (pinterface.ISet, error) {
+	return &memorySet{c.store, id}, nil
+}
+
+func (c *memoryCreator) NewHashMap(id string) (pinterface.IHashMap, error) {
+	return &memoryHashMap{c.store, id}, nil
+}
+
+func (c *memoryCreator) NewKeyValue(id string) (pinterface.IKeyValue, error) {
+	return &memoryKeyValue{c.store, id}, nil
+}
+
+/* --- List --- */
+
+type memoryList struct {
+	store *memoryStore
+	id    string
+}
+
+func (l *memoryList) Add(value string) error {
+	return l.store.update(func() {
+		l.store.Lists[l.id] = append(l.store.Lists[l.id], value)
+	})
+}
+
+func (l *memoryList) GetAll() ([]string, error) {
+	l.store.mut.RLock()
+	defer l.store.mut.RUnlock()
+	return append([]string{}, l.store.Lists[l.id]...), nil
+}
+
+func (l *memoryList) GetLast() (string, error) {
+	l.store.mut.RLock()
+	defer l.store.mut.RUnlock()
+	values := l.store.Lists[l.id]
+	if len(values) == 0 {
+		return "", nil
+	}
+	return values[len(values)-1], nil
+}
+
+func (l *memoryList) GetLastN(n int) ([]string, error) {
+	l.store.mut.RLock()
+	defer l.store.mut.RUnlock()
+	values := l.store.Lists[l.id]
+	if len(values) < n {
+		return nil, errMemTooFew
+	}
+	return append([]string{}, values[len(values)-n:]...), nil
+}
+
+func (l *memoryList) Remove() error {
+	return l.store.update(func() {
+		delete(l.store.Lists, l.id)
+	})
+}
+
+func (l *memoryList) Clear() error {
+	return l.Remove()
+}
+
+/* --- Set --- */
+
+type memorySet struct {
+	store *memoryStore
+	id    string
+}
+
+func (s *memorySet) Add(value string) error {
+	if has, _ := s.Has(value); has {
+		return nil
+	}
+	return s.store.update(func() {
+		s.store.Sets[s.id] = append(s.store.Sets[s.id], value)
+	})
+}
+
+func (s *memorySet) Has(value string) (bool, error) {
+	s.store.mut.RLock()
+	defer s.store.mut.RUnlock()
+	for _, v := range s.store.Sets[s.id] {
+		if v == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memorySet) GetAll() ([]string, error) {
+	s.store.mut.RLock()
+	defer s.store.mut.RUnlock()
+	return append([]string{}, s.store.Sets[s.id]...), nil
+}
+
+func (s *memorySet) Del(value string) error {
+	return s.store.update(func() {
+		values := s.store.Sets[s.id]
+		for i, v := range values {
+			if v == value {
+				s.store.Sets[s.id] = append(values[:i:i], values[i+1:]...)
+				break
+			}
+		}
+	})
+}
+
+func (s *memorySet) Remove() error {
+	return s.store.update(func() {
+		delete(s.store.Sets, s.id)
+	})
+}
+
+func (s *memorySet) Clear() error {
+	return s.Remove()
+}
+
+/* --- HashMap --- */
+
+type memoryHashMap struct {
+	store *memoryStore
+	id    string
+}
+
+func (h *memoryHashMap) Set(owner, key, value string) error {
+	return h.store.update(func() {
+		owners, ok := h.store.HashMaps[h.id]
+		if !ok {
+			owners = make(map[string]map[string]string)
+			h.store.HashMaps[h.id] = owners
+		}
+		fields, ok := owners[owner]
+		if !ok {
+			fields = make(map[string]string)
+			owners[owner] = fields
+		}
+		fields[key] = value
+	})
+}
+
+func (h *memoryHashMap) Get(owner, key string) (string, error) {
+	h.store.mut.RLock()
+	defer h.store.mut.RUnlock()
+	value, ok := h.store.HashMaps[h.id][owner][key]
+	if !ok {
+		return "", errMemKeyNotFound
+	}
+	return value, nil
+}
+
+func (h *memoryHashMap) Has(owner, key string) (bool, error) {
+	h.store.mut.RLock()
+	defer h.store.mut.RUnlock()
+	_, ok := h.store.HashMaps[h.id][owner][key]
+	return ok, nil
+}
+
+func (h *memoryHashMap) Exists(owner string) (bool, error) {
+	h.store.mut.RLock()
+	defer h.store.mut.RUnlock()
+	_, ok := h.store.HashMaps[h.id][owner]
+	return ok, nil
+}
+
+func (h *memoryHashMap) GetAll() ([]string, error) {
+	h.store.mut.RLock()
+	defer h.store.mut.RUnlock()
+	var owners []string
+	for owner := range h.store.HashMaps[h.id] {
+		owners = append(owners, owner)
+	}
+	return owners, nil
+}
+
+func (h *memoryHashMap) DelKey(owner, key string) error {
+	return h.store.update(func() {
+		delete(h.store.HashMaps[h.id][owner], key)
+	})
+}
+
+func (h *memoryHashMap) Del(owner string) error {
+	return h.store.update(func() {
+		delete(h.store.HashMaps[h.id], owner)
+	})
+}
+
+func (h *memoryHashMap) Remove() error {
+	return h.store.update(func() {
+		delete(h.store.HashMaps, h.id)
+	})
+}
+
+func (h *memoryHashMap) Clear() error {
+	return h.Remove()
+}
+
+/* --- KeyValue --- */
+
+type memoryKeyValue struct {
+	store *memoryStore
+	id    string
+}
+
+func (kv *memoryKeyValue) Set(key, value string) error {
+	return kv.store.update(func() {
+		values, ok := kv.store.KeyValues[kv.id]
+		if !ok {
+			values = make(map[string]string)
+			kv.store.KeyValues[kv.id] = values
+		}
+		values[key] = value
+	})
+}
+
+func (kv *memoryKeyValue) Get(key string) (string, error) {
+	kv.store.mut.RLock()
+	defer kv.store.mut.RUnlock()
+	value, ok := kv.store.KeyValues[kv.id][key]
+	if !ok {
+		return "", errMemKeyNotFound
+	}
+	return value, nil
+}
+
+func (kv *memoryKeyValue) Del(key string) error {
+	return kv.store.update(func() {
+		delete(kv.store.KeyValues[kv.id], key)
+	})
+}
+
+// Increase the value of a key by one. Missing keys and values that are not
+// numbers start at 0.
+func (kv *memoryKeyValue) Inc(key string) (string, error) {
+	var result string
+	return result, kv.store.update(func() {
+		values, ok := kv.store.KeyValues[kv.id]
+		if !ok {
+			values = make(map[string]string)
+			kv.store.KeyValues[kv.id] = values
+		}
+		num, _ := strconv.ParseInt(values[key], 10, 64)
+		result = strconv.FormatInt(num+1, 10)
+		values[key] = result
+	})
+}
+
+func (kv *memoryKeyValue) Remove() error {
+	return kv.store.update(func() {
+		delete(kv.store.KeyValues, kv.id)
+	})
+}
+
+func (kv *memoryKeyValue) Clear() error {
+	return kv.Remove()
+}
+
+// Use in-memory data structures for the permission middleware, and save them
+// to the snapshot file regularly and at shutdown, if a filename is given
+func (ac *algernonConfig) memoryBackend() (pinterface.IPermissions, error) {
+	store := newMemoryStore()
+	ac.dbName = "In-memory"
+	if ac.snapshotFilename != "" {
+		if err := store.load(ac.snapshotFilename); err != nil {
+			return nil, errors.New("Could not load " + ac.snapshotFilename + ": " + err.Error())
+		}
+		ac.dbName = "In-memory (" + ac.snapshotFilename + ")"
+		save := func() {
+			if err := store.save(ac.snapshotFilename); err != nil {
+				log.Error("Could not save the snapshot: ", err)
+			}
+		}
+		go func() {
+			for range time.Tick(snapshotInterval) {
+				save()
+			}
+		}()
+		atShutdown(save)
+	}
+	return newMemoryPermissions(store), nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := newMemoryStore()
+	creator := &memoryCreator{store}
+	kv, _ := creator.NewKeyValue("counters")
+	kv.Inc("visits")
+	if n, _ := kv.Inc("visits"); n != "2" {
+		t.Errorf("expected 2 visits, got %s", n)
+	}
+	set, _ := creator.NewSet("tags")
+	set.Add("go")
+	set.Add("go")
+	if all, _ := set.GetAll(); len(all) != 1 {
+		t.Errorf("expected 1 element in the set, got %d", len(all))
+	}
+	state := newMemoryUserState(store)
+	state.AddUser("bob", "hunter2", "bob@example.com")
+
+	f, err := ioutil.TempFile("", "algernon-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	if err := store.save(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	loaded := newMemoryStore()
+	if err := loaded.load(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := (&memoryKeyValue{loaded, "counters"}).Get("visits"); value != "2" {
+		t.Errorf("expected 2 visits after loading, got %q", value)
+	}
+	if !newMemoryUserState(loaded).CorrectPassword("bob", "hunter2") {
+		t.Error("expected the password to be correct after loading")
+	}
+	// No paths are protected without a database, as before
+	perm := newMemoryPermissions(store)
+	for _, path := range []string{"/admin", "/data/x", "/repo"} {
+		if perm.Rejected(nil, httptest.NewRequest("GET", path, nil)) {
+			t.Errorf("expected %s to be public", path)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+// Method override, for HTML forms that can only be sent with GET or POST.
+// With --methodoverride, a POST request with an X-HTTP-Method-Override
+// header, or a "_method" field in an URL encoded form, is handled as a PUT,
+// PATCH or DELETE request. This is done before anything else, so that
+// method() in Lua, the handlers and the logs all see the same method.
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// The header that can be used for overriding the method
+	methodOverrideHeader = "X-HTTP-Method-Override"
+
+	// The form field that can be used for overriding the method
+	methodOverrideField = "_method"
+)
+
+// Return the method that a POST request should be handled as, or an empty
+// string if it should not be overridden. Only PUT, PATCH and DELETE are allowed.
+func overrideMethod(req *http.Request) string {
+	if req.Method != "POST" {
+		return ""
+	}
+	method := req.Header.Get(methodOverrideHeader)
+	// Only URL encoded forms are read, so that uploads are not read into memory
+	if method == "" && strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if err := req.ParseForm(); err != nil {
+			return ""
+		}
+		method = req.PostForm.Get(methodOverrideField)
+		// Let the handlers read the body again
+		req.Body = ioutil.NopCloser(strings.NewReader(req.PostForm.Encode()))
+	}
+	switch method = strings.ToUpper(strings.TrimSpace(method)); method {
+	case "PUT", "PATCH", "DELETE":
+		return method
+	}
+	return ""
+}
+
+// Handle POST requests as the method given in the header or form field
+func (ac *algernonConfig) methodOverrideHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if method := overrideMethod(req); method != "" {
+			if ac.verboseMode {
+				log.Info("Handling POST ", req.URL.Path, " from ", req.RemoteAddr, " as ", method)
+			}
+			req.Method = method
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMethodOverride(t *testing.T) {
+	req := httptest.NewRequest("POST", "/items/1", strings.NewReader("_method=delete&name=a"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if method := overrideMethod(req); method != "DELETE" {
+		t.Errorf("expected DELETE, got %q", method)
+	}
+	if name := req.FormValue("name"); name != "a" {
+		t.Errorf("expected the form to still be available, got %q", name)
+	}
+	req = httptest.NewRequest("POST", "/items/1", nil)
+	req.Header.Set(methodOverrideHeader, "PUT")
+	if method := overrideMethod(req); method != "PUT" {
+		t.Errorf("expected PUT, got %q", method)
+	}
+	req.Header.Set(methodOverrideHeader, "CONNECT")
+	if method := overrideMethod(req); method != "" {
+		t.Errorf("expected no override for CONNECT, got %q", method)
+	}
+	req = httptest.NewRequest("GET", "/items/1", nil)
+	req.Header.Set(methodOverrideHeader, "DELETE")
+	if method := overrideMethod(req); method != "" {
+		t.Errorf("expected no override for GET, got %q", method)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+// A history of the request rate, error rate and latency for the last hour, in
+// one minute intervals, for seeing trends without external monitoring. The
+// history is shown with the "metrics" command at the REPL, and to admins at
+// /_metrics.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// The URL path of the metrics page
+	metricsPath = "/_metrics"
+
+	// The number of latencies that are kept per minute, for the percentiles
+	maxLatencySamples = 1024
+)
+
+// The requests during one minute
+type metricsBucket struct {
+	minute    int64 // the Unix time of the start of the minute
+	requests  int
+	errors    int
+	latencies []time.Duration // a random sample, if there are many requests
+}
+
+// The requests during one minute, with the latency percentiles in milliseconds
+type metricsMinute struct {
+	Time      time.Time `json:"time"`
+	Requests  int       `json:"requests"`
+	Errors    int       `json:"errors"`
+	ErrorRate float64   `json:"error_rate"`
+	P50       float64   `json:"p50_ms"`
+	P90       float64   `json:"p90_ms"`
+	P99       float64   `json:"p99_ms"`
+}
+
+// Keeps the requests for the last hour, in one minute intervals
+type metricsHistory struct {
+	mut     sync.Mutex
+	buckets [60]metricsBucket
+}
+
+// Count a request that ended with the given status code, after the given duration
+func (mh *metricsHistory) add(now time.Time, status int, duration time.Duration) {
+	minute := now.Unix() / 60 * 60
+	b := &mh.buckets[(minute/60)%int64(len(mh.buckets))]
+	mh.mut.Lock()
+	defer mh.mut.Unlock()
+	if b.minute != minute {
+		*b = metricsBucket{minute: minute, latencies: b.latencies[:0]}
+	}
+	b.requests++
+	if status >= 500 {
+		b.errors++
+	}
+	// Reservoir sampling, so that all requests are equally likely to be kept
+	if len(b.latencies) < maxLatencySamples {
+		b.latencies = append(b.latencies, duration)
+	} else if i := rand.Intn(b.requests); i < maxLatencySamples {
+		b.latencies[i] = duration
+	}
+}
+
+// For sorting durations, the shortest first
+type durations []time.Duration
+
+func (d durations) Len() int {
+	return len(d)
+}
+
+func (d durations) Less(i, j int) bool {
+	return d[i] < d[j]
+}
+
+func (d durations) Swap(i, j int) {
+	d[i], d[j] = d[j], d[i]
+}
+
+// Return the given percentile of a sorted list of durations, in milliseconds
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return float64(sorted[i]) / float64(time.Millisecond)
+}
+
+// Return the last hour, one minute at a time, oldest first. Minutes without
+// requests are included.
+func (mh *metricsHistory) minutes(now time.Time) []metricsMinute {
+	current := now.Unix() / 60 * 60
+	result := make([]metricsMinute, len(mh.buckets))
+	mh.mut.Lock()
+	defer mh.mut.Unlock()
+	for i := range result {
+		minute := current - int64(len(mh.buckets)-1-i)*60
+		m := metricsMinute{Time: time.Unix(minute, 0)}
+		if b := &mh.buckets[(minute/60)%int64(len(mh.buckets))]; b.minute == minute && b.requests > 0 {
+			sorted := make([]time.Duration, len(b.latencies))
+			copy(sorted, b.latencies)
+			sort.Sort(durations(sorted))
+			m.Requests = b.requests
+			m.Errors = b.errors
+			m.ErrorRate = float64(b.errors) / float64(b.requests)
+			m.P50 = percentile(sorted, 0.5)
+			m.P90 = percentile(sorted, 0.9)
+			m.P99 = percentile(sorted, 0.99)
+		}
+		result[i] = m
+	}
+	return result
+}
+
+// Count all requests, with their status codes and latencies
+func (mh *metricsHistory) handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		sr := newStatusRecorder(w)
+		handler.ServeHTTP(sr, req)
+		mh.add(time.Now(), sr.status, time.Since(start))
+	})
+}
+
+// Format the minutes with requests as a table, newest first
+func formatMetrics(minutes []metricsMinute) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%-6s %9s %7s %7s %9s %9s %9s\n", "Time", "Requests", "Errors", "Error%", "p50 ms", "p90 ms", "p99 ms")
+	found := false
+	for i := len(minutes) - 1; i >= 0; i-- {
+		m := minutes[i]
+		if m.Requests == 0 {
+			continue
+		}
+		found = true
+		fmt.Fprintf(&buf, "%-6s %9d %7d %6.1f%% %9.1f %9.1f %9.1f\n",
+			m.Time.Format("15:04"), m.Requests, m.Errors, m.ErrorRate*100, m.P50, m.P90, m.P99)
+	}
+	if !found {
+		buf.WriteString("No requests during the last hour\n")
+	}
+	return buf.String()
+}
+
+// Show the history as HTML, or as JSON with ?format=json. Only for admins.
+func (ac *algernonConfig) metricsHandler(w http.ResponseWriter, req *http.Request) {
+	if !ac.perm.UserState().AdminRights(req) {
+		http.Error(w, "Only admins can see the metrics", http.StatusForbidden)
+		return
+	}
+	minutes := ac.metricsHistory.minutes(time.Now())
+	w.Header().Set("Cache-Control", "no-store")
+	if req.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(minutes)
+		return
+	}
+	var buf bytes.Buffer
+	buf.WriteString(`<p>The last hour, newest first. <a href="?format=json">JSON</a></p>`)
+	buf.WriteString("<table><tr><th>Time</th><th>Requests</th><th>Errors</th><th>Error rate</th><th>p50 ms</th><th>p90 ms</th><th>p99 ms</th></tr>")
+	for i := len(minutes) - 1; i >= 0; i-- {
+		m := minutes[i]
+		if m.Requests == 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, "<tr><td>%s</td><td>%d</td><td>%d</td><td>%.1f%%</td><td>%.1f</td><td>%.1f</td><td>%.1f</td></tr>",
+			m.Time.Format("15:04"), m.Requests, m.Errors, m.ErrorRate*100, m.P50, m.P90, m.P99)
+	}
+	buf.WriteString("</table>")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, messagePage("Metrics", buf.String(), ac.defaultTheme))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHistory(t *testing.T) {
+	mh := &metricsHistory{}
+	now := time.Unix(1700000000, 0)
+	// Two hours ago, so this bucket is reused
+	mh.add(now.Add(-2*time.Hour), http.StatusOK, time.Second)
+	for i := 1; i <= 100; i++ {
+		mh.add(now, http.StatusOK, time.Duration(i)*time.Millisecond)
+	}
+	mh.add(now, http.StatusInternalServerError, time.Millisecond)
+	mh.add(now.Add(-time.Minute), http.StatusOK, time.Millisecond)
+	minutes := mh.minutes(now)
+	if len(minutes) != 60 {
+		t.Fatalf("expected 60 minutes, got %d", len(minutes))
+	}
+	m := minutes[59]
+	if m.Requests != 101 || m.Errors != 1 {
+		t.Errorf("expected 101 requests and 1 error, got %d and %d", m.Requests, m.Errors)
+	}
+	if m.P50 != 50 || m.P99 != 99 {
+		t.Errorf("unexpected percentiles: %v and %v", m.P50, m.P99)
+	}
+	if minutes[58].Requests != 1 || minutes[0].Requests != 0 {
+		t.Error("expected one request the minute before, and none an hour ago")
+	}
+	if !strings.Contains(formatMetrics(minutes), "101") {
+		t.Error("expected the requests in the table")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+// Overrides for the mime types that are read from the system
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/yuin/gopher-lua"
+)
+
+var (
+	// Mime types that are often missing or wrong in /etc/mime.types on minimal systems.
+	// These are used as given, including the charset parameter, if any.
+	builtinMimeTypes = map[string]string{
+		"wasm":        "application/wasm",
+		"avif":        "image/avif",
+		"webp":        "image/webp",
+		"heic":        "image/heic",
+		"jxl":         "image/jxl",
+		"svg":         "image/svg+xml; charset=utf-8",
+		"js":          "application/javascript; charset=utf-8",
+		"mjs":         "application/javascript; charset=utf-8",
+		"json":        "application/json; charset=utf-8",
+		"map":         "application/json; charset=utf-8",
+		"webmanifest": "application/manifest+json; charset=utf-8",
+		"woff":        "font/woff",
+		"woff2":       "font/woff2",
+		"otf":         "font/otf",
+		"ttf":         "font/ttf",
+		"opus":        "audio/ogg",
+		"webm":        "video/webm",
+		"mp4":         "video/mp4",
+		"m4v":         "video/mp4",
+		"mkv":         "video/x-matroska",
+		"mov":         "video/quicktime",
+		"ogv":         "video/ogg",
+		"mp3":         "audio/mpeg",
+		"m4a":         "audio/mp4",
+		"ogg":         "audio/ogg",
+		"oga":         "audio/ogg",
+		"flac":        "audio/flac",
+		"wav":         "audio/wav",
+		"vtt":         "text/vtt; charset=utf-8",
+	}
+
+	// Mime types given with --mimetypes or from server.lua
+	mimeOverrides   = make(map[string]string)
+	mimeOverrideMut sync.RWMutex
+)
+
+// Add or replace the mime type for an extension. The mime type can
+// contain parameters, like "text/plain; charset=iso-8859-1".
+func setMimeType(ext, mimetype string) {
+	ext = strings.ToLower(strings.TrimPrefix(ext, "."))
+	mimeOverrideMut.Lock()
+	mimeOverrides[ext] = mimetype
+	mimeOverrideMut.Unlock()
+}
+
+// Return the overridden or built-in mime type for the extension, if there is one
+func mimeOverride(ext string) (string, bool) {
+	ext = strings.ToLower(strings.TrimPrefix(ext, "."))
+	mimeOverrideMut.RLock()
+	mimetype, ok := mimeOverrides[ext]
+	mimeOverrideMut.RUnlock()
+	if ok {
+		return mimetype, true
+	}
+	mimetype, ok = builtinMimeTypes[ext]
+	return mimetype, ok
+}
+
+// Read mime type overrides from a file in the mime.types format.
+// Parameters can be given after the mime type, like this:
+// text/plain; charset=iso-8859-1 txt asc
+func readMimeTypes(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if pos := strings.Index(line, "#"); pos != -1 {
+			line = line[:pos]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		mimetype := strings.TrimSuffix(fields[0], ";")
+		var exts []string
+		for _, field := range fields[1:] {
+			if strings.Contains(field, "=") {
+				mimetype += "; " + strings.TrimSuffix(strings.TrimPrefix(field, ";"), ";")
+			} else if field != ";" {
+				exts = append(exts, field)
+			}
+		}
+		for _, ext := range exts {
+			setMimeType(ext, mimetype)
+		}
+	}
+	return scanner.Err()
+}
+
+// Set the Content-Type header, given a filename extension
+func setContentType(w http.ResponseWriter, ext string) {
+	if mimetype, ok := mimeOverride(ext); ok {
+		w.Header().Set("Content-Type", mimetype)
+		return
+	}
+	if mimereader != nil {
+		mimereader.SetHeader(w, ext)
+	} else {
+		log.Error("Uninitialized mimereader!")
+	}
+}
+
+// Export the server configuration functions for overriding mime types
+func exportMimeTypeFunctions(L *lua.LState, filename string) {
+
+	// Set the mime type for an extension, like SetMimeType("wasm", "application/wasm")
+	L.SetGlobal("SetMimeType", L.NewFunction(func(L *lua.LState) int {
+		setMimeType(L.ToString(1), L.ToString(2))
+		return 0 // number of results
+	}))
+
+	// Read mime types from a file in the mime.types format, relative to the
+	// configuration script. Returns true on success.
+	L.SetGlobal("LoadMimeTypes", L.NewFunction(func(L *lua.LState) int {
+		mimeTypesFilename := L.ToString(1)
+		if !filepath.IsAbs(mimeTypesFilename) {
+			mimeTypesFilename = filepath.Join(filepath.Dir(filename), mimeTypesFilename)
+		}
+		if err := readMimeTypes(mimeTypesFilename); err != nil {
+			log.Error(err)
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMimeTypes(t *testing.T) {
+	f, err := ioutil.TempFile("", "mime.types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# comment\ntext/plain; charset=iso-8859-1 asc nfo\napplication/x-custom custom\n")
+	f.Close()
+	if err := readMimeTypes(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if mimetype, _ := mimeOverride(".nfo"); mimetype != "text/plain; charset=iso-8859-1" {
+		t.Error("unexpected mime type for nfo: " + mimetype)
+	}
+	if mimetype, _ := mimeOverride("custom"); mimetype != "application/x-custom" {
+		t.Error("unexpected mime type for custom: " + mimetype)
+	}
+	if mimetype, _ := mimeOverride("wasm"); mimetype != "application/wasm" {
+		t.Error("unexpected mime type for wasm: " + mimetype)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+// Mirroring of requests, for testing a new version of an application against
+// real traffic. A percentage of the requests is copied and sent to another
+// server, or written to a log file, in the background. The responses from the
+// mirror are discarded, so the clients are not affected.
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Requests with larger bodies than this are not mirrored
+	maxMirrorBodySize = 1 * MiB
+
+	// How many requests may wait to be mirrored, before new ones are dropped
+	mirrorQueueSize = 256
+
+	// How many requests are sent to the mirror at the same time
+	mirrorWorkers = 4
+
+	// How long to wait for the mirror to respond
+	mirrorTimeout = 10 * time.Second
+
+	// The header that is added to mirrored requests
+	mirrorHeader = "X-Algernon-Mirror"
+)
+
+// Headers that are only for one connection, and are not mirrored
+var hopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// Headers that are left out of the mirror log file
+var redactedMirrorHeaders = []string{"Authorization", "Cookie"}
+
+// A request that is to be mirrored, and how it was responded to
+type mirroredRequest struct {
+	Time     string      `json:"time"`
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Host     string      `json:"host"`
+	Remote   string      `json:"remote"`
+	Header   http.Header `json:"header"`
+	Body     string      `json:"body,omitempty"`
+	Status   int         `json:"status"`
+	Duration string      `json:"duration"`
+}
+
+// Mirrors requests to an URL or a log file
+type requestMirror struct {
+	target  string // an http:// or https:// URL, or a filename
+	percent float64
+	queue   chan *mirroredRequest
+	client  *http.Client
+	logFile *os.File
+	logMut  sync.Mutex
+	dropped int64
+}
+
+// Create a request mirror, and start sending requests to the target, which is
+// either an URL or a filename. percent is the percentage of requests to mirror.
+func newRequestMirror(target string, percent float64) (*requestMirror, error) {
+	m := &requestMirror{
+		target:  strings.TrimSuffix(target, "/"),
+		percent: percent,
+		queue:   make(chan *mirroredRequest, mirrorQueueSize),
+	}
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		m.client = &http.Client{
+			Timeout: mirrorTimeout,
+			// Redirects from the mirror are not followed
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	} else {
+		f, err := os.OpenFile(target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		m.logFile = f
+		atShutdown(func() {
+			m.logMut.Lock()
+			m.logFile.Close()
+			m.logMut.Unlock()
+		})
+	}
+	for i := 0; i < mirrorWorkers; i++ {
+		go func() {
+			for mr := range m.queue {
+				m.send(mr)
+			}
+		}()
+	}
+	return m, nil
+}
+
+// Check if a request should be mirrored
+func (m *requestMirror) sample(req *http.Request) bool {
+	// Websockets and other upgraded connections can not be replayed
+	if req.Header.Get("Upgrade") != "" || req.ContentLength > maxMirrorBodySize {
+		return false
+	}
+	return m.percent >= 100 || rand.Float64()*100 < m.percent
+}
+
+// Add a request to the queue. If the queue is full, the request is dropped,
+// so that a slow mirror does not use up the memory.
+func (m *requestMirror) enqueue(mr *mirroredRequest) {
+	select {
+	case m.queue <- mr:
+	default:
+		if dropped := atomic.AddInt64(&m.dropped, 1); dropped%100 == 1 {
+			log.Warnf("The mirror at %s is falling behind, %d requests have not been mirrored", m.target, dropped)
+		}
+	}
+}
+
+// Send a request to the mirror, or write it to the log file
+func (m *requestMirror) send(mr *mirroredRequest) {
+	if m.logFile != nil {
+		for _, name := range redactedMirrorHeaders {
+			mr.Header.Del(name)
+		}
+		data, err := json.Marshal(mr)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		m.logMut.Lock()
+		_, err = m.logFile.Write(append(data, '\n'))
+		m.logMut.Unlock()
+		if err != nil {
+			log.Error("Could not write to ", m.target, ": ", err)
+		}
+		return
+	}
+	req, err := http.NewRequest(mr.Method, m.target+mr.URL, strings.NewReader(mr.Body))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	req.Header = mr.Header
+	req.Host = mr.Host
+	req.Header.Set(mirrorHeader, "1")
+	if ip, _, err := net.SplitHostPort(mr.Remote); err == nil {
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		log.Warn("Could not mirror ", mr.Method, " ", mr.URL, ": ", err)
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	// A different status from the mirror may be a regression
+	if resp.StatusCode != mr.Status {
+		log.Warnf("%s %s: %d, but %d from the mirror", mr.Method, mr.URL, mr.Status, resp.StatusCode)
+	}
+}
+
+// Serve the request, then mirror a copy of it in the background
+func (m *requestMirror) handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !m.sample(req) {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		// Read the body, and let the handler read it again
+		var body []byte
+		if req.Body != nil {
+			var err error
+			body, err = ioutil.ReadAll(io.LimitReader(req.Body, maxMirrorBodySize+1))
+			req.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+			if err != nil || len(body) > maxMirrorBodySize {
+				handler.ServeHTTP(w, req)
+				return
+			}
+		}
+		header := make(http.Header, len(req.Header))
+		for name, values := range req.Header {
+			header[name] = append([]string{}, values...)
+		}
+		for _, name := range hopByHopHeaders {
+			header.Del(name)
+		}
+		uri := req.URL.RequestURI()
+		start := time.Now()
+		sr := newStatusRecorder(w)
+		handler.ServeHTTP(sr, req)
+		m.enqueue(&mirroredRequest{
+			Time:     start.UTC().Format(time.RFC3339),
+			Method:   req.Method,
+			URL:      uri,
+			Host:     req.Host,
+			Remote:   req.RemoteAddr,
+			Header:   header,
+			Body:     string(body),
+			Status:   sr.status,
+			Duration: time.Since(start).String(),
+		})
+	})
+}
@@ -0,0 +1,498 @@
+package main
+
+// Models, for storing Lua tables as records in the database, without having
+// to come up with a key layout for every kind of record. The records of a
+// model are stored in a HashMap named "model:" + the name of the model, with
+// the ID of the record as the element ID and one key per field. New IDs are
+// counted upwards, with a KeyValue of the same name.
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xyproto/pinterface"
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	// Identifier for the Model class in Lua
+	lModelClass = "MODEL"
+
+	// The prefix of the HashMap and KeyValue for the records of a model
+	modelPrefix = "model:"
+
+	// The field with the ID of a record
+	modelIDField = "id"
+
+	// The default number of records per page, for paginate
+	defaultModelPerPage = 20
+)
+
+// The types of model fields
+var modelFieldTypes = map[string]bool{
+	"string": true,
+	"number": true,
+	"bool":   true,
+}
+
+// A field in a model
+type modelField struct {
+	name     string
+	kind     string
+	required bool
+}
+
+// A model, and where the records are stored
+type model struct {
+	name   string
+	fields []modelField
+	hash   pinterface.IHashMap
+	ids    pinterface.IKeyValue
+}
+
+// Parse a comma separated list of fields, on the form "name*:type", where
+// "*" marks a required field and the type is "string" (the default),
+// "number" or "bool". For example: "title*, body, views:number, draft:bool"
+func parseModelFields(spec string) ([]modelField, error) {
+	var fields []modelField
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		field := modelField{kind: "string"}
+		if pos := strings.Index(part, ":"); pos != -1 {
+			field.kind = strings.ToLower(strings.TrimSpace(part[pos+1:]))
+			part = strings.TrimSpace(part[:pos])
+		}
+		if strings.HasSuffix(part, "*") {
+			field.required = true
+			part = strings.TrimSpace(part[:len(part)-1])
+		}
+		field.name = part
+		if !formNameRegexp.MatchString(field.name) || field.name == modelIDField {
+			return nil, fmt.Errorf("invalid model field name: %q", field.name)
+		}
+		if !modelFieldTypes[field.kind] {
+			return nil, fmt.Errorf("unknown model field type: %q", field.kind)
+		}
+		fields = append(fields, field)
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("a model must have at least one field")
+	}
+	return fields, nil
+}
+
+// Create a model, with fields as described by parseModelFields
+func newModel(creator pinterface.ICreator, name, fieldSpec string) (*model, error) {
+	if !formNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid model name: %q", name)
+	}
+	fields, err := parseModelFields(fieldSpec)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := creator.NewHashMap(modelPrefix + name)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := creator.NewKeyValue(modelPrefix + name)
+	if err != nil {
+		return nil, err
+	}
+	return &model{name: name, fields: fields, hash: hash, ids: ids}, nil
+}
+
+// Convert a Lua value to the string that is stored for the given type
+func encodeModelValue(kind string, value lua.LValue) (string, error) {
+	switch kind {
+	case "number":
+		switch v := value.(type) {
+		case lua.LNumber:
+			return strconv.FormatFloat(float64(v), 'g', -1, 64), nil
+		case lua.LString:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(string(v)), 64); err == nil {
+				return strconv.FormatFloat(f, 'g', -1, 64), nil
+			}
+		}
+		return "", fmt.Errorf("not a number: %s", value.String())
+	case "bool":
+		switch v := value.(type) {
+		case lua.LBool:
+			return strconv.FormatBool(bool(v)), nil
+		case lua.LString:
+			if b, err := strconv.ParseBool(string(v)); err == nil {
+				return strconv.FormatBool(b), nil
+			}
+		}
+		return "", fmt.Errorf("not a boolean: %s", value.String())
+	}
+	switch value.(type) {
+	case lua.LString, lua.LNumber, lua.LBool:
+		return value.String(), nil
+	}
+	return "", fmt.Errorf("not a string: %s", value.Type().String())
+}
+
+// Convert a stored string to a Lua value of the given type
+func decodeModelValue(kind, value string) lua.LValue {
+	switch kind {
+	case "number":
+		f, _ := strconv.ParseFloat(value, 64)
+		return lua.LNumber(f)
+	case "bool":
+		return lua.LBool(value == "true")
+	}
+	return lua.LString(value)
+}
+
+// Check the fields of a Lua table, and convert them to the strings that are stored
+func (m *model) encode(record *lua.LTable) (map[string]string, error) {
+	known := map[string]bool{modelIDField: true}
+	values := make(map[string]string)
+	for _, field := range m.fields {
+		known[field.name] = true
+		value := record.RawGetString(field.name)
+		if value == lua.LNil || (field.required && field.kind == "string" && strings.TrimSpace(value.String()) == "") {
+			if field.required {
+				return nil, fmt.Errorf("%s is required", field.name)
+			}
+			continue
+		}
+		encoded, err := encodeModelValue(field.kind, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", field.name, err)
+		}
+		values[field.name] = encoded
+	}
+	var unknown error
+	record.ForEach(func(key, _ lua.LValue) {
+		if name, ok := key.(lua.LString); !ok || !known[string(name)] {
+			unknown = fmt.Errorf("%s is not a field in %s", key.String(), m.name)
+		}
+	})
+	return values, unknown
+}
+
+// Save a record with the given ID, or with a new ID if it is blank.
+// Fields that are not given are removed. Returns the ID.
+func (m *model) save(id string, values map[string]string) (string, error) {
+	if id == "" {
+		var err error
+		if id, err = m.ids.Inc(modelIDField); err != nil {
+			return "", err
+		}
+	}
+	// The ID is also stored as a field, so that records without fields exist
+	if err := m.hash.Set(id, modelIDField, id); err != nil {
+		return "", err
+	}
+	for _, field := range m.fields {
+		value, ok := values[field.name]
+		if !ok {
+			m.hash.DelKey(id, field.name)
+			continue
+		}
+		if err := m.hash.Set(id, field.name, value); err != nil {
+			return "", err
+		}
+	}
+	return id, nil
+}
+
+// Read a record, as a Lua table. Returns nil if the record does not exist.
+func (m *model) find(L *lua.LState, id string) *lua.LTable {
+	if exists, err := m.hash.Exists(id); err != nil || !exists {
+		return nil
+	}
+	record := L.NewTable()
+	record.RawSetString(modelIDField, lua.LString(id))
+	for _, field := range m.fields {
+		if value, err := m.hash.Get(id, field.name); err == nil {
+			record.RawSetString(field.name, decodeModelValue(field.kind, value))
+		}
+	}
+	return record
+}
+
+// For sorting record IDs in the order they were created. The numeric IDs
+// come first, in numeric order.
+type recordIDs []string
+
+func (ids recordIDs) Len() int {
+	return len(ids)
+}
+
+func (ids recordIDs) Less(i, j int) bool {
+	a, errA := strconv.ParseInt(ids[i], 10, 64)
+	b, errB := strconv.ParseInt(ids[j], 10, 64)
+	if errA == nil && errB == nil {
+		return a < b
+	}
+	if (errA == nil) != (errB == nil) {
+		return errA == nil
+	}
+	return ids[i] < ids[j]
+}
+
+func (ids recordIDs) Swap(i, j int) {
+	ids[i], ids[j] = ids[j], ids[i]
+}
+
+// Return the IDs of all the records, in the order they were created
+func (m *model) allIDs() []string {
+	ids, err := m.hash.GetAll()
+	if err != nil {
+		return []string{}
+	}
+	sort.Sort(recordIDs(ids))
+	return ids
+}
+
+// Return the records that match the given criteria, which can be nil, a
+// table with field values or a Lua function that takes a record and returns
+// true for the records that should be included
+func (m *model) filter(L *lua.LState, criteria lua.LValue) ([]*lua.LTable, error) {
+	var conditions map[string]string
+	if table, ok := criteria.(*lua.LTable); ok {
+		conditions = make(map[string]string)
+		var err error
+		table.ForEach(func(key, value lua.LValue) {
+			name := key.String()
+			kind := "string"
+			for _, field := range m.fields {
+				if field.name == name {
+					kind = field.kind
+				}
+			}
+			encoded, encodeErr := encodeModelValue(kind, value)
+			if encodeErr != nil {
+				err = fmt.Errorf("%s: %s", name, encodeErr)
+			}
+			conditions[name] = encoded
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	fn, _ := criteria.(*lua.LFunction)
+	var records []*lua.LTable
+	for _, id := range m.allIDs() {
+		record := m.find(L, id)
+		if record == nil {
+			continue
+		}
+		matches := true
+		for name, value := range conditions {
+			if stored, err := m.hash.Get(id, name); err != nil || stored != value {
+				matches = false
+				break
+			}
+		}
+		if matches && fn != nil {
+			if err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, record); err != nil {
+				return nil, err
+			}
+			matches = lua.LVAsBool(L.Get(-1))
+			L.Pop(1)
+		}
+		if matches {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// Get the first argument, "self", and cast it from userdata to a model.
+func checkModel(L *lua.LState) *model {
+	ud := L.CheckUserData(1)
+	if m, ok := ud.Value.(*model); ok {
+		return m
+	}
+	L.ArgError(1, "model expected")
+	return nil
+}
+
+// Convert a list of records to a Lua table
+func records2table(L *lua.LState, records []*lua.LTable) *lua.LTable {
+	table := L.NewTable()
+	for _, record := range records {
+		table.Append(record)
+	}
+	return table
+}
+
+// String representation
+// model:__tostring() -> string
+func modelToString(L *lua.LState) int {
+	m := checkModel(L) // arg 1
+	names := make([]string, len(m.fields))
+	for i, field := range m.fields {
+		names[i] = field.name
+	}
+	L.Push(lua.LString(m.name + ": " + strings.Join(names, ", ")))
+	return 1 // Number of returned values
+}
+
+// Save a record. The record gets an ID if it does not have one.
+// Returns the ID, or nil and an error message.
+// model:save(table) -> string
+func modelSave(L *lua.LState) int {
+	m := checkModel(L) // arg 1
+	record := L.CheckTable(2)
+	values, err := m.encode(record)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // Number of returned values
+	}
+	id := ""
+	if value := record.RawGetString(modelIDField); value != lua.LNil {
+		id = value.String()
+	}
+	id, err = m.save(id, values)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // Number of returned values
+	}
+	record.RawSetString(modelIDField, lua.LString(id))
+	L.Push(lua.LString(id))
+	return 1 // Number of returned values
+}
+
+// Find a record by ID. Returns nil if it does not exist.
+// model:find(string) -> table
+func modelFind(L *lua.LState) int {
+	m := checkModel(L) // arg 1
+	id := L.ToString(2)
+	if record := m.find(L, id); record != nil {
+		L.Push(record)
+	} else {
+		L.Push(lua.LNil)
+	}
+	return 1 // Number of returned values
+}
+
+// Return the records that match a table of field values, or a function
+// model:filter([table or function]) -> table
+func modelFilter(L *lua.LState) int {
+	m := checkModel(L) // arg 1
+	records, err := m.filter(L, L.Get(2))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // Number of returned values
+	}
+	L.Push(records2table(L, records))
+	return 1 // Number of returned values
+}
+
+// Return one page of the records, and the number of pages. The page
+// numbers start at 1. Takes an optional number of records per page and the
+// same criteria as filter.
+// model:paginate(number[, number[, table or function]]) -> table, number
+func modelPaginate(L *lua.LState) int {
+	m := checkModel(L) // arg 1
+	page := L.OptInt(2, 1)
+	perPage := L.OptInt(3, defaultModelPerPage)
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = defaultModelPerPage
+	}
+	records, err := m.filter(L, L.Get(4))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // Number of returned values
+	}
+	pages := (len(records) + perPage - 1) / perPage
+	start := (page - 1) * perPage
+	if start > len(records) {
+		start = len(records)
+	}
+	end := start + perPage
+	if end > len(records) {
+		end = len(records)
+	}
+	L.Push(records2table(L, records[start:end]))
+	L.Push(lua.LNumber(pages))
+	return 2 // Number of returned values
+}
+
+// Remove a record. Returns true if successful.
+// model:delete(string) -> bool
+func modelDelete(L *lua.LState) int {
+	m := checkModel(L) // arg 1
+	id := L.ToString(2)
+	L.Push(lua.LBool(nil == m.hash.Del(id)))
+	return 1 // Number of returned values
+}
+
+// Return the number of records
+// model:count() -> number
+func modelCount(L *lua.LState) int {
+	m := checkModel(L) // arg 1
+	L.Push(lua.LNumber(len(m.allIDs())))
+	return 1 // Number of returned values
+}
+
+// The model methods that are to be registered
+var modelMethods = map[string]lua.LGFunction{
+	"__tostring": modelToString,
+	"save":       modelSave,
+	"find":       modelFind,
+	"filter":     modelFilter,
+	"paginate":   modelPaginate,
+	"delete":     modelDelete,
+	"count":      modelCount,
+}
+
+// Make the model functions available to Lua scripts
+func exportModel(L *lua.LState, userstate pinterface.IUserState) {
+	creator := userstate.Creator()
+
+	// Register the model class and the methods that belongs with it.
+	mt := L.NewTypeMetatable(lModelClass)
+	mt.RawSetH(lua.LString("__index"), mt)
+	L.SetFuncs(mt, modelMethods)
+
+	modelTable := L.NewTable()
+
+	// Define a model, given a name and the fields as a comma separated
+	// string or a table of strings, like "title*, body, views:number".
+	// Returns the model, or nil and an error message.
+	L.SetField(modelTable, "define", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		var spec string
+		switch v := L.Get(2).(type) {
+		case *lua.LTable:
+			var specs []string
+			v.ForEach(func(_, value lua.LValue) {
+				specs = append(specs, value.String())
+			})
+			spec = strings.Join(specs, ",")
+		default:
+			spec = L.ToString(2)
+		}
+		m, err := newModel(creator, name, spec)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // Number of returned values
+		}
+		ud := L.NewUserData()
+		ud.Value = m
+		L.SetMetatable(ud, L.GetTypeMetatable(lModelClass))
+		L.Push(ud)
+		return 1 // Number of returned values
+	}))
+
+	L.SetGlobal("model", modelTable)
+}
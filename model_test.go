@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+func TestModel(t *testing.T) {
+	if _, err := parseModelFields("title*, views:number, id"); err == nil {
+		t.Error("expected id to be rejected as a field name")
+	}
+	if _, err := parseModelFields("title:date"); err == nil {
+		t.Error("expected an unknown field type to be rejected")
+	}
+	L := lua.NewState()
+	defer L.Close()
+	exportModel(L, newMemoryUserState(newMemoryStore()))
+	err := L.DoString(`
+Post = model.define("post", "title*, views:number, draft:bool")
+assert(Post:save({views = 1}) == nil, "a required field is missing")
+assert(Post:save({title = "a", views = 3, draft = true}) == "1")
+local b = {title = "b", views = "4", draft = false}
+assert(Post:save(b) == "2" and b.id == "2")
+b.views = 5
+assert(Post:save(b) == "2")
+assert(Post:find("2").views == 5)
+assert(Post:find("3") == nil)
+assert(#Post:filter({draft = false}) == 1)
+assert(#Post:filter(function(p) return p.views > 2 end) == 2)
+local page, pages = Post:paginate(2, 1)
+assert(pages == 2 and page[1].title == "b")
+assert(Post:delete("1") and Post:count() == 1)
+`)
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+// Configuration for a directory and its subdirectories, in .algernon.toml files.
+// Only a fixed set of settings can be changed, and no code is run:
+//
+//     theme = "dark"                  # theme for Markdown and directory listings
+//     index = ["index.md"]            # index files, in order of priority
+//     listing = false                 # show a directory listing if there is no index file
+//
+//     [cache]
+//     max_age = 3600                  # or control = "public, max-age=3600"
+//
+//     [headers]
+//     X-Frame-Options = "DENY"
+//
+//     [access]
+//     allow = ["127.0.0.1", "10.0.0.0/8"]
+//     deny = ["10.0.0.13"]
+//     login = "admin"                 # or "user"
+//
+// The files in the parent directories are merged, and the closest file wins.
+// Access rules are not replaced, but added to the ones from the parent
+// directories, so that a subdirectory can not loosen them.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// The name of the configuration file for a directory
+	overlayFilename = ".algernon.toml"
+
+	// How long the merged settings for a directory are used before the
+	// .algernon.toml files are checked again
+	overlayCheckInterval = 2 * time.Second
+
+	// The maximum number of directories to remember the merged settings for
+	maxMergedOverlays = 1024
+)
+
+// The access rules from one .algernon.toml file
+type overlayAccess struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	login string // "user", "admin" or blank
+}
+
+// The settings for a directory
+type dirOverlay struct {
+	theme        string
+	index        []string
+	listing      *bool
+	cacheControl string
+	headers      map[string]string
+	access       []*overlayAccess
+	err          error // a file that could not be read, which blocks the directory
+}
+
+// A parsed .algernon.toml file, and when it was changed
+type overlayFile struct {
+	modTime time.Time
+	overlay *dirOverlay
+}
+
+// The merged settings for a directory, and when the files were checked
+type mergedOverlay struct {
+	checked time.Time
+	overlay *dirOverlay
+}
+
+// The parsed .algernon.toml files and the merged settings, by directory
+type overlayCache struct {
+	mut    sync.Mutex
+	files  map[string]*overlayFile
+	merged map[string]*mergedOverlay
+}
+
+// Parse a TOML value: a string, a number, a boolean or an array of those
+func parseTOMLValue(s string) (interface{}, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "":
+		return nil, errors.New("missing value")
+	case s == "true":
+		return true, nil
+	case s == "false":
+		return false, nil
+	case strings.HasPrefix(s, `"`):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, errors.New("unterminated string: " + s)
+		}
+		return s[1 : len(s)-1], nil
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return nil, errors.New("unterminated array: " + s)
+		}
+		var (
+			values  []interface{}
+			element bytes.Buffer
+			quote   rune
+		)
+		inner := strings.TrimSpace(s[1 : len(s)-1])
+		for _, r := range inner + "," {
+			switch {
+			case quote != 0:
+				if r == quote {
+					quote = 0
+				}
+			case r == '"' || r == '\'':
+				quote = r
+			case r == ',':
+				if e := strings.TrimSpace(element.String()); e != "" {
+					value, err := parseTOMLValue(e)
+					if err != nil {
+						return nil, err
+					}
+					values = append(values, value)
+				}
+				element.Reset()
+				continue
+			}
+			element.WriteRune(r)
+		}
+		return values, nil
+	}
+	if i, err := strconv.ParseInt(strings.Replace(s, "_", "", -1), 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(strings.Replace(s, "_", "", -1), 64); err == nil {
+		return f, nil
+	}
+	return nil, errors.New("invalid value: " + s)
+}
+
+// Remove a comment from a line, unless the "#" is in a string
+func stripTOMLComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// Parse the subset of TOML that is used by .algernon.toml files: tables and
+// keys with strings, numbers, booleans and arrays. The keys are returned as
+// "table.key".
+func parseTOML(data []byte) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	table := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(stripTOMLComment(scanner.Text()))
+		// Arrays may span several lines
+		for strings.Count(line, "[") > strings.Count(line, "]") && !strings.HasPrefix(line, "[") && scanner.Scan() {
+			lineNumber++
+			line += " " + strings.TrimSpace(stripTOMLComment(scanner.Text()))
+		}
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: invalid table: %s", lineNumber, line)
+			}
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNumber)
+		}
+		key := strings.Trim(strings.TrimSpace(fields[0]), `"`)
+		if table != "" {
+			key = table + "." + key
+		}
+		value, err := parseTOMLValue(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+		}
+		if _, exists := values[key]; exists {
+			return nil, fmt.Errorf("line %d: %s is given twice", lineNumber, key)
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
+
+// Convert a string or an array of strings to a list of strings
+func tomlStrings(value interface{}) ([]string, bool) {
+	switch v := value.(type) {
+	case string:
+		return []string{v}, true
+	case []interface{}:
+		var values []string
+		for _, element := range v {
+			s, ok := element.(string)
+			if !ok {
+				return nil, false
+			}
+			values = append(values, s)
+		}
+		return values, true
+	}
+	return nil, false
+}
+
+// Parse IP addresses and networks, like "10.0.0.13" or "10.0.0.0/8"
+func parseNetworks(addresses []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, address := range addresses {
+		if !strings.Contains(address, "/") {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				return nil, errors.New("invalid IP address: " + address)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Parse the settings in a .algernon.toml file. Unknown settings are errors,
+// so that a misspelled access rule is not ignored.
+func parseOverlay(data []byte) (*dirOverlay, error) {
+	values, err := parseTOML(data)
+	if err != nil {
+		return nil, err
+	}
+	o := &dirOverlay{}
+	access := &overlayAccess{}
+	for key, value := range values {
+		ok := true
+		switch {
+		case key == "theme":
+			o.theme, ok = value.(string)
+		case key == "index":
+			o.index, ok = tomlStrings(value)
+		case key == "listing":
+			var listing bool
+			listing, ok = value.(bool)
+			o.listing = &listing
+		case key == "cache.control":
+			o.cacheControl, ok = value.(string)
+		case key == "cache.max_age":
+			var maxAge int64
+			if maxAge, ok = value.(int64); ok && o.cacheControl == "" {
+				o.cacheControl = fmt.Sprintf("public, max-age=%d", maxAge)
+			}
+		case strings.HasPrefix(key, "headers."):
+			if o.headers == nil {
+				o.headers = make(map[string]string)
+			}
+			o.headers[strings.TrimPrefix(key, "headers.")], ok = value.(string)
+		case key == "access.allow", key == "access.deny":
+			var addresses []string
+			if addresses, ok = tomlStrings(value); ok {
+				networks, err := parseNetworks(addresses)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %s", key, err)
+				}
+				if key == "access.allow" {
+					access.allow = networks
+				} else {
+					access.deny = networks
+				}
+			}
+		case key == "access.login":
+			access.login, ok = value.(string)
+			if ok && access.login != "user" && access.login != "admin" {
+				return nil, errors.New(`access.login must be "user" or "admin"`)
+			}
+		default:
+			return nil, errors.New("unknown setting: " + key)
+		}
+		if !ok {
+			return nil, errors.New("invalid value for " + key)
+		}
+	}
+	if access.allow != nil || access.deny != nil || access.login != "" {
+		o.access = []*overlayAccess{access}
+	}
+	return o, nil
+}
+
+// Return the settings from the .algernon.toml file in the given directory,
+// or nil if there is none. The file is read again if it has changed.
+func (ac *algernonConfig) readOverlay(dir string) *dirOverlay {
+	filename := filepath.Join(dir, overlayFilename)
+	fi, err := os.Stat(filename)
+	ac.overlays.mut.Lock()
+	defer ac.overlays.mut.Unlock()
+	if err != nil {
+		delete(ac.overlays.files, dir)
+		return nil
+	}
+	if f, ok := ac.overlays.files[dir]; ok && f.modTime.Equal(fi.ModTime()) {
+		return f.overlay
+	}
+	var overlay *dirOverlay
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		overlay, err = parseOverlay(data)
+	}
+	if err != nil {
+		log.Errorf("Could not read %s: %s", filename, err)
+		overlay = &dirOverlay{err: err}
+	}
+	if ac.overlays.files == nil {
+		ac.overlays.files = make(map[string]*overlayFile)
+	}
+	ac.overlays.files[dir] = &overlayFile{fi.ModTime(), overlay}
+	return overlay
+}
+
+// Return the merged settings from the .algernon.toml files from the server
+// directory down to the given directory, or nil if there are none. The
+// settings are remembered for a little while, so that the parent directories
+// are not checked for every request.
+func (ac *algernonConfig) overlayFor(dirname string) *dirOverlay {
+	now := time.Now()
+	ac.overlays.mut.Lock()
+	m, ok := ac.overlays.merged[dirname]
+	ac.overlays.mut.Unlock()
+	if ok && now.Sub(m.checked) < overlayCheckInterval {
+		return m.overlay
+	}
+	merged := ac.mergeOverlays(dirname)
+	ac.overlays.mut.Lock()
+	defer ac.overlays.mut.Unlock()
+	if ac.overlays.merged == nil || len(ac.overlays.merged) >= maxMergedOverlays {
+		ac.overlays.merged = make(map[string]*mergedOverlay)
+	}
+	ac.overlays.merged[dirname] = &mergedOverlay{now, merged}
+	return merged
+}
+
+// Merge the settings from the .algernon.toml files from the server directory
+// down to the given directory. Returns nil if there are none.
+func (ac *algernonConfig) mergeOverlays(dirname string) *dirOverlay {
+	rel, err := filepath.Rel(ac.serverDirOrFilename, dirname)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return nil
+	}
+	dirs := []string{ac.serverDirOrFilename}
+	if rel != "." {
+		dir := ac.serverDirOrFilename
+		for _, part := range strings.Split(rel, string(filepath.Separator)) {
+			dir = filepath.Join(dir, part)
+			dirs = append(dirs, dir)
+		}
+	}
+	var merged *dirOverlay
+	for _, dir := range dirs {
+		o := ac.readOverlay(dir)
+		if o == nil {
+			continue
+		}
+		if merged == nil {
+			merged = &dirOverlay{}
+		}
+		if o.err != nil {
+			merged.err = o.err
+		}
+		if o.theme != "" {
+			merged.theme = o.theme
+		}
+		if o.index != nil {
+			merged.index = o.index
+		}
+		if o.listing != nil {
+			merged.listing = o.listing
+		}
+		if o.cacheControl != "" {
+			merged.cacheControl = o.cacheControl
+		}
+		for name, value := range o.headers {
+			if merged.headers == nil {
+				merged.headers = make(map[string]string)
+			}
+			merged.headers[name] = value
+		}
+		merged.access = append(merged.access, o.access...)
+	}
+	return merged
+}
+
+// Check if an IP address is in one of the given networks
+func inNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if a request is allowed by all the access rules
+func (ac *algernonConfig) overlayAllows(req *http.Request, o *dirOverlay) bool {
+	ip := net.ParseIP(clientIP(req))
+	for _, access := range o.access {
+		if access.allow != nil && (ip == nil || !inNetworks(ip, access.allow)) {
+			return false
+		}
+		if access.deny != nil && ip != nil && inNetworks(ip, access.deny) {
+			return false
+		}
+		if access.login != "" {
+			userstate := ac.perm.UserState()
+			username := userstate.Username(req)
+			if username == "" || !userstate.IsLoggedIn(username) {
+				return false
+			}
+			if access.login == "admin" && !userstate.IsAdmin(username) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Apply the settings for the directory of the requested file. Returns false
+// if the request has been denied.
+func (ac *algernonConfig) applyOverlay(w http.ResponseWriter, req *http.Request, o *dirOverlay) bool {
+	if o.err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, messagePage("Configuration error", "<p>The "+overlayFilename+" file for this directory is invalid.</p>", ac.defaultTheme))
+		return false
+	}
+	if !ac.overlayAllows(req, o) {
+		tracef(req, "Denied by %s", overlayFilename)
+		ac.perm.DenyFunction()(w, req)
+		return false
+	}
+	for name, value := range o.headers {
+		w.Header().Set(name, value)
+	}
+	if o.cacheControl != "" {
+		w.Header().Set("Cache-Control", o.cacheControl)
+	}
+	return true
+}
+
+// Return the theme for pages in the given directory
+func (ac *algernonConfig) themeFor(dirname string) string {
+	if o := ac.overlayFor(dirname); o != nil && o.theme != "" {
+		return o.theme
+	}
+	return ac.defaultTheme
+}
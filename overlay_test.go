@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseOverlay(t *testing.T) {
+	o, err := parseOverlay([]byte(`theme = "dark" # comment
+index = [
+  "index.md",
+  "README.md",
+]
+listing = false
+
+[cache]
+max_age = 3600
+
+[headers]
+X-Frame-Options = "DENY"
+
+[access]
+allow = ["127.0.0.1", "10.0.0.0/8"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.theme != "dark" || len(o.index) != 2 || o.listing == nil || *o.listing {
+		t.Errorf("unexpected settings: %+v", o)
+	}
+	if o.cacheControl != "public, max-age=3600" || o.headers["X-Frame-Options"] != "DENY" {
+		t.Errorf("unexpected headers: %+v", o)
+	}
+	if len(o.access) != 1 || !inNetworks(net.ParseIP("10.1.2.3"), o.access[0].allow) || inNetworks(net.ParseIP("192.168.0.1"), o.access[0].allow) {
+		t.Errorf("unexpected access rules: %+v", o.access)
+	}
+	if _, err := parseOverlay([]byte("[access]\nalow = [\"127.0.0.1\"]\n")); err == nil {
+		t.Error("expected an error for an unknown setting")
+	}
+}
+
+func TestOverlayFor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sub := filepath.Join(dir, "sub")
+	os.Mkdir(sub, 0755)
+	ioutil.WriteFile(filepath.Join(dir, overlayFilename), []byte(`theme = "dark"`), 0644)
+	ac := newAlgernonConfig()
+	ac.serverDirOrFilename = dir
+	if theme := ac.themeFor(sub); theme != "dark" {
+		t.Errorf("expected the theme from the parent directory, got %q", theme)
+	}
+
+	// The merged settings are remembered for a little while
+	ioutil.WriteFile(filepath.Join(sub, overlayFilename), []byte(`theme = "light"`), 0644)
+	if theme := ac.themeFor(sub); theme != "dark" {
+		t.Errorf("expected the remembered theme, got %q", theme)
+	}
+	ac.overlays.merged[sub].checked = time.Now().Add(-overlayCheckInterval)
+	if theme := ac.themeFor(sub); theme != "light" {
+		t.Errorf("expected the theme from the subdirectory, got %q", theme)
+	}
+}
+
+func TestApplyOverlayLogin(t *testing.T) {
+	ac := newAlgernonConfig()
+	var err error
+	if ac.perm, err = ac.memoryBackend(); err != nil {
+		t.Fatal(err)
+	}
+	o := &dirOverlay{access: []*overlayAccess{{login: "user"}}}
+	w := httptest.NewRecorder()
+	if ac.applyOverlay(w, httptest.NewRequest("GET", "/", nil), o) || w.Code != http.StatusForbidden {
+		t.Errorf("expected the request to be denied when nobody is logged in, got %d", w.Code)
+	}
+}
@@ -25,7 +25,7 @@ func pongoPageTest(n int, t *testing.T) {
 
 	ac := newAlgernonConfig()
 
-	ac.cache = datablock.NewFileCache(20000000, true, 64*KiB, true)
+	ac.cache = newFileCache(20000000, true, 64*KiB, true)
 
 	luablock, err := ac.cache.Read(luafilename, ac.shouldCache(".po2"))
 	assert.Equal(t, err, nil)
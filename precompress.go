@@ -0,0 +1,159 @@
+package main
+
+// Writing fingerprinted and compressed copies of static assets ahead of time,
+// with "algernon manifest -hashed -gzip", and serving the compressed .gz
+// files with --precompressed, so that nothing has to be compressed when the
+// assets are requested
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The file extensions of assets that are already compressed
+var compressedAssetExtensions = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true,
+	".woff": true, ".woff2": true,
+}
+
+// Matches the fingerprint in filenames like "style.3a7bd3e2360a.css"
+var hashedAssetPattern = regexp.MustCompile(`\.[0-9a-f]{12}(\.[^./\\]+)$`)
+
+// Check if an asset is served as it is, and not built from GCSS, SCSS or JSX
+func servedAsIs(filename string) bool {
+	return staticAssetExtensions[strings.ToLower(filepath.Ext(filename))]
+}
+
+// Return the filename for a copy of an asset, with the fingerprint in it,
+// like "style.3a7bd3e2360a.css" for "style.css"
+func hashedFilename(filename, fp string) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "." + fp + ext
+}
+
+// Check if a file is a fingerprinted copy of an asset that is next to it
+func isHashedCopy(filename string) bool {
+	if !hashedAssetPattern.MatchString(filename) {
+		return false
+	}
+	_, err := os.Stat(hashedAssetPattern.ReplaceAllString(filename, "$1"))
+	return err == nil
+}
+
+// Write a compressed copy of an asset to FILENAME.gz, if the asset is served
+// as it is and compressing it makes it smaller. Returns true if a compressed
+// copy was written.
+func precompressAsset(filename string) (bool, error) {
+	if !servedAsIs(filename) || compressedAssetExtensions[strings.ToLower(filepath.Ext(filename))] {
+		return false, nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return false, err
+	}
+	var buf bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return false, err
+	}
+	if _, err := gz.Write(data); err != nil {
+		return false, err
+	}
+	if err := gz.Close(); err != nil {
+		return false, err
+	}
+	if buf.Len() >= len(data) {
+		return false, nil
+	}
+	return true, ioutil.WriteFile(filename+".gz", buf.Bytes(), 0644)
+}
+
+// Write fingerprinted and/or compressed copies of the assets in the manifest
+// that are served as they are. With hashed, the URLs in the manifest are
+// changed to the fingerprinted copies.
+func writeAssetCopies(dir string, manifest map[string]manifestEntry, hashed, precompress bool) error {
+	copies, compressed := 0, 0
+	for urlpath, entry := range manifest {
+		filename := filepath.Join(dir, filepath.FromSlash(urlpath))
+		if !servedAsIs(filename) {
+			continue
+		}
+		filenames := []string{filename}
+		if hashed {
+			data, err := ioutil.ReadFile(filename)
+			if err != nil {
+				return err
+			}
+			fp := fingerprint(data)
+			copyFilename := hashedFilename(filename, fp)
+			if err := ioutil.WriteFile(copyFilename, data, 0644); err != nil {
+				return err
+			}
+			copies++
+			entry.URL = path.Join(path.Dir(urlpath), filepath.Base(copyFilename))
+			manifest[urlpath] = entry
+			filenames = append(filenames, copyFilename)
+		}
+		if precompress {
+			for _, filename := range filenames {
+				written, err := precompressAsset(filename)
+				if err != nil {
+					return err
+				}
+				if written {
+					compressed++
+				}
+			}
+		}
+	}
+	// Keep stdout for the manifest
+	if hashed {
+		fmt.Fprintf(os.Stderr, "Wrote %d fingerprinted assets\n", copies)
+	}
+	if precompress {
+		fmt.Fprintf(os.Stderr, "Compressed %d assets\n", compressed)
+	}
+	return nil
+}
+
+// Serve FILENAME.gz instead of the file, if --precompressed is given, the
+// client supports gzip and the compressed file is at least as new as the
+// file. Never in legacy mode, which promises no compression. The
+// Content-Type must already be set. Returns true if the compressed file was
+// served.
+func (ac *algernonConfig) servePrecompressed(w http.ResponseWriter, req *http.Request, filename string) bool {
+	if !ac.precompressed || ac.legacyMode || !clientCanGzip(req) {
+		return false
+	}
+	gzFilename := filename + ".gz"
+	// Use the stat cache for the common case, where there is no .gz file
+	if !fs.Exists(gzFilename) {
+		return false
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return false
+	}
+	gzfi, err := os.Stat(gzFilename)
+	if err != nil || !gzfi.Mode().IsRegular() || gzfi.ModTime().Before(fi.ModTime()) {
+		return false
+	}
+	f, err := os.Open(gzFilename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Add("Vary", "Accept-Encoding")
+	http.ServeContent(w, req, filename, time.Time{}, f)
+	return true
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xyproto/datablock"
+)
+
+func TestPrecompressAsset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "precompress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	css := filepath.Join(dir, "style.css")
+	png := filepath.Join(dir, "logo.png")
+	ioutil.WriteFile(css, []byte(strings.Repeat("body { color: red; }\n", 100)), 0644)
+	ioutil.WriteFile(png, []byte(strings.Repeat("x", 1000)), 0644)
+	if written, err := precompressAsset(css); err != nil || !written {
+		t.Fatal("expected style.css.gz to be written:", err)
+	}
+	if written, _ := precompressAsset(png); written {
+		t.Error("expected PNG images not to be compressed")
+	}
+
+	if fs == nil {
+		fs = datablock.NewFileStat(false, 0)
+	}
+	ac := newAlgernonConfig()
+	req := httptest.NewRequest("GET", "/style.css", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	if ac.servePrecompressed(httptest.NewRecorder(), req, css) {
+		t.Error("expected style.css.gz to be served only with --precompressed")
+	}
+	ac.precompressed = true
+	w := httptest.NewRecorder()
+	if !ac.servePrecompressed(w, req, css) || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("expected style.css.gz to be served")
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(gz); !strings.HasPrefix(string(data), "body { color: red; }") {
+		t.Errorf("expected the compressed file to have the contents of style.css, got %q", data)
+	}
+
+	// Not in legacy mode
+	ac.legacyMode = true
+	if ac.servePrecompressed(httptest.NewRecorder(), req, css) {
+		t.Error("expected style.css.gz not to be served in legacy mode")
+	}
+	ac.legacyMode = false
+
+	// Not for clients without gzip support
+	req.Header.Del("Accept-Encoding")
+	if ac.servePrecompressed(httptest.NewRecorder(), req, css) {
+		t.Error("expected style.css.gz not to be served to a client without gzip support")
+	}
+}
+
+func TestWriteAssetCopies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hashed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "app.js"), []byte(strings.Repeat("console.log(1);\n", 100)), 0644)
+	manifest, err := assetManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeAssetCopies(dir, manifest, true, true); err != nil {
+		t.Fatal(err)
+	}
+	url := manifest["/app.js"].URL
+	if !hashedAssetPattern.MatchString(url) {
+		t.Fatalf("expected the URL of the fingerprinted copy, got %s", url)
+	}
+	for _, name := range []string{url, url + ".gz", "/app.js.gz"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	// The copies are not assets of their own
+	if manifest, _ = assetManifest(dir); len(manifest) != 1 {
+		t.Errorf("expected only app.js in the manifest, got %v", manifest)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+// Prefetching of the local images, style sheets and scripts that are
+// referenced by a page, so that the requests that follows the page hit the cache
+
+import (
+	"net/http"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The maximum number of files to prefetch per page
+const maxPrefetch = 16
+
+var (
+	// References in HTML and Amber (src="..." and href="..."),
+	// Markdown (![](...)) and CSS (url(...))
+	referencePattern = regexp.MustCompile(`(?:src|href)\s*=\s*["']([^"'#?]+)|\]\(\s*<?([^)\s>#?]+)|url\(\s*["']?([^"')#?]+)`)
+
+	// Extensions of files that are worth prefetching
+	prefetchExtensions = map[string]bool{
+		".css": true, ".js": true, ".svg": true, ".ico": true, ".bmp": true, ".apng": true,
+		".woff": true, ".woff2": true, ".ttf": true, ".otf": true,
+	}
+)
+
+// Return the local files that are referenced by the given page data, like
+// images and style sheets. The URL path of the page is used for finding the
+// directory that URL paths starting with "/" are relative to.
+func (ac *algernonConfig) referencedFiles(urlpath, filename string, data []byte) []string {
+	dir := filepath.Dir(filename)
+	urldir := urlpath
+	if !strings.HasSuffix(urldir, "/") {
+		urldir = path.Dir(urldir)
+	}
+	rootdir := ac.serverDirOrFilename
+	slashdir := filepath.ToSlash(dir)
+	if suffix := strings.TrimSuffix(urldir, "/"); strings.HasSuffix(slashdir, suffix) {
+		rootdir = filepath.FromSlash(strings.TrimSuffix(slashdir, suffix))
+	}
+
+	found := make(map[string]bool)
+	var filenames []string
+	for _, match := range referencePattern.FindAllSubmatch(data, -1) {
+		var ref string
+		for _, group := range match[1:] {
+			if len(group) > 0 {
+				ref = string(group)
+				break
+			}
+		}
+		// Skip external resources, like "https://..." and "//example.com/..."
+		if ref == "" || strings.Contains(ref, ":") || strings.HasPrefix(ref, "//") {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(ref))
+		if !isImageExtension(ext) && !prefetchExtensions[ext] {
+			continue
+		}
+		var refFilename string
+		if strings.HasPrefix(ref, "/") {
+			refFilename = filepath.Join(rootdir, filepath.FromSlash(ref))
+		} else {
+			refFilename = filepath.Join(dir, filepath.FromSlash(ref))
+		}
+		if found[refFilename] {
+			continue
+		}
+		found[refFilename] = true
+		filenames = append(filenames, refFilename)
+		if len(filenames) == maxPrefetch {
+			break
+		}
+	}
+	return filenames
+}
+
+// Load the local files that are referenced by a page into the cache,
+// concurrently with rendering the page
+func (ac *algernonConfig) prefetch(req *http.Request, filename string, data []byte) {
+	if ac.cache == nil {
+		return
+	}
+	for _, refFilename := range ac.referencedFiles(req.URL.Path, filename, data) {
+		if !ac.shouldCache(strings.ToLower(filepath.Ext(refFilename))) {
+			continue
+		}
+		go func(refFilename string) {
+			if fs.Exists(refFilename) && !fs.IsDir(refFilename) {
+				ac.cache.Read(refFilename, true)
+			}
+		}(refFilename)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestReferencedFiles(t *testing.T) {
+	ac := newAlgernonConfig()
+	page := []byte(`![logo](img/logo.png) <img src="/static/a.jpg"> <a href="other.md">x</a>
+<link href="https://example.com/x.css"> <style>body { background: url('bg.svg'); }</style>`)
+	filenames := ac.referencedFiles("/blog/post.md", "/srv/site/blog/post.md", page)
+	expected := []string{"/srv/site/blog/img/logo.png", "/srv/site/static/a.jpg", "/srv/site/blog/bg.svg"}
+	if len(filenames) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, filenames)
+	}
+	for i := range expected {
+		if filenames[i] != expected[i] {
+			t.Errorf("expected %s, got %s", expected[i], filenames[i])
+		}
+	}
+}
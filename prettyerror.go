@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"html"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
@@ -78,8 +79,15 @@ func (ac *algernonConfig) prettyError(w http.ResponseWriter, req *http.Request,
 	// The line that the error refers to, for the case of Lua
 	linenr := -1
 
+	// Errors from templateError include the position, and an excerpt of the
+	// source that must be escaped
+	if line, ok := templateErrorLine(errormessage); ok && lang != "lua" {
+		linenr = line - 1
+		errormessage = html.EscapeString(errormessage)
+	}
+
 	if len(filebytes) > 0 {
-		if lang == "lua" {
+		if linenr == -1 && lang == "lua" {
 			// If the first line of the error message has two colons, see if the second field is a number
 			fields := strings.SplitN(errormessage, ":", 3)
 			if len(fields) > 2 {
@@ -96,7 +104,7 @@ func (ac *algernonConfig) prettyError(w http.ResponseWriter, req *http.Request,
 					linenr = -1
 				}
 			}
-		} else if lang == "amber" {
+		} else if linenr == -1 && lang == "amber" {
 			// If the error contains "- Line: ", extract the line number
 			if strings.Contains(errormessage, "- Line: ") {
 				fields := strings.SplitN(errormessage, "- Line: ", 2)
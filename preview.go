@@ -0,0 +1,209 @@
+package main
+
+// JPEG previews of HEIC and camera RAW images (DNG, CR2, NEF and ARW), for
+// browsing photo directories. RAW files have an embedded JPEG preview, which
+// is used if found. HEIC images are converted with heif-convert or ImageMagick,
+// if one of them is installed.
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	img "image"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// The query parameter for asking for a preview instead of the original file
+	imagePreviewParameter = "preview"
+
+	// The maximum width and height of previews, in pixels
+	previewSize = 2048
+
+	// The JPEG quality of previews
+	previewQuality = 85
+
+	// Files larger than this are not previewed
+	maxPreviewSourceSize = 256 * MiB
+
+	// The maximum total size of the previews to keep in memory
+	maxPreviewCacheSize = 64 * MiB
+
+	// How long an external converter may take
+	previewConverterTimeout = 30 * time.Second
+)
+
+// The extensions of the images that are previewed as JPEG
+var previewExtensions = map[string]bool{
+	".heic": true, ".heif": true, ".dng": true, ".cr2": true, ".nef": true, ".arw": true,
+}
+
+var (
+	// Cached previews, by filename
+	previews         = make(map[string]preview)
+	previewCacheSize int
+	previewMut       sync.Mutex
+)
+
+// A JPEG preview, and the modification time of the image
+type preview struct {
+	data    []byte
+	modTime time.Time
+}
+
+// Check if a file is an image that can be previewed as JPEG
+func hasPreview(filename string) bool {
+	return previewExtensions[strings.ToLower(filepath.Ext(filename))]
+}
+
+// Find the largest JPEG image that is embedded in the given data.
+// Lossless JPEG, which is used for the raw sensor data, is skipped.
+func embeddedJPEG(data []byte) (img.Image, error) {
+	var (
+		largest img.Config
+		offset  = -1
+	)
+	soi := []byte{0xff, 0xd8, 0xff}
+	for pos := 0; ; pos++ {
+		found := bytes.Index(data[pos:], soi)
+		if found == -1 {
+			break
+		}
+		pos += found
+		config, err := jpeg.DecodeConfig(bytes.NewReader(data[pos:]))
+		if err == nil && config.Width*config.Height > largest.Width*largest.Height {
+			largest, offset = config, pos
+		}
+	}
+	if offset == -1 || largest.Width*largest.Height > maxThumbnailSourcePixels {
+		return nil, errors.New("no embedded JPEG preview")
+	}
+	return jpeg.Decode(bytes.NewReader(data[offset:]))
+}
+
+// Convert an image to JPEG with heif-convert or ImageMagick
+func convertWithTool(filename string) ([]byte, error) {
+	tmpdir, err := ioutil.TempDir("", "algernon-preview")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpdir)
+	output := filepath.Join(tmpdir, "preview.jpg")
+	tools := [][]string{
+		{"heif-convert", filename, output},
+		{"magick", filename + "[0]", output},
+		{"convert", filename + "[0]", output},
+	}
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool[0]); err != nil {
+			continue
+		}
+		if err := runConverter(exec.Command(tool[0], tool[1:]...)); err != nil {
+			log.Warn("Could not convert " + filename + " with " + tool[0] + ": " + err.Error())
+			continue
+		}
+		return ioutil.ReadFile(output)
+	}
+	return nil, errors.New("heif-convert or ImageMagick is needed for converting " + filepath.Base(filename))
+}
+
+// Run an external converter, and stop it if it takes too long
+func runConverter(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	timer := time.AfterFunc(previewConverterTimeout, func() {
+		cmd.Process.Kill()
+	})
+	defer timer.Stop()
+	return cmd.Wait()
+}
+
+// Make a JPEG preview of an image, no larger than previewSize x previewSize
+func makePreview(filename string) ([]byte, error) {
+	if fi, err := os.Stat(filename); err == nil && fi.Size() > maxPreviewSourceSize {
+		return nil, errors.New("the image is too large to be previewed")
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	src, err := embeddedJPEG(data)
+	if err != nil {
+		// HEIC images rarely have an embedded JPEG
+		converted, err := convertWithTool(filename)
+		if err != nil {
+			return nil, err
+		}
+		if src, err = jpeg.Decode(bytes.NewReader(converted)); err != nil {
+			return nil, err
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleDown(src, previewSize), &jpeg.Options{Quality: previewQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Return a JPEG preview of an image. Previews are cached until the image changes.
+func previewJPEG(filename string) ([]byte, error) {
+	return cachedPreview(filename, makePreview)
+}
+
+// Return a cached JPEG for a file, like a preview of an image or a poster for
+// a video, or make one with the given function if the file has changed
+func cachedPreview(filename string, makeJPEG func(string) ([]byte, error)) ([]byte, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	previewMut.Lock()
+	cached, ok := previews[filename]
+	previewMut.Unlock()
+	if ok && cached.modTime.Equal(fi.ModTime()) {
+		return cached.data, nil
+	}
+	data, err := makeJPEG(filename)
+	if err != nil {
+		return nil, err
+	}
+	previewMut.Lock()
+	if previewCacheSize+len(data) > maxPreviewCacheSize {
+		// Start over instead of keeping track of which previews are used the least
+		previews = make(map[string]preview)
+		previewCacheSize = 0
+	}
+	if old, ok := previews[filename]; ok {
+		previewCacheSize -= len(old.data)
+	}
+	previews[filename] = preview{data, fi.ModTime()}
+	previewCacheSize += len(data)
+	previewMut.Unlock()
+	return data, nil
+}
+
+// Serve a JPEG preview of an image
+func (ac *algernonConfig) servePreview(w http.ResponseWriter, req *http.Request, filename string) {
+	data, err := previewJPEG(filename)
+	if err != nil {
+		log.Error("Could not make a preview of ", filename, ": ", err)
+		traceError(req, "preview of %s: %s", filename, err)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		w.Write([]byte(messagePage("No preview", "<p>Could not make a preview of "+html.EscapeString(filepath.Base(filename))+".</p>", ac.defaultTheme)))
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	dataToClient(w, req, filename+".jpg", data)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	img "image"
+	"image/jpeg"
+	"testing"
+)
+
+func TestEmbeddedJPEG(t *testing.T) {
+	// A RAW file has a small thumbnail and a larger preview among other data
+	var raw bytes.Buffer
+	raw.WriteString("II*\x00 header")
+	for _, size := range []int{160, 640} {
+		if err := jpeg.Encode(&raw, img.NewGray(img.Rect(0, 0, size, size*3/4)), nil); err != nil {
+			t.Fatal(err)
+		}
+		raw.Write([]byte{0xff, 0xd8, 0xff, 0x00, 0x12, 0x34})
+	}
+	src, err := embeddedJPEG(raw.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.Bounds().Dx() != 640 {
+		t.Errorf("expected the largest preview, got a width of %d", src.Bounds().Dx())
+	}
+	if _, err := embeddedJPEG([]byte("no preview")); err == nil {
+		t.Error("expected an error when there is no embedded JPEG")
+	}
+}
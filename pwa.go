@@ -0,0 +1,250 @@
+package main
+
+// A generated service worker and web app manifest, for making a site
+// installable and available offline, as a Progressive Web App (PWA)
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// The URL paths of the generated service worker and web app manifest
+	serviceWorkerPath = "/sw.js"
+	webManifestPath   = "/manifest.webmanifest"
+
+	// The prefix of the names of the caches that are used by the service worker
+	pwaCachePrefix = "algernon-"
+)
+
+// Icons that are listed in the web app manifest, if they are found in the
+// server directory
+var pwaIconFilenames = []string{"icon-192.png", "icon-512.png", "icon.png", "apple-touch-icon.png", "favicon.png"}
+
+// The tags that are inserted into HTML pages, for registering the service worker
+const pwaTags = `<link rel="manifest" href="` + webManifestPath + `"><script>if ('serviceWorker' in navigator) { navigator.serviceWorker.register('` + serviceWorkerPath + `'); }</script>`
+
+// The service worker. Precached assets have fingerprinted URLs, so they are
+// served from the cache. Pages are fetched from the network when possible,
+// and from the cache when offline. The cache is replaced when the list of
+// precached URLs changes, which it does when an asset changes.
+const serviceWorkerTemplate = `const CACHE = '%CACHE%';
+const PRECACHE = %PRECACHE%;
+
+self.addEventListener('install', function(event) {
+  event.waitUntil(caches.open(CACHE).then(function(cache) {
+    return cache.addAll(PRECACHE);
+  }).then(function() {
+    return self.skipWaiting();
+  }));
+});
+
+self.addEventListener('activate', function(event) {
+  event.waitUntil(caches.keys().then(function(keys) {
+    return Promise.all(keys.filter(function(key) {
+      return key.indexOf('` + pwaCachePrefix + `') === 0 && key !== CACHE;
+    }).map(function(key) {
+      return caches.delete(key);
+    }));
+  }).then(function() {
+    return self.clients.claim();
+  }));
+});
+
+self.addEventListener('fetch', function(event) {
+  const req = event.request;
+  const url = new URL(req.url);
+  if (req.method !== 'GET' || url.origin !== location.origin) {
+    return;
+  }
+  if (req.mode === 'navigate') {
+    event.respondWith(fetch(req).then(function(resp) {
+      if (resp.ok) {
+        const copy = resp.clone();
+        caches.open(CACHE).then(function(cache) { cache.put(req, copy); });
+      }
+      return resp;
+    }).catch(function() {
+      return caches.match(req).then(function(resp) {
+        return resp || caches.match('/');
+      });
+    }));
+    return;
+  }
+  // Assets that are referred to without the fingerprint are also found
+  event.respondWith(caches.match(req, {ignoreSearch: url.search === ''}).then(function(resp) {
+    return resp || fetch(req);
+  }));
+});
+`
+
+// The generated service worker and web app manifest
+type pwaFiles struct {
+	mut           sync.RWMutex
+	serviceWorker []byte
+	webManifest   []byte
+}
+
+// Split a comma separated list, and leave out the blank elements
+func splitList(s string) []string {
+	var elements []string
+	for _, element := range strings.Split(s, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
+
+// Check if a URL path matches one of the given patterns, like "/css/*.css"
+func matchesAny(urlpath string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, urlpath); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Find the URLs that should be precached: the given routes and the
+// fingerprinted URLs of the assets that match the --pwaassets patterns.
+// Only what is asked for is precached, since a single URL that can not be
+// fetched makes the installation of the service worker fail.
+func (ac *algernonConfig) precacheURLs() []string {
+	urls := splitList(ac.pwaRoutes)
+	patterns := splitList(ac.pwaAssets)
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Error("Invalid pattern for --pwaassets: ", pattern)
+		}
+	}
+	if len(patterns) > 0 && fs.IsDir(ac.serverDirOrFilename) {
+		manifest, err := assetManifest(ac.serverDirOrFilename)
+		if err != nil {
+			log.Error("Could not find the assets to precache: ", err)
+		}
+		for urlpath, entry := range manifest {
+			if matchesAny(urlpath, patterns) {
+				urls = append(urls, entry.URL)
+			}
+		}
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// Find the icons in the server directory, for the web app manifest
+func (ac *algernonConfig) pwaIcons() []map[string]string {
+	icons := []map[string]string{}
+	if !fs.IsDir(ac.serverDirOrFilename) {
+		return icons
+	}
+	for _, name := range pwaIconFilenames {
+		f, err := os.Open(filepath.Join(ac.serverDirOrFilename, name))
+		if err != nil {
+			continue
+		}
+		config, err := png.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			log.Warn("Could not read the size of " + name + ": " + err.Error())
+			continue
+		}
+		icons = append(icons, map[string]string{
+			"src":   "/" + name,
+			"sizes": fmt.Sprintf("%dx%d", config.Width, config.Height),
+			"type":  "image/png",
+		})
+	}
+	return icons
+}
+
+// Generate the service worker and web app manifest
+func (ac *algernonConfig) generatePWA(files *pwaFiles) {
+	urls := ac.precacheURLs()
+	precache, err := json.Marshal(urls)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	sum := sha256.Sum256(precache)
+	serviceWorker := strings.NewReplacer(
+		"%CACHE%", pwaCachePrefix+hex.EncodeToString(sum[:])[:12],
+		"%PRECACHE%", string(precache),
+	).Replace(serviceWorkerTemplate)
+
+	name := ac.pwaName
+	if name == "" {
+		name = filepath.Base(ac.serverDirOrFilename)
+	}
+	webManifest, err := json.MarshalIndent(map[string]interface{}{
+		"name":             name,
+		"short_name":       name,
+		"start_url":        "/",
+		"scope":            "/",
+		"display":          "standalone",
+		"background_color": "#ffffff",
+		"theme_color":      "#ffffff",
+		"icons":            ac.pwaIcons(),
+	}, "", "  ")
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	files.mut.Lock()
+	files.serviceWorker = []byte(serviceWorker)
+	files.webManifest = webManifest
+	files.mut.Unlock()
+	log.Infof("Generated a service worker that precaches %d URLs", len(urls))
+}
+
+// Insert the tags for the web app manifest and service worker into HTML
+func insertPWATags(htmldata []byte) []byte {
+	if bytes.Contains(htmldata, []byte("</head>")) {
+		return bytes.Replace(htmldata, []byte("</head>"), []byte(pwaTags+"</head>"), 1)
+	} else if bytes.Contains(htmldata, []byte("<head>")) {
+		return bytes.Replace(htmldata, []byte("<head>"), []byte("<head>"+pwaTags), 1)
+	} else if bytes.Contains(htmldata, []byte("<html>")) {
+		return bytes.Replace(htmldata, []byte("<html>"), []byte("<html><head>"+pwaTags+"</head>"), 1)
+	}
+	return htmldata
+}
+
+// Serve the generated service worker and web app manifest, insert the tags
+// for them into rendered HTML and generate them again when reloading
+func (ac *algernonConfig) setupPWA(mux *http.ServeMux) {
+	files := &pwaFiles{}
+	ac.generatePWA(files)
+	atReload(func() {
+		ac.generatePWA(files)
+	})
+	serve := func(contentType string, data func() []byte) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			files.mut.RLock()
+			defer files.mut.RUnlock()
+			w.Header().Set("Content-Type", contentType)
+			// The browser should always check for a new version
+			w.Header().Set("Cache-Control", "no-cache")
+			dataToClient(w, req, req.URL.Path, data())
+		}
+	}
+	ac.limitedHandle(mux, serviceWorkerPath, serve("application/javascript; charset=utf-8", func() []byte { return files.serviceWorker }))
+	ac.limitedHandle(mux, webManifestPath, serve("application/manifest+json", func() []byte { return files.webManifest }))
+	ac.addHTMLFilter("/", func(req *http.Request, htmldata []byte) ([]byte, error) {
+		return insertPWATags(htmldata), nil
+	})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xyproto/datablock"
+)
+
+func TestPrecacheURLs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pwa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "css"), 0755)
+	os.Mkdir(filepath.Join(dir, "admin"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "css", "style.css"), []byte("body {}"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "admin", "admin.css"), []byte("body {}"), 0644)
+	if fs == nil {
+		fs = datablock.NewFileStat(false, 0)
+	}
+	ac := newAlgernonConfig()
+	ac.serverDirOrFilename = dir
+	ac.pwaRoutes = "/, /about"
+
+	// Only the routes, by default
+	if urls := ac.precacheURLs(); strings.Join(urls, " ") != "/ /about" {
+		t.Errorf("expected only the routes to be precached, got %v", urls)
+	}
+
+	ac.pwaAssets = "/css/*.css"
+	urls := ac.precacheURLs()
+	if len(urls) != 3 || !strings.HasPrefix(urls[2], "/css/style.css?v=") {
+		t.Errorf("expected the routes and /css/style.css to be precached, got %v", urls)
+	}
+}
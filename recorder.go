@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// A response writer that keeps track of the status code and the number of
+// bytes that are written, for middleware that needs to know how a request
+// went. Flushing, hijacking and close notifications are passed on.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.ResponseWriter.WriteHeader(status)
+	sr.status = status
+}
+
+func (sr *statusRecorder) Write(data []byte) (int, error) {
+	n, err := sr.ResponseWriter.Write(data)
+	sr.written += int64(n)
+	return n, err
+}
+
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (sr *statusRecorder) CloseNotify() <-chan bool {
+	if notifier, ok := sr.ResponseWriter.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	// Never closes
+	return make(chan bool)
+}
+
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := sr.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("the response writer can not be hijacked")
+}
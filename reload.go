@@ -0,0 +1,6 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+// Reloading with signals is not supported on this platform
+func (ac *algernonConfig) handleReloadSignal() {}
@@ -0,0 +1,20 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Reload the server when receiving SIGHUP
+func (ac *algernonConfig) handleReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			ac.reload()
+		}
+	}()
+}
@@ -0,0 +1,106 @@
+package main
+
+// Rendering of Markdown, Amber and GCSS over HTTP, for editors and bots
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/eknkc/amber"
+	"github.com/russross/blackfriday"
+	"github.com/yosssi/gcss"
+)
+
+const (
+	// Maximum size of the source that can be given to the rendering API
+	renderAPILimit = 4 * MiB
+)
+
+// Find the source type from the "type" URL parameter or the Content-Type
+func renderAPIType(req *http.Request) string {
+	given := strings.ToLower(req.URL.Query().Get("type"))
+	if given == "" {
+		given = strings.ToLower(req.Header.Get("Content-Type"))
+	}
+	switch {
+	case strings.Contains(given, "amber"):
+		return "amber"
+	case strings.Contains(given, "gcss"):
+		return "gcss"
+	}
+	// Markdown is the default
+	return "markdown"
+}
+
+// Check if the request has the bearer token for the rendering API
+func (ac *algernonConfig) validRenderAPIKey(req *http.Request) bool {
+	if ac.renderAPIKey == "" {
+		return false
+	}
+	given := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(ac.renderAPIKey)) == 1
+}
+
+// Check if the request may use the rendering API.
+// A correct bearer token or admin rights are required.
+func (ac *algernonConfig) renderAPIAuthorized(req *http.Request) bool {
+	return ac.validRenderAPIKey(req) || ac.perm.UserState().AdminRights(req)
+}
+
+// Render the source given in the body of a POST request, and return the result
+func (ac *algernonConfig) renderAPIHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if !ac.renderAPIAuthorized(req) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, renderAPILimit))
+	if err != nil {
+		http.Error(w, "Could not read the request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch renderAPIType(req) {
+	case "amber":
+		tpl, err := amber.Compile(string(data), amber.Options{PrettyPrint: true, LineNumbers: false})
+		if err != nil {
+			http.Error(w, "Could not compile Amber template: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var buf bytes.Buffer
+		if err := tpl.Execute(&buf, nil); err != nil {
+			http.Error(w, "Could not execute Amber template: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		buf.WriteTo(w)
+	case "gcss":
+		var buf bytes.Buffer
+		if _, err := gcss.Compile(&buf, bytes.NewReader(data)); err != nil {
+			http.Error(w, "Could not compile GCSS: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/css; charset=utf-8")
+		buf.WriteTo(w)
+	default:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		// Render a complete page, with the theme and keywords, if asked for
+		if req.URL.Query().Get("page") != "" {
+			ac.markdownPage(w, req, data, filepath.Join(ac.serverDirOrFilename, "render.md"))
+			return
+		}
+		w.Write(blackfriday.MarkdownCommon(data))
+	}
+}
+
+// Register the rendering API at the configured path
+func (ac *algernonConfig) registerRenderAPI(mux *http.ServeMux) {
+	ac.limitedHandle(mux, ac.renderAPIPath, ac.renderAPIHandler)
+}
@@ -22,10 +22,8 @@ import (
 )
 
 // Check if the given data is valid GCSS. The error value is returned on the channel.
-func validGCSS(gcssdata []byte, errorReturn chan error) {
-	buf := bytes.NewBuffer(gcssdata)
-	var w bytes.Buffer
-	_, err := gcss.Compile(&w, buf)
+func validGCSS(filename string, gcssdata []byte, errorReturn chan error) {
+	_, err := compileGCSS(filename, gcssdata)
 	errorReturn <- err
 }
 
@@ -141,7 +139,7 @@ func (ac *algernonConfig) exportRenderFunctions(w http.ResponseWriter, req *http
 // Write the given source bytes as markdown wrapped in HTML to a writer, with a title
 func (ac *algernonConfig) markdownPage(w http.ResponseWriter, req *http.Request, data []byte, filename string) {
 	// Prepare for receiving title and codeStyle information
-	given := map[string]string{"title": "", "codestyle": "", "theme": "", "replace_with_theme": "", "css": ""}
+	given := map[string]string{"title": "", "codestyle": "", "theme": "", "replace_with_theme": "", "css": "", "draft": "", "comments": "", "form": "", "form_fields": "", "form_email": "", "form_redirect": "", "form_submit": ""}
 
 	// Also prepare for receiving meta tag information
 	addMetaKeywords(given)
@@ -149,8 +147,26 @@ func (ac *algernonConfig) markdownPage(w http.ResponseWriter, req *http.Request,
 	// Extract keywords from the given data, and remove the lines with keywords
 	data = extractKeywords(data, given)
 
-	// Convert from Markdown to HTML
-	htmlbody := string(blackfriday.MarkdownCommon(data))
+	// Only serve drafts if drafts are enabled or a valid preview token is given
+	if isDraft(given["draft"]) && !ac.serveDrafts {
+		if !ac.validPreviewToken(req.URL.Path, req.URL.Query().Get(previewParameter)) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, noPage(req.URL.Path, ac.defaultTheme))
+			return
+		}
+		// Previews should not be indexed nor stored
+		w.Header().Set("X-Robots-Tag", "noindex")
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
+	// Warm the cache for the images and other files the page refers to
+	ac.prefetch(req, filename, data)
+
+	// Convert from Markdown to HTML, once for concurrent requests
+	rendered, _ := compileOnce("markdown", filename, data, func() (interface{}, error) {
+		return blackfriday.MarkdownCommon(data), nil
+	})
+	htmlbody := string(rendered.([]byte))
 
 	// TODO: Check if handling "# title <tags" on the first line is valid
 	// Markdown or not. Submit a patch to blackfriday if it is.
@@ -183,7 +199,7 @@ func (ac *algernonConfig) markdownPage(w http.ResponseWriter, req *http.Request,
 	// Find the theme that should be used
 	theme := given["theme"]
 	if theme == "" {
-		theme = ac.defaultTheme
+		theme = ac.themeFor(filepath.Dir(filename))
 	}
 
 	// Theme aliases. Use a map if there are more than 1 aliases in the future.
@@ -219,7 +235,7 @@ func (ac *algernonConfig) markdownPage(w http.ResponseWriter, req *http.Request,
 
 			// Try compiling the GCSS file first
 			errChan := make(chan error)
-			go validGCSS(gcssdata, errChan)
+			go validGCSS(GCSSfilename, gcssdata, errChan)
 			err = <-errChan
 			if err != nil {
 				// Invalid GCSS, return an error page
@@ -273,9 +289,31 @@ func (ac *algernonConfig) markdownPage(w http.ResponseWriter, req *http.Request,
 		}
 	}
 
+	// Add the form, and handle it if it has been submitted
+	f, err := ac.markdownForm(given)
+	if err != nil {
+		log.Error(filename + ": " + err.Error())
+	} else if f != nil {
+		formHTML, handled := ac.markdownFormHTML(w, req, f)
+		if handled {
+			return
+		}
+		htmlbody += formHTML
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+
+	// Add the comments, which depend on the user that is logged in
+	if ac.commentsEnabledFor(given["comments"]) {
+		htmlbody += ac.commentsHTML(w, req)
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+
 	// Embed the style and rendered markdown into a simple HTML 5 page
 	htmldata := []byte(fmt.Sprintf("<!doctype html><html><head><title>%s</title>%s<head><body><h1>%s</h1>%s</body></html>", title, head.String(), h1title, htmlbody))
 
+	// Apply the HTML filters for this URL path, if any
+	htmldata = ac.filterHTML(req, htmldata)
+
 	// If the auto-refresh feature has been enabled
 	if ac.autoRefreshMode {
 		// Insert JavaScript for refreshing the page into the generated HTML
@@ -306,7 +344,7 @@ func (ac *algernonConfig) pongoPage(w http.ResponseWriter, req *http.Request, fi
 
 			// Try compiling the GCSS file before the Pongo2 file
 			errChan := make(chan error)
-			go validGCSS(gcssdata, errChan)
+			go validGCSS(GCSSfilename, gcssdata, errChan)
 			err = <-errChan
 			if err != nil {
 				// Invalid GCSS, return an error page
@@ -328,6 +366,9 @@ func (ac *algernonConfig) pongoPage(w http.ResponseWriter, req *http.Request, fi
 		return
 	}
 
+	// CSRF tokens and flash messages
+	ac.addSessionFuncs(w, req, funcs)
+
 	okfuncs := make(pongo2.Context)
 
 	// Go through the global Lua scope
@@ -360,6 +401,10 @@ func (ac *algernonConfig) pongoPage(w http.ResponseWriter, req *http.Request, fi
 				if err != nil {
 					return pongo2.AsValue(err)
 				}
+				// HTML, like the CSRF form field, is not escaped
+				if h, ok := retval.(template.HTML); ok {
+					return pongo2.AsSafeValue(string(h))
+				}
 				// Return the returned value if things went well
 				return pongo2.AsValue(retval)
 			}
@@ -421,6 +466,13 @@ func (ac *algernonConfig) pongoPage(w http.ResponseWriter, req *http.Request, fi
 			}
 		}
 
+		// Apply the HTML filters for this URL path, if any
+		if ac.hasHTMLFilters(req.URL.Path) {
+			changedBytes := ac.filterHTML(req, buf.Bytes())
+			buf.Reset()
+			buf.Write(changedBytes)
+		}
+
 		// If the auto-refresh feature has been enabled
 		if ac.autoRefreshMode {
 			// Insert JavaScript for refreshing the page into the generated HTML
@@ -455,6 +507,9 @@ func (ac *algernonConfig) amberPage(w http.ResponseWriter, req *http.Request, fi
 
 	var buf bytes.Buffer
 
+	// Warm the cache for the images and other files the page refers to
+	ac.prefetch(req, filename, amberdata)
+
 	// If style.gcss is present, and a header is present, and it has not already been linked in, link it in
 	GCSSfilename := filepath.Join(filepath.Dir(filename), defaultStyleFilename)
 	if fs.Exists(GCSSfilename) {
@@ -468,7 +523,7 @@ func (ac *algernonConfig) amberPage(w http.ResponseWriter, req *http.Request, fi
 
 			// Try compiling the GCSS file before the Amber file
 			errChan := make(chan error)
-			go validGCSS(gcssdata, errChan)
+			go validGCSS(GCSSfilename, gcssdata, errChan)
 			err = <-errChan
 			if err != nil {
 				// Invalid GCSS, return an error page
@@ -480,8 +535,14 @@ func (ac *algernonConfig) amberPage(w http.ResponseWriter, req *http.Request, fi
 		linkToStyle(&amberdata, defaultStyleFilename)
 	}
 
-	// Compile the given amber template
-	tpl, err := amber.CompileData(amberdata, filename, amber.Options{PrettyPrint: true, LineNumbers: false})
+	// Compile the given amber template, once for concurrent requests
+	compiled, err := compileOnce("amber", filename, amberdata, func() (interface{}, error) {
+		tpl, err := amber.CompileData(amberdata, filename, amber.Options{PrettyPrint: true, LineNumbers: false})
+		if err != nil {
+			return nil, newTemplateError("amber", filename, amberdata, err)
+		}
+		return tpl, nil
+	})
 	if err != nil {
 		if ac.debugMode {
 			ac.prettyError(w, req, filename, amberdata, err.Error(), "amber")
@@ -491,8 +552,11 @@ func (ac *algernonConfig) amberPage(w http.ResponseWriter, req *http.Request, fi
 		return
 	}
 
+	// CSRF tokens and flash messages
+	ac.addSessionFuncs(w, req, funcs)
+
 	// Render the Amber template to the buffer
-	if err := tpl.Execute(&buf, funcs); err != nil {
+	if err := compiled.(*template.Template).Execute(&buf, funcs); err != nil {
 
 		// If it was one particular error, where the template can not find the
 		// function or variable name that is used, give the user a friendlier
@@ -515,6 +579,13 @@ func (ac *algernonConfig) amberPage(w http.ResponseWriter, req *http.Request, fi
 		return
 	}
 
+	// Apply the HTML filters for this URL path, if any
+	if ac.hasHTMLFilters(req.URL.Path) {
+		changedBytes := ac.filterHTML(req, buf.Bytes())
+		buf.Reset()
+		buf.Write(changedBytes)
+	}
+
 	// If the auto-refresh feature has been enabled
 	if ac.autoRefreshMode {
 		// Insert JavaScript for refreshing the page into the generated HTML
@@ -543,8 +614,10 @@ func (ac *algernonConfig) amberPage(w http.ResponseWriter, req *http.Request, fi
 // Write the given source bytes as GCSS converted to CSS, to a writer.
 // filename is only used if there are errors.
 func (ac *algernonConfig) gcssPage(w http.ResponseWriter, req *http.Request, filename string, gcssdata []byte) {
-	var buf bytes.Buffer
-	if _, err := gcss.Compile(&buf, bytes.NewReader(gcssdata)); err != nil {
+	compiled, err := compileOnce("gcss", filename, gcssdata, func() (interface{}, error) {
+		return compileGCSS(filename, gcssdata)
+	})
+	if err != nil {
 		if ac.debugMode {
 			fmt.Fprintf(w, "Could not compile GCSS:\n\n%s\n%s", err, string(gcssdata))
 		} else {
@@ -553,11 +626,22 @@ func (ac *algernonConfig) gcssPage(w http.ResponseWriter, req *http.Request, fil
 		return
 	}
 	// Write the resulting CSS to the client
-	dataToClient(w, req, filename, buf.Bytes())
+	dataToClient(w, req, filename, compiled.([]byte))
+}
+
+// Compile GCSS to CSS
+func compileGCSS(filename string, gcssdata []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := gcss.Compile(&buf, bytes.NewReader(gcssdata)); err != nil {
+		return nil, newTemplateError("gcss", filename, gcssdata, err)
+	}
+	return buf.Bytes(), nil
 }
 
 func (ac *algernonConfig) jsxPage(w http.ResponseWriter, req *http.Request, filename string, jsxdata []byte) {
-	prog, err := parser.ParseFile(nil, filename, jsxdata, parser.IgnoreRegExpErrors)
+	compiled, err := compileOnce("jsx", filename, jsxdata, func() (interface{}, error) {
+		return compileJSX(filename, jsxdata)
+	})
 	if err != nil {
 		if ac.debugMode {
 			ac.prettyError(w, req, filename, jsxdata, err.Error(), "jsx")
@@ -566,41 +650,45 @@ func (ac *algernonConfig) jsxPage(w http.ResponseWriter, req *http.Request, file
 		}
 		return
 	}
+	// Write the generated data to the client
+	dataToClient(w, req, filename, compiled.([]byte))
+}
+
+// Compile JSX to JavaScript. filename is only used in error messages.
+func compileJSX(filename string, jsxdata []byte) ([]byte, error) {
+	prog, err := parser.ParseFile(nil, filename, jsxdata, parser.IgnoreRegExpErrors)
+	if err != nil {
+		return nil, newTemplateError("jsx", filename, jsxdata, err)
+	}
 	gen, err := generator.Generate(prog)
 	if err != nil {
-		if ac.debugMode {
-			ac.prettyError(w, req, filename, jsxdata, err.Error(), "jsx")
-		} else {
-			log.Errorf("Could not generate javascript:\n%s\n%s", err, string(jsxdata))
-		}
-		return
+		return nil, err
 	}
-	if gen != nil {
-		data, err := ioutil.ReadAll(gen)
-		if err != nil {
-			log.Error("Could not read bytes from JSX generator:", err)
-			return
-		}
-		// Write the generated data to the client
-		dataToClient(w, req, filename, data)
+	if gen == nil {
+		return []byte{}, nil
 	}
+	return ioutil.ReadAll(gen)
 }
 
 // Write the given source bytes as SCSS converted to CSS, to a writer.
 // filename is only used if there are errors.
 func (ac *algernonConfig) scssPage(w http.ResponseWriter, req *http.Request, filename string, scssdata []byte) {
-	// TODO: Gather stderr and print with log.Errorf if needed
-	o := Output{}
-	// Silence the compiler output
-	if !ac.debugMode {
-		o.disable()
-	}
-	// Compile the given filename. Sass might want to import other file, which is probably
-	// why the Sass compiler doesn't support just taking in a slice of bytes.
-	cssString, err := compiler.Run(filename)
-	if !ac.debugMode {
-		o.enable()
-	}
+	// Compile the given filename, once for concurrent requests. Sass might want to import
+	// other file, which is probably why the Sass compiler doesn't support just taking in
+	// a slice of bytes.
+	compiled, err := compileOnce("scss", filename, scssdata, func() (interface{}, error) {
+		// TODO: Gather stderr and print with log.Errorf if needed
+		o := Output{}
+		// Silence the compiler output
+		if !ac.debugMode {
+			o.disable()
+		}
+		cssString, err := compiler.Run(filename)
+		if !ac.debugMode {
+			o.enable()
+		}
+		return []byte(cssString), err
+	})
 	if err != nil {
 		if ac.debugMode {
 			fmt.Fprintf(w, "Could not compile SCSS:\n\n%s\n%s", err, string(scssdata))
@@ -610,5 +698,5 @@ func (ac *algernonConfig) scssPage(w http.ResponseWriter, req *http.Request, fil
 		return
 	}
 	// Write the resulting CSS to the client
-	dataToClient(w, req, filename, []byte(cssString))
+	dataToClient(w, req, filename, compiled.([]byte))
 }
@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/chzyer/readline"
 	"github.com/mitchellh/go-homedir"
@@ -93,6 +94,22 @@ kv:remove() -> bool
 // Clear the KeyValue. Returns true if successful.
 kv:clear() -> bool
 
+// Define a model for database records, given a name and the fields,
+// like "title*, body, views:number, draft:bool". Returns a model object.
+model.define(string, string or table) -> userdata
+// Save a record. It gets an "id" if it does not have one. Returns the ID.
+model:save(table) -> string
+// Find a record by ID. Returns nil if it does not exist.
+model:find(string) -> table
+// Return the records that match a table of field values or a function.
+model:filter([table or function]) -> table
+// Return a page of records, starting at 1, and the number of pages.
+model:paginate(number[, number[, table or function]]) -> table, number
+// Remove a record by ID. Returns true if successful.
+model:delete(string) -> bool
+// Return the number of records.
+model:count() -> number
+
 Live server configuration
 
 // Reset the URL prefixes and make everything *public*.
@@ -133,6 +150,18 @@ Cache
 CacheInfo() -> string // Return information about the file cache.
 ClearCache() // Clear the file cache.
 preload(string) -> bool // Load a file into the cache, returns true on success.
+StreamInfo() -> string // Return information about streams and websockets.
+dbHealthy() -> bool // Check if the database was up the last time it was pinged.
+
+Drafts
+
+// Return an URL path for previewing a draft, valid for the given number of seconds.
+PreviewURL(string[, number]) -> string
+
+Debugging
+
+// Pause here, in debug mode. Type "dbg" in the REPL for the debugger commands.
+breakpoint()
 
 JSON
 
@@ -226,6 +255,20 @@ Various
 ServerInfo() -> string
 // Return the version string for the server
 version() -> string
+// Declare the version of the Lua API that the script is written for
+apiversion([number]) -> number
+// Get a setting from the flags, environment or --settings file, as the type of the default
+config.get(string[, default]) -> value
+// Return the CSRF token for the current user
+csrftoken() -> string
+// Return a hidden form field with the CSRF token
+csrffield() -> string
+// Check the CSRF token in the X-CSRF-Token header or the _csrf form field
+csrfcheck() -> bool
+// Keep a message, with an optional kind, until the next page calls flashes()
+flash(string[, string])
+// Return and remove the flash messages, as a table of {message, kind} tables
+flashes() -> table
 // Tries to extract and print the contents of the given Lua values
 pprint(...)
 // Sleep the given number of seconds (can be a float)
@@ -250,7 +293,9 @@ dir([table]) -> string
 	usageMessage = `
 Type "webhelp" for an overview of functions that are available when
 handling requests. Or "confighelp" for an overview of functions that are
-available when configuring an Algernon application.
+available when configuring an Algernon application. In debug mode, type
+"dbg" for the Lua debugger commands. With --metrics, type "metrics" for the
+requests during the last hour.
 `
 	webHelpText = `Available functions:
 
@@ -367,11 +412,14 @@ uploadedfile:filename() -> string
 uploadedfile:size() -> number
 // Return the mime type of the uploaded file, as specified by the client
 uploadedfile:mimetype() -> string
-// Save the uploaded data locally. Takes an optional filename.
-uploadedfile:save([string]) -> bool
+// Save the uploaded data locally. Takes an optional filename. Returns false
+// and an error message if the file could not be saved or was flagged.
+uploadedfile:save([string]) -> bool[, string]
 // Save the uploaded data as the client-provided filename, in the specified
 // directory. Takes a relative or absolute path. Returns true on success.
-uploadedfile:savein(string)  -> bool
+uploadedfile:savein(string)  -> bool[, string]
+// Scan the uploaded data without saving it. Takes an optional directory.
+uploadedfile:scan([string]) -> bool[, string]
 
 Handling requests
 
@@ -389,6 +437,11 @@ header(string) -> string
 setheader(string, string)
 // Return the HTTP headers, as a table.
 headers() -> table
+// Return the client hints, as a table with the keys "savedata",
+// "dpr", "viewportwidth" and "width".
+clienthints() -> table
+// Return the preferred languages of the client, as a table of language tags.
+languages() -> table
 // Return the HTTP body in the request
 // (will only read the body once, since it's streamed).
 body() -> string
@@ -436,6 +489,26 @@ DenyHandler(function)
 OnReady(function)
 // Use a Lua file for setting up HTTP handlers instead of using the directory structure.
 ServerFile(string) -> bool
+// Set the index files, in order of priority, for all directories or for the
+// given directory (relative to the server directory). Takes a table or a
+// comma separated string of filenames.
+IndexFiles([string, ]table or string)
+// Send server events to a webhook URL, as JSON. Takes an optional table or
+// comma separated string of events and an optional secret for signing.
+Webhook(string[, table or string[, string]])
+
+// Declare a form that is stored in the database. Takes a name, the fields
+// as a string or table, like "name*, email*:email, message*:textarea", and
+// an optional table with "email", "subject", "redirect", "submit" and "limit".
+Form(string, string or table[, table]) -> bool
+// Scan uploads to a directory with a scanner or a table of scanners, like
+// "clamd://localhost" or a command. Takes an optional quarantine directory.
+ScanUploads(string, string or table[, string]) -> bool
+// Add an authentication provider, given a name and a function that returns
+// the username for the current request, or nothing
+AuthProvider(string, function)
+// Call a function with the new and old value when a setting changes at reload
+config.onchange(string, function)
 `
 	exitMessage = "bye"
 )
@@ -552,6 +625,9 @@ func addFunctionsFromHelptextToCompleter(helpText string, completer *readline.Pr
 // Export the various Lua functions that might be needed at the REPL
 func (ac *algernonConfig) exportLuaFunctionsForREPL(L *lua.LState, o *term.TextOutput) {
 
+	// Typed access to flags, environment variables and settings
+	ac.exportConfigFunctions(L)
+
 	// Server configuration functions
 	ac.exportServerConfigFunctions(L, "")
 
@@ -569,6 +645,7 @@ func (ac *algernonConfig) exportLuaFunctionsForREPL(L *lua.LState, o *term.TextO
 		exportSet(L, userstate)
 		exportHash(L, userstate)
 		exportKeyValue(L, userstate)
+		exportModel(L, userstate)
 
 		// For saving and loading Lua functions
 		exportCodeLibrary(L, userstate)
@@ -590,6 +667,11 @@ func (ac *algernonConfig) exportLuaFunctionsForREPL(L *lua.LState, o *term.TextO
 
 	// Cache
 	ac.exportCacheFunctions(L)
+	ac.exportStreamFunctions(L)
+	ac.exportDBHealthFunction(L)
+
+	// Draft previews
+	ac.exportDraftFunctions(L)
 }
 
 // REPL provides a "Read Eval Print" loop for interacting with Lua.
@@ -611,8 +693,8 @@ func (ac *algernonConfig) REPL(ready, done chan bool) error {
 		historyFilename = filepath.Join(historydir, ".algernon_history")
 	}
 
-	// Retrieve a Lua state
-	L := ac.luapool.Get()
+	// Create a Lua state with all libraries, regardless of the sandbox profiles
+	L := lua.NewState()
 	// Don't re-use the Lua state
 	defer L.Close()
 
@@ -631,6 +713,13 @@ func (ac *algernonConfig) REPL(ready, done chan bool) error {
 	// Tell the user that the server is ready
 	o.Println(o.LightGreen("Ready"))
 
+	// Tell the user when Lua code is paused by the debugger
+	if ac.debugger != nil {
+		ac.debugger.addListener(func(p *debugPause) {
+			o.Println(o.LightYellow(fmt.Sprintf("\nPaused at %s:%d (%s). Type \"dbg\" for debugger commands.", p.filename, p.line, p.reason)))
+		})
+	}
+
 	// Start the read, eval, print loop
 	var (
 		line     string
@@ -645,6 +734,7 @@ func (ac *algernonConfig) REPL(ready, done chan bool) error {
 	completer := readline.NewPrefixCompleter(
 		&readline.PrefixCompleter{Name: []rune("help")},
 		&readline.PrefixCompleter{Name: []rune("webhelp")},
+		&readline.PrefixCompleter{Name: []rune("metrics")},
 		&readline.PrefixCompleter{Name: []rune("bye")},
 		&readline.PrefixCompleter{Name: []rune("quit")},
 		&readline.PrefixCompleter{Name: []rune("exit")},
@@ -713,6 +803,12 @@ func (ac *algernonConfig) REPL(ready, done chan bool) error {
 			continue
 		}
 
+		// Debugger commands, like "dbg break index.lua:3"
+		if ac.debugger != nil && (line == "dbg" || strings.HasPrefix(line, "dbg ")) {
+			ac.debugCommand(o, strings.TrimPrefix(line, "dbg"))
+			continue
+		}
+
 		switch line {
 		case "help":
 			outputHelp(o, generalHelpText)
@@ -723,6 +819,13 @@ func (ac *algernonConfig) REPL(ready, done chan bool) error {
 		case "confighelp":
 			outputHelp(o, configHelpText)
 			continue
+		case "metrics":
+			if ac.metricsHistory == nil {
+				o.Err("Start the server with --metrics to keep a history of the requests.")
+			} else {
+				o.Println(strings.TrimSuffix(formatMetrics(ac.metricsHistory.minutes(time.Now())), "\n"))
+			}
+			continue
 		case "quit", "exit", "shutdown", "halt":
 			done <- true
 			return nil
@@ -0,0 +1,38 @@
+package main
+
+// Keeping search engines from indexing staging and development servers.
+// With --noindex, or in development mode, every response has an
+// "X-Robots-Tag: noindex" header, and /robots.txt disallows everything,
+// even if the server directory has a robots.txt file for production.
+
+import (
+	"net/http"
+)
+
+const (
+	// The robots.txt that is served instead of the one in the server directory
+	disallowAllRobots = "User-agent: *\nDisallow: /\n"
+
+	// The URL path of robots.txt
+	robotsPath = "/robots.txt"
+)
+
+// Check if pages should be kept from being indexed. Production mode and
+// --allowindex override both --noindex and development mode.
+func (ac *algernonConfig) shouldNoIndex() bool {
+	return !ac.productionMode && !ac.allowIndex && (ac.noIndex || ac.devMode)
+}
+
+// Add "X-Robots-Tag: noindex" to all responses, and serve a robots.txt
+// that disallows everything
+func (ac *algernonConfig) noIndexHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+		if req.URL.Path == robotsPath {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte(disallowAllRobots))
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
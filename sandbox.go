@@ -0,0 +1,121 @@
+package main
+
+// Sandbox profiles, for limiting which Lua libraries and Algernon functions
+// are available to page scripts and to server configuration scripts
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+type sandboxProfile int
+
+const (
+	// All Lua libraries and Algernon functions
+	sandboxFull sandboxProfile = iota
+	// No io and debug libraries, no plugins and no os functions that can
+	// run programs or change files
+	sandboxStandard
+	// Only functions that can not read or change files, run programs or load
+	// code, in addition to the functions for handling the request
+	sandboxRestricted
+)
+
+// The registry key for the sandbox profile of a Lua state
+const sandboxRegistryKey = "algernon.sandbox"
+
+var (
+	// The Lua libraries that are opened for each profile, in order
+	sandboxLibraries = map[sandboxProfile][]string{
+		sandboxFull:       {lua.LoadLibName, lua.BaseLibName, lua.TabLibName, lua.IoLibName, lua.OsLibName, lua.StringLibName, lua.MathLibName, lua.DebugLibName, lua.ChannelLibName, lua.CoroutineLibName},
+		sandboxStandard:   {lua.LoadLibName, lua.BaseLibName, lua.TabLibName, lua.OsLibName, lua.StringLibName, lua.MathLibName, lua.ChannelLibName, lua.CoroutineLibName},
+		sandboxRestricted: {lua.BaseLibName, lua.TabLibName, lua.OsLibName, lua.StringLibName, lua.MathLibName, lua.CoroutineLibName},
+	}
+
+	// The functions for opening the Lua libraries
+	luaLibraryOpeners = map[string]lua.LGFunction{
+		lua.LoadLibName:      lua.OpenPackage,
+		lua.BaseLibName:      lua.OpenBase,
+		lua.TabLibName:       lua.OpenTable,
+		lua.IoLibName:        lua.OpenIo,
+		lua.OsLibName:        lua.OpenOs,
+		lua.StringLibName:    lua.OpenString,
+		lua.MathLibName:      lua.OpenMath,
+		lua.DebugLibName:     lua.OpenDebug,
+		lua.ChannelLibName:   lua.OpenChannel,
+		lua.CoroutineLibName: lua.OpenCoroutine,
+	}
+
+	// The functions in the os library that are removed for each profile
+	sandboxRemovedOSFunctions = map[sandboxProfile][]string{
+		sandboxStandard:   {"execute", "exit", "remove", "rename", "setenv", "setlocale", "tmpname"},
+		sandboxRestricted: {"execute", "exit", "remove", "rename", "setenv", "setlocale", "tmpname", "getenv"},
+	}
+
+	// The global functions that are removed for each profile
+	sandboxRemovedGlobals = map[sandboxProfile][]string{
+		sandboxStandard: {"Plugin", "PluginCode", "CallPlugin"},
+		sandboxRestricted: {"Plugin", "PluginCode", "CallPlugin",
+			"dofile", "loadfile", "load", "loadstring", "require", "module",
+			"getfenv", "setfenv", "collectgarbage", "_printregs",
+			"CodeLib", "JFile", "serve", "UploadedFile", "preload", "ClearCache", "ServerInfo"},
+	}
+)
+
+func (profile sandboxProfile) String() string {
+	switch profile {
+	case sandboxStandard:
+		return "standard"
+	case sandboxRestricted:
+		return "restricted"
+	}
+	return "full"
+}
+
+// Parse the name of a sandbox profile
+func parseSandboxProfile(name string) (sandboxProfile, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "full":
+		return sandboxFull, nil
+	case "standard":
+		return sandboxStandard, nil
+	case "restricted":
+		return sandboxRestricted, nil
+	}
+	return sandboxFull, fmt.Errorf("unknown sandbox profile: %s (should be full, standard or restricted)", name)
+}
+
+// Create a Lua state with the libraries that are available for the given profile
+func newSandboxedState(profile sandboxProfile) *lua.LState {
+	if profile == sandboxFull {
+		return lua.NewState()
+	}
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, name := range sandboxLibraries[profile] {
+		L.Push(L.NewFunction(luaLibraryOpeners[name]))
+		L.Push(lua.LString(name))
+		L.Call(1, 0)
+	}
+	if osTable, ok := L.GetGlobal(lua.OsLibName).(*lua.LTable); ok {
+		for _, name := range sandboxRemovedOSFunctions[profile] {
+			osTable.RawSetString(name, lua.LNil)
+		}
+	}
+	L.G.Registry.RawSetString(sandboxRegistryKey, lua.LNumber(profile))
+	applySandbox(L)
+	return L
+}
+
+// Remove the global functions that are not available for the sandbox profile
+// of the given Lua state. Must be called after exporting Algernon functions.
+func applySandbox(L *lua.LState) {
+	profile, ok := L.G.Registry.RawGetString(sandboxRegistryKey).(lua.LNumber)
+	if !ok {
+		return
+	}
+	for _, name := range sandboxRemovedGlobals[sandboxProfile(profile)] {
+		L.SetGlobal(name, lua.LNil)
+	}
+}
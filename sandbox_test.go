@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+func TestSandboxProfiles(t *testing.T) {
+	if _, err := parseSandboxProfile("unknown"); err == nil {
+		t.Error("expected an error for an unknown sandbox profile")
+	}
+	L := newSandboxedState(sandboxRestricted)
+	defer L.Close()
+	L.SetGlobal("JFile", L.NewFunction(func(L *lua.LState) int { return 0 }))
+	applySandbox(L)
+	if err := L.DoString(`assert(io == nil and os.execute == nil and load == nil and JFile == nil and os.time ~= nil)`); err != nil {
+		t.Error(err)
+	}
+}
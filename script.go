@@ -0,0 +1,66 @@
+package main
+
+// Running Lua code non-interactively, with --eval or --run, for admin
+// one-offs and maintenance tasks that use the same backends as the server
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/xyproto/term"
+	"github.com/yuin/gopher-lua"
+)
+
+// Check if Lua code or a Lua script should be run instead of serving
+func (ac *algernonConfig) scriptMode() bool {
+	return ac.evalCode != "" || ac.runFilename != ""
+}
+
+// Run the Lua script, or evaluate the Lua code. The result of the code is
+// pretty printed if it is an expression, just like in the REPL.
+func (ac *algernonConfig) runScript() error {
+	// All libraries are available, regardless of the sandbox profiles
+	L := lua.NewState()
+	// Don't re-use the Lua state
+	defer L.Close()
+
+	o := term.NewTextOutput(runtime.GOOS != "windows", true)
+	ac.exportLuaFunctionsForREPL(L, o)
+
+	// User management, with a request and response that are not sent
+	// anywhere, since there is no client
+	if ac.perm != nil {
+		req := httptest.NewRequest("GET", "/", nil)
+		ac.exportUserstate(httptest.NewRecorder(), req, L, ac.perm.UserState())
+	}
+
+	if ac.runFilename != "" {
+		return L.DoFile(ac.runFilename)
+	}
+	if err := L.DoString("pprint(" + ac.evalCode + ")"); err != nil {
+		// Not an expression, run it as a statement instead
+		if strings.Contains(err.Error(), "syntax error") {
+			return L.DoString(ac.evalCode)
+		}
+		return err
+	}
+	return nil
+}
+
+// Run the Lua code given with --eval or the script given with --run,
+// with the database backend and cache set up, then exit
+func (ac *algernonConfig) runScriptAndExit() {
+	err := ac.runScript()
+
+	// Close the database connection and the Lua state pool
+	ac.generateShutdownFunction(nil)()
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: "+err.Error())
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
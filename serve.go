@@ -20,6 +20,34 @@ var (
 	completed         bool
 )
 
+// List of functions to run when the server is reloaded
+var (
+	reloadFunctions [](func())
+	reloadMut       sync.Mutex
+)
+
+// Add a function to the list of functions that will be ran when reloading
+func atReload(reloadFunction func()) {
+	reloadMut.Lock()
+	defer reloadMut.Unlock()
+	reloadFunctions = append(reloadFunctions, reloadFunction)
+}
+
+// Reload the server, for instance after new files have been deployed.
+// Clears the file cache and runs the reload functions.
+func (ac *algernonConfig) reload() {
+	log.Info("Reloading")
+	if ac.cache != nil {
+		ac.cache.Clear()
+		ac.broadcaster.cleared()
+	}
+	reloadMut.Lock()
+	defer reloadMut.Unlock()
+	for _, reloadFunction := range reloadFunctions {
+		reloadFunction()
+	}
+}
+
 // Add a function to the list of functions that will be ran at shutdown
 func atShutdown(shutdownFunction func()) {
 	mut.Lock()
@@ -70,10 +98,73 @@ func (ac *algernonConfig) generateShutdownFunction(gracefulServer *graceful.Serv
 
 // Create a new graceful server configuration
 func (ac *algernonConfig) newGracefulServer(mux *http.ServeMux, http2support bool, addr string) *graceful.Server {
+	// Send complete responses with Content-Length to old clients
+	var handler http.Handler = mux
+	if ac.legacyMode {
+		handler = ac.legacyHandler(mux)
+	}
+
+	// Send an event if there are too many server errors
+	if ac.errorRateThreshold > 0 {
+		handler = ac.errorRateHandler(handler)
+	}
+
+	// Keep search engines away from staging and development servers
+	if ac.shouldNoIndex() {
+		handler = ac.noIndexHandler(handler)
+	}
+
+	// Count the requests, for the status badge
+	if ac.requestRate != nil {
+		handler = ac.requestRate.handler(handler)
+	}
+
+	// Keep a history of the request rate, error rate and latency
+	if ac.metricsHistory != nil {
+		handler = ac.metricsHistory.handler(handler)
+	}
+
+	// Keep track of the requests that are being handled, for the leak detector
+	if ac.leaks != nil {
+		handler = ac.leaks.handler(handler)
+	}
+
+	// Reject form submissions without a valid CSRF token
+	if ac.csrfProtection {
+		handler = ac.csrfHandler(handler)
+	}
+
+	// Reject requests that may change something while the database is down
+	if ac.dbHealth != nil && ac.dbHealth.readOnly {
+		handler = ac.readOnlyHandler(handler)
+	}
+
+	// Send a copy of the requests to a mirror
+	if ac.mirror != nil {
+		handler = ac.mirror.handler(handler)
+	}
+
+	// Only log the traces of failed or slow requests
+	if ac.tailSampling {
+		handler = ac.tailSamplingHandler(handler)
+	}
+
+	// Handle POST requests with a method override as PUT, PATCH or DELETE,
+	// before the requests are logged, mirrored or checked
+	if ac.methodOverride {
+		handler = ac.methodOverrideHandler(handler)
+	}
+
+	// Limit the number of Server-Sent Event streams and websockets, and
+	// disconnect clients that are too slow to read what is sent to them
+	if ac.streams != nil {
+		handler = ac.streams.handler(handler)
+	}
+
 	// Server configuration
 	s := &http.Server{
 		Addr:    addr,
-		Handler: mux,
+		Handler: handler,
 
 		// The timeout values is also the maximum time it can take
 		// for a complete page of Server-Sent Events (SSE).
@@ -92,6 +183,10 @@ func (ac *algernonConfig) newGracefulServer(mux *http.ServeMux, http2support boo
 	}
 	// Handle ctrl-c
 	gracefulServer.ShutdownInitiated = ac.generateShutdownFunction(gracefulServer) // for investigating gracefulServer.Interrupted
+	// The stream limiter changes the deadlines of the streaming connections
+	if ac.streams != nil {
+		gracefulServer.ConnState = ac.streams.connState
+	}
 	return gracefulServer
 }
 
@@ -124,16 +219,20 @@ func (ac *algernonConfig) serve(mux *http.ServeMux, done, ready chan bool) error
 	switch {
 	case ac.productionMode:
 		// Listen for both HTTPS+HTTP/2 and HTTP requests, on different ports
-		log.Info("Serving HTTP/2 on https://" + ac.serverHost + "/")
-		go func() {
-			// Start serving. Shut down gracefully at exit.
-			// Listen for HTTPS + HTTP/2 requests
-			HTTPS2server := ac.newGracefulServer(mux, true, ac.serverHost+":443")
-			// Start serving. Shut down gracefully at exit.
-			if err := HTTPS2server.ListenAndServeTLS(ac.serverCert, ac.serverKey); err != nil {
-				log.Error(err)
-			}
-		}()
+		if err := ac.checkTLS(); err != nil {
+			log.Error("Not serving HTTPS: ", err)
+		} else {
+			log.Info("Serving HTTP/2 on https://" + ac.serverHost + "/")
+			go func() {
+				// Start serving. Shut down gracefully at exit.
+				// Listen for HTTPS + HTTP/2 requests
+				HTTPS2server := ac.newGracefulServer(mux, true, ac.serverHost+":443")
+				// Start serving. Shut down gracefully at exit.
+				if err := ac.listenAndServeTLS(HTTPS2server); err != nil {
+					log.Error(err)
+				}
+			}()
+		}
 		log.Info("Serving HTTP on http://" + ac.serverHost + "/")
 		go func() {
 			HTTPserver := ac.newGracefulServer(mux, false, ac.serverHost+":80")
@@ -157,6 +256,13 @@ func (ac *algernonConfig) serve(mux *http.ServeMux, done, ready chan bool) error
 			}
 		}()
 	case !(ac.serveJustHTTP2 || ac.serveJustHTTP):
+		// Check the certificate and key before binding
+		if err := ac.checkTLS(); err != nil {
+			log.Error("Not serving HTTPS: ", err)
+			log.Info("Use the -t flag for serving regular HTTP")
+			justServeRegularHTTP <- true
+			break
+		}
 		if strings.HasPrefix(ac.serverAddr, ":") {
 			log.Info("Serving HTTP/2 on https://localhost" + ac.serverAddr + "/")
 		} else {
@@ -166,7 +272,7 @@ func (ac *algernonConfig) serve(mux *http.ServeMux, done, ready chan bool) error
 		HTTPS2server := ac.newGracefulServer(mux, true, ac.serverAddr)
 		// Start serving. Shut down gracefully at exit.
 		go func() {
-			if err := HTTPS2server.ListenAndServeTLS(ac.serverCert, ac.serverKey); err != nil {
+			if err := ac.listenAndServeTLS(HTTPS2server); err != nil {
 				log.Error("Not serving HTTPS: ", err)
 				log.Info("Use the -t flag for serving regular HTTP")
 				// If HTTPS failed (perhaps the key + cert are missing),
@@ -181,6 +287,9 @@ func (ac *algernonConfig) serve(mux *http.ServeMux, done, ready chan bool) error
 	// Wait just a tiny bit
 	time.Sleep(20 * time.Millisecond)
 
+	// Webhooks for startup, shutdown and deploys
+	ac.setupServerEvents()
+
 	ready <- true // Send a "ready" message to the REPL
 
 	// Open the URL, if specified
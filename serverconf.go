@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -15,7 +16,6 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/xyproto/datablock"
 	postgres "github.com/xyproto/permissionHSTORE"
 	bolt "github.com/xyproto/permissionbolt"
 	redis "github.com/xyproto/permissions2"
@@ -114,6 +114,7 @@ type algernonConfig struct {
 	cacheCompression      bool
 	cacheMaxEntitySize    uint64
 	cacheCompressionSpeed bool // Compression speed over compactness
+	cacheAdmission        bool // Only let popular files replace cached files
 	noCache               bool
 	noHeaders             bool
 
@@ -140,10 +141,63 @@ type algernonConfig struct {
 	// Look for files in the directory with the same name as the requested hostname
 	serverAddDomain bool
 
-	// Don't use a database backend. There will be loss of functionality.
-	// TODO: Add a flag for this.
+	// Don't use a database backend. The data is kept in memory instead.
 	useNoDatabase bool
 
+	// JSON file for saving and loading the in-memory data
+	snapshotFilename string
+
+	// JSON file with settings for config.get, and the loaded settings
+	settingsFilename string
+	settings         *settingsFile
+
+	// Keep search engines from indexing the pages, unless in production mode
+	// or if --allowindex is given
+	noIndex    bool
+	allowIndex bool
+
+	// Add CSRF tokens to POST forms, and reject requests without a valid token
+	csrfProtection bool
+
+	// Scanners for uploaded files, for all uploads and for upload directories,
+	// and the directory where flagged files are moved
+	uploadScanners        string
+	uploadQuarantine      string
+	uploadScanPolicy      *uploadScanPolicy
+	dirUploadScanPolicies map[string]*uploadScanPolicy
+
+	// The settings from .algernon.toml files, by directory
+	overlays overlayCache
+
+	// Check the templates for errors, then exit, with --check or --checkjson
+	checkMode bool
+	checkJSON bool
+
+	// Write the server information as JSON, then exit
+	infoJSON bool
+
+	// Limits for Server-Sent Event streams and websockets
+	maxStreams         int
+	maxStreamsPerIP    int
+	streamWriteTimeout time.Duration
+	streams            *streamLimiter
+
+	// Serve a status badge at /status.svg, with the number of requests per minute
+	statusBadge bool
+	requestRate *requestRate
+
+	// What to do while the database is down, and if it is up
+	dbFallback string
+	dbHealth   *dbHealth
+
+	// Handle POST requests as PUT, PATCH or DELETE, if the method is overridden
+	methodOverride bool
+
+	// Mirror a percentage of the requests to an URL or a log file
+	mirrorTarget  string
+	mirrorPercent float64
+	mirror        *requestMirror
+
 	// For serving a directory with files over regular HTTP
 	simpleMode bool
 
@@ -164,16 +218,155 @@ type algernonConfig struct {
 	// Workaround for rendering Pongo2 pages without concurrency issues
 	pongomutex *sync.RWMutex
 
+	// For the Lua states of server configuration scripts and Lua server
+	// files, that are shared by the handlers, authentication providers and
+	// HTML filters that are defined in them
+	luahandlermutex *sync.RWMutex
+
 	// Temporary directory
 	serverTempDir string
 
 	// REPL
 	ctrldTwice bool
 
+	// Serve language variants of files, like "index.de.md" for "index.md"
+	languageVariants bool
+
+	// Compatibility with HTTP/1.0 and other old clients
+	legacyMode bool
+
+	// Serve FILE.gz files from "algernon manifest -gzip" instead of compressing FILE
+	precompressed bool
+
+	// The Lua debugger, in debug mode, and the address for DAP clients
+	debugger *luaDebugger
+	dapAddr  string
+
+	// The number of worker processes for running Lua and rendering pages,
+	// the memory limit per worker (in MiB) and, in a worker, the Unix socket
+	workerCount     int
+	workerMemoryMiB uint64
+	workerSocket    string
+
+	// Index filenames, in order of priority, for all directories
+	// and for specific directories (relative to the server directory)
+	indexFilenames    []string
+	dirIndexFilenames map[string][]string
+
+	// Sandbox profiles for page scripts and for configuration scripts
+	sandboxName     string
+	confSandboxName string
+
+	// How pooled Lua states are cleaned up between requests
+	stateHygieneName string
+
+	// Webhooks for server events, the default secret for signing them and
+	// the number of server errors per minute that triggers an event
+	webhooks           []webhook
+	webhookMut         *sync.Mutex
+	webhookURLs        string
+	webhookSecret      string
+	errorRateThreshold int
+
+	// Comments for Markdown pages, and if new comments must be approved
+	comments         bool
+	moderateComments bool
+	commentsMut      *sync.Mutex
+
+	// Forms from the server configuration, the recent submissions per form
+	// and client, and the SMTP server and sender address for sending them
+	forms           map[string]*form
+	formSubmissions map[string][]time.Time
+	formsSwept      time.Time // when the old submissions were last forgotten
+	formsMut        *sync.Mutex
+	smtpURL         string
+	mailFrom        string
+
+	// Generate a service worker that precaches the given routes and the
+	// assets, and a web app manifest with the given name
+	pwa       bool
+	pwaRoutes string
+	pwaAssets string
+	pwaName   string
+
+	// Log traces of requests that fail or take longer than traceLatency
+	tailSampling bool
+	traceLatency time.Duration
+
+	// Lua code to evaluate, or a Lua script to run, instead of serving
+	evalCode    string
+	runFilename string
+
+	// Show thumbnails of images in directory listings
+	listingThumbnails bool
+
+	// Link to a player page for audio and video files in directory listings
+	mediaPlayer bool
+
+	// Remove files that change on disk from the cache
+	watchFiles bool
+	changes    *changeQueue
+
+	// Tell other instances that use the same Redis server about cache invalidations
+	cacheBroadcast bool
+	broadcaster    *cacheBroadcaster
+
+	// Serve a page for admins with the files in the cache, at /_cache
+	cacheDebug bool
+
+	// Keep a history of the requests for the last hour, for the REPL and /_metrics
+	metrics        bool
+	metricsHistory *metricsHistory
+
+	// Find goroutines and memory that Lua handlers leave behind, in debug mode
+	leaks *leakDetector
+
+	// Use client hints for selecting image variants
+	clientHints bool
+
+	// Filters for rendered HTML, by URL path prefix
+	htmlFilters    []htmlFilter
+	htmlFiltersMut sync.RWMutex
+
+	// Providers for logging in users with SSO, Kerberos and the like
+	authProviders    []authProvider
+	authProvidersMut sync.RWMutex
+
+	// Subcommand, like "sign", and the arguments that follows it
+	command     string
+	commandArgs []string
+
+	// Build a self-contained executable, with --build-exe DIR OUTPUT
+	buildExe bool
+
+	// Serve the application that is appended to the executable
+	embeddedApp bool
+
+	// File with trusted public keys, for only serving signed archives
+	trustedKeysFilename string
+
+	// File with mime types that overrides the system mime types
+	mimeTypesFilename string
+
+	// Certificates from ACME DNS-01 challenges
+	acmeDNSProvider string
+	acmeDomains     []string
+	acmeSettings    map[string]string
+	acmeDNS         *acmeDNSManager
+
+	// Draft pages and preview URLs
+	serveDrafts   bool
+	previewSecret []byte
+
+	// Rendering API, for rendering Markdown, Amber and GCSS over HTTP
+	renderAPIPath string
+	renderAPIKey  string
+
 	// State and caching
-	perm    pinterface.IPermissions
-	luapool *lStatePool
-	cache   *datablock.FileCache
+	perm        pinterface.IPermissions
+	luapool     *lStatePool // for page scripts
+	confluapool *lStatePool // for configuration scripts
+	cache       *fileCache
 }
 
 func newAlgernonConfig() *algernonConfig {
@@ -210,7 +403,15 @@ func newAlgernonConfig() *algernonConfig {
 		cacheCompressionSpeed: true,
 
 		// Mutex for rendering Pongo2 pages
-		pongomutex: &sync.RWMutex{},
+		pongomutex:      &sync.RWMutex{},
+		luahandlermutex: &sync.RWMutex{},
+		webhookMut:      &sync.Mutex{},
+		commentsMut:     &sync.Mutex{},
+
+		// Forms and recent form submissions
+		forms:           make(map[string]*form),
+		formSubmissions: make(map[string][]time.Time),
+		formsMut:        &sync.Mutex{},
 	}
 }
 
@@ -225,6 +426,11 @@ func (ac *algernonConfig) init() {
 	// Set several configuration variables, based on the given flags and arguments
 	ac.handleFlags(serverTempDir)
 
+	// Run a command, like "algernon sign app.alg", instead of serving
+	if ac.command != "" {
+		ac.runCommandAndExit()
+	}
+
 	// Version
 	if ac.showVersion {
 		if !ac.quietMode {
@@ -267,7 +473,9 @@ func (ac *algernonConfig) init() {
 	// Create a cache struct for reading files (contains functions that can
 	// be used for reading files, also when caching is disabled).
 	// The final argument is for compressing with "fast" instead of "best".
-	ac.cache = datablock.NewFileCache(ac.cacheSize, ac.cacheCompression, ac.cacheMaxEntitySize, ac.cacheCompressionSpeed)
+	ac.cache = newFileCache(ac.cacheSize, ac.cacheCompression, ac.cacheMaxEntitySize, ac.cacheCompressionSpeed)
+	// Keep large or rarely requested files from pushing popular files out of the cache
+	ac.cache.SetAdmission(ac.cacheAdmission)
 }
 
 // Write a status message to a buffer, given a name and a bool
@@ -305,76 +513,163 @@ func writeStatus(buf *bytes.Buffer, title string, flags map[string]bool) {
 	buf.WriteString("]\n")
 }
 
-func (ac *algernonConfig) Info() string {
-	var buf bytes.Buffer
+// A line of server information, for Info and InfoJSON
+type infoEntry struct {
+	key   string      // the key in the JSON output
+	label string      // the label in the text output
+	value interface{} // a string, number, bool, list of strings or map of options
+	text  string      // the value in the text output, if different from the value
+}
+
+// Return the server information, in the order it is shown
+func (ac *algernonConfig) infoEntries() []infoEntry {
+	var entries []infoEntry
+	add := func(key, label string, value interface{}, text string) {
+		entries = append(entries, infoEntry{key, label, value, text})
+	}
 
 	if !ac.singleFileMode {
-		buf.WriteString("Server directory:\t" + ac.serverDirOrFilename + "\n")
+		add("server_directory", "Server directory", ac.serverDirOrFilename, "")
 	} else {
-		buf.WriteString("Filename:\t\t" + ac.serverDirOrFilename + "\n")
+		add("filename", "Filename", ac.serverDirOrFilename, "")
 	}
 	if !ac.productionMode {
-		buf.WriteString("Server address:\t\t" + ac.serverAddr + "\n")
+		add("server_address", "Server address", ac.serverAddr, "")
 	} // else port 80 and 443
 	if ac.dbName == "" {
-		buf.WriteString("Database:\t\tDisabled\n")
+		add("database", "Database", nil, "Disabled")
 	} else {
-		buf.WriteString("Database:\t\t" + ac.dbName + "\n")
+		add("database", "Database", ac.dbName, "")
 	}
-	if ac.luaServerFilename != "" {
-		buf.WriteString("Server filename:\t" + ac.luaServerFilename + "\n")
+	if ac.dbHealth != nil && ac.dbFallback != "" {
+		add("database_fallback", "Database fallback", ac.dbFallback, "")
 	}
-
-	// Write the status of flags that can be toggled
-	writeStatus(&buf, "Options", map[string]bool{
-		"Debug":        ac.debugMode,
-		"Production":   ac.productionMode,
-		"Auto-refresh": ac.autoRefreshMode,
-		"Dev":          ac.devMode,
-		"Server":       ac.serverMode,
-		"StatCache":    ac.cacheFileStat,
-	})
-
-	buf.WriteString("Cache mode:\t\t" + ac.cacheMode.String() + "\n")
+	if ac.luaServerFilename != "" {
+		add("server_filename", "Server filename", ac.luaServerFilename, "")
+	}
+	if ac.sandboxName != "" && ac.sandboxName != "full" {
+		add("page_sandbox", "Page sandbox", ac.sandboxName, "")
+	}
+	if ac.confSandboxName != "" && ac.confSandboxName != "full" {
+		add("config_sandbox", "Config sandbox", ac.confSandboxName, "")
+	}
+	if ac.workerCount > 0 {
+		add("workers", "Workers", ac.workerCount, "")
+	}
+
+	// The status of flags that can be toggled
+	add("options", "Options", map[string]bool{
+		"Debug":         ac.debugMode,
+		"Production":    ac.productionMode,
+		"Auto-refresh":  ac.autoRefreshMode,
+		"Dev":           ac.devMode,
+		"Server":        ac.serverMode,
+		"StatCache":     ac.cacheFileStat,
+		"Legacy":        ac.legacyMode,
+		"Precompressed": ac.precompressed,
+		"Comments":      ac.comments,
+		"PWA":           ac.pwa,
+		"NoIndex":       ac.shouldNoIndex(),
+	}, "")
+
+	add("cache_mode", "Cache mode", ac.cacheMode.String(), "")
 	if ac.cacheSize != 0 {
-		buf.WriteString(fmt.Sprintf("Cache size:\t\t%d bytes\n", ac.cacheSize))
+		add("cache_size", "Cache size", ac.cacheSize, fmt.Sprintf("%d bytes", ac.cacheSize))
+	}
+	if ac.cacheAdmission && ac.cacheMode != cacheModeOff {
+		add("cache_admission", "Cache admission", "TinyLFU", "")
+	}
+	if ac.cacheBroadcast && ac.cacheMode != cacheModeOff {
+		add("cache_broadcast", "Cache broadcast", cacheBroadcastChannel, "")
 	}
 
 	if ac.serverLogFile != "" {
-		buf.WriteString("Log file:\t\t" + ac.serverLogFile + "\n")
+		add("log_file", "Log file", ac.serverLogFile, "")
 	}
 	if !(ac.serveJustHTTP2 || ac.serveJustHTTP) {
-		buf.WriteString("TLS certificate:\t" + ac.serverCert + "\n")
-		buf.WriteString("TLS key:\t\t" + ac.serverKey + "\n")
+		add("tls_certificate", "TLS certificate", ac.serverCert, "")
+		add("tls_key", "TLS key", ac.serverKey, "")
 	}
 	if ac.autoRefreshMode {
-		buf.WriteString("Event server:\t\t" + ac.eventAddr + "\n")
+		add("event_server", "Event server", ac.eventAddr, "")
 	}
 	if ac.autoRefreshDir != "" {
-		buf.WriteString("Only watching:\t\t" + ac.autoRefreshDir + "\n")
+		add("only_watching", "Only watching", ac.autoRefreshDir, "")
 	}
 	if ac.redisAddr != ac.defaultRedisColonPort {
-		buf.WriteString("Redis address:\t\t" + ac.redisAddr + "\n")
+		add("redis_address", "Redis address", ac.redisAddr, "")
 	}
 	if ac.disableRateLimiting {
-		buf.WriteString("Request limit:\t\tOff\n")
+		add("request_limit", "Request limit", nil, "Off")
 	} else {
-		buf.WriteString(fmt.Sprintf("Request limit:\t\t%d/sec\n", ac.limitRequests))
+		add("request_limit", "Request limit", ac.limitRequests, fmt.Sprintf("%d/sec", ac.limitRequests))
 	}
 	if ac.redisDBindex != 0 {
-		buf.WriteString(fmt.Sprintf("Redis database index:\t%d\n", ac.redisDBindex))
+		add("redis_database_index", "Redis database index", ac.redisDBindex, "")
 	}
 	if len(ac.serverConfigurationFilenames) > 0 {
-		buf.WriteString(fmt.Sprintf("Server configuration:\t%v\n", ac.serverConfigurationFilenames))
+		add("server_configuration", "Server configuration", ac.serverConfigurationFilenames, fmt.Sprintf("%v", ac.serverConfigurationFilenames))
+	}
+	if ac.clientHints {
+		add("client_hints", "Client hints", true, "Enabled")
+	}
+	if ac.trustedKeysFilename != "" {
+		add("trusted_keys", "Trusted keys", ac.trustedKeysFilename, "")
+	}
+	if ac.mimeTypesFilename != "" {
+		add("mime_types", "Mime types", ac.mimeTypesFilename, "")
+	}
+	if ac.acmeDNSProvider != "" {
+		add("acme_dns01", "ACME DNS-01", map[string]interface{}{"provider": ac.acmeDNSProvider, "domains": ac.acmeDomains}, ac.acmeDNSProvider+" ("+strings.Join(ac.acmeDomains, ", ")+")")
+	}
+	if ac.renderAPIPath != "" {
+		add("rendering_api", "Rendering API", ac.renderAPIPath, "")
 	}
 	if ac.internalLogFilename != "/dev/null" {
-		buf.WriteString("Internal log file:\t" + ac.internalLogFilename + "\n")
+		add("internal_log_file", "Internal log file", ac.internalLogFilename, "")
+	}
+	return entries
+}
+
+// Info returns the server information as text, with the values lined up
+func (ac *algernonConfig) Info() string {
+	var buf bytes.Buffer
+	for _, entry := range ac.infoEntries() {
+		if options, ok := entry.value.(map[string]bool); ok {
+			writeStatus(&buf, entry.label, options)
+			continue
+		}
+		text := entry.text
+		if text == "" {
+			text = fmt.Sprint(entry.value)
+		}
+		// Line up the values at the third tab stop
+		label := entry.label + ":"
+		buf.WriteString(label + strings.Repeat("\t", (24-len(label)+7)/8) + text + "\n")
 	}
 	infoString := buf.String()
 	// Return without the final newline
 	return infoString[:len(infoString)-1]
 }
 
+// InfoJSON returns the server information as JSON, with all the options,
+// both enabled and disabled, and the version
+func (ac *algernonConfig) InfoJSON() ([]byte, error) {
+	info := map[string]interface{}{"version": versionString}
+	for _, entry := range ac.infoEntries() {
+		if options, ok := entry.value.(map[string]bool); ok {
+			lowerCaseOptions := make(map[string]bool, len(options))
+			for name, enabled := range options {
+				lowerCaseOptions[strings.ToLower(name)] = enabled
+			}
+			info[entry.key] = lowerCaseOptions
+			continue
+		}
+		info[entry.key] = entry.value
+	}
+	return json.MarshalIndent(info, "", "  ")
+}
+
 // Make functions related to server configuration and permissions available
 // Can not handle perm == nil
 func (ac *algernonConfig) exportServerConfigFunctions(L *lua.LState, filename string) {
@@ -491,6 +786,30 @@ func (ac *algernonConfig) exportServerConfigFunctions(L *lua.LState, filename st
 		return 1 // number of results
 	}))
 
+	// Certificates from ACME DNS-01 challenges
+	ac.exportACMEDNSFunction(L)
+
+	// Overriding mime types
+	exportMimeTypeFunctions(L, filename)
+
+	// The index files for directories
+	ac.exportIndexFilesFunction(L)
+
+	// Webhooks for server events
+	ac.exportWebhookFunction(L)
+
+	// Forms that are stored in the database
+	ac.exportFormFunction(L)
+
+	// Scanning of uploaded files
+	ac.exportUploadScanFunction(L)
+
+	// Authentication providers
+	ac.exportAuthProviderFunction(L, filename)
+
+	// Functions that are called when settings change
+	ac.exportConfigChangeFunction(L)
+
 }
 
 // Use one of the databases for the permission middleware,
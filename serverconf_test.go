@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestInfoJSON(t *testing.T) {
+	ac := newAlgernonConfig()
+	ac.serverDirOrFilename = "/srv/www"
+	ac.serverAddr = ":3000"
+	if !strings.HasPrefix(ac.Info(), "Server directory:\t/srv/www\nServer address:\t\t:3000\n") {
+		t.Errorf("unexpected server information:\n%s", ac.Info())
+	}
+	data, err := ac.InfoJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info map[string]interface{}
+	if err := json.Unmarshal(data, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info["server_directory"] != "/srv/www" || info["version"] != versionString {
+		t.Errorf("unexpected server information: %s", data)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+// CSRF tokens and flash messages, for pages with forms.
+//
+// The CSRF token is an HMAC of the signed "user" cookie, with the cookie
+// secret of the user state as the key. It is the same for all pages for as
+// long as the user stays logged in, and changes when the user logs in again.
+// Visitors that are not logged in are given a random value in the "csrf"
+// cookie instead, so that each client has its own token.
+// With --csrf, a hidden field with the token is added to all POST forms, and
+// POST, PUT, PATCH and DELETE requests without a valid token are rejected.
+//
+// Flash messages are stored in a signed cookie until the next page shows them,
+// which is useful for showing a message after a redirect.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/cookie"
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	// The name of the hidden form field with the CSRF token
+	csrfFieldName = "_csrf"
+
+	// The header that can be used for the CSRF token instead, for AJAX requests
+	csrfHeaderName = "X-CSRF-Token"
+
+	// The cookie with a random value for each client, for the CSRF tokens of
+	// visitors that are not logged in
+	csrfCookieName = "csrf"
+
+	// The name of the cookie with the flash messages
+	flashCookieName = "flash"
+
+	// How long flash messages are kept, if they are not shown, in seconds
+	flashCookieAge = 3600
+
+	// The maximum number of flash messages that are kept
+	maxFlashMessages = 16
+)
+
+var (
+	// The opening tag of forms that use POST
+	postFormPattern = regexp.MustCompile(`(?i)<form\b[^>]*\bmethod\s*=\s*["']?post\b[^>]*>`)
+
+	// Used for signing if there is no user state
+	fallbackSecret     string
+	fallbackSecretOnce sync.Once
+)
+
+// A message to be shown on the next page
+type flashMessage struct {
+	Message string `json:"message"`
+	Kind    string `json:"kind"`
+}
+
+// Return the secret that is used for signing the CSRF tokens and flash messages
+func (ac *algernonConfig) sessionSecret() string {
+	if ac.perm != nil {
+		return ac.perm.UserState().CookieSecret()
+	}
+	fallbackSecretOnce.Do(func() {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			log.Fatal(err)
+		}
+		fallbackSecret = hex.EncodeToString(b)
+	})
+	return fallbackSecret
+}
+
+// Return the CSRF token for the current user, or for visitors that are not
+// logged in. Returns an empty string for visitors without a "csrf" cookie.
+func (ac *algernonConfig) csrfToken(req *http.Request) string {
+	secret := ac.sessionSecret()
+	var session string
+	if _, ok := cookie.SecureCookie(req, "user", secret); ok {
+		if c, err := req.Cookie("user"); err == nil {
+			session = "user\x00" + c.Value
+		}
+	}
+	if session == "" {
+		c, err := req.Cookie(csrfCookieName)
+		if err != nil || c.Value == "" {
+			return ""
+		}
+		session = "client\x00" + c.Value
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("csrf\x00" + session))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Give a visitor a "csrf" cookie with a random value, if there is none. The
+// cookie is also added to the request, so that csrfToken can be used for the
+// rest of the request.
+func ensureCSRFCookie(w http.ResponseWriter, req *http.Request) {
+	if c, err := req.Cookie(csrfCookieName); err == nil && c.Value != "" {
+		return
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Error(err)
+		return
+	}
+	c := &http.Cookie{Name: csrfCookieName, Value: hex.EncodeToString(b), Path: "/", HttpOnly: true, Secure: req.TLS != nil}
+	http.SetCookie(w, c)
+	req.AddCookie(c)
+}
+
+// Return a hidden form field with the given CSRF token
+func csrfField(token string) string {
+	return fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`, csrfFieldName, html.EscapeString(token))
+}
+
+// Check the CSRF token in the header or in the form data of a request
+func (ac *algernonConfig) validCSRF(req *http.Request) bool {
+	given := req.Header.Get(csrfHeaderName)
+	if given == "" {
+		given = req.FormValue(csrfFieldName)
+	}
+	token := ac.csrfToken(req)
+	return given != "" && token != "" && hmac.Equal([]byte(given), []byte(token))
+}
+
+// Check if a request method does not change anything, and needs no CSRF token
+func safeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// Reject requests that may change something, if they do not have a valid CSRF
+// token. Requests to the rendering API with the right bearer token are not
+// sent automatically by browsers, and are let through. Visitors are given a
+// "csrf" cookie, for their CSRF token.
+func (ac *algernonConfig) csrfHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ensureCSRFCookie(w, req)
+		if safeMethod(req.Method) || (ac.renderAPIPath != "" && req.URL.Path == ac.renderAPIPath && ac.validRenderAPIKey(req)) {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		if !ac.validCSRF(req) {
+			log.Warn("Missing or invalid CSRF token for ", req.Method, " ", req.URL.Path, " from ", req.RemoteAddr)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, messagePage("Forbidden", "The form has expired, or was sent from another site. Go back, reload the page and try again.", ac.defaultTheme))
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// Add a hidden field with the CSRF token to all POST forms in the HTML
+func insertCSRFFields(htmldata []byte, token string) []byte {
+	field := []byte(csrfField(token))
+	return postFormPattern.ReplaceAllFunc(htmldata, func(tag []byte) []byte {
+		return append(append([]byte{}, tag...), field...)
+	})
+}
+
+// An HTML filter that adds the CSRF token to all POST forms
+func (ac *algernonConfig) csrfFilter(req *http.Request, htmldata []byte) ([]byte, error) {
+	if !bytes.Contains(bytes.ToLower(htmldata), []byte("<form")) {
+		return htmldata, nil
+	}
+	return insertCSRFFields(htmldata, ac.csrfToken(req)), nil
+}
+
+// The flash messages for a request
+type flashMessages struct {
+	ac       *algernonConfig
+	w        http.ResponseWriter
+	req      *http.Request
+	messages []flashMessage
+	loaded   bool
+}
+
+// Prepare the flash messages for a request. They are read from the cookie when needed.
+func (ac *algernonConfig) newFlashMessages(w http.ResponseWriter, req *http.Request) *flashMessages {
+	return &flashMessages{ac: ac, w: w, req: req}
+}
+
+// Read the flash messages from the cookie, if this has not been done already
+func (fm *flashMessages) load() {
+	if fm.loaded {
+		return
+	}
+	fm.loaded = true
+	value, ok := cookie.SecureCookie(fm.req, flashCookieName, fm.ac.sessionSecret())
+	if !ok || value == "" {
+		return
+	}
+	if err := json.Unmarshal([]byte(value), &fm.messages); err != nil {
+		fm.messages = nil
+	}
+}
+
+// Write the flash messages to the cookie, or remove the cookie if there are none
+func (fm *flashMessages) save() {
+	// Replace the flash cookie, if it has already been set for this response
+	var setCookies []string
+	for _, line := range fm.w.Header()["Set-Cookie"] {
+		if !strings.HasPrefix(line, flashCookieName+"=") {
+			setCookies = append(setCookies, line)
+		}
+	}
+	fm.w.Header()["Set-Cookie"] = setCookies
+
+	if len(fm.messages) == 0 {
+		if _, err := fm.req.Cookie(flashCookieName); err == nil {
+			http.SetCookie(fm.w, &http.Cookie{Name: flashCookieName, Path: "/", MaxAge: -1, HttpOnly: true})
+		}
+		return
+	}
+	data, err := json.Marshal(fm.messages)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	cookie.SetSecureCookiePathWithFlags(fm.w, flashCookieName, string(data), flashCookieAge, "/", fm.ac.sessionSecret(), false, true)
+}
+
+// Add a message to be shown on the next page
+func (fm *flashMessages) add(message, kind string) {
+	fm.load()
+	fm.messages = append(fm.messages, flashMessage{message, kind})
+	if len(fm.messages) > maxFlashMessages {
+		fm.messages = fm.messages[len(fm.messages)-maxFlashMessages:]
+	}
+	fm.save()
+}
+
+// Return the flash messages, and remove them so that they are only shown once
+func (fm *flashMessages) take() []flashMessage {
+	fm.load()
+	messages := fm.messages
+	fm.messages = nil
+	if len(messages) > 0 {
+		fm.save()
+	}
+	return messages
+}
+
+// Functions for templates, for the CSRF token and the flash messages
+func (ac *algernonConfig) sessionFuncs(w http.ResponseWriter, req *http.Request) template.FuncMap {
+	fm := ac.newFlashMessages(w, req)
+	return template.FuncMap{
+		"csrftoken": func(...string) (interface{}, error) {
+			ensureCSRFCookie(w, req)
+			return ac.csrfToken(req), nil
+		},
+		"csrffield": func(...string) (interface{}, error) {
+			ensureCSRFCookie(w, req)
+			return template.HTML(csrfField(ac.csrfToken(req))), nil
+		},
+		"flashes": func(...string) (interface{}, error) {
+			var messages []map[string]string
+			for _, m := range fm.take() {
+				messages = append(messages, map[string]string{"message": m.Message, "kind": m.Kind})
+			}
+			return messages, nil
+		},
+	}
+}
+
+// Add the functions for the CSRF token and the flash messages to the
+// functions for a template, unless data.lua has functions with the same names
+func (ac *algernonConfig) addSessionFuncs(w http.ResponseWriter, req *http.Request, funcs template.FuncMap) {
+	for name, f := range ac.sessionFuncs(w, req) {
+		if _, found := funcs[name]; !found {
+			funcs[name] = f
+		}
+	}
+}
+
+// Make functions for the CSRF token and the flash messages available to Lua
+func (ac *algernonConfig) exportSessionFunctions(w http.ResponseWriter, req *http.Request, L *lua.LState) {
+	fm := ac.newFlashMessages(w, req)
+
+	// Return the CSRF token for the current user
+	L.SetGlobal("csrftoken", L.NewFunction(func(L *lua.LState) int {
+		ensureCSRFCookie(w, req)
+		L.Push(lua.LString(ac.csrfToken(req)))
+		return 1 // number of results
+	}))
+
+	// Return a hidden form field with the CSRF token
+	L.SetGlobal("csrffield", L.NewFunction(func(L *lua.LState) int {
+		ensureCSRFCookie(w, req)
+		L.Push(lua.LString(csrfField(ac.csrfToken(req))))
+		return 1 // number of results
+	}))
+
+	// Check the CSRF token in the X-CSRF-Token header or the _csrf form field
+	L.SetGlobal("csrfcheck", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(ac.validCSRF(req)))
+		return 1 // number of results
+	}))
+
+	// Add a message to be shown on the next page, with an optional kind,
+	// like "info", "success", "warning" or "error"
+	L.SetGlobal("flash", L.NewFunction(func(L *lua.LState) int {
+		message := L.CheckString(1)
+		kind := L.OptString(2, "info")
+		fm.add(message, kind)
+		return 0 // number of results
+	}))
+
+	// Return the flash messages as a table of tables with "message" and "kind",
+	// and remove them
+	L.SetGlobal("flashes", L.NewFunction(func(L *lua.LState) int {
+		table := L.NewTable()
+		for _, m := range fm.take() {
+			entry := L.NewTable()
+			L.SetField(entry, "message", lua.LString(m.Message))
+			L.SetField(entry, "kind", lua.LString(m.Kind))
+			table.Append(entry)
+		}
+		L.Push(table)
+		return 1 // number of results
+	}))
+}
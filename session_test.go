@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	ac := newAlgernonConfig()
+	req := httptest.NewRequest("POST", "/", nil)
+	if token := ac.csrfToken(req); token != "" {
+		t.Errorf("expected no token without a session or a csrf cookie, got %s", token)
+	}
+	ensureCSRFCookie(httptest.NewRecorder(), req)
+	token := ac.csrfToken(req)
+	html := string(insertCSRFFields([]byte(`<form method="POST" action="/"><form method="get">`), token))
+	if strings.Count(html, csrfFieldName) != 1 || !strings.Contains(html, token) {
+		t.Errorf("expected one CSRF field, got %s", html)
+	}
+	c, _ := req.Cookie(csrfCookieName)
+	req = httptest.NewRequest("POST", "/", strings.NewReader(csrfFieldName+"="+token))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(c)
+	if !ac.validCSRF(req) {
+		t.Error("expected the CSRF token to be valid")
+	}
+	req = httptest.NewRequest("POST", "/", nil)
+	req.Header.Set(csrfHeaderName, "wrong")
+	req.AddCookie(c)
+	if ac.validCSRF(req) {
+		t.Error("expected the CSRF token to be invalid")
+	}
+
+	// Another visitor gets another token, and can not use this one
+	other := httptest.NewRequest("POST", "/", nil)
+	ensureCSRFCookie(httptest.NewRecorder(), other)
+	if ac.csrfToken(other) == token {
+		t.Error("expected visitors to have different tokens")
+	}
+	other.Header.Set(csrfHeaderName, token)
+	if ac.validCSRF(other) {
+		t.Error("expected the token of another visitor to be rejected")
+	}
+}
+
+func TestCSRFHandler(t *testing.T) {
+	ac := newAlgernonConfig()
+	ac.renderAPIPath = "/render"
+	ac.renderAPIKey = "secret"
+	handler := ac.csrfHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	for _, tc := range []struct {
+		path, authorization string
+		status              int
+	}{
+		{"/", "Bearer anything", http.StatusForbidden},
+		{"/render", "Bearer wrong", http.StatusForbidden},
+		{"/render", "Bearer secret", http.StatusOK},
+	} {
+		req := httptest.NewRequest("POST", tc.path, nil)
+		req.Header.Set("Authorization", tc.authorization)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("expected %d for %s with %q, got %d", tc.status, tc.path, tc.authorization, w.Code)
+		}
+		if !strings.Contains(w.Header().Get("Set-Cookie"), csrfCookieName+"=") {
+			t.Error("expected the visitor to be given a csrf cookie")
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+// Signing and verification of .alg archives with Ed25519 keys.
+// Signatures are stored next to the archive, in a file ending with ".sig".
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ed25519"
+)
+
+const signatureExtension = ".sig"
+
+// Read a file with a base64 encoded key or signature of the given size
+func readBase64File(filename string, size int) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	if len(decoded) != size {
+		return nil, fmt.Errorf("%s: expected %d bytes, got %d", filename, size, len(decoded))
+	}
+	return decoded, nil
+}
+
+// Read a file with trusted public keys, one base64 encoded key per line.
+// Empty lines and lines starting with "#" are ignored.
+func readPublicKeys(filename string) ([]ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ed25519.PublicKey
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		// Allow a comment after the key, like in authorized_keys
+		fields := bytes.Fields(line)
+		key, err := base64.StdEncoding.DecodeString(string(fields[0]))
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s, line %d: not an Ed25519 public key", filename, i+1)
+		}
+		keys = append(keys, ed25519.PublicKey(key))
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("found no public keys in " + filename)
+	}
+	return keys, nil
+}
+
+// Verify the signature of an archive, given a list of trusted public keys
+func verifyArchive(filename string, keys []ed25519.PublicKey) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	signature, err := readBase64File(filename+signatureExtension, ed25519.SignatureSize)
+	if err != nil {
+		return fmt.Errorf("%s is not signed: %s", filename, err)
+	}
+	for _, key := range keys {
+		if ed25519.Verify(key, data, signature) {
+			return nil
+		}
+	}
+	return errors.New("the signature of " + filename + " is not from a trusted key")
+}
+
+// Generate a new key pair, as NAME.key and NAME.pub
+func keygenCommand(ac *algernonConfig, args []string) error {
+	name := "algernon"
+	if len(args) > 0 {
+		name = args[0]
+	}
+	privateFilename, publicFilename := name+".key", name+".pub"
+	if _, err := os.Stat(privateFilename); err == nil {
+		return errors.New(privateFilename + " already exists")
+	}
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(privateFilename, []byte(base64.StdEncoding.EncodeToString(priv)+"\n"), 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(publicFilename, []byte(base64.StdEncoding.EncodeToString(pub)+"\n"), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s and %s\n", privateFilename, publicFilename)
+	return nil
+}
+
+// Sign one or more archives with a private key
+func signCommand(ac *algernonConfig, args []string) error {
+	flags := flag.NewFlagSet("sign", flag.ContinueOnError)
+	keyFilename := flags.String("key", "algernon.key", "Ed25519 private key")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("usage: algernon sign [-key FILENAME] ARCHIVE...")
+	}
+	priv, err := readBase64File(*keyFilename, ed25519.PrivateKeySize)
+	if err != nil {
+		return err
+	}
+	for _, filename := range flags.Args() {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		signature := ed25519.Sign(ed25519.PrivateKey(priv), data)
+		if err := ioutil.WriteFile(filename+signatureExtension, []byte(base64.StdEncoding.EncodeToString(signature)+"\n"), 0644); err != nil {
+			return err
+		}
+		fmt.Println("Signed " + filename)
+	}
+	return nil
+}
+
+// Verify the signatures of one or more archives
+func verifyCommand(ac *algernonConfig, args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	pubFilename := flags.String("pub", "algernon.pub", "File with trusted Ed25519 public keys")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("usage: algernon verify [-pub FILENAME] ARCHIVE...")
+	}
+	keys, err := readPublicKeys(*pubFilename)
+	if err != nil {
+		return err
+	}
+	for _, filename := range flags.Args() {
+		if err := verifyArchive(filename, keys); err != nil {
+			return err
+		}
+		fmt.Println("Verified " + filename)
+	}
+	return nil
+}
+
+// Check that the given file is an archive with a trusted signature, if
+// signatures are required. Exits if the file can not be trusted.
+func (ac *algernonConfig) checkSignature(filename string) {
+	if ac.trustedKeysFilename == "" {
+		return
+	}
+	keys, err := readPublicKeys(ac.trustedKeysFilename)
+	if err != nil {
+		ac.fatalExit(err)
+	}
+	if err := verifyArchive(filename, keys); err != nil {
+		ac.fatalExit(err)
+	}
+	if ac.verboseMode {
+		log.Info("Verified the signature of " + filename)
+	}
+}
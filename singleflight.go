@@ -0,0 +1,76 @@
+package main
+
+// Single-flight rendering. When several requests for the same page arrive at
+// the same time, the page is only compiled once, and the result is shared.
+// This is the same idea as golang.org/x/sync/singleflight.
+
+import (
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"sync"
+)
+
+// A compilation that is in progress or done
+type flightCall struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+// A group of compilations, by key
+type flightGroup struct {
+	mut   sync.Mutex
+	calls map[string]*flightCall
+
+	// Called when a caller waits for a call that is in progress, if set
+	waiting func(key string)
+}
+
+// Compilations of pages, by the kind of page, the filename and the source
+var renderFlights flightGroup
+
+// Run the given function, unless it is already running for the same key, in
+// which case the result of that call is waited for and returned instead.
+// The returned value must not be modified, since it may be shared.
+func (g *flightGroup) do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mut.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mut.Unlock()
+		if g.waiting != nil {
+			g.waiting(key)
+		}
+		call.wg.Wait()
+		return call.val, call.err
+	}
+	// If fn panics, the waiting callers get this error
+	call := &flightCall{err: errors.New("the compilation failed")}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mut.Unlock()
+
+	defer func() {
+		g.mut.Lock()
+		delete(g.calls, key)
+		g.mut.Unlock()
+		call.wg.Done()
+	}()
+	call.val, call.err = fn()
+	return call.val, call.err
+}
+
+// Return a key for compiling the given source. The source is part of the key,
+// so that a file that changes while it is being compiled is compiled again.
+func renderKey(kind, filename string, source []byte) string {
+	h := fnv.New64a()
+	h.Write(source)
+	return kind + "\x00" + filename + "\x00" + strconv.FormatUint(h.Sum64(), 16)
+}
+
+// Compile the source once, even if several requests ask for it at the same time
+func compileOnce(kind, filename string, source []byte, compile func() (interface{}, error)) (interface{}, error) {
+	return renderFlights.do(renderKey(kind, filename, source), compile)
+}
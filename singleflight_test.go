@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCompileOnce(t *testing.T) {
+	var (
+		calls   int32
+		started = make(chan struct{})
+		joined  = make(chan struct{})
+		release = make(chan struct{})
+		wg      sync.WaitGroup
+	)
+	g := &flightGroup{waiting: func(key string) { close(joined) }}
+	key := renderKey("markdown", "index.md", []byte("# hi"))
+	compile := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		close(started)
+		<-release
+		return "html", nil
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		g.do(key, compile)
+	}()
+	<-started
+	go func() {
+		defer wg.Done()
+		// Waits for the first call, instead of compiling again
+		result, _ := g.do(key, compile)
+		if result != "html" {
+			t.Errorf("expected the shared result, got %v", result)
+		}
+	}()
+	// Let the first call finish when the second call is waiting for it
+	<-joined
+	close(release)
+	wg.Wait()
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("expected 1 compilation, got %d", calls)
+	}
+}
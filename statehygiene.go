@@ -0,0 +1,124 @@
+package main
+
+// Cleaning up pooled Lua states between requests, so that globals and loaded
+// modules that are left behind by one request can not leak into the next
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+type stateHygiene int
+
+const (
+	// Reuse Lua states as they are
+	hygieneOff stateHygiene = iota
+	// Restore the globals, the library tables and package.loaded
+	// before a Lua state is reused
+	hygieneReset
+	// Never reuse Lua states
+	hygieneFresh
+)
+
+// The registry key for the baseline of a Lua state
+const baselineRegistryKey = "algernon.baseline"
+
+// The globals of a fresh Lua state, and the contents of the tables among them,
+// like "string" and "package.loaded"
+type stateBaseline struct {
+	globals   map[lua.LValue]lua.LValue
+	metatable lua.LValue
+	tables    map[*lua.LTable]map[lua.LValue]lua.LValue
+}
+
+func (hygiene stateHygiene) String() string {
+	switch hygiene {
+	case hygieneOff:
+		return "off"
+	case hygieneFresh:
+		return "fresh"
+	}
+	return "reset"
+}
+
+// Parse the name of a state hygiene level
+func parseStateHygiene(name string) (stateHygiene, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "off":
+		return hygieneOff, nil
+	case "reset":
+		return hygieneReset, nil
+	case "fresh":
+		return hygieneFresh, nil
+	}
+	return hygieneOff, fmt.Errorf("unknown state hygiene level: %s (should be off, reset or fresh)", name)
+}
+
+// Copy the contents of a table
+func tableContents(table *lua.LTable) map[lua.LValue]lua.LValue {
+	contents := make(map[lua.LValue]lua.LValue)
+	table.ForEach(func(key, value lua.LValue) {
+		contents[key] = value
+	})
+	return contents
+}
+
+// Make the contents of a table the same as the given contents
+func restoreTable(table *lua.LTable, contents map[lua.LValue]lua.LValue) {
+	var added []lua.LValue
+	table.ForEach(func(key, _ lua.LValue) {
+		if _, ok := contents[key]; !ok {
+			added = append(added, key)
+		}
+	})
+	for _, key := range added {
+		table.RawSet(key, lua.LNil)
+	}
+	for key, value := range contents {
+		table.RawSet(key, value)
+	}
+}
+
+// Record the baseline of a fresh Lua state, in the registry of the state
+func recordBaseline(L *lua.LState) {
+	globalTable := L.G.Global
+	baseline := &stateBaseline{
+		globals:   tableContents(globalTable),
+		metatable: L.GetMetatable(globalTable),
+		tables:    make(map[*lua.LTable]map[lua.LValue]lua.LValue),
+	}
+	for _, value := range baseline.globals {
+		if table, ok := value.(*lua.LTable); ok && table != globalTable {
+			baseline.tables[table] = tableContents(table)
+		}
+	}
+	if pkg, ok := L.GetGlobal(lua.LoadLibName).(*lua.LTable); ok {
+		if loaded, ok := pkg.RawGetString("loaded").(*lua.LTable); ok {
+			baseline.tables[loaded] = tableContents(loaded)
+		}
+	}
+	ud := L.NewUserData()
+	ud.Value = baseline
+	L.G.Registry.RawSetString(baselineRegistryKey, ud)
+}
+
+// Restore the globals of a Lua state to the recorded baseline.
+// Returns false if there is no baseline.
+func restoreBaseline(L *lua.LState) bool {
+	ud, ok := L.G.Registry.RawGetString(baselineRegistryKey).(*lua.LUserData)
+	if !ok {
+		return false
+	}
+	baseline, ok := ud.Value.(*stateBaseline)
+	if !ok {
+		return false
+	}
+	restoreTable(L.G.Global, baseline.globals)
+	L.SetMetatable(L.G.Global, baseline.metatable)
+	for table, contents := range baseline.tables {
+		restoreTable(table, contents)
+	}
+	return true
+}
@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestStateHygiene(t *testing.T) {
+	pool := &lStatePool{hygiene: hygieneReset}
+	L := pool.Get()
+	if err := L.DoString(`leak = 1; string.leak = 2; package.loaded.leak = 3`); err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(L)
+	L = pool.Get()
+	defer L.Close()
+	if err := L.DoString(`assert(leak == nil and string.leak == nil and package.loaded.leak == nil)`); err != nil {
+		t.Error(err)
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/xyproto/datablock"
 )
 
 const (
@@ -73,7 +72,7 @@ func (ac *algernonConfig) serveStaticFile(filename, colonPort string) {
 
 	mux := http.NewServeMux()
 	// 64 MiB cache, use cache compression, no per-file size limit, use best gzip compression, compress for size not for speed
-	ac.cache = datablock.NewFileCache(defaultStaticCacheSize, true, 0, false)
+	ac.cache = newFileCache(defaultStaticCacheSize, true, 0, false)
 	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("Server", versionString)
 		ac.filePage(w, req, filename, ac.defaultLuaDataFilename)
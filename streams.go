@@ -0,0 +1,289 @@
+package main
+
+// Limits for long-lived connections, like Server-Sent Events and websockets.
+// There is a limit for the number of connections in total and for each IP
+// address. Each write to such a connection must complete within the write
+// timeout, so that a client that does not read what is sent to it is
+// disconnected instead of keeping buffers and goroutines around.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	// The default maximum number of streaming connections
+	defaultMaxStreams = 1000
+
+	// The default maximum number of streaming connections for each IP address
+	defaultMaxStreamsPerIP = 10
+
+	// The default time each write to a streaming connection may take
+	defaultStreamWriteTimeout = 10 * time.Second
+
+	// How long clients are asked to wait before trying again, when rejected
+	streamRetryAfter = 5 * time.Second
+)
+
+// Used when writing to a stream where the client has been disconnected
+var errStreamClosed = errors.New("the stream has been closed")
+
+// Keeps track of the streaming connections
+type streamLimiter struct {
+	mut          sync.Mutex
+	maxTotal     int
+	maxPerIP     int
+	writeTimeout time.Duration
+	active       int
+	perIP        map[string]int
+	conns        map[string]net.Conn // the connections, by remote address
+
+	// Counters, for StreamInfo()
+	accepted      uint64
+	rejected      uint64
+	rejectedPerIP uint64
+	evicted       uint64
+}
+
+// Create a limiter for streaming connections. A limit of 0 means no limit.
+func newStreamLimiter(maxTotal, maxPerIP int, writeTimeout time.Duration) *streamLimiter {
+	return &streamLimiter{
+		maxTotal:     maxTotal,
+		maxPerIP:     maxPerIP,
+		writeTimeout: writeTimeout,
+		perIP:        make(map[string]int),
+		conns:        make(map[string]net.Conn),
+	}
+}
+
+// Keep track of the connections, so that the deadlines can be changed for
+// the connections of streaming requests. For the ConnState of the server.
+func (sl *streamLimiter) connState(conn net.Conn, state http.ConnState) {
+	addr := conn.RemoteAddr().String()
+	sl.mut.Lock()
+	defer sl.mut.Unlock()
+	switch state {
+	case http.StateNew:
+		sl.conns[addr] = conn
+	case http.StateHijacked, http.StateClosed:
+		delete(sl.conns, addr)
+	}
+}
+
+// Return the connection of a request, or nil if it is not known. HTTP/2
+// connections are shared by many requests, so they are not returned.
+func (sl *streamLimiter) conn(req *http.Request) net.Conn {
+	if req.ProtoMajor != 1 {
+		return nil
+	}
+	sl.mut.Lock()
+	defer sl.mut.Unlock()
+	return sl.conns[req.RemoteAddr]
+}
+
+// Check if a request is for a stream of Server-Sent Events or a websocket
+func isStreamRequest(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "text/event-stream") ||
+		strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+// Reserve a connection for the given IP address. Returns the HTTP status
+// code to reject the request with, or 0 if the connection is allowed.
+func (sl *streamLimiter) acquire(ip string) int {
+	sl.mut.Lock()
+	defer sl.mut.Unlock()
+	if sl.maxTotal > 0 && sl.active >= sl.maxTotal {
+		atomic.AddUint64(&sl.rejected, 1)
+		return http.StatusServiceUnavailable
+	}
+	if sl.maxPerIP > 0 && sl.perIP[ip] >= sl.maxPerIP {
+		atomic.AddUint64(&sl.rejectedPerIP, 1)
+		return http.StatusTooManyRequests
+	}
+	sl.active++
+	sl.perIP[ip]++
+	atomic.AddUint64(&sl.accepted, 1)
+	return 0
+}
+
+// Release a connection for the given IP address
+func (sl *streamLimiter) release(ip string) {
+	sl.mut.Lock()
+	defer sl.mut.Unlock()
+	sl.active--
+	if sl.perIP[ip]--; sl.perIP[ip] <= 0 {
+		delete(sl.perIP, ip)
+	}
+}
+
+// Count a client that was disconnected for being too slow
+func (sl *streamLimiter) evict(req *http.Request, err error) {
+	atomic.AddUint64(&sl.evicted, 1)
+	log.Warn("Disconnected a slow client at ", req.RemoteAddr, " for ", req.URL.Path, ": ", err)
+}
+
+// Return the number of connections and the counters, as text
+func (sl *streamLimiter) Stats() string {
+	sl.mut.Lock()
+	active, clients := sl.active, len(sl.perIP)
+	sl.mut.Unlock()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Active streams: %d (limit %d)\n", active, sl.maxTotal)
+	fmt.Fprintf(&buf, "Clients: %d (limit %d streams each)\n", clients, sl.maxPerIP)
+	fmt.Fprintf(&buf, "Accepted: %d\n", atomic.LoadUint64(&sl.accepted))
+	fmt.Fprintf(&buf, "Rejected, server limit: %d\n", atomic.LoadUint64(&sl.rejected))
+	fmt.Fprintf(&buf, "Rejected, client limit: %d\n", atomic.LoadUint64(&sl.rejectedPerIP))
+	fmt.Fprintf(&buf, "Disconnected, too slow: %d\n", atomic.LoadUint64(&sl.evicted))
+	return buf.String()
+}
+
+// Limit the number of streaming requests, and disconnect slow clients.
+// Other requests are passed on as they are.
+func (sl *streamLimiter) handler(handler http.Handler) http.Handler {
+	limited := sl.limit(handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if isStreamRequest(req) {
+			limited.ServeHTTP(w, req)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// Limit the number of requests, and disconnect slow clients, for handlers
+// where all requests are streams
+func (sl *streamLimiter) limit(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ip := clientIP(req)
+		if status := sl.acquire(ip); status != 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(streamRetryAfter.Seconds())))
+			http.Error(w, "Too many connections", status)
+			return
+		}
+		defer sl.release(ip)
+		sw := &streamWriter{ResponseWriter: w, conn: sl.conn(req), sl: sl, req: req}
+		if sw.conn != nil {
+			// The stream may last longer than the read timeout of the server
+			sw.conn.SetReadDeadline(time.Time{})
+		}
+		sw.extendDeadline()
+		handler.ServeHTTP(sw, req)
+	})
+}
+
+// A ResponseWriter where every write must complete within the write timeout.
+// The deadlines can only be set if the connection is known.
+type streamWriter struct {
+	http.ResponseWriter
+	conn    net.Conn // may be nil
+	sl      *streamLimiter
+	req     *http.Request
+	evicted int32
+}
+
+// Check if the client has been disconnected
+func (sw *streamWriter) closed() bool {
+	return atomic.LoadInt32(&sw.evicted) == 1
+}
+
+// Count the client as evicted, the first time a write fails
+func (sw *streamWriter) fail(err error) {
+	if atomic.CompareAndSwapInt32(&sw.evicted, 0, 1) {
+		sw.sl.evict(sw.req, err)
+	}
+}
+
+// Allow the next write to take up to the write timeout
+func (sw *streamWriter) extendDeadline() {
+	if sw.conn != nil {
+		sw.conn.SetWriteDeadline(time.Now().Add(sw.sl.writeTimeout))
+	}
+}
+
+func (sw *streamWriter) Write(data []byte) (int, error) {
+	if sw.closed() {
+		return 0, errStreamClosed
+	}
+	sw.extendDeadline()
+	n, err := sw.ResponseWriter.Write(data)
+	if err != nil {
+		sw.fail(err)
+	}
+	return n, err
+}
+
+// Flush the data to the client. If that times out, the next write fails.
+func (sw *streamWriter) Flush() {
+	if sw.closed() {
+		return
+	}
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		sw.extendDeadline()
+		flusher.Flush()
+	}
+}
+
+func (sw *streamWriter) CloseNotify() <-chan bool {
+	if notifier, ok := sw.ResponseWriter.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	// Never closes
+	return make(chan bool)
+}
+
+// Hijack the connection, for websockets. Writes to the connection must
+// also complete within the write timeout.
+func (sw *streamWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer can not be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	dc := &deadlineConn{Conn: conn, sw: sw}
+	return dc, bufio.NewReadWriter(rw.Reader, bufio.NewWriter(dc)), nil
+}
+
+// A hijacked connection where every write must complete within the write timeout
+type deadlineConn struct {
+	net.Conn
+	sw *streamWriter
+}
+
+func (dc *deadlineConn) Write(data []byte) (int, error) {
+	dc.Conn.SetWriteDeadline(time.Now().Add(dc.sw.sl.writeTimeout))
+	n, err := dc.Conn.Write(data)
+	if err != nil {
+		dc.sw.fail(err)
+	}
+	return n, err
+}
+
+// Make information about the streaming connections available to Lua
+func (ac *algernonConfig) exportStreamFunctions(L *lua.LState) {
+	L.SetGlobal("StreamInfo", L.NewFunction(func(L *lua.LState) int {
+		if ac.streams == nil {
+			L.Push(lua.LString("Streaming connections are not limited"))
+			return 1 // number of results
+		}
+		info := ac.streams.Stats()
+		// Return the string, but drop the final newline
+		L.Push(lua.LString(info[:len(info)-1]))
+		return 1 // number of results
+	}))
+}
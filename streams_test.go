@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStreamLimiter(t *testing.T) {
+	sl := newStreamLimiter(3, 2, time.Second)
+	if sl.acquire("10.0.0.1") != 0 || sl.acquire("10.0.0.1") != 0 {
+		t.Fatal("expected two streams to be allowed")
+	}
+	if status := sl.acquire("10.0.0.1"); status != http.StatusTooManyRequests {
+		t.Errorf("expected the client limit, got %d", status)
+	}
+	if sl.acquire("10.0.0.2") != 0 {
+		t.Fatal("expected a stream from another client to be allowed")
+	}
+	if status := sl.acquire("10.0.0.3"); status != http.StatusServiceUnavailable {
+		t.Errorf("expected the server limit, got %d", status)
+	}
+	sl.release("10.0.0.1")
+	if sl.acquire("10.0.0.3") != 0 {
+		t.Error("expected a stream to be allowed after one was released")
+	}
+}
+
+func TestStreamConn(t *testing.T) {
+	sl := newStreamLimiter(0, 0, time.Second)
+	found := make(chan bool, 1)
+	ts := httptest.NewUnstartedServer(sl.limit(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		found <- w.(*streamWriter).conn != nil
+		w.Write([]byte("data: hello\n\n"))
+	})))
+	ts.Config.ConnState = sl.connState
+	ts.Start()
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !<-found {
+		t.Error("expected the connection of the stream to be known")
+	}
+	if string(body) != "data: hello\n\n" {
+		t.Errorf("unexpected body: %q", body)
+	}
+}
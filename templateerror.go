@@ -0,0 +1,223 @@
+package main
+
+// Compile errors for Amber templates, GCSS and JSX, with the position in the
+// source and an excerpt of the source around it. The compilers report the
+// position in different ways, which is parsed into a templateError.
+// The templates in a directory can be checked with --check.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/eknkc/amber"
+	"github.com/mamaar/risotto/parser"
+)
+
+// How many lines before and after the error to include in the excerpt
+const excerptContext = 2
+
+var (
+	// "Amber Error in <index.amber>: message - Line: 3, Column: 5, Length: 4"
+	amberErrorPattern = regexp.MustCompile(`(?s)^Amber Error(?: in <[^>]*>)?: (.*) - Line: (\d+), Column: (\d+), Length: \d+$`)
+
+	// "message [line: 3]"
+	gcssErrorPattern = regexp.MustCompile(`(?s)^(.*) \[line: (\d+)\]$`)
+
+	// The first line of templateError.Error(), "filename:line[:column]: message"
+	templateErrorPattern = regexp.MustCompile(`^.+?:(\d+)(?::\d+)?: `)
+)
+
+// A compile error, with the position in the source, if known
+type templateError struct {
+	Filename string `json:"filename"`
+	Lang     string `json:"lang"`
+	Line     int    `json:"line,omitempty"`   // starting at 1, 0 if not known
+	Column   int    `json:"column,omitempty"` // starting at 1, 0 if not known
+	Message  string `json:"message"`
+	Excerpt  string `json:"excerpt,omitempty"`
+}
+
+// Return the error as "filename:line:column: message", followed by the excerpt
+func (e *templateError) Error() string {
+	var buf bytes.Buffer
+	buf.WriteString(e.Filename)
+	if e.Line > 0 {
+		fmt.Fprintf(&buf, ":%d", e.Line)
+	}
+	if e.Column > 0 {
+		fmt.Fprintf(&buf, ":%d", e.Column)
+	}
+	buf.WriteString(": " + e.Message)
+	if e.Excerpt != "" {
+		buf.WriteString("\n\n" + e.Excerpt)
+	}
+	return buf.String()
+}
+
+// Return the lines around the given line, with line numbers and a marker
+// below the given column
+func sourceExcerpt(source []byte, line, column int) string {
+	lines := strings.Split(strings.TrimSuffix(string(source), "\n"), "\n")
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	first, last := line-excerptContext, line+excerptContext
+	if first < 1 {
+		first = 1
+	}
+	if last > len(lines) {
+		last = len(lines)
+	}
+	width := len(strconv.Itoa(last))
+	var buf bytes.Buffer
+	for nr := first; nr <= last; nr++ {
+		marker := " "
+		if nr == line {
+			marker = ">"
+		}
+		fmt.Fprintf(&buf, "%s %*d | %s\n", marker, width, nr, strings.TrimRight(lines[nr-1], "\r"))
+		if nr == line && column > 0 {
+			// Keep tabs, so that the marker lines up with the code
+			indent := []rune(lines[nr-1])
+			if column-1 < len(indent) {
+				indent = indent[:column-1]
+			}
+			for i, r := range indent {
+				if r != '\t' {
+					indent[i] = ' '
+				}
+			}
+			fmt.Fprintf(&buf, "  %*s | %s^\n", width, "", string(indent))
+		}
+	}
+	return strings.TrimRight(buf.String(), "\n")
+}
+
+// Convert an error from the Amber, GCSS or JSX compiler to a templateError
+func newTemplateError(lang, filename string, source []byte, err error) *templateError {
+	if te, ok := err.(*templateError); ok {
+		return te
+	}
+	te := &templateError{Filename: filename, Lang: lang, Message: strings.TrimSpace(err.Error())}
+	switch lang {
+	case "amber":
+		if m := amberErrorPattern.FindStringSubmatch(te.Message); m != nil {
+			te.Message = m[1]
+			te.Line, _ = strconv.Atoi(m[2])
+			te.Column, _ = strconv.Atoi(m[3])
+		}
+	case "gcss":
+		if m := gcssErrorPattern.FindStringSubmatch(te.Message); m != nil {
+			te.Message = m[1]
+			te.Line, _ = strconv.Atoi(m[2])
+		}
+	case "jsx":
+		var (
+			first *parser.Error
+			more  int
+		)
+		switch e := err.(type) {
+		case parser.ErrorList:
+			if len(e) > 0 {
+				first, more = e[0], len(e)-1
+			}
+		case *parser.Error:
+			first = e
+		}
+		if first != nil {
+			te.Message = first.Message
+			te.Line = first.Position.Line
+			te.Column = first.Position.Column
+		}
+		if more > 0 {
+			te.Message += fmt.Sprintf(" (and %d more errors)", more)
+		}
+	}
+	te.Excerpt = sourceExcerpt(source, te.Line, te.Column)
+	return te
+}
+
+// Return the line number in the message from templateError.Error(), if any
+func templateErrorLine(errormessage string) (int, bool) {
+	m := templateErrorPattern.FindStringSubmatch(errormessage)
+	if m == nil {
+		return 0, false
+	}
+	line, err := strconv.Atoi(m[1])
+	return line, err == nil
+}
+
+// Check a template or stylesheet for compile errors
+func checkTemplate(filename string) *templateError {
+	lang := strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+	source, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return &templateError{Filename: filename, Lang: lang, Message: err.Error()}
+	}
+	switch lang {
+	case "amber":
+		_, err = amber.CompileData(source, filename, amber.Options{PrettyPrint: true, LineNumbers: false})
+	case "gcss":
+		_, err = compileGCSS(filename, source)
+	case "jsx":
+		_, err = compileJSX(filename, source)
+	default:
+		return nil
+	}
+	if err != nil {
+		return newTemplateError(lang, filename, source, err)
+	}
+	return nil
+}
+
+// Check the Amber, GCSS and JSX files in a directory, or a single file, and
+// exit with status 1 if there are errors. The errors are written as JSON with
+// --checkjson.
+func (ac *algernonConfig) checkTemplatesAndExit(path string) {
+	var (
+		errs    = []*templateError{}
+		checked int
+	)
+	filepath.Walk(path, func(filename string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if fi.IsDir() {
+			if filename != path && strings.HasPrefix(fi.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(filename)) {
+		case ".amber", ".gcss", ".jsx":
+			checked++
+			if te := checkTemplate(filename); te != nil {
+				errs = append(errs, te)
+			}
+		}
+		return nil
+	})
+	if ac.checkJSON {
+		data, err := json.MarshalIndent(errs, "", "  ")
+		if err != nil {
+			ac.fatalExit(err)
+		}
+		fmt.Println(string(data))
+	} else {
+		for _, te := range errs {
+			fmt.Fprintln(os.Stderr, te.Error()+"\n")
+		}
+		fmt.Printf("Checked %d files, found %d errors\n", checked, len(errs))
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestTemplateError(t *testing.T) {
+	source := []byte("body\n  color: red;\n")
+	_, err := compileGCSS("style.gcss", source)
+	te, ok := err.(*templateError)
+	if !ok {
+		t.Fatalf("expected a templateError, got %v", err)
+	}
+	if te.Line != 2 || !strings.Contains(te.Excerpt, "> 2 |   color: red;") {
+		t.Errorf("unexpected position or excerpt: %d\n%s", te.Line, te.Excerpt)
+	}
+	te = newTemplateError("amber", "index.amber", []byte("html\n  +nomixin()\n"), errors.New("Amber Error in <index.amber>: unknown mixin - Line: 2, Column: 3, Length: 8"))
+	if te.Line != 2 || te.Column != 3 || te.Message != "unknown mixin" {
+		t.Errorf("unexpected Amber error: %+v", te)
+	}
+	if line, ok := templateErrorLine(te.Error()); !ok || line != 2 {
+		t.Errorf("expected line 2 from %q", te.Error())
+	}
+}
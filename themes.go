@@ -32,7 +32,12 @@ var (
 
 // Easy way to output a HTML page
 func messagePage(title, body, theme string) string {
-	return fmt.Sprintf("<!doctype html><html><head><title>%s</title>%s<style>%s</style><head><body><h1>%s</h1>%s</body></html>", title, "", builtinThemes[theme], title, body)
+	return messagePageWithHead(title, "", body, theme)
+}
+
+// Same as messagePage, but with additional HTML for the head section
+func messagePageWithHead(title, head, body, theme string) string {
+	return fmt.Sprintf("<!doctype html><html><head><title>%s</title>%s<style>%s</style><head><body><h1>%s</h1>%s</body></html>", title, head, builtinThemes[theme], title, body)
 }
 
 // Easy way to build links to directories
@@ -0,0 +1,187 @@
+package main
+
+// Checking the TLS certificate and key at startup, before binding, so that
+// problems are logged clearly instead of showing up as handshake failures in
+// the browser. The expiry date is also checked once a day while serving.
+
+import (
+	"bytes"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Warn about certificates that expire within this duration
+	tlsExpiryWarning = 30 * 24 * time.Hour
+
+	// How often to check if the certificate is about to expire, while serving
+	tlsExpiryCheckInterval = 24 * time.Hour
+
+	// The smallest RSA key size that is not considered weak
+	minRSAKeyBits = 2048
+)
+
+// Load and check a certificate and key pair. Returns an error if the pair can
+// not be used at all, or else the leaf certificate and a list of warnings.
+// The hostname is checked against the certificate, unless it is blank or a
+// loopback address.
+func checkTLSPair(certFile, keyFile, host string, now time.Time) (*x509.Certificate, []string, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load the TLS certificate %s and key %s: %s", certFile, keyFile, err)
+	}
+	if len(pair.Certificate) == 0 {
+		return nil, nil, fmt.Errorf("no certificates found in %s", certFile)
+	}
+	chain := make([]*x509.Certificate, len(pair.Certificate))
+	for i, der := range pair.Certificate {
+		if chain[i], err = x509.ParseCertificate(der); err != nil {
+			return nil, nil, fmt.Errorf("could not parse certificate %d in %s: %s", i+1, certFile, err)
+		}
+	}
+	leaf := chain[0]
+
+	var warnings []string
+
+	// Expiry
+	if msg := certificateExpiry(leaf, now); msg != "" {
+		warnings = append(warnings, msg)
+	}
+
+	// Hostname
+	if host != "" && !isLoopback(host) {
+		if err := leaf.VerifyHostname(host); err != nil {
+			warnings = append(warnings, fmt.Sprintf("the certificate is not valid for %s: %s", host, err))
+		}
+	}
+
+	// Weak keys and signatures
+	switch key := leaf.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if bits := key.N.BitLen(); bits < minRSAKeyBits {
+			warnings = append(warnings, fmt.Sprintf("the RSA key is only %d bits, use at least %d bits", bits, minRSAKeyBits))
+		}
+	case *ecdsa.PublicKey:
+		if bits := key.Curve.Params().BitSize; bits < 256 {
+			warnings = append(warnings, fmt.Sprintf("the ECDSA key is only %d bits, use at least 256 bits", bits))
+		}
+	case *dsa.PublicKey:
+		warnings = append(warnings, "the key is a DSA key, which browsers do not support")
+	}
+	for _, cert := range chain {
+		if weakSignature(cert.SignatureAlgorithm) && !selfSigned(cert) {
+			warnings = append(warnings, fmt.Sprintf("%q is signed with %s, which browsers do not trust", cert.Subject.CommonName, cert.SignatureAlgorithm))
+		}
+	}
+
+	// Chain completeness, for certificates that are not self-signed
+	if !selfSigned(leaf) {
+		if msg := checkChain(chain, now); msg != "" {
+			warnings = append(warnings, msg)
+		}
+	}
+
+	return leaf, warnings, nil
+}
+
+// Return a warning if the certificate has expired, is not valid yet or
+// expires soon, or an empty string
+func certificateExpiry(cert *x509.Certificate, now time.Time) string {
+	switch {
+	case now.After(cert.NotAfter):
+		return "the certificate expired " + cert.NotAfter.Format(time.RFC1123)
+	case now.Before(cert.NotBefore):
+		return "the certificate is not valid before " + cert.NotBefore.Format(time.RFC1123)
+	case cert.NotAfter.Sub(now) < tlsExpiryWarning:
+		return fmt.Sprintf("the certificate expires in %d days, at %s", int(cert.NotAfter.Sub(now).Hours()/24), cert.NotAfter.Format(time.RFC1123))
+	}
+	return ""
+}
+
+// Check if the certificate chain can be verified with the system roots and
+// the intermediate certificates from the certificate file
+func checkChain(chain []*x509.Certificate, now time.Time) string {
+	roots, err := x509.SystemCertPool()
+	if err != nil || roots == nil {
+		// Can not tell without the system roots
+		return ""
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	leaf := chain[0]
+	// Expiry is checked separately
+	if now.After(leaf.NotAfter) || now.Before(leaf.NotBefore) {
+		now = leaf.NotBefore
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+	})
+	if err == nil {
+		return ""
+	}
+	if _, unknownAuthority := err.(x509.UnknownAuthorityError); unknownAuthority && len(chain) == 1 {
+		return "the certificate chain is incomplete, add the intermediate certificates to the certificate file: " + err.Error()
+	}
+	return "the certificate chain could not be verified: " + err.Error()
+}
+
+// Check if a certificate is signed by its own key
+func selfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+// Check if a signature algorithm is no longer trusted by browsers
+func weakSignature(algorithm x509.SignatureAlgorithm) bool {
+	switch algorithm {
+	case x509.MD2WithRSA, x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+		return true
+	}
+	return false
+}
+
+// Check if a hostname is "localhost" or a loopback IP address
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Check the certificate and key before serving HTTPS, and log any problems.
+// Returns an error if HTTPS can not be served with them. While serving, the
+// expiry date is checked once a day.
+func (ac *algernonConfig) checkTLS() error {
+	if ac.acmeDNS != nil {
+		// Certificates from ACME are obtained in the background, and are
+		// renewed before they expire
+		return nil
+	}
+	leaf, warnings, err := checkTLSPair(ac.serverCert, ac.serverKey, ac.serverHost, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, msg := range warnings {
+		log.Warn("TLS: ", msg)
+	}
+	go func() {
+		for range time.Tick(tlsExpiryCheckInterval) {
+			if msg := certificateExpiry(leaf, time.Now()); msg != "" {
+				log.Warn("TLS: ", msg)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckTLSPair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "algernon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(10 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+
+	_, warnings, err := checkTLSPair(certFile, keyFile, "other.org", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Expires soon, wrong hostname and a weak key
+	if len(warnings) != 3 {
+		t.Errorf("expected 3 warnings, got %q", warnings)
+	}
+	if _, warnings, _ = checkTLSPair(certFile, keyFile, "localhost", now); len(warnings) != 2 {
+		t.Errorf("expected the hostname to be skipped for localhost, got %q", warnings)
+	}
+	if certificateExpiry(template, now.Add(20*24*time.Hour)) == "" {
+		t.Error("expected a warning for an expired certificate")
+	}
+	if _, _, err = checkTLSPair(certFile, filepath.Join(dir, "missing.pem"), "", now); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+// Tail-based sampling of request traces. Debug messages for each request are
+// kept in memory, and only logged if the request failed or was slow.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The context key for the trace of a request
+type traceKey struct{}
+
+// A message in a request trace, and when it happened
+type traceLine struct {
+	elapsed time.Duration
+	message string
+}
+
+// The debug messages for a single request
+type requestTrace struct {
+	mut    sync.Mutex
+	start  time.Time
+	lines  []traceLine
+	failed bool
+}
+
+// For giving each logged trace an ID, so that the lines can be grouped
+var traceCounter uint64
+
+// Return the trace for a request, or nil if requests are not traced
+func traceOf(req *http.Request) *requestTrace {
+	trace, _ := req.Context().Value(traceKey{}).(*requestTrace)
+	return trace
+}
+
+// Add a message to the trace of a request, if requests are traced
+func tracef(req *http.Request, format string, args ...interface{}) {
+	if trace := traceOf(req); trace != nil {
+		trace.mut.Lock()
+		trace.lines = append(trace.lines, traceLine{time.Since(trace.start), fmt.Sprintf(format, args...)})
+		trace.mut.Unlock()
+	}
+}
+
+// Add an error to the trace of a request, which makes sure the trace is logged
+func traceError(req *http.Request, format string, args ...interface{}) {
+	if trace := traceOf(req); trace != nil {
+		tracef(req, "Error: "+format, args...)
+		trace.mut.Lock()
+		trace.failed = true
+		trace.mut.Unlock()
+	}
+}
+
+// Trace all requests, and log the traces of the requests that end with a
+// server error or take longer than the latency threshold
+func (ac *algernonConfig) tailSamplingHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		trace := &requestTrace{start: time.Now()}
+		req = req.WithContext(context.WithValue(req.Context(), traceKey{}, trace))
+		tracef(req, "%s %s %s from %s, User-Agent: %q", req.Method, req.URL.RequestURI(), req.Proto, req.RemoteAddr, req.UserAgent())
+
+		sr := newStatusRecorder(w)
+		handler.ServeHTTP(sr, req)
+
+		duration := time.Since(trace.start)
+		tracef(req, "Responded with status %d and %d bytes", sr.status, sr.written)
+
+		trace.mut.Lock()
+		defer trace.mut.Unlock()
+		slow := ac.traceLatency > 0 && duration >= ac.traceLatency
+		if !trace.failed && sr.status < 500 && !slow {
+			return
+		}
+		reason := "failed"
+		if slow && !trace.failed && sr.status < 500 {
+			reason = "slow"
+		}
+		id := atomic.AddUint64(&traceCounter, 1)
+		for _, line := range trace.lines {
+			log.WithFields(log.Fields{
+				"trace":   id,
+				"reason":  reason,
+				"elapsed": line.elapsed.String(),
+			}).Warn(line.message)
+		}
+		log.WithFields(log.Fields{
+			"trace":    id,
+			"reason":   reason,
+			"duration": duration.String(),
+		}).Warnf("Request %s: %s %s in %s", reason, req.Method, req.URL.Path, duration)
+	})
+}
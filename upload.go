@@ -39,6 +39,7 @@ type UploadedFile struct {
 	header    textproto.MIMEHeader
 	filename  string
 	buf       *bytes.Buffer
+	scan      func(fullFilename string, data []byte) error // may be nil
 }
 
 // Receives an uploadeded file
@@ -95,7 +96,7 @@ func newUploadedFile(req *http.Request, scriptdir, formID string, uploadLimit in
 	}
 
 	// all ok
-	return &UploadedFile{req, scriptdir, handler.Header, handler.Filename, buf}, nil
+	return &UploadedFile{req, scriptdir, handler.Header, handler.Filename, buf, nil}, nil
 }
 
 // Get the first argument, "self", and cast it from userdata to
@@ -110,12 +111,13 @@ func checkUploadedFile(L *lua.LState) *UploadedFile {
 }
 
 // Create a new Upload file
-func constructUploadedFile(L *lua.LState, req *http.Request, scriptdir, formID string, uploadLimit int64) (*lua.LUserData, error) {
+func constructUploadedFile(L *lua.LState, req *http.Request, scriptdir, formID string, uploadLimit int64, scan func(string, []byte) error) (*lua.LUserData, error) {
 	// Create a new UploadedFile
 	uploadedfile, err := newUploadedFile(req, scriptdir, formID, uploadLimit)
 	if err != nil {
 		return nil, err
 	}
+	uploadedfile.scan = scan
 	// Create a new userdata struct
 	ud := L.NewUserData()
 	ud.Value = uploadedfile
@@ -157,12 +159,18 @@ func uploadedfileMimeType(L *lua.LState) int {
 }
 
 // Write the uploaded file to the given full filename.
-// Does not overwrite files.
+// Does not overwrite files. The file is scanned first, if scanning is enabled.
 func (ulf *UploadedFile) write(fullFilename string, fperm os.FileMode) error {
 	// Check if the file already exists
 	if _, err := os.Stat(fullFilename); err == nil { // exists
 		log.Error(fullFilename, " already exists")
-		return fmt.Errorf("File exists: " + fullFilename)
+		return fmt.Errorf("File exists: %s", fullFilename)
+	}
+	// Scan the file before it is written to a directory where it can be served
+	if ulf.scan != nil {
+		if err := ulf.scan(fullFilename, ulf.buf.Bytes()); err != nil {
+			return err
+		}
 	}
 	// Write the uploaded file
 	f, err := os.OpenFile(fullFilename, os.O_WRONLY|os.O_CREATE, fperm)
@@ -205,8 +213,7 @@ func uploadedfileSave(L *lua.LState) int {
 	writeFilename := filepath.Join(ulf.scriptdir, filename)
 
 	// Write the file and return true if successful
-	L.Push(lua.LBool(ulf.write(writeFilename, givenPermissions) == nil))
-	return 1 // number of results
+	return pushWriteResult(L, ulf.write(writeFilename, givenPermissions))
 }
 
 // Save the file locally, to a given directory
@@ -229,10 +236,40 @@ func uploadedfileSaveIn(L *lua.LState) int {
 	}
 
 	// Write the file and return true if successful
-	L.Push(lua.LBool(ulf.write(writeFilename, givenPermissions) == nil))
+	return pushWriteResult(L, ulf.write(writeFilename, givenPermissions))
+}
+
+// Push true if the file was written, or false and the error message
+func pushWriteResult(L *lua.LState, err error) int {
+	if err != nil {
+		L.Push(lua.LFalse)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	L.Push(lua.LTrue)
 	return 1 // number of results
 }
 
+// Scan the file, as if it was saved to the directory of the script, or to
+// the given directory. Returns true if the file is clean, or false and the
+// reason if it was flagged or could not be scanned.
+func uploadedfileScan(L *lua.LState) int {
+	ulf := checkUploadedFile(L) // arg 1
+	if ulf.scan == nil {
+		L.Push(lua.LTrue)
+		return 1 // number of results
+	}
+	dir := ulf.scriptdir
+	if givenDirectory := L.OptString(2, ""); givenDirectory != "" {
+		if filepath.IsAbs(givenDirectory) {
+			dir = givenDirectory
+		} else {
+			dir = filepath.Join(ulf.scriptdir, givenDirectory)
+		}
+	}
+	return pushWriteResult(L, ulf.scan(filepath.Join(dir, ulf.filename), ulf.buf.Bytes()))
+}
+
 // The hash map methods that are to be registered
 var uploadedfileMethods = map[string]lua.LGFunction{
 	"__tostring": uploadedfileToString,
@@ -241,10 +278,11 @@ var uploadedfileMethods = map[string]lua.LGFunction{
 	"mimetype":   uploadedfileMimeType,
 	"save":       uploadedfileSave,
 	"savein":     uploadedfileSaveIn,
+	"scan":       uploadedfileScan,
 }
 
 // Make functions related to saving an uploaded file available
-func exportUploadedFile(L *lua.LState, w http.ResponseWriter, req *http.Request, scriptdir string) {
+func exportUploadedFile(L *lua.LState, w http.ResponseWriter, req *http.Request, scriptdir string, scan func(string, []byte) error) {
 
 	// Register the UploadedFile class and the methods that belongs with it.
 	mt := L.NewTypeMetatable(lUploadedFileClass)
@@ -265,7 +303,7 @@ func exportUploadedFile(L *lua.LState, w http.ResponseWriter, req *http.Request,
 			uploadLimit = int64(L.ToInt(2)) * MiB // optional upload limit, in MiB
 		}
 		// Construct a new UploadedFile
-		userdata, err := constructUploadedFile(L, req, scriptdir, formID, uploadLimit)
+		userdata, err := constructUploadedFile(L, req, scriptdir, formID, uploadLimit, scan)
 		if err != nil {
 			// Log the error
 			log.Error(err)
@@ -0,0 +1,421 @@
+package main
+
+// Scanning of uploaded files, before they are saved to a directory where they
+// can be served. A scanner can be an external command, a clamd server or an
+// ICAP server. Several scanners can be used for the same directory, and are
+// run one after the other. Files that are flagged are not saved, and are moved
+// to a quarantine directory, if one is configured.
+//
+// The scanners for all uploads are given with --scanupload, and the scanners
+// for a directory can be given with ScanUploads in the server configuration.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	// How long a scanner may take, for each file
+	uploadScanTimeout = 60 * time.Second
+
+	// The size of the chunks that are streamed to clamd
+	clamdChunkSize = 64 * KiB
+)
+
+// A scanner for uploaded files. If the file is flagged, scan returns the reason.
+type uploadScanner interface {
+	scan(filename string, data []byte) (reason string, err error)
+	String() string
+}
+
+// The scanners and the quarantine directory for uploads to a directory
+type uploadScanPolicy struct {
+	scanners   []uploadScanner
+	quarantine string
+}
+
+// An uploaded file that was flagged by a scanner
+type uploadRejectedError struct {
+	filename string
+	scanner  string
+	reason   string
+}
+
+func (e *uploadRejectedError) Error() string {
+	return fmt.Sprintf("%s was rejected by %s: %s", e.filename, e.scanner, e.reason)
+}
+
+// Add the given port to a host, if it has no port
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// Create a scanner from a "clamd://host:port", "clamd:///path/to/clamd.sock"
+// or "icap://host:port/service" URL, or from a command. The command is given
+// the file on stdin, or as a temporary file if one of the arguments is "{}".
+// It should exit with 0 if the file is clean and 1 if the file is flagged.
+func newUploadScanner(spec string) (uploadScanner, error) {
+	spec = strings.TrimSpace(spec)
+	switch {
+	case strings.HasPrefix(spec, "clamd://"):
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host == "" {
+			return &clamdScanner{"unix", u.Path}, nil
+		}
+		return &clamdScanner{"tcp", withDefaultPort(u.Host, "3310")}, nil
+	case strings.HasPrefix(spec, "icap://"):
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		u.Host = withDefaultPort(u.Host, "1344")
+		return &icapScanner{u}, nil
+	}
+	args := strings.Fields(spec)
+	if len(args) == 0 {
+		return nil, errors.New("no scanner given")
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return nil, err
+	}
+	return &commandScanner{args}, nil
+}
+
+// Create a scan policy with the given scanners, which are run in order
+func newUploadScanPolicy(specs []string, quarantine string) (*uploadScanPolicy, error) {
+	policy := &uploadScanPolicy{quarantine: quarantine}
+	for _, spec := range specs {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		scanner, err := newUploadScanner(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upload scanner %q: %s", spec, err)
+		}
+		policy.scanners = append(policy.scanners, scanner)
+	}
+	return policy, nil
+}
+
+// Scans the file with an external command
+type commandScanner struct {
+	args []string
+}
+
+func (s *commandScanner) String() string {
+	return s.args[0]
+}
+
+func (s *commandScanner) scan(filename string, data []byte) (string, error) {
+	// Replace "{}" with the name of a temporary file with the data
+	args := append([]string{}, s.args[1:]...)
+	tempFilename := ""
+	for i, arg := range args {
+		if arg != "{}" {
+			continue
+		}
+		if tempFilename == "" {
+			tempFile, err := ioutil.TempFile("", "algernon-upload")
+			if err != nil {
+				return "", err
+			}
+			tempFilename = tempFile.Name()
+			defer os.Remove(tempFilename)
+			_, err = tempFile.Write(data)
+			tempFile.Close()
+			if err != nil {
+				return "", err
+			}
+		}
+		args[i] = tempFilename
+	}
+	return s.run(args, data, tempFilename == "")
+}
+
+// Return the exit code of a command that has exited
+func exitStatus(exitErr *exec.ExitError) int {
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+		return status.ExitStatus()
+	}
+	return -1
+}
+
+// Run the command, and interpret the exit code
+func (s *commandScanner) run(args []string, data []byte, useStdin bool) (string, error) {
+	cmd := exec.Command(s.args[0], args...)
+	if useStdin {
+		cmd.Stdin = bytes.NewReader(data)
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	timer := time.AfterFunc(uploadScanTimeout, func() {
+		cmd.Process.Kill()
+	})
+	err := cmd.Wait()
+	timer.Stop()
+	if err == nil {
+		return "", nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && exitStatus(exitErr) == 1 {
+		reason := strings.TrimSpace(output.String())
+		if reason == "" {
+			reason = "flagged"
+		}
+		return reason, nil
+	}
+	return "", fmt.Errorf("%s: %s %s", s.args[0], err, strings.TrimSpace(output.String()))
+}
+
+// Scans the file with clamd, with the INSTREAM command
+type clamdScanner struct {
+	network string
+	address string
+}
+
+func (s *clamdScanner) String() string {
+	return "clamd (" + s.address + ")"
+}
+
+func (s *clamdScanner) scan(filename string, data []byte) (string, error) {
+	conn, err := net.DialTimeout(s.network, s.address, uploadScanTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(uploadScanTimeout))
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	// Send the data in chunks, each prefixed with the length, and end with an empty chunk
+	size := make([]byte, 4)
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > clamdChunkSize {
+			chunk = chunk[:clamdChunkSize]
+		}
+		binary.BigEndian.PutUint32(size, uint32(len(chunk)))
+		if _, err := conn.Write(append(size, chunk...)); err != nil {
+			return "", err
+		}
+		data = data[len(chunk):]
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return "", err
+	}
+	// The reply is "stream: OK" or "stream: <signature> FOUND"
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", err
+	}
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	}
+	return "", errors.New("clamd: " + reply)
+}
+
+// Scans the file with an ICAP server, by sending it as an HTTP response
+// with RESPMOD. The server replies with 204 if the file is clean.
+type icapScanner struct {
+	u *url.URL
+}
+
+func (s *icapScanner) String() string {
+	return "ICAP (" + s.u.Host + s.u.Path + ")"
+}
+
+func (s *icapScanner) scan(filename string, data []byte) (string, error) {
+	conn, err := net.DialTimeout("tcp", s.u.Host, uploadScanTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(uploadScanTimeout))
+
+	httpHeader := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=" + strconv.Quote(filepath.Base(filename)) + "\r\n" +
+		"Content-Length: " + strconv.Itoa(len(data)) + "\r\n\r\n"
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "RESPMOD %s ICAP/1.0\r\n", s.u.String())
+	fmt.Fprintf(&buf, "Host: %s\r\n", s.u.Host)
+	buf.WriteString("Allow: 204\r\n")
+	fmt.Fprintf(&buf, "Encapsulated: res-hdr=0, res-body=%d\r\n\r\n", len(httpHeader))
+	buf.WriteString(httpHeader)
+	if len(data) > 0 {
+		fmt.Fprintf(&buf, "%x\r\n", len(data))
+		buf.Write(data)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("0\r\n\r\n")
+	if _, err := buf.WriteTo(conn); err != nil {
+		return "", err
+	}
+
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	statusLine, err := reader.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	fields := strings.SplitN(statusLine, " ", 3)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "ICAP/") {
+		return "", errors.New("invalid ICAP response: " + statusLine)
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return "", err
+	}
+	switch fields[1] {
+	case "204":
+		return "", nil
+	case "200":
+		// The server has replaced the file, for instance with a page that says it was blocked
+		for _, name := range []string{"X-Infection-Found", "X-Violations-Found", "X-Virus-Id"} {
+			if reason := header.Get(name); reason != "" {
+				return reason, nil
+			}
+		}
+		return "blocked by the ICAP server", nil
+	}
+	return "", errors.New("ICAP: " + statusLine)
+}
+
+// Return the scan policy for uploads to the given directory. The policy for
+// the closest parent directory is used, if there is none for the directory itself.
+func (ac *algernonConfig) uploadScanPolicyFor(dirname string) *uploadScanPolicy {
+	if len(ac.dirUploadScanPolicies) > 0 {
+		if rel, err := filepath.Rel(ac.serverDirOrFilename, dirname); err == nil && !strings.HasPrefix(rel, "..") {
+			for dir := filepath.ToSlash(rel); ; dir = filepath.ToSlash(filepath.Dir(dir)) {
+				if policy, ok := ac.dirUploadScanPolicies[dir]; ok {
+					return policy
+				}
+				if dir == "." || dir == "/" {
+					break
+				}
+			}
+		}
+	}
+	return ac.uploadScanPolicy
+}
+
+// Set the scan policy for uploads to a directory, relative to the server
+// directory. If the directory is blank, the policy is used for all uploads.
+func (ac *algernonConfig) setUploadScanPolicy(dir string, policy *uploadScanPolicy) {
+	if dir == "" {
+		ac.uploadScanPolicy = policy
+		return
+	}
+	if ac.dirUploadScanPolicies == nil {
+		ac.dirUploadScanPolicies = make(map[string]*uploadScanPolicy)
+	}
+	ac.dirUploadScanPolicies[filepath.ToSlash(filepath.Clean(strings.TrimPrefix(dir, "/")))] = policy
+}
+
+// Scan an uploaded file that is about to be written to the given filename.
+// Returns an uploadRejectedError if the file is flagged. If a scanner fails,
+// the file is rejected as well, since it could not be checked.
+func (ac *algernonConfig) scanUpload(fullFilename string, data []byte) error {
+	policy := ac.uploadScanPolicyFor(filepath.Dir(fullFilename))
+	if policy == nil {
+		return nil
+	}
+	for _, scanner := range policy.scanners {
+		reason, err := scanner.scan(fullFilename, data)
+		if err != nil {
+			log.Error("Could not scan ", fullFilename, " with ", scanner, ": ", err)
+			return fmt.Errorf("%s could not be scanned", filepath.Base(fullFilename))
+		}
+		if reason != "" {
+			rejected := &uploadRejectedError{filepath.Base(fullFilename), scanner.String(), reason}
+			log.Warn("Uploaded file ", rejected)
+			if policy.quarantine != "" {
+				ac.quarantineUpload(policy.quarantine, fullFilename, data)
+			}
+			return rejected
+		}
+	}
+	return nil
+}
+
+// Write a flagged file to the quarantine directory, where it is not served
+func (ac *algernonConfig) quarantineUpload(quarantine, fullFilename string, data []byte) {
+	if err := os.MkdirAll(quarantine, 0700); err != nil {
+		log.Error("Could not create the quarantine directory: ", err)
+		return
+	}
+	quarantineFilename := filepath.Join(quarantine, time.Now().Format("20060102-150405.000000")+"-"+filepath.Base(fullFilename))
+	if err := ioutil.WriteFile(quarantineFilename, data, 0600); err != nil {
+		log.Error("Could not quarantine ", fullFilename, ": ", err)
+		return
+	}
+	log.Info("Moved ", filepath.Base(fullFilename), " to ", quarantineFilename)
+}
+
+// Convert a Lua string or table to a list of strings
+func luaStrings(value lua.LValue) []string {
+	var values []string
+	switch v := value.(type) {
+	case *lua.LTable:
+		v.ForEach(func(_, element lua.LValue) {
+			values = append(values, element.String())
+		})
+	case *lua.LNilType:
+	default:
+		values = append(values, lua.LVAsString(v))
+	}
+	return values
+}
+
+// Export the server configuration function for scanning uploads
+func (ac *algernonConfig) exportUploadScanFunction(L *lua.LState) {
+
+	// Scan the files that are uploaded to a directory, relative to the server
+	// directory, before they are saved. Takes the directory, a scanner or a
+	// table of scanners and an optional quarantine directory. A blank
+	// directory is for all uploads, and no scanners turns scanning off.
+	// For example: ScanUploads("uploads", {"clamd://localhost:3310"}, "/var/quarantine")
+	L.SetGlobal("ScanUploads", L.NewFunction(func(L *lua.LState) int {
+		dir := L.CheckString(1)
+		policy, err := newUploadScanPolicy(luaStrings(L.Get(2)), L.OptString(3, ac.uploadQuarantine))
+		if err != nil {
+			log.Error(err)
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		ac.setUploadScanPolicy(dir, policy)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
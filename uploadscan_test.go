@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScanUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "algernon-scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "scan.sh")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\n! grep -q EVIL \"$1\"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := newUploadScanPolicy([]string{script + " {}"}, filepath.Join(dir, "quarantine"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac := newAlgernonConfig()
+	ac.serverDirOrFilename = dir
+	ac.setUploadScanPolicy("uploads", policy)
+	if err := ac.scanUpload(filepath.Join(dir, "uploads", "a.txt"), []byte("hello")); err != nil {
+		t.Errorf("expected a clean file, got %v", err)
+	}
+	if _, ok := ac.scanUpload(filepath.Join(dir, "uploads", "sub", "b.txt"), []byte("EVIL")).(*uploadRejectedError); !ok {
+		t.Error("expected the file to be rejected")
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "quarantine")); len(files) != 1 {
+		t.Errorf("expected one file in quarantine, got %d", len(files))
+	}
+	if err := ac.scanUpload(filepath.Join(dir, "other", "c.txt"), []byte("EVIL")); err != nil {
+		t.Errorf("expected no scanning outside of the upload directory, got %v", err)
+	}
+}
+
+func TestWithDefaultPort(t *testing.T) {
+	for host, expected := range map[string]string{
+		"localhost":      "localhost:3310",
+		"localhost:1234": "localhost:1234",
+		"[::1]":          "[::1]:3310",
+		"[::1]:1234":     "[::1]:1234",
+	} {
+		if address := withDefaultPort(host, "3310"); address != expected {
+			t.Errorf("expected %s for %s, got %s", expected, host, address)
+		}
+	}
+}
@@ -8,7 +8,7 @@ import (
 )
 
 // Make functions related to users and permissions available to Lua scripts
-func exportUserstate(w http.ResponseWriter, req *http.Request, L *lua.LState, userstate pinterface.IUserState) {
+func (ac *algernonConfig) exportUserstate(w http.ResponseWriter, req *http.Request, L *lua.LState, userstate pinterface.IUserState) {
 	// Check if the current user has "user rights", returns bool
 	// Takes no arguments
 	L.SetGlobal("UserRights", L.NewFunction(func(L *lua.LState) int {
@@ -209,6 +209,7 @@ func exportUserstate(w http.ResponseWriter, req *http.Request, L *lua.LState, us
 		password := L.ToString(2)
 		email := L.ToString(3)
 		userstate.AddUser(username, password, email)
+		ac.emitEvent(eventUserRegistered, map[string]interface{}{"username": username})
 		return 0 // number of results
 	}))
 	// Set a user as logged in on the server (not cookie), returns nothing
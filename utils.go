@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"math"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -228,3 +230,16 @@ func roundf(x float64) float64 {
 func round(x float64) int64 {
 	return int64(roundf(x))
 }
+
+// Return the path of the running executable. Uses /proc/self/exe where it is
+// available, and looks up os.Args[0] otherwise.
+func executable() (string, error) {
+	if exe, err := os.Readlink("/proc/self/exe"); err == nil {
+		return exe, nil
+	}
+	exe, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(exe)
+}
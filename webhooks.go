@@ -0,0 +1,224 @@
+package main
+
+// Webhooks, for letting other systems know about server events, like
+// startup, shutdown, deploys, a high error rate and new users.
+// Events are sent as JSON in POST requests, signed with HMAC-SHA256.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/yuin/gopher-lua"
+)
+
+// The server events that can be sent to webhooks
+const (
+	eventStartup        = "startup"
+	eventShutdown       = "shutdown"
+	eventDeploy         = "deploy"
+	eventErrorRate      = "error-rate"
+	eventUserRegistered = "user-registered"
+	eventDatabaseDown   = "database-down"
+	eventDatabaseUp     = "database-up"
+)
+
+const (
+	// The header with the signature of the body, on the form "sha256=<hex>"
+	webhookSignatureHeader = "X-Algernon-Signature"
+	// The header with the name of the event
+	webhookEventHeader = "X-Algernon-Event"
+	// How long to wait for a webhook to respond
+	webhookTimeout = 10 * time.Second
+	// How many times to try sending an event
+	webhookAttempts = 3
+)
+
+// A webhook, for the given events, or for all events if events is nil
+type webhook struct {
+	url    string
+	secret string
+	events map[string]bool
+}
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// Add a webhook, for a comma separated list of events, or for all events if
+// the list is empty. If the secret is empty, the --webhooksecret is used.
+func (ac *algernonConfig) addWebhook(url, events, secret string) {
+	hook := webhook{url: url, secret: secret}
+	for _, event := range strings.Split(events, ",") {
+		if event = strings.TrimSpace(event); event != "" {
+			if hook.events == nil {
+				hook.events = make(map[string]bool)
+			}
+			hook.events[event] = true
+		}
+	}
+	ac.webhookMut.Lock()
+	ac.webhooks = append(ac.webhooks, hook)
+	ac.webhookMut.Unlock()
+}
+
+// Sign a webhook body with the given secret
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send an event to a webhook, and try again a couple of times if it fails
+func (hook webhook) send(event string, body []byte) {
+	var err error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		var req *http.Request
+		req, err = http.NewRequest("POST", hook.url, bytes.NewReader(body))
+		if err != nil {
+			break
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(webhookEventHeader, event)
+		if hook.secret != "" {
+			req.Header.Set(webhookSignatureHeader, webhookSignature(hook.secret, body))
+		}
+		var resp *http.Response
+		resp, err = webhookClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("status %s", resp.Status)
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+	log.Errorf("Could not send the %s event to %s: %s", event, hook.url, err)
+}
+
+// Send an event to the webhooks that want it, in the background.
+// Returns a WaitGroup for waiting until the event has been sent.
+func (ac *algernonConfig) emitEvent(event string, data map[string]interface{}) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	ac.webhookMut.Lock()
+	hooks := ac.webhooks
+	ac.webhookMut.Unlock()
+	if len(hooks) == 0 {
+		return &wg
+	}
+	hostname, _ := os.Hostname()
+	body, err := json.Marshal(map[string]interface{}{
+		"event": event,
+		"time":  time.Now().UTC().Format(time.RFC3339),
+		"host":  hostname,
+		"addr":  ac.serverAddr,
+		"data":  data,
+	})
+	if err != nil {
+		log.Error(err)
+		return &wg
+	}
+	for _, hook := range hooks {
+		if hook.events != nil && !hook.events[event] {
+			continue
+		}
+		if hook.secret == "" {
+			hook.secret = ac.webhookSecret
+		}
+		wg.Add(1)
+		go func(hook webhook) {
+			defer wg.Done()
+			hook.send(event, body)
+		}(hook)
+	}
+	return &wg
+}
+
+// Send the startup event, and set up the shutdown and deploy events
+func (ac *algernonConfig) setupServerEvents() {
+	ac.emitEvent(eventStartup, map[string]interface{}{"version": versionString})
+	atShutdown(func() {
+		// Wait for the event to be sent, but not for too long
+		sent := make(chan struct{})
+		go func() {
+			ac.emitEvent(eventShutdown, nil).Wait()
+			close(sent)
+		}()
+		select {
+		case <-sent:
+		case <-time.After(webhookTimeout):
+		}
+	})
+	// Files are deployed with "algernon deploy", which then reloads the server
+	atReload(func() {
+		ac.emitEvent(eventDeploy, nil)
+	})
+}
+
+// Count the responses with a 5xx status code, and send an event when there are
+// more than the configured number of them within a minute. The event is sent
+// at most once per minute.
+func (ac *algernonConfig) errorRateHandler(handler http.Handler) http.Handler {
+	var (
+		mut         sync.Mutex
+		windowStart = time.Now()
+		errors      int
+		sent        bool
+	)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		sr := newStatusRecorder(w)
+		handler.ServeHTTP(sr, req)
+		if sr.status < 500 {
+			return
+		}
+		mut.Lock()
+		defer mut.Unlock()
+		if time.Since(windowStart) >= time.Minute {
+			windowStart = time.Now()
+			errors = 0
+			sent = false
+		}
+		errors++
+		if errors >= ac.errorRateThreshold && !sent {
+			sent = true
+			ac.emitEvent(eventErrorRate, map[string]interface{}{
+				"errors":    errors,
+				"threshold": ac.errorRateThreshold,
+				"window":    "1m",
+				"path":      req.URL.Path,
+				"status":    sr.status,
+			})
+		}
+	})
+}
+
+// Export the server configuration function for adding webhooks
+func (ac *algernonConfig) exportWebhookFunction(L *lua.LState) {
+
+	// Add a webhook. Takes an URL, an optional table or comma separated string
+	// of events (all events if not given) and an optional secret for signing.
+	L.SetGlobal("Webhook", L.NewFunction(func(L *lua.LState) int {
+		url := L.ToString(1)
+		var events string
+		switch v := L.Get(2).(type) {
+		case *lua.LTable:
+			var names []string
+			v.ForEach(func(_, value lua.LValue) {
+				names = append(names, value.String())
+			})
+			events = strings.Join(names, ",")
+		case lua.LString:
+			events = string(v)
+		}
+		ac.addWebhook(url, events, L.OptString(3, ""))
+		return 0 // number of results
+	}))
+}
@@ -0,0 +1,308 @@
+package main
+
+// Worker processes, for running Lua handlers and rendering pages in
+// subprocesses, so that a crash or a handler that uses too much memory can
+// not take down the process that listens for requests. The listener process
+// passes the requests on to the workers as HTTP over Unix sockets.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// The environment variable that makes the process a worker, serving
+	// on the Unix socket it is set to
+	workerSocketEnv = "ALGERNON_WORKER_SOCKET"
+
+	// The header for passing on the address of the client to a worker
+	workerRemoteAddrHeader = "X-Algernon-Remote-Addr"
+
+	// How long to wait for the workers to start listening
+	workerStartTimeout = 10 * time.Second
+
+	// How long to wait before starting a worker process again. The delay is
+	// doubled each time the worker fails to start or stops again soon, up
+	// to the maximum delay.
+	workerRestartDelay    = time.Second
+	workerMaxRestartDelay = time.Minute
+
+	// Give up on a worker after this many failed attempts at starting it, in a row
+	workerMaxStartFailures = 10
+)
+
+// A worker process and the Unix socket it serves on
+type worker struct {
+	socket    string
+	transport *http.Transport
+}
+
+// The worker processes, and a reverse proxy that passes requests on to them
+type workerPool struct {
+	workers    []*worker
+	next       uint32
+	executable string
+	stopping   int32
+
+	// The page that is shown if a request could not be handled by a worker
+	badGatewayPage string
+
+	mut  sync.Mutex
+	cmds map[*worker]*exec.Cmd
+}
+
+// Start the worker processes, and restart them if they stop
+func (ac *algernonConfig) startWorkers() (*workerPool, error) {
+	executable, err := executable()
+	if err != nil {
+		return nil, err
+	}
+	pool := &workerPool{executable: executable, cmds: make(map[*worker]*exec.Cmd)}
+	for i := 0; i < ac.workerCount; i++ {
+		w := &worker{socket: filepath.Join(ac.serverTempDir, fmt.Sprintf("worker%d.sock", i))}
+		socket := w.socket
+		w.transport = &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+			MaxIdleConnsPerHost: 64,
+		}
+		pool.workers = append(pool.workers, w)
+		go pool.supervise(w)
+	}
+	atShutdown(pool.stop)
+	// Start new workers when reloading, for instance after "algernon deploy"
+	atReload(pool.restart)
+
+	// Wait for the workers to start listening
+	deadline := time.Now().Add(workerStartTimeout)
+	for _, w := range pool.workers {
+		for {
+			if _, err := os.Stat(w.socket); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				return pool, errors.New("timed out waiting for the worker processes to start")
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	return pool, nil
+}
+
+// Double the delay before a worker process is started again, up to the maximum delay
+func nextRestartDelay(delay time.Duration) time.Duration {
+	delay *= 2
+	if delay > workerMaxRestartDelay {
+		return workerMaxRestartDelay
+	}
+	return delay
+}
+
+// Start a worker process. Returns the command and the pipe to its stdin.
+func (pool *workerPool) startWorker(w *worker) (*exec.Cmd, io.Closer, error) {
+	os.Remove(w.socket)
+	cmd := exec.Command(pool.executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), workerSocketEnv+"="+w.socket)
+	cmd.Stderr = os.Stderr
+	// The worker exits when stdin is closed, which happens if this process dies
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		stdin.Close()
+		return nil, nil, err
+	}
+	return cmd, stdin, nil
+}
+
+// Run a worker process, and start it again if it stops, until the pool is
+// stopped. Waits longer and longer between the attempts if the worker can
+// not be started or stops again soon, and gives up if it can not be started
+// workerMaxStartFailures times in a row.
+func (pool *workerPool) supervise(w *worker) {
+	delay := workerRestartDelay
+	failures := 0
+	for atomic.LoadInt32(&pool.stopping) == 0 {
+		cmd, stdin, err := pool.startWorker(w)
+		if err != nil {
+			failures++
+			if failures >= workerMaxStartFailures {
+				log.Errorf("Could not start a worker process for %s after %d attempts, giving up: %s", w.socket, failures, err)
+				return
+			}
+			log.Errorf("Could not start a worker process (%s), trying again in %s", err, delay)
+			time.Sleep(delay)
+			delay = nextRestartDelay(delay)
+			continue
+		}
+		failures = 0
+		started := time.Now()
+		pool.mut.Lock()
+		pool.cmds[w] = cmd
+		pool.mut.Unlock()
+
+		err = cmd.Wait()
+		stdin.Close()
+
+		// Start with a short delay again if the worker ran for a good while
+		if time.Since(started) > workerMaxRestartDelay {
+			delay = workerRestartDelay
+		}
+
+		// Also gives the pool some time to be marked as stopping, if everything is shutting down
+		time.Sleep(delay)
+		if atomic.LoadInt32(&pool.stopping) == 0 {
+			log.Errorf("Worker process %d stopped (%v), restarting it", cmd.Process.Pid, err)
+		}
+		delay = nextRestartDelay(delay)
+	}
+}
+
+// Stop the worker processes
+func (pool *workerPool) stop() {
+	atomic.StoreInt32(&pool.stopping, 1)
+	pool.mut.Lock()
+	defer pool.mut.Unlock()
+	for _, cmd := range pool.cmds {
+		// Let the worker finish the current requests, if possible
+		if err := cmd.Process.Signal(os.Interrupt); err != nil {
+			cmd.Process.Kill()
+		}
+	}
+}
+
+// Stop the worker processes, so that they are started again with the current files
+func (pool *workerPool) restart() {
+	pool.mut.Lock()
+	defer pool.mut.Unlock()
+	for _, cmd := range pool.cmds {
+		cmd.Process.Signal(os.Interrupt)
+	}
+}
+
+// Pass a request on to the next worker that is available. If the request
+// could not be handled by a worker, a "Bad gateway" page is returned.
+func (pool *workerPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	var err error
+	for range pool.workers {
+		w := pool.workers[int(atomic.AddUint32(&pool.next, 1))%len(pool.workers)]
+		var resp *http.Response
+		resp, err = w.transport.RoundTrip(req)
+		// Try the next worker if this one could not be reached,
+		// for instance because it is being restarted
+		if opErr, ok := err.(*net.OpError); ok && opErr.Op == "dial" {
+			continue
+		}
+		if err == nil {
+			return resp, nil
+		}
+		break
+	}
+	log.Error("Worker process failed: ", err)
+	return &http.Response{
+		Status:     "502 Bad Gateway",
+		StatusCode: http.StatusBadGateway,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+		Body:       ioutil.NopCloser(strings.NewReader(pool.badGatewayPage)),
+		Request:    req,
+	}, nil
+}
+
+// Return a handler that passes requests on to the workers
+func (ac *algernonConfig) workerProxy(pool *workerPool) http.Handler {
+	pool.badGatewayPage = messagePage("Bad gateway", "The request could not be handled by a worker process.", ac.defaultTheme)
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = "worker"
+			req.Header.Set(workerRemoteAddrHeader, req.RemoteAddr)
+			if req.TLS != nil {
+				req.Header.Set("X-Forwarded-Proto", "https")
+			}
+		},
+		Transport: pool,
+		// Pass on flushed output from Lua and Server-Sent Events quickly.
+		// Negative intervals, for flushing right away, need Go 1.12.
+		FlushInterval: 100 * time.Millisecond,
+	}
+}
+
+// Change the configuration for running as a worker process, if this is one
+func (ac *algernonConfig) setupWorkerMode() {
+	ac.workerSocket = os.Getenv(workerSocketEnv)
+	if ac.workerSocket == "" {
+		return
+	}
+	// The listener process takes care of the rest
+	ac.workerCount = 0
+	ac.serverMode = true
+	ac.noBanner = true
+	ac.autoRefreshMode = false
+	ac.openURLAfterServing = false
+	ac.quitAfterFirstRequest = false
+	ac.disableRateLimiting = true
+	ac.legacyMode = false
+	ac.acmeDNSProvider = ""
+	ac.dapAddr = ""
+	ac.errorRateThreshold = 0
+}
+
+// Serve requests from the listener process on a Unix socket
+func (ac *algernonConfig) serveWorker(mux *http.ServeMux) error {
+	listener, err := net.Listen("unix", ac.workerSocket)
+	if err != nil {
+		return err
+	}
+
+	// Exit when the listener process is gone and stdin is closed
+	go func() {
+		io.Copy(ioutil.Discard, os.Stdin)
+		ac.generateShutdownFunction(nil)()
+		os.Exit(0)
+	}()
+
+	// Exit if too much memory is used, so that the listener process can start a new worker
+	if ac.workerMemoryMiB > 0 {
+		go func() {
+			var m runtime.MemStats
+			for range time.Tick(time.Second) {
+				runtime.ReadMemStats(&m)
+				if m.HeapAlloc > ac.workerMemoryMiB*MiB {
+					log.Errorf("Worker process %d uses %d MiB of memory, exiting", os.Getpid(), m.HeapAlloc/MiB)
+					os.Exit(1)
+				}
+			}
+		}()
+	}
+
+	srv := ac.newGracefulServer(mux, false, "")
+	// Use the address of the client instead of the address of the Unix socket
+	srv.Server.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if remoteAddr := req.Header.Get(workerRemoteAddrHeader); remoteAddr != "" {
+			req.RemoteAddr = remoteAddr
+			req.Header.Del(workerRemoteAddrHeader)
+		}
+		mux.ServeHTTP(w, req)
+	})
+	return srv.Serve(listener)
+}
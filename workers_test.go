@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNextRestartDelay(t *testing.T) {
+	delay := workerRestartDelay
+	for i := 0; i < 3; i++ {
+		delay = nextRestartDelay(delay)
+	}
+	if delay != 8*time.Second {
+		t.Errorf("expected the delay to be doubled three times, got %s", delay)
+	}
+	for i := 0; i < 10; i++ {
+		delay = nextRestartDelay(delay)
+	}
+	if delay != workerMaxRestartDelay {
+		t.Errorf("expected the delay to be capped at %s, got %s", workerMaxRestartDelay, delay)
+	}
+}
+
+func TestWorkerBadGateway(t *testing.T) {
+	w := &worker{transport: &http.Transport{
+		Dial: func(_, _ string) (net.Conn, error) {
+			return net.Dial("unix", "/nonexistent/worker.sock")
+		},
+	}}
+	pool := &workerPool{workers: []*worker{w}, badGatewayPage: "bad gateway"}
+	req, err := http.NewRequest("GET", "http://worker/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := pool.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected a Bad gateway response, got %v, %v", resp, err)
+	}
+	resp.Body.Close()
+}